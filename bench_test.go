@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ============================================================================
+// Benchmarks
+// ============================================================================
+// the benchmarks run a fixed set of guest workloads through Run and report how
+// fast the emulator executes them, in ns per guest instruction and the derived
+// MIPS (millions of guest instructions per second). each workload runs once per
+// execution configuration (backend and caches), as a sub-benchmark. compare runs
+// with benchstat:
+//
+//	go test -run '^$' -bench . -count 10 > old.txt
+//	# make a change
+//	go test -run '^$' -bench . -count 10 > new.txt
+//	benchstat old.txt new.txt
+//
+// the workloads are part of the yardstick: don't change what one executes, add
+// a new one instead, or numbers from before and after stop being comparable.
+//
+// once the caches are warm, executing an instruction must not allocate, and
+// TestWorkloadsDontAllocate fails if a workload does. the exceptions are all off
+// the steady-state path:
+//   - a trapping instruction allocates its *Exception
+//   - tracing and debug logging allocate for what they print
+//   - the ecall and ebreak hooks allocate whatever they like
+//   - the first execution of code decodes it into the caches
+//
+// BenchmarkELF runs a real benchmark program instead, a newlib build of
+// CoreMark or Dhrystone for rv32i (there's no M extension), linked to run from
+// address 0 up. the program times itself through the cycle and time CSRs, which
+// count retired instructions and wall-clock microseconds, and prints its result;
+// the score it reports (CoreMark's Iterations/Sec, Dhrystones per Second) is
+// reported next to the emulator's own rate:
+//
+//	go test -run '^$' -bench ELF -elf dhrystone.elf -count 5
+//	BenchmarkELF/dhrystone.elf-8	1	2153012000 ns/op	4.31 ns/instr	232.1 MIPS	412371 score
+//
+// this is what `riscv-emu bench -elf` used to do, before the bench subcommand
+// became these benchmarks: -elf-mem-size (16 MiB by default) and
+// -elf-max-instructions take the place of its -mem-size and -max-instructions,
+// the program's output is dropped, and -bench ELF/<file> with -count replaces
+// its own -count
+
+// workload is a guest program that runs to completion and exits through ecall
+type workload struct {
+	name  string
+	build func(b *Builder)
+}
+
+var workloads = []workload{
+	{"Arith", buildArith},
+	{"Memcpy", buildMemcpy},
+	{"Branchy", buildBranchy},
+	{"Mixed", buildMixed},
+}
+
+// benchConfigs are the ways of executing the workloads that are measured
+var benchConfigs = []struct {
+	name string
+	opts []Option
+}{
+	{"threaded", []Option{WithBackend(BackendThreaded)}},
+	{"table", []Option{WithBackend(BackendTable)}},
+	{"no-block-cache", []Option{WithoutBlockCache()}},
+	{"no-decode-cache", []Option{WithoutDecodeCache(), WithoutBlockCache()}},
+	{"no-fast-memory", []Option{WithoutFastMemory()}},
+}
+
+// where the workloads keep their data, well past their code
+const (
+	benchSrc = 0x4000
+	benchDst = 0x8000
+)
+
+// buildArith is a tight loop of register-to-register arithmetic
+func buildArith(b *Builder) {
+	b.Li(T0, 20000) // iterations
+	b.Li(A0, 1)
+	b.Li(A1, 0x12345)
+	b.Label("loop")
+	b.Add(A2, A0, A1)
+	b.Xor(A0, A2, T0)
+	b.Slli(A3, A0, 3)
+	b.Srli(A4, A1, 5)
+	b.Sub(A1, A3, A4)
+	b.And(A5, A1, A2)
+	b.Or(A0, A0, A5)
+	b.Addi(T0, T0, -1)
+	b.Bnez(T0, "loop")
+	b.Li(A0, 0)
+	b.Ecall()
+}
+
+// buildMemcpy copies 4KB word by word, 32 times over
+func buildMemcpy(b *Builder) {
+	b.Li(T0, 32) // copies
+	b.Label("copy")
+	b.Li(A0, benchSrc)
+	b.Li(A1, benchDst)
+	b.Li(A2, benchSrc+4096)
+	b.Label("word")
+	b.Lw(T1, A0, 0)
+	b.Sw(T1, A1, 0)
+	b.Addi(A0, A0, 4)
+	b.Addi(A1, A1, 4)
+	b.Bltu(A0, A2, "word")
+	b.Addi(T0, T0, -1)
+	b.Bnez(T0, "copy")
+	b.Li(A0, 0)
+	b.Ecall()
+}
+
+// buildBranchy takes data-dependent branches on the bits of a pseudo-random sequence
+func buildBranchy(b *Builder) {
+	b.Li(T0, 20000) // iterations
+	b.Li(A0, 1)     // the sequence
+	b.Li(A1, 0)     // how many times each side was taken
+	b.Li(A2, 0)
+	b.Li(A3, 0x5BD1E995)
+	b.Li(A4, 1013904223)
+	b.Label("loop")
+	// a0 = (a0*5 ^ a3) + a4, multiplying by a shift and an add since there's no M extension
+	b.Slli(T1, A0, 2)
+	b.Add(T1, T1, A0)
+	b.Xor(A0, T1, A3)
+	b.Add(A0, A0, A4)
+	b.Andi(T2, A0, 0x100)
+	b.Beqz(T2, "even")
+	b.Addi(A1, A1, 1)
+	b.J("next")
+	b.Label("even")
+	b.Addi(A2, A2, 1)
+	b.Label("next")
+	b.Andi(T2, A0, 0x3000)
+	b.Bnez(T2, "skip")
+	b.Addi(A1, A1, -1)
+	b.Label("skip")
+	b.Addi(T0, T0, -1)
+	b.Bnez(T0, "loop")
+	b.Li(A0, 0)
+	b.Ecall()
+}
+
+// buildMixed fills an array, then sums it through a function call per element,
+// so it has loads, stores, arithmetic, branches and calls
+func buildMixed(b *Builder) {
+	b.Li(SP, 0x3FF0)
+	b.Li(S0, 16) // rounds
+	b.Label("round")
+	b.Li(A0, benchSrc)
+	b.Li(A1, 0)
+	b.Label("fill")
+	b.Slli(T1, A1, 2)
+	b.Add(T1, T1, A0)
+	b.Xori(T2, A1, 0x55)
+	b.Sw(T2, T1, 0)
+	b.Addi(A1, A1, 1)
+	b.Li(T3, 256)
+	b.Blt(A1, T3, "fill")
+
+	b.Li(S1, 0) // checksum
+	b.Li(A1, 0)
+	b.Label("sum")
+	b.Slli(T1, A1, 2)
+	b.Add(T1, T1, A0)
+	b.Lw(A2, T1, 0)
+	b.Call("mix")
+	b.Add(S1, S1, A2)
+	b.Addi(A1, A1, 1)
+	b.Li(T3, 256)
+	b.Blt(A1, T3, "sum")
+	b.Sw(S1, SP, 0)
+	b.Addi(S0, S0, -1)
+	b.Bnez(S0, "round")
+	b.Li(A0, 0)
+	b.Ecall()
+
+	// mix(a2) returns a scrambled a2
+	b.Label("mix")
+	b.Slli(T4, A2, 7)
+	b.Xor(A2, A2, T4)
+	b.Srli(T4, A2, 9)
+	b.Xor(A2, A2, T4)
+	b.Ret()
+}
+
+// BenchmarkRegisterByName reads and writes registers the way tools given names do
+func BenchmarkRegisterByName(b *testing.B) {
+	cpu := NewCPU()
+	names := []string{"a0", "sp", "t6", "x10", "ra", "s11"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		name := names[i%len(names)]
+		v, err := cpu.GetRegisterValue(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := cpu.SetRegisterValue(name, v+1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRegisterByNumber is BenchmarkRegisterByName for callers that have register numbers
+func BenchmarkRegisterByNumber(b *testing.B) {
+	cpu := NewCPU()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reg := i % 32
+		v, err := cpu.GetReg(reg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := cpu.SetReg(reg, v+1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// workloadRunner loads w on a CPU built with opts and returns a function that
+// runs it from the start to its exit, once the caches are warm
+func workloadRunner(tb testing.TB, w workload, opts []Option) (cpu *CPU, run func()) {
+	tb.Helper()
+	c := NewCPU(opts...)
+	cpu = &c
+	cpu.LoadProgram(assemble(tb, w.build))
+	cpu.EcallHook = func(cpu *CPU) error {
+		cpu.Exit(int(cpu.Regs[A0]))
+		return nil
+	}
+	run = func() {
+		cpu.PC = 0
+		cpu.Regs = [32]uint32{}
+		cpu.Exited = false
+		if reason, err := cpu.Run(0); err != nil || reason != StopExit {
+			tb.Fatalf("workload %s stopped with %v: %v", w.name, reason, err)
+		}
+	}
+	run() // fills the caches, so only the steady state is measured
+	return cpu, run
+}
+
+// benchmarkWorkload runs w under every configuration
+func benchmarkWorkload(b *testing.B, w workload) {
+	for _, c := range benchConfigs {
+		b.Run(c.name, func(b *testing.B) {
+			cpu, run := workloadRunner(b, w, c.opts)
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := cpu.Retired
+			for i := 0; i < b.N; i++ {
+				run()
+			}
+			b.StopTimer()
+			instrs := float64(cpu.Retired - start)
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/instrs, "ns/instr")
+			b.ReportMetric(instrs/b.Elapsed().Seconds()/1e6, "MIPS")
+		})
+	}
+}
+
+func BenchmarkArith(b *testing.B)   { benchmarkWorkload(b, workloads[0]) }
+func BenchmarkMemcpy(b *testing.B)  { benchmarkWorkload(b, workloads[1]) }
+func BenchmarkBranchy(b *testing.B) { benchmarkWorkload(b, workloads[2]) }
+func BenchmarkMixed(b *testing.B)   { benchmarkWorkload(b, workloads[3]) }
+
+func TestWorkloadsDontAllocate(t *testing.T) {
+	for _, w := range workloads {
+		for _, c := range benchConfigs {
+			_, run := workloadRunner(t, w, c.opts)
+			if allocs := testing.AllocsPerRun(3, run); allocs != 0 {
+				t.Errorf("%s/%s: %v allocations per run, the steady state must not allocate", w.name, c.name, allocs)
+			}
+		}
+	}
+
+	cpu := NewCPU()
+	allocs := testing.AllocsPerRun(100, func() {
+		v, _ := cpu.GetRegisterValue("x10")
+		cpu.SetRegisterValue("a0", v+1)
+	})
+	if allocs != 0 {
+		t.Errorf("accessing a register by name allocates %v times", allocs)
+	}
+}
+
+var (
+	benchELFPath      = flag.String("elf", "", "BenchmarkELF runs this benchmark program (a newlib build of CoreMark or Dhrystone)")
+	benchELFMemSize   = flag.Uint("elf-mem-size", 16<<20, "memory size in bytes for BenchmarkELF")
+	benchELFMaxInstrs = flag.Uint64("elf-max-instructions", 0, "stop BenchmarkELF's program after this many instructions (0 means no limit)")
+)
+
+// benchScores match the lines benchmark programs print their score in
+var benchScores = []*regexp.Regexp{
+	regexp.MustCompile(`Iterations/Sec\s*:\s*([0-9.]+)`),        // CoreMark
+	regexp.MustCompile(`Dhrystones per Second\s*:\s*([0-9.]+)`), // Dhrystone
+}
+
+// benchScore finds the score in what a benchmark program printed
+func benchScore(out []byte) (float64, bool) {
+	for _, re := range benchScores {
+		if m := re.FindSubmatch(out); m != nil {
+			if v, err := strconv.ParseFloat(string(m[1]), 64); err == nil {
+				return v, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// elfResult is what running a benchmark program measured
+type elfResult struct {
+	elapsed  time.Duration
+	retired  uint64
+	score    float64 // what the program reported, if hasScore
+	hasScore bool
+}
+
+// runBenchmarkELF runs the benchmark program in the ELF file at path to its
+// exit; what it prints goes to console as well as into the score search
+func runBenchmarkELF(path string, memSize uint32, maxInstructions uint64, console io.Writer) (elfResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return elfResult{}, err
+	}
+	machine := DefaultMachine()
+	machine.MemSize = memSize
+	var out bytes.Buffer
+	w := io.MultiWriter(console, &out)
+	cpu, err := machine.NewCPU(WithConsole(nil, w))
+	if err != nil {
+		return elfResult{}, err
+	}
+	image, err := cpu.LoadELF(bytes.NewReader(data))
+	if err != nil {
+		return elfResult{}, fmt.Errorf("loading %s: %w", path, err)
+	}
+	heapStart := (image.End + 0xF) &^ 0xF
+	cpu.EcallHook = NewNewlibSyscalls(nil, w, w, heapStart, cpu.Regs[SP]).Handle
+
+	start := time.Now()
+	reason, err := cpu.Run(maxInstructions)
+	result := elfResult{elapsed: time.Since(start), retired: cpu.Retired}
+	if err != nil {
+		return result, err
+	}
+	if reason != StopExit {
+		return result, fmt.Errorf("%s stopped: %s after %d instructions at pc=0x%08X", path, reason, cpu.Retired, cpu.PC)
+	}
+	if cpu.ExitCode != 0 {
+		return result, fmt.Errorf("%s exited with code %d", path, cpu.ExitCode)
+	}
+	result.score, result.hasScore = benchScore(out.Bytes())
+	return result, nil
+}
+
+// BenchmarkELF runs the program given with -elf (it's skipped without one)
+func BenchmarkELF(b *testing.B) {
+	if *benchELFPath == "" {
+		b.Skip("no -elf benchmark program")
+	}
+	b.Run(filepath.Base(*benchELFPath), func(b *testing.B) {
+		var elapsed time.Duration
+		var retired uint64
+		for i := 0; i < b.N; i++ {
+			r, err := runBenchmarkELF(*benchELFPath, uint32(*benchELFMemSize), *benchELFMaxInstrs, io.Discard)
+			if err != nil {
+				b.Fatal(err)
+			}
+			elapsed += r.elapsed
+			retired += r.retired
+			if r.hasScore {
+				b.ReportMetric(r.score, "score")
+			}
+		}
+		b.ReportMetric(float64(elapsed.Nanoseconds())/float64(retired), "ns/instr")
+		b.ReportMetric(float64(retired)/elapsed.Seconds()/1e6, "MIPS")
+	})
+}
+
+// testdata/bench-mini.elf is a benchmark program in miniature: it times a short
+// loop through the time CSR and prints its score the way CoreMark does, so
+// TestBenchmarkELF checks the whole path (ELF, newlib calls, the clock, the
+// score) even with -short. `go test -run TestBenchmarkELF -update` rewrites it
+// from buildMiniBenchmark
+
+const (
+	miniBenchIterations = 1000
+	miniBenchLabel      = "Iterations/Sec : "
+	miniBenchLabelAddr  = 0x800 // where the label is in the image
+	miniBenchDigits     = 0x840 // the score is printed into the bytes before this
+)
+
+func buildMiniBenchmark(b *Builder) {
+	b.Csrrs(S1, CSR_TIME, ZERO)
+	b.Li(S0, miniBenchIterations)
+	b.Li(A0, 0)
+	b.Label("work")
+	b.Add(A0, A0, S0)
+	b.Xori(A0, A0, 0x55)
+	b.Addi(S0, S0, -1)
+	b.Bnez(S0, "work")
+	b.Csrrs(S2, CSR_TIME, ZERO)
+	b.Sub(S2, S2, S1) // microseconds, at least one
+	b.Bnez(S2, "timed")
+	b.Li(S2, 1)
+	b.Label("timed")
+
+	// score = iterations * 1000000 / microseconds
+	b.Li(A0, miniBenchIterations*1_000_000)
+	b.Mv(A1, S2)
+	b.Call("udiv")
+	b.Mv(S3, A0)
+
+	b.Li(A0, 1)
+	b.Li(A1, miniBenchLabelAddr)
+	b.Li(A2, int32(len(miniBenchLabel)))
+	b.Li(A7, newlibSysWrite)
+	b.Ecall()
+
+	// the digits, last first, then a newline
+	b.Li(S4, miniBenchDigits)
+	b.Li(T0, '\n')
+	b.Sb(T0, S4, 0)
+	b.Mv(S5, S4)
+	b.Label("digit")
+	b.Mv(A0, S3)
+	b.Li(A1, 10)
+	b.Call("udiv")
+	b.Addi(A1, A1, '0')
+	b.Addi(S5, S5, -1)
+	b.Sb(A1, S5, 0)
+	b.Mv(S3, A0)
+	b.Bnez(S3, "digit")
+	b.Li(A0, 1)
+	b.Mv(A1, S5)
+	b.Sub(A2, S4, S5)
+	b.Addi(A2, A2, 1)
+	b.Li(A7, newlibSysWrite)
+	b.Ecall()
+
+	b.Li(A0, 0)
+	b.Li(A7, newlibSysExit)
+	b.Ecall()
+
+	// udiv divides a0 by a1 a bit at a time (there's no M extension), leaving
+	// the quotient in a0 and the remainder in a1
+	b.Label("udiv")
+	b.Li(T0, 32)
+	b.Li(T1, 0)
+	b.Label("udiv_bit")
+	b.Srli(T2, A0, 31)
+	b.Slli(T1, T1, 1)
+	b.Or(T1, T1, T2)
+	b.Slli(A0, A0, 1)
+	b.Bltu(T1, A1, "udiv_next")
+	b.Sub(T1, T1, A1)
+	b.Ori(A0, A0, 1)
+	b.Label("udiv_next")
+	b.Addi(T0, T0, -1)
+	b.Bnez(T0, "udiv_bit")
+	b.Mv(A1, T1)
+	b.Ret()
+}
+
+func TestBenchmarkELF(t *testing.T) {
+	path := filepath.Join("testdata", "bench-mini.elf")
+	image := assemble(t, buildMiniBenchmark)
+	if len(image) > miniBenchLabelAddr {
+		t.Fatalf("the program is %d bytes, past its label at 0x%X", len(image), miniBenchLabelAddr)
+	}
+	image = append(image, make([]byte, miniBenchLabelAddr-len(image))...)
+	elf := buildELF(append(image, miniBenchLabel...), 0, map[string]uint32{"main": 0}, "main")
+	if *update {
+		if err := os.WriteFile(path, elf, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if checkedIn, err := os.ReadFile(path); err != nil || !bytes.Equal(checkedIn, elf) {
+		t.Fatalf("%s is missing or out of date (%v), run with -update", path, err)
+	}
+
+	var out bytes.Buffer
+	r, err := runBenchmarkELF(path, 1<<16, 1_000_000, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.hasScore || r.score <= 0 || !strings.HasPrefix(out.String(), miniBenchLabel) {
+		t.Fatalf("no score in %q", out.String())
+	}
+	t.Logf("score %.0f, %d instructions at %.1f MIPS", r.score, r.retired, float64(r.retired)/r.elapsed.Seconds()/1e6)
+}
+
+func TestBenchScore(t *testing.T) {
+	for _, c := range []struct {
+		out   string
+		score float64
+		ok    bool
+	}{
+		{"CoreMark Size    : 666\nIterations/Sec   : 1234.567\n", 1234.567, true},
+		{"Dhrystones per Second:                      412371.0\n", 412371, true},
+		{"Iterations/Sec : \n", 0, false},
+		{"done\n", 0, false},
+	} {
+		if score, ok := benchScore([]byte(c.out)); score != c.score || ok != c.ok {
+			t.Errorf("benchScore(%q) = %v, %v; want %v, %v", c.out, score, ok, c.score, c.ok)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+// ============================================================================
+// Bit fields
+// ============================================================================
+// the primitives the decoder, the encoders of builder.go and anything else
+// taking instructions apart or putting them together use, so that each format's
+// immediate layout is written down exactly once. the Imm functions take the
+// immediate out of an instruction word (sign-extended, except for the U-type
+// one, which is the 20-bit field as it's stored); the EncodeImm functions are
+// their inverses, returning the instruction bits that carry imm, to be ORed
+// with the rest of the instruction. the layouts are the ones of the unprivileged
+// spec, section 2.3:
+//
+//	I  [31:20] imm[11:0]
+//	S  [31:25] imm[11:5]               [11:7] imm[4:0]
+//	B  [31] imm[12] [30:25] imm[10:5]  [11:8] imm[4:1] [7] imm[11]
+//	U  [31:12] imm[31:12]
+//	J  [31] imm[20] [30:21] imm[10:1]  [20] imm[11]    [19:12] imm[19:12]
+//
+// B and J offsets are always even, so their bit 0 isn't stored (and is ignored
+// when encoding)
+
+// SignExtend extends the sign bit fromBit of value through the bits above it
+func SignExtend(value uint32, fromBit uint) uint32 {
+	shift := 31 - fromBit
+	return uint32(int32(value<<shift) >> shift)
+}
+
+// ExtractBits returns bits hi down to lo of word, moved down to bit 0
+func ExtractBits(word uint32, hi, lo uint) uint32 {
+	return word >> lo & (1<<(hi-lo+1) - 1)
+}
+
+// ImmI is the immediate of an I-type instruction
+func ImmI(instr uint32) uint32 {
+	// converting to int32 before shifting right copies the sign bit (bit 31) into the upper bits
+	return uint32(int32(instr) >> 20)
+}
+
+// ImmS is the immediate of an S-type instruction
+func ImmS(instr uint32) uint32 {
+	return uint32(int32(instr)>>25)<<5 | ExtractBits(instr, 11, 7)
+}
+
+// ImmB is the offset of a B-type instruction
+func ImmB(instr uint32) uint32 {
+	return uint32(int32(instr)>>31)<<12 | // imm[12], sign-extended through the upper bits
+		ExtractBits(instr, 7, 7)<<11 |
+		ExtractBits(instr, 30, 25)<<5 |
+		ExtractBits(instr, 11, 8)<<1
+}
+
+// ImmU is the 20-bit immediate of a U-type instruction, imm[31:12] moved down to bit 0
+func ImmU(instr uint32) uint32 {
+	return instr >> 12
+}
+
+// ImmJ is the offset of a J-type instruction
+func ImmJ(instr uint32) uint32 {
+	return uint32(int32(instr)>>31)<<20 | // imm[20], sign-extended through the upper bits
+		instr&0xFF000 | // imm[19:12] is already in place
+		ExtractBits(instr, 20, 20)<<11 |
+		ExtractBits(instr, 30, 21)<<1
+}
+
+// EncodeImmI places the low 12 bits of imm where an I-type instruction has them
+func EncodeImmI(imm uint32) uint32 {
+	return (imm & 0xFFF) << 20
+}
+
+// EncodeImmS places the low 12 bits of imm where an S-type instruction has them
+func EncodeImmS(imm uint32) uint32 {
+	return ExtractBits(imm, 11, 5)<<25 | ExtractBits(imm, 4, 0)<<7
+}
+
+// EncodeImmB places the offset imm (bits 12 to 1) where a B-type instruction has it
+func EncodeImmB(imm uint32) uint32 {
+	return ExtractBits(imm, 12, 12)<<31 | ExtractBits(imm, 10, 5)<<25 |
+		ExtractBits(imm, 4, 1)<<8 | ExtractBits(imm, 11, 11)<<7
+}
+
+// EncodeImmU places the 20-bit immediate imm where a U-type instruction has it
+func EncodeImmU(imm uint32) uint32 {
+	return (imm & 0xFFFFF) << 12
+}
+
+// EncodeImmJ places the offset imm (bits 20 to 1) where a J-type instruction has it
+func EncodeImmJ(imm uint32) uint32 {
+	return ExtractBits(imm, 20, 20)<<31 | ExtractBits(imm, 10, 1)<<21 |
+		ExtractBits(imm, 11, 11)<<20 | ExtractBits(imm, 19, 12)<<12
+}
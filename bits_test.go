@@ -0,0 +1,112 @@
+package main
+
+import "testing"
+
+func TestSignExtend(t *testing.T) {
+	tests := []struct {
+		value   uint32
+		fromBit uint
+		want    uint32
+	}{
+		// width 1: bit 0 is the sign
+		{0x0, 0, 0x00000000},
+		{0x1, 0, 0xFFFFFFFF},
+		{0x2, 0, 0x00000000}, // bits above fromBit are dropped
+		// 12-bit immediates
+		{0x7FF, 11, 0x000007FF},
+		{0x800, 11, 0xFFFFF800},
+		{0xFFF, 11, 0xFFFFFFFF},
+		{0x1800, 11, 0xFFFFF800},
+		// 13-bit branch offsets, bit 12 is the sign
+		{0x0FFE, 12, 0x00000FFE},
+		{0x1000, 12, 0xFFFFF000},
+		{0x1FFE, 12, 0xFFFFFFFE},
+		// bytes and halfwords, as lb and lh use it
+		{0x7F, 7, 0x0000007F},
+		{0x80, 7, 0xFFFFFF80},
+		{0x7FFF, 15, 0x00007FFF},
+		{0x8000, 15, 0xFFFF8000},
+		// width 32: nothing to extend
+		{0x7FFFFFFF, 31, 0x7FFFFFFF},
+		{0x80000000, 31, 0x80000000},
+		{0xFFFFFFFF, 31, 0xFFFFFFFF},
+	}
+	for _, tt := range tests {
+		if got := SignExtend(tt.value, tt.fromBit); got != tt.want {
+			t.Errorf("SignExtend(0x%X, %d) = 0x%08X, want 0x%08X", tt.value, tt.fromBit, got, tt.want)
+		}
+	}
+}
+
+func TestExtractBits(t *testing.T) {
+	tests := []struct {
+		word   uint32
+		hi, lo uint
+		want   uint32
+	}{
+		{0xFFFFFFFF, 31, 0, 0xFFFFFFFF},
+		{0x80000000, 31, 31, 1},
+		{0x00000001, 0, 0, 1},
+		{0x12345678, 15, 8, 0x56},
+		{0x12345678, 31, 20, 0x123},
+		{0xFE000F80, 11, 7, 0x1F},
+	}
+	for _, tt := range tests {
+		if got := ExtractBits(tt.word, tt.hi, tt.lo); got != tt.want {
+			t.Errorf("ExtractBits(0x%08X, %d, %d) = 0x%X, want 0x%X", tt.word, tt.hi, tt.lo, got, tt.want)
+		}
+	}
+}
+
+// every immediate must come back out of the instruction it was encoded into
+func TestImmediateRoundTrip(t *testing.T) {
+	for _, imm := range []int32{0, 1, -1, 0x7FF, -0x800, 0x7FE, -2, 0x555, -0x556} {
+		if got := int32(ImmI(EncodeImmI(uint32(imm)))); got != imm {
+			t.Errorf("I: %d came back as %d", imm, got)
+		}
+		if got := int32(ImmS(EncodeImmS(uint32(imm)))); got != imm {
+			t.Errorf("S: %d came back as %d", imm, got)
+		}
+	}
+	// branch offsets: even, -4096 to 4094
+	for _, imm := range []int32{0, 2, -2, 0x7FE, 0x800, 0xFFE, -0x1000, -0x800, 0xAAA, -0x556} {
+		if got := int32(ImmB(EncodeImmB(uint32(imm)))); got != imm {
+			t.Errorf("B: %d came back as %d", imm, got)
+		}
+	}
+	// jump offsets: even, -1MiB to 1MiB-2
+	for _, imm := range []int32{0, 2, -2, 0x7FE, 0x800, 0xFFFFE, -0x100000, 0x80000, -0x80000, 0x55554} {
+		if got := int32(ImmJ(EncodeImmJ(uint32(imm)))); got != imm {
+			t.Errorf("J: %d came back as %d", imm, got)
+		}
+	}
+	for _, imm := range []uint32{0, 1, 0x80000, 0xFFFFF, 0x12345} {
+		if got := ImmU(EncodeImmU(imm)); got != imm {
+			t.Errorf("U: 0x%X came back as 0x%X", imm, got)
+		}
+	}
+}
+
+// the immediates of known encodings, from the GNU assembler
+func TestImmediatesOfEncodings(t *testing.T) {
+	tests := []struct {
+		name  string
+		instr uint32
+		imm   func(uint32) uint32
+		want  uint32
+	}{
+		{"addi a0, a0, 2047", 0x7FF50513, ImmI, 0x7FF},
+		{"addi a0, a0, -2048", 0x80050513, ImmI, 0xFFFFF800},
+		{"sw a2, -4(sp)", 0xFEC12E23, ImmS, 0xFFFFFFFC},
+		{"beq zero, zero, .+4094", 0x7E000FE3, ImmB, 0xFFE},
+		{"beq zero, zero, .-4096", 0x80000063, ImmB, 0xFFFFF000},
+		{"jal zero, .+1048574", 0x7FFFF06F, ImmJ, 0xFFFFE},
+		{"jal zero, .-1048576", 0x8000006F, ImmJ, 0xFFF00000},
+		{"lui a0, 0x80000", 0x80000537, ImmU, 0x80000},
+	}
+	for _, tt := range tests {
+		if got := tt.imm(tt.instr); got != tt.want {
+			t.Errorf("%s (0x%08X): immediate 0x%08X, want 0x%08X", tt.name, tt.instr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ============================================================================
+// Basic-block cache
+// ============================================================================
+// Run executes straight-line code a basic block at a time: the first time it
+// reaches an address it decodes forward until the next branch, jump, system or
+// fence instruction (or maxBlockLen instructions), and from then on runs the
+// stored block in a tight loop instead of fetching and dispatching through Step.
+//
+// the tradeoff is interrupt latency: pending interrupts are only taken, and
+// devices only run, between blocks, so an interrupt can arrive up to a block
+// late. to keep that from changing what a program does:
+//   - Step (and so the debugger) never uses blocks
+//   - Run falls back to Step while a tracer, an access observer, breakpoints, tracepoints
+//     or debug triggers are set,
+//     or debug logging is on
+//   - WithDeterministic turns blocks off, so a deterministic run behaves the same
+//     whether or not it's traced
+//
+// coherence is the same as for the decode cache: a write to memory holding a
+// block drops the block (ending it early if it's the one executing) and FENCE.I
+// drops them all
+
+const maxBlockLen = 64
+
+type block struct {
+	start  uint32
+	instrs []decoded
+	ops    []op // instrs compiled for the threaded backend, nil with the table backend
+	valid  bool // cleared when the block is dropped
+}
+
+type blockCache struct {
+	blocks map[uint32]*block // by start address
+	lo, hi uint32            // every block is inside [lo, hi)
+}
+
+// WithoutBlockCache makes Run execute one instruction at a time through Step
+func WithoutBlockCache() Option {
+	return func(cpu *CPU) {
+		cpu.bcache = nil
+	}
+}
+
+func newBlockCache() *blockCache {
+	return &blockCache{blocks: make(map[uint32]*block)}
+}
+
+// blockAt returns the block starting at the PC, building it if needed. it returns
+// nil if there's no instruction there a block can start with (Step then reports why)
+func (cpu *CPU) blockAt() *block {
+	c := cpu.bcache
+	if b, ok := c.blocks[uint32(cpu.PC)]; ok {
+		return b
+	}
+	if cpu.PC < 0 || cpu.PC%4 != 0 {
+		return nil
+	}
+
+	b := &block{start: uint32(cpu.PC), valid: true}
+	for pc := uint32(cpu.PC); len(b.instrs) < maxBlockLen; pc += 4 {
+		off, ok := cpu.ramOffset(pc, 4)
+		if !ok {
+			break
+		}
+		if cpu.uninit != nil && cpu.checkInitialized(pc, pc, 4, true) != nil {
+			break
+		}
+		d := decode(binary.LittleEndian.Uint32(cpu.Memory[off:]))
+		if d.exec == nil {
+			break
+		}
+		b.instrs = append(b.instrs, d)
+		if endsBlock(d.opcode) {
+			break
+		}
+	}
+	if len(b.instrs) == 0 {
+		return nil
+	}
+	if cpu.backend == BackendThreaded {
+		b.ops = make([]op, len(b.instrs))
+		for i, d := range b.instrs {
+			b.ops[i] = compile(d)
+		}
+	}
+
+	end := b.start + uint32(len(b.instrs))*4
+	if len(c.blocks) == 0 {
+		c.lo, c.hi = b.start, end
+	} else {
+		c.lo, c.hi = min(c.lo, b.start), max(c.hi, end)
+	}
+	c.blocks[b.start] = b
+	return b
+}
+
+// endsBlock reports whether instructions with opcode may continue anywhere but the next instruction
+// (or, for fences, change what the following instructions are)
+func endsBlock(opcode uint32) bool {
+	switch opcode {
+	case BRANCH, JAL, JALR, SYSTEM, MISC_MEM:
+		return true
+	}
+	return false
+}
+
+// runBlock executes b and returns how many instructions it went through (a
+// trapping one included, like Step counts it). err is what Step would have
+// returned for the instruction that stopped the block
+func (cpu *CPU) runBlock(b *block) (n uint64, err error) {
+	for i := range b.instrs {
+		pc := b.start + uint32(i)*4
+		cpu.PC = int(pc) + 4
+		var err error
+		if b.ops != nil {
+			err = b.ops[i](cpu)
+		} else {
+			err = cpu.execute(&b.instrs[i])
+		}
+		if err != nil {
+			var exc *Exception
+			if errors.As(err, &exc) {
+				err = cpu.takeException(exc, pc)
+			}
+			if err == nil {
+				cpu.tickDevices()
+			}
+			return uint64(i) + 1, err
+		}
+		cpu.Retired++
+		if cpu.cycleModel != nil {
+			cpu.countCycles(&b.instrs[i], pc)
+		}
+		if cpu.hpmActive {
+			cpu.countEvents(&b.instrs[i], pc)
+		}
+		if !b.valid || cpu.halted { // the block overwrote its own code, or stored to tohost
+			cpu.tickDevices()
+			return uint64(i) + 1, nil
+		}
+	}
+	cpu.tickDevices()
+	return uint64(len(b.instrs)), nil
+}
+
+// invalidate drops the blocks overlapping [addr, addr+n)
+func (c *blockCache) invalidate(addr, n uint32) {
+	end := uint64(addr) + uint64(n)
+	if n == 0 || uint64(addr) >= uint64(c.hi) || end <= uint64(c.lo) {
+		return
+	}
+	for start, b := range c.blocks {
+		if uint64(start) < end && addr < start+uint32(len(b.instrs))*4 {
+			b.valid = false
+			delete(c.blocks, start)
+		}
+	}
+}
+
+// flush drops every block
+func (c *blockCache) flush() {
+	for _, b := range c.blocks {
+		b.valid = false
+	}
+	clear(c.blocks)
+	c.lo, c.hi = 0, 0
+}
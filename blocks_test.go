@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// runMode is a way of running a program, as in tortureModes
+type runMode = struct {
+	name string
+	opts []Option
+}
+
+// archState is what the differential tests compare between modes
+type archState struct {
+	regs     [32]uint32
+	pc       int
+	retired  uint64
+	exitCode int // -1 if the program didn't exit
+	err      string
+	csrs     [4096]uint32
+	memory   []byte
+}
+
+func archStateOf(cpu *CPU, err error) archState {
+	s := archState{regs: cpu.Regs, pc: cpu.PC, retired: cpu.Retired, exitCode: -1, memory: cpu.Memory}
+	for addr := range s.csrs {
+		s.csrs[addr], _ = cpu.ReadCSR(uint32(addr)) // 0 for the ones that don't exist
+	}
+	if cpu.Exited {
+		s.exitCode = cpu.ExitCode
+	}
+	if err != nil {
+		s.err = err.Error()
+	}
+	return s
+}
+
+// diff describes the first difference between s and want, or returns ""
+func (s archState) diff(want archState) string {
+	for i := range s.regs {
+		if s.regs[i] != want.regs[i] {
+			return fmt.Sprintf("%s = 0x%08X, want 0x%08X", abiNames[i], s.regs[i], want.regs[i])
+		}
+	}
+	switch {
+	case s.pc != want.pc:
+		return fmt.Sprintf("pc = 0x%08X, want 0x%08X", s.pc, want.pc)
+	case s.retired != want.retired:
+		return fmt.Sprintf("%d instructions retired, want %d", s.retired, want.retired)
+	case s.exitCode != want.exitCode:
+		return fmt.Sprintf("exit code %d, want %d", s.exitCode, want.exitCode)
+	case s.err != want.err:
+		return fmt.Sprintf("error %q, want %q", s.err, want.err)
+	}
+	for i := range s.csrs {
+		if s.csrs[i] != want.csrs[i] {
+			return fmt.Sprintf("CSR 0x%03X = 0x%08X, want 0x%08X", i, s.csrs[i], want.csrs[i])
+		}
+	}
+	if len(s.memory) != len(want.memory) {
+		return fmt.Sprintf("%d bytes of memory, want %d", len(s.memory), len(want.memory))
+	}
+	for i := range s.memory {
+		if s.memory[i] != want.memory[i] {
+			return fmt.Sprintf("the byte at offset 0x%X of memory = 0x%02X, want 0x%02X", i, s.memory[i], want.memory[i])
+		}
+	}
+	return ""
+}
+
+// diffProgram is a program the differential tests run: run loads it on a CPU
+// made with opts, runs it to the end and returns the CPU and the error it stopped with
+type diffProgram struct {
+	name string
+	run  func(opts ...Option) (*CPU, error)
+}
+
+// requireSameState runs p in each of modes and fails the test unless every run
+// ends in the state the first one does
+func requireSameState(t *testing.T, p diffProgram, modes []runMode) {
+	t.Helper()
+	var want archState
+	for i, mode := range modes {
+		cpu, err := p.run(mode.opts...)
+		if cpu == nil {
+			t.Fatalf("%s, %s: %v", p.name, mode.name, err)
+		}
+		got := archStateOf(cpu, err)
+		if i == 0 {
+			want = got
+		} else if d := got.diff(want); d != "" {
+			t.Errorf("%s: %s differs from %s: %s", p.name, mode.name, modes[0].name, d)
+		}
+	}
+}
+
+// instructionTime makes time follow the retired instructions, so it reads the
+// same in every mode. (WithDeterministic would too, but it turns the block cache off)
+var instructionTime = WithTimeBase(TimeBase{Source: "instructions"})
+
+// programCorpus is the example programs, the spike trace programs (stopped a
+// few instructions into their final loop), the self-modifying program and, if
+// $RISCV_TESTS has them, the rv32ui riscv-tests
+func programCorpus() []diffProgram {
+	var corpus []diffProgram
+	for _, e := range examples {
+		corpus = append(corpus, diffProgram{"example " + e.name, func(opts ...Option) (*CPU, error) {
+			cpu, err := e.load(io.Discard, append([]Option{instructionTime}, opts...)...)
+			if err != nil {
+				return nil, err
+			}
+			_, err = cpu.Run(1_000_000)
+			return cpu, err
+		}})
+	}
+	for _, name := range slices.Sorted(maps.Keys(spikePrograms)) {
+		corpus = append(corpus, diffProgram{"spike " + name, func(opts ...Option) (*CPU, error) {
+			var b Builder
+			spikePrograms[name](&b)
+			program, err := b.Assemble()
+			if err != nil {
+				return nil, err
+			}
+			cpu := NewCPUWithMemory(0x2000, append([]Option{WithRAMBase(spikeBase), instructionTime}, opts...)...)
+			if err := cpu.LoadProgramAt(program, spikeBase); err != nil {
+				return nil, err
+			}
+			cpu.PC = spikeBase
+			_, err = cpu.Run(200)
+			return &cpu, err
+		}})
+	}
+	for _, fenceI := range []bool{false, true} {
+		corpus = append(corpus, diffProgram{fmt.Sprintf("self-modifying code, fence.i %v", fenceI), func(opts ...Option) (*CPU, error) {
+			var b Builder
+			selfModifyingProgram(fenceI)(&b)
+			program, err := b.Assemble()
+			if err != nil {
+				return nil, err
+			}
+			cpu := NewCPUWithMemory(0x1000, append([]Option{instructionTime}, opts...)...)
+			cpu.LoadProgram(program)
+			_, err = cpu.Run(100)
+			return &cpu, err
+		}})
+	}
+	if dir := os.Getenv("RISCV_TESTS"); dir != "" {
+		for _, path := range riscvTestPaths(dir) {
+			corpus = append(corpus, diffProgram{filepath.Base(path), func(opts ...Option) (*CPU, error) {
+				cpu, err := loadRISCVTest(path, append([]Option{instructionTime}, opts...)...)
+				if err != nil {
+					return nil, err
+				}
+				_, err = cpu.Run(1_000_000)
+				return cpu, err
+			}})
+		}
+	}
+	return corpus
+}
+
+// executing a basic block at a time gets exactly what executing one
+// instruction at a time does
+func TestBlocksMatchInterpreter(t *testing.T) {
+	modes := []runMode{
+		{"one instruction at a time", []Option{WithoutBlockCache(), WithoutDecodeCache()}},
+		{"blocks", []Option{WithBackend(BackendTable)}},
+	}
+	for _, p := range programCorpus() {
+		requireSameState(t, p, modes)
+	}
+}
+
+// the threaded and table backends run every program in the corpus to the same state
+func TestBackendsAgree(t *testing.T) {
+	modes := []runMode{
+		{"table", []Option{WithBackend(BackendTable)}},
+		{"threaded", []Option{WithBackend(BackendThreaded)}},
+	}
+	for _, p := range programCorpus() {
+		requireSameState(t, p, modes)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ============================================================================
+// Boot ROM
+// ============================================================================
+// with "boot_rom": true in the machine file (or run --boot-rom), the program
+// doesn't start with its registers set up by the emulator: the machine starts
+// in a small read-only ROM at the reset vector (rom_base, 0x1000 like qemu's
+// virt machine) that does it, and then jumps to the program:
+//
+//	auipc t0, 0
+//	csrr  a0, mhartid
+//	lw    a1, 32(t0)      the device tree, or 0
+//	lw    sp, 36(t0)
+//	lw    gp, 40(t0)
+//	lw    t0, 44(t0)      the program's entry point
+//	jr    t0
+//
+// the four words at offset 32 are filled in by BootFromROM once the program is
+// loaded, from what the loaders would otherwise have put in the registers. the
+// ROM is a device, so it must be outside RAM (the default RAM at 0 covers the
+// reset vector: move it, e.g. to 0x80000000 like virt). it's the only device
+// instructions can be fetched from, and stores to it are access faults
+
+// DefaultROMBase is where the boot ROM is when the machine doesn't say
+const DefaultROMBase = 0x1000
+
+// BootROMSize is the size of the boot ROM's window
+const BootROMSize = 0x1000
+
+// the offset of the table BootFromROM fills in
+const bootROMTable = 32
+
+// BootROM is the boot ROM device
+type BootROM struct {
+	base  uint32
+	image []byte // the code and the table, the rest of the window reads as zero
+}
+
+// NewBootROM creates the boot ROM at base, with an empty table
+func NewBootROM(base uint32) *BootROM {
+	var b Builder
+	b.Auipc(T0, 0)
+	b.Csrrs(A0, CSR_MHARTID, ZERO)
+	b.Lw(A1, T0, bootROMTable)
+	b.Lw(SP, T0, bootROMTable+4)
+	b.Lw(GP, T0, bootROMTable+8)
+	b.Lw(T0, T0, bootROMTable+12)
+	b.Jalr(ZERO, T0, 0)
+	code, _ := b.Assemble() // there are no labels to go wrong
+	image := make([]byte, bootROMTable+16)
+	copy(image, code)
+	return &BootROM{base: base, image: image}
+}
+
+func (r *BootROM) Read(offset, size uint32) (uint32, error) {
+	var word [4]byte
+	if offset < uint32(len(r.image)) {
+		copy(word[:], r.image[offset:])
+	}
+	switch size {
+	case 1:
+		return uint32(word[0]), nil
+	case 2:
+		return uint32(binary.LittleEndian.Uint16(word[:])), nil
+	}
+	return binary.LittleEndian.Uint32(word[:]), nil
+}
+
+func (r *BootROM) Write(offset, size, value uint32) error {
+	return fmt.Errorf("store to the boot ROM at 0x%08X", r.base+offset)
+}
+
+// fetchROM reads the instruction at pc from the boot ROM, if the machine has one and pc is in it
+func (cpu *CPU) fetchROM(pc uint32) (uint32, bool) {
+	r := cpu.bootROM
+	if r == nil || pc < r.base || pc-r.base > BootROMSize-4 {
+		return 0, false
+	}
+	instr, _ := r.Read(pc-r.base, 4)
+	return instr, true
+}
+
+// BootFromROM makes the loaded program start through the boot ROM: the ROM's
+// table takes the entry point (the PC) and the sp, gp and a1 the loaders set up,
+// those registers and a0 are cleared, and the PC moves to the ROM
+func (cpu *CPU) BootFromROM() error {
+	r := cpu.bootROM
+	if r == nil {
+		return errors.New("the machine has no boot ROM")
+	}
+	for i, v := range []uint32{cpu.Regs[A1], cpu.Regs[SP], cpu.Regs[GP], uint32(cpu.PC)} {
+		binary.LittleEndian.PutUint32(r.image[bootROMTable+4*i:], v)
+	}
+	for _, reg := range []int{A0, A1, SP, GP} {
+		cpu.Regs[reg] = 0
+	}
+	cpu.PC = int(r.base)
+	return nil
+}
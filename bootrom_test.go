@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// bootMachine is a virt-like machine with a boot ROM and a device tree, RAM at 0x80000000
+func bootMachine() MachineConfig {
+	m := DefaultMachine()
+	m.RAMBase = 0x80000000
+	m.MemSize = 0x10000
+	m.DeviceTree = true
+	m.BootROM = true
+	return m
+}
+
+func TestBootROM(t *testing.T) {
+	const ram, gp = 0x80000000, 0x80000800
+	const entry = ram // buildELF's entry point is where it loads
+	cpu, err := bootMachine().NewCPU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buildELF(assemble(t, func(b *Builder) { b.Ebreak() }), ram, map[string]uint32{"_start": entry, globalPointerSymbol: gp}, "_start")
+	if _, err := cpu.LoadELF(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	dtb, sp := cpu.Regs[A1], cpu.Regs[SP]
+	if dtb == 0 || sp == 0 || cpu.PC != entry {
+		t.Fatalf("the loaders left a1 0x%X, sp 0x%X, pc 0x%X", dtb, sp, cpu.PC)
+	}
+
+	if err := cpu.BootFromROM(); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.PC != DefaultROMBase || cpu.Regs[A1] != 0 || cpu.Regs[SP] != 0 || cpu.Regs[GP] != 0 {
+		t.Fatalf("after BootFromROM: pc 0x%X, a1 0x%X, sp 0x%X, gp 0x%X", cpu.PC, cpu.Regs[A1], cpu.Regs[SP], cpu.Regs[GP])
+	}
+	for cpu.PC != entry {
+		if cpu.Retired == 16 {
+			t.Fatalf("the ROM hasn't reached the entry point, pc 0x%X", cpu.PC)
+		}
+		if err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cpu.Retired != 7 {
+		t.Errorf("the ROM took %d instructions, want 7", cpu.Retired)
+	}
+	if cpu.Regs[A0] != 0 || cpu.Regs[A1] != dtb || cpu.Regs[SP] != sp || cpu.Regs[GP] != gp {
+		t.Errorf("at the entry point: a0 %d, a1 0x%X, sp 0x%X, gp 0x%X; want 0, 0x%X, 0x%X, 0x%X",
+			cpu.Regs[A0], cpu.Regs[A1], cpu.Regs[SP], cpu.Regs[GP], dtb, sp, gp)
+	}
+	if magic, _ := cpu.Load(cpu.Regs[A1], 4); magic != 0xEDFE0DD0 {
+		t.Errorf("a1 points at 0x%08X, not a device tree", magic)
+	}
+
+	// the ROM reads like memory, but doesn't take stores
+	if v, _ := cpu.Load(DefaultROMBase, 4); v != encodeU(AUIPC, T0, 0) {
+		t.Errorf("the ROM starts with 0x%08X", v)
+	}
+	if v, _ := cpu.Load(DefaultROMBase+bootROMTable+12, 2); v != entry&0xFFFF {
+		t.Errorf("the table's entry point reads 0x%04X", v)
+	}
+	if v, _ := cpu.Load(DefaultROMBase+BootROMSize-4, 4); v != 0 {
+		t.Errorf("the end of the ROM reads 0x%08X", v)
+	}
+	cpu.LoadProgramAt(assemble(t, func(b *Builder) {
+		b.Lui(T0, DefaultROMBase>>12)
+		b.Sw(T0, T0, 0)
+	}), ram)
+	var exc *Exception
+	if err := cpu.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Step(); !errors.As(err, &exc) || exc.Cause != CauseStoreAccessFault {
+		t.Errorf("store to the ROM: %v, want a store access fault", err)
+	}
+	if v, _ := cpu.Load(DefaultROMBase, 4); v != encodeU(AUIPC, T0, 0) {
+		t.Errorf("the store changed the ROM to 0x%08X", v)
+	}
+
+	plain := NewCPUWithMemory(0x1000)
+	if err := plain.BootFromROM(); err == nil {
+		t.Error("BootFromROM worked without a ROM")
+	}
+	m := bootMachine()
+	m.RAMBase = 0
+	if _, err := m.NewCPU(); err == nil || !strings.Contains(err.Error(), "bootrom at 0x00001000 overlaps") {
+		t.Errorf("a ROM inside RAM: %v", err)
+	}
+}
+
+func TestRunBootROM(t *testing.T) {
+	// the payload exits with 0 only if the ROM set it up: a0 the hart, a1 the
+	// device tree, sp inside RAM
+	image := writeTemp(t, "payload.bin", assemble(t, func(b *Builder) {
+		b.Li(T2, 1)
+		b.Bnez(A0, "fail")
+		b.Li(T2, 2)
+		b.Lw(T0, A1, 0)
+		var magic uint32 = 0xEDFE0DD0
+		b.Li(T1, int32(magic))
+		b.Bne(T0, T1, "fail")
+		b.Li(T2, 3)
+		b.Lui(T1, 0x80000)
+		b.Bltu(SP, T1, "fail")
+		b.Li(T2, 0)
+		b.Label("fail")
+		b.Mv(A0, T2)
+		b.Li(A7, newlibSysExit)
+		b.Ecall()
+	}))
+	args := []string{"run", "--syscalls=newlib", "--boot-rom", "--dtb", "--ram-base=0x80000000", "--mem-size=0x10000"}
+	for _, extra := range [][]string{nil, {"--rom-base=0x20000"}} {
+		if code, _, stderr := runCommand(append(append(args, extra...), image)...); code != 0 {
+			t.Errorf("%v: check %d failed (%s)", extra, code, stderr)
+		}
+	}
+	code, stdout, _ := runCommand(append(args, "--trace", "--max-instructions=1", image)...)
+	if code != 0 || !strings.Contains(stdout, "pc=0x00001000") {
+		t.Errorf("the first instruction isn't in the ROM (exit %d):\n%s", code, stdout)
+	}
+	if code, _, stderr := runCommand("run", "--boot-rom", image); code != 2 || !strings.Contains(stderr, "overlaps") {
+		t.Errorf("--boot-rom with RAM over the ROM: exit %d, %q", code, stderr)
+	}
+}
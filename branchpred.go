@@ -0,0 +1,180 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+)
+
+// ============================================================================
+// Branch prediction
+// ============================================================================
+// BranchModel is a Tracer that asks a BranchPredictor about every conditional
+// branch before telling it the outcome, and counts how often it was right,
+// overall and per branch instruction. like the pipeline and cache models it
+// only watches, execution is exactly the same with or without it.
+//
+// the predictors are the textbook ones:
+//   - always-taken predicts every branch taken
+//   - btfnt predicts backward branches (loops) taken and forward ones not taken
+//   - 2bit keeps a table of 2-bit saturating counters indexed by the branch's
+//     address, each starting at weakly not taken; two wrong guesses in a row
+//     are needed to change its mind
+//
+// a branch to the next instruction counts as not taken, since whether it was
+// makes no difference
+
+// DefaultPredictorSize is the number of counters in the 2bit predictor's table
+const DefaultPredictorSize = 1024
+
+// BranchPredictor guesses whether the conditional branch at pc, jumping to target when taken, is taken
+type BranchPredictor interface {
+	Predict(pc, target uint32) bool
+	Update(pc, target uint32, taken bool) // the outcome of the branch just predicted
+}
+
+// PredictorNames are the predictors NewBranchPredictor knows
+var PredictorNames = []string{"always-taken", "btfnt", "2bit"}
+
+// NewBranchPredictor returns the predictor called name; size is the number of counters
+// of the 2bit predictor, a power of two
+func NewBranchPredictor(name string, size int) (BranchPredictor, error) {
+	switch name {
+	case "always-taken":
+		return alwaysTaken{}, nil
+	case "btfnt":
+		return btfnt{}, nil
+	case "2bit":
+		if size <= 0 || size&(size-1) != 0 {
+			return nil, fmt.Errorf("predictor size %d is not a power of two", size)
+		}
+		counters := make([]uint8, size)
+		for i := range counters {
+			counters[i] = 1 // weakly not taken
+		}
+		return &twoBit{counters: counters}, nil
+	}
+	return nil, fmt.Errorf("unknown branch predictor %q (want one of %v)", name, PredictorNames)
+}
+
+type alwaysTaken struct{}
+
+func (alwaysTaken) Predict(pc, target uint32) bool       { return true }
+func (alwaysTaken) Update(pc, target uint32, taken bool) {}
+
+type btfnt struct{}
+
+func (btfnt) Predict(pc, target uint32) bool       { return target < pc }
+func (btfnt) Update(pc, target uint32, taken bool) {}
+
+// twoBit is a table of 2-bit saturating counters: 0 and 1 predict not taken, 2 and 3 taken
+type twoBit struct {
+	counters []uint8
+}
+
+func (p *twoBit) counter(pc uint32) *uint8 {
+	return &p.counters[(pc>>2)&uint32(len(p.counters)-1)]
+}
+
+func (p *twoBit) Predict(pc, target uint32) bool {
+	return *p.counter(pc) >= 2
+}
+
+func (p *twoBit) Update(pc, target uint32, taken bool) {
+	c := p.counter(pc)
+	if taken && *c < 3 {
+		*c++
+	} else if !taken && *c > 0 {
+		*c--
+	}
+}
+
+// BranchSite is what happened at one branch instruction
+type BranchSite struct {
+	PC        uint32 `json:"pc"`
+	Executed  uint64 `json:"executed"`
+	Taken     uint64 `json:"taken"`
+	Predicted uint64 `json:"predicted"` // how many times the prediction was right
+}
+
+// Accuracy is the fraction of the branch's executions that were predicted right
+func (s BranchSite) Accuracy() float64 {
+	if s.Executed == 0 {
+		return 0
+	}
+	return float64(s.Predicted) / float64(s.Executed)
+}
+
+// BranchStats are the totals of a BranchModel
+type BranchStats struct {
+	Predictor string       `json:"predictor"`
+	Branches  uint64       `json:"branches"`
+	Predicted uint64       `json:"predicted"`
+	Sites     []BranchSite `json:"sites"` // the most executed first
+}
+
+// Accuracy is the fraction of all branches that were predicted right
+func (s BranchStats) Accuracy() float64 {
+	if s.Branches == 0 {
+		return 0
+	}
+	return float64(s.Predicted) / float64(s.Branches)
+}
+
+func (s BranchStats) String() string {
+	return fmt.Sprintf("%s predicted %d of %d branches (%.2f%% accuracy) at %d sites",
+		s.Predictor, s.Predicted, s.Branches, 100*s.Accuracy(), len(s.Sites))
+}
+
+// BranchModel is the predictor model; install it as (or, with MultiTracer, next to) the CPU's Tracer
+type BranchModel struct {
+	name      string
+	predictor BranchPredictor
+	branches  uint64
+	predicted uint64
+	sites     map[uint32]*BranchSite
+}
+
+// NewBranchModel creates a model running predictor, reported under name
+func NewBranchModel(name string, predictor BranchPredictor) *BranchModel {
+	return &BranchModel{name: name, predictor: predictor, sites: make(map[uint32]*BranchSite)}
+}
+
+// Stats returns the totals so far
+func (m *BranchModel) Stats() BranchStats {
+	stats := BranchStats{Predictor: m.name, Branches: m.branches, Predicted: m.predicted}
+	for _, site := range m.sites {
+		stats.Sites = append(stats.Sites, *site)
+	}
+	slices.SortFunc(stats.Sites, func(a, b BranchSite) int {
+		return cmp.Or(cmp.Compare(b.Executed, a.Executed), cmp.Compare(a.PC, b.PC))
+	})
+	return stats
+}
+
+// Trace predicts the instruction instr at pc, which has just been executed, if it's a branch
+func (m *BranchModel) Trace(cpu *CPU, pc int, instr uint32) {
+	if instr&0x7F != BRANCH {
+		return
+	}
+	d := decode(instr)
+	from := uint32(pc)
+	target := from + d.imm
+	taken := uint32(cpu.PC) != from+4
+
+	site := m.sites[from]
+	if site == nil {
+		site = &BranchSite{PC: from}
+		m.sites[from] = site
+	}
+	site.Executed++
+	m.branches++
+	if taken {
+		site.Taken++
+	}
+	if m.predictor.Predict(from, target) == taken {
+		site.Predicted++
+		m.predicted++
+	}
+	m.predictor.Update(from, target, taken)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// the predictors on a branch at 0x100 with the outcomes TTTTN four times over,
+// jumping backwards (like a loop's) or forwards
+func TestBranchPredictors(t *testing.T) {
+	const pc = 0x100
+	pattern := strings.Repeat("TTTTN", 4)
+	for _, tt := range []struct {
+		predictor string
+		backward  bool
+		predicted uint64 // of the 20
+	}{
+		{"always-taken", true, 16},
+		{"always-taken", false, 16},
+		{"btfnt", true, 16},
+		{"btfnt", false, 4},
+		// weakly not taken to start with, it misses the first T and then every N
+		{"2bit", true, 15},
+		{"2bit", false, 15},
+	} {
+		predictor, err := NewBranchPredictor(tt.predictor, DefaultPredictorSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		model := NewBranchModel(tt.predictor, predictor)
+		offset := uint32(0x40)
+		if tt.backward {
+			offset = -offset
+		}
+		instr := encodeB(BRANCH, 0x1, A0, ZERO, offset) // bnez a0
+		var cpu CPU
+		for _, outcome := range pattern {
+			cpu.PC = pc + 4
+			if outcome == 'T' {
+				cpu.PC = int(pc + offset)
+			}
+			model.Trace(&cpu, pc, instr)
+		}
+		stats := model.Stats()
+		if stats.Branches != 20 || stats.Predicted != tt.predicted || stats.Accuracy() != float64(tt.predicted)/20 {
+			t.Errorf("%s, backward %v: predicted %d of %d branches (%.2f), want %d of 20", tt.predictor, tt.backward, stats.Predicted, stats.Branches, stats.Accuracy(), tt.predicted)
+		}
+		if want := (BranchSite{PC: pc, Executed: 20, Taken: 16, Predicted: tt.predicted}); len(stats.Sites) != 1 || stats.Sites[0] != want {
+			t.Errorf("%s, backward %v: sites %+v, want just %+v", tt.predictor, tt.backward, stats.Sites, want)
+		}
+	}
+}
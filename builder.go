@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ============================================================================
+// Instruction builder
+// ============================================================================
+// Builder writes RV32I programs from Go, one method per instruction, with
+// labels for branch and jump targets:
+//
+//	var b Builder
+//	b.Li(T0, 10)
+//	b.Label("loop")
+//	b.Addi(T0, T0, -1)
+//	b.Bne(T0, ZERO, "loop")
+//	b.Ecall()
+//	program, err := b.Assemble()
+//
+// registers are the constants of registers.go. labels may be used before they're
+// defined; Assemble resolves them and reports any that are missing.
+//
+// a branch or jump whose target is out of its range is relaxed into a longer
+// sequence that reaches it, rather than being an error:
+//
+//	beq a0, a1, far    ->  bne a0, a1, +8; jal zero, far          (far within ±1MiB)
+//	                   ->  bne a0, a1, +12; auipc t1, hi; jalr zero, lo(t1)
+//	jal rd, far        ->  auipc rd, hi; jalr rd, lo(rd)          (the scratch register when rd is zero)
+//
+// a branch beyond ±1MiB, and a jal zero (j) beyond it, need a register to hold
+// the upper part of the address, and overwrite it the way the tail
+// pseudo-instruction overwrites t1. that's opt in: Assemble reports them as out
+// of range unless SetScratch has named the register they may use (t1 above).
+// relaxing moves what follows, which can push other branches out of range, so
+// Assemble repeats until nothing more needs it. Relaxed lists the sites and the
+// registers they overwrote, and Len and the label addresses don't include the
+// instructions it adds
+
+// Builder accumulates instructions; the zero value is an empty program
+type Builder struct {
+	words   []uint32
+	labels  map[string]int // label -> word index
+	fixups  []fixup
+	relaxed []Relaxation // filled in by Assemble
+	scratch uint32       // the register relaxation may overwrite, ZERO for none
+}
+
+// fixup is a branch or jump whose offset is filled in by Assemble
+type fixup struct {
+	index int    // word index of the instruction
+	label string // its target
+	jump  bool   // J-type (jal) rather than B-type
+}
+
+// Relaxation is a branch or jump Assemble had to replace with a longer sequence
+type Relaxation struct {
+	Offset uint32 // where the sequence is in the assembled program
+	Label  string // the target
+	Form   string // "branch over jal", "branch over auipc+jalr" or "auipc+jalr"
+	// Clobbered is the scratch register the sequence overwrote, or ZERO if it
+	// only writes what the original instruction did
+	Clobbered uint32
+}
+
+// SetScratch lets Assemble overwrite reg when it relaxes a branch or jal zero
+// beyond ±1MiB; ZERO (the default) makes those an error instead
+func (b *Builder) SetScratch(reg uint32) {
+	b.scratch = reg
+}
+
+// Label defines name as the address of the next instruction
+func (b *Builder) Label(name string) {
+	if b.labels == nil {
+		b.labels = make(map[string]int)
+	}
+	b.labels[name] = len(b.words)
+}
+
+// Len is the number of bytes emitted so far (the offset of the next instruction)
+func (b *Builder) Len() int {
+	return len(b.words) * 4
+}
+
+// Word emits a raw 32-bit word
+func (b *Builder) Word(w uint32) {
+	b.words = append(b.words, w)
+}
+
+// Space emits n bytes of zeros (rounded up to whole words), e.g. to leave room for data
+func (b *Builder) Space(n int) {
+	b.words = append(b.words, make([]uint32, (n+3)/4)...)
+}
+
+// the longest sequences a branch or jump can be relaxed into, in words
+const (
+	branchWords = 3 // inverted branch, auipc, jalr
+	jumpWords   = 2 // auipc, jalr
+)
+
+// Assemble resolves the labels, relaxing the branches and jumps that can't reach
+// their targets, and returns the program as little-endian bytes
+func (b *Builder) Assemble() ([]byte, error) {
+	for _, f := range b.fixups {
+		if _, ok := b.labels[f.label]; !ok {
+			return nil, fmt.Errorf("undefined label %q", f.label)
+		}
+	}
+
+	// sizes[i] is how many words fixup i takes. they only ever grow, and each is
+	// bounded, so this ends
+	sizes := make([]int, len(b.fixups))
+	for i := range sizes {
+		sizes[i] = 1
+	}
+	var at func(index int) int32
+	for changed := true; changed; {
+		// at is the byte address word index ends up at with the current sizes
+		at = func(index int) int32 {
+			n := index
+			for i, f := range b.fixups {
+				if f.index < index {
+					n += sizes[i] - 1
+				}
+			}
+			return int32(n) * 4
+		}
+		changed = false
+		for i, f := range b.fixups {
+			if sizes[i] < b.fixupSize(f, at(b.labels[f.label])-at(f.index)) {
+				sizes[i]++
+				changed = true
+			}
+		}
+	}
+
+	if b.scratch == ZERO {
+		for i, f := range b.fixups {
+			if !needsScratch(f, sizes[i], b.words[f.index]) {
+				continue
+			}
+			kind := "branch"
+			if f.jump {
+				kind = "jump"
+			}
+			return nil, fmt.Errorf("%s to %q at 0x%X is beyond ±1MiB, and relaxing it needs a scratch register (SetScratch)", kind, f.label, at(f.index))
+		}
+	}
+
+	words := make([]uint32, 0, len(b.words))
+	b.relaxed = nil
+	next := 0 // the next fixup, they're in index order
+	for index, w := range b.words {
+		if next == len(b.fixups) || b.fixups[next].index != index {
+			words = append(words, w)
+			continue
+		}
+		f, size := b.fixups[next], sizes[next]
+		next++
+		pc := at(index)
+		offset := at(b.labels[f.label]) - pc
+		if size == 1 {
+			if f.jump {
+				words = append(words, w|encodeJ(0, 0, uint32(offset)))
+			} else {
+				words = append(words, w|encodeB(0, 0, 0, 0, uint32(offset)))
+			}
+			continue
+		}
+
+		r := Relaxation{Offset: uint32(pc), Label: f.label}
+		if !f.jump {
+			// the inverted condition skips over the jump, whichever it is
+			words = append(words, w^1<<12|encodeB(0, 0, 0, 0, uint32(4*size)))
+			offset -= 4
+		}
+		if !f.jump && size == 2 {
+			r.Form = "branch over jal"
+			words = append(words, encodeJ(JAL, ZERO, uint32(offset)))
+		} else {
+			rd := (w >> 7) & 0x1F
+			if !f.jump {
+				rd = ZERO
+			}
+			base := rd
+			if needsScratch(f, size, w) {
+				base = b.scratch
+				r.Clobbered = base
+			}
+			// jalr sign-extends its immediate, so round the upper part up when bit 11 is set
+			words = append(words,
+				encodeU(AUIPC, base, (uint32(offset)+0x800)>>12),
+				encodeI(JALR, rd, 0x0, base, uint32(offset)&0xFFF))
+			r.Form = "auipc+jalr"
+			if !f.jump {
+				r.Form = "branch over auipc+jalr"
+			}
+		}
+		b.relaxed = append(b.relaxed, r)
+	}
+
+	program := make([]byte, len(words)*4)
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(program[i*4:], w)
+	}
+	return program, nil
+}
+
+// fixupSize returns how many words f needs to reach offset bytes from its first word
+func (b *Builder) fixupSize(f fixup, offset int32) int {
+	if f.jump {
+		if offset >= -(1<<20) && offset < 1<<20 {
+			return 1
+		}
+		return jumpWords
+	}
+	if offset >= -(1<<12) && offset < 1<<12 {
+		return 1
+	}
+	// the jal comes a word after the branch
+	if offset-4 >= -(1<<20) && offset-4 < 1<<20 {
+		return 2
+	}
+	return branchWords
+}
+
+// needsScratch reports whether fixup f, first word w, relaxed to size words, goes
+// through the scratch register: the auipc forms with nowhere else to put the address
+func needsScratch(f fixup, size int, w uint32) bool {
+	if f.jump {
+		return size == jumpWords && (w>>7)&0x1F == ZERO
+	}
+	return size == branchWords
+}
+
+// Relaxed lists the branches and jumps the last Assemble relaxed, in program order
+func (b *Builder) Relaxed() []Relaxation {
+	return b.relaxed
+}
+
+// ----------------------------------------------------------------------------
+// encoders, one per instruction format (the immediates are placed by bits.go)
+
+func encodeR(opcode, rd, funct3, rs1, rs2, funct7 uint32) uint32 {
+	return funct7<<25 | rs2<<20 | rs1<<15 | funct3<<12 | rd<<7 | opcode
+}
+
+func encodeI(opcode, rd, funct3, rs1, imm uint32) uint32 {
+	return EncodeImmI(imm) | rs1<<15 | funct3<<12 | rd<<7 | opcode
+}
+
+func encodeS(opcode, funct3, rs1, rs2, imm uint32) uint32 {
+	return EncodeImmS(imm) | rs2<<20 | rs1<<15 | funct3<<12 | opcode
+}
+
+func encodeB(opcode, funct3, rs1, rs2, imm uint32) uint32 {
+	return EncodeImmB(imm) | rs2<<20 | rs1<<15 | funct3<<12 | opcode
+}
+
+func encodeU(opcode, rd, imm uint32) uint32 {
+	return EncodeImmU(imm) | rd<<7 | opcode
+}
+
+func encodeJ(opcode, rd, imm uint32) uint32 {
+	return EncodeImmJ(imm) | rd<<7 | opcode
+}
+
+func (b *Builder) r(funct3, funct7, rd, rs1, rs2 uint32) {
+	b.Word(encodeR(OP, rd, funct3, rs1, rs2, funct7))
+}
+
+func (b *Builder) i(opcode, funct3, rd, rs1 uint32, imm int32) {
+	b.Word(encodeI(opcode, rd, funct3, rs1, uint32(imm)))
+}
+
+func (b *Builder) s(funct3, rs2, rs1 uint32, imm int32) {
+	b.Word(encodeS(STORE, funct3, rs1, rs2, uint32(imm)))
+}
+
+func (b *Builder) branch(funct3, rs1, rs2 uint32, label string) {
+	b.fixups = append(b.fixups, fixup{index: len(b.words), label: label})
+	b.Word(encodeB(BRANCH, funct3, rs1, rs2, 0))
+}
+
+// ----------------------------------------------------------------------------
+// instructions
+
+func (b *Builder) Add(rd, rs1, rs2 uint32)  { b.r(0x0, 0x00, rd, rs1, rs2) }
+func (b *Builder) Sub(rd, rs1, rs2 uint32)  { b.r(0x0, 0x20, rd, rs1, rs2) }
+func (b *Builder) Sll(rd, rs1, rs2 uint32)  { b.r(0x1, 0x00, rd, rs1, rs2) }
+func (b *Builder) Slt(rd, rs1, rs2 uint32)  { b.r(0x2, 0x00, rd, rs1, rs2) }
+func (b *Builder) Sltu(rd, rs1, rs2 uint32) { b.r(0x3, 0x00, rd, rs1, rs2) }
+func (b *Builder) Xor(rd, rs1, rs2 uint32)  { b.r(0x4, 0x00, rd, rs1, rs2) }
+func (b *Builder) Srl(rd, rs1, rs2 uint32)  { b.r(0x5, 0x00, rd, rs1, rs2) }
+func (b *Builder) Sra(rd, rs1, rs2 uint32)  { b.r(0x5, 0x20, rd, rs1, rs2) }
+func (b *Builder) Or(rd, rs1, rs2 uint32)   { b.r(0x6, 0x00, rd, rs1, rs2) }
+func (b *Builder) And(rd, rs1, rs2 uint32)  { b.r(0x7, 0x00, rd, rs1, rs2) }
+
+func (b *Builder) Addi(rd, rs1 uint32, imm int32)  { b.i(OP_IMM, 0x0, rd, rs1, imm) }
+func (b *Builder) Slti(rd, rs1 uint32, imm int32)  { b.i(OP_IMM, 0x2, rd, rs1, imm) }
+func (b *Builder) Sltiu(rd, rs1 uint32, imm int32) { b.i(OP_IMM, 0x3, rd, rs1, imm) }
+func (b *Builder) Xori(rd, rs1 uint32, imm int32)  { b.i(OP_IMM, 0x4, rd, rs1, imm) }
+func (b *Builder) Ori(rd, rs1 uint32, imm int32)   { b.i(OP_IMM, 0x6, rd, rs1, imm) }
+func (b *Builder) Andi(rd, rs1 uint32, imm int32)  { b.i(OP_IMM, 0x7, rd, rs1, imm) }
+func (b *Builder) Slli(rd, rs1, shamt uint32)      { b.i(OP_IMM, 0x1, rd, rs1, int32(shamt&0x1F)) }
+func (b *Builder) Srli(rd, rs1, shamt uint32)      { b.i(OP_IMM, 0x5, rd, rs1, int32(shamt&0x1F)) }
+func (b *Builder) Srai(rd, rs1, shamt uint32)      { b.i(OP_IMM, 0x5, rd, rs1, int32(shamt&0x1F|0x400)) }
+
+func (b *Builder) Lb(rd, rs1 uint32, imm int32)  { b.i(LOAD, 0x0, rd, rs1, imm) }
+func (b *Builder) Lh(rd, rs1 uint32, imm int32)  { b.i(LOAD, 0x1, rd, rs1, imm) }
+func (b *Builder) Lw(rd, rs1 uint32, imm int32)  { b.i(LOAD, 0x2, rd, rs1, imm) }
+func (b *Builder) Lbu(rd, rs1 uint32, imm int32) { b.i(LOAD, 0x4, rd, rs1, imm) }
+func (b *Builder) Lhu(rd, rs1 uint32, imm int32) { b.i(LOAD, 0x5, rd, rs1, imm) }
+
+func (b *Builder) Sb(rs2, rs1 uint32, imm int32) { b.s(0x0, rs2, rs1, imm) }
+func (b *Builder) Sh(rs2, rs1 uint32, imm int32) { b.s(0x1, rs2, rs1, imm) }
+func (b *Builder) Sw(rs2, rs1 uint32, imm int32) { b.s(0x2, rs2, rs1, imm) }
+
+func (b *Builder) Beq(rs1, rs2 uint32, label string)  { b.branch(0x0, rs1, rs2, label) }
+func (b *Builder) Bne(rs1, rs2 uint32, label string)  { b.branch(0x1, rs1, rs2, label) }
+func (b *Builder) Blt(rs1, rs2 uint32, label string)  { b.branch(0x4, rs1, rs2, label) }
+func (b *Builder) Bge(rs1, rs2 uint32, label string)  { b.branch(0x5, rs1, rs2, label) }
+func (b *Builder) Bltu(rs1, rs2 uint32, label string) { b.branch(0x6, rs1, rs2, label) }
+func (b *Builder) Bgeu(rs1, rs2 uint32, label string) { b.branch(0x7, rs1, rs2, label) }
+
+func (b *Builder) Lui(rd, imm uint32)   { b.Word(encodeU(LUI, rd, imm)) }
+func (b *Builder) Auipc(rd, imm uint32) { b.Word(encodeU(AUIPC, rd, imm)) }
+
+func (b *Builder) Jal(rd uint32, label string) {
+	b.fixups = append(b.fixups, fixup{index: len(b.words), label: label, jump: true})
+	b.Word(encodeJ(JAL, rd, 0))
+}
+
+func (b *Builder) Jalr(rd, rs1 uint32, imm int32) { b.i(JALR, 0x0, rd, rs1, imm) }
+
+func (b *Builder) Fence()  { b.Word(encodeI(MISC_MEM, 0, 0x0, 0, 0x0FF)) }
+func (b *Builder) FenceI() { b.Word(encodeI(MISC_MEM, 0, 0x1, 0, 0)) }
+func (b *Builder) Ecall()  { b.Word(encodeI(SYSTEM, 0, 0x0, 0, 0x000)) }
+func (b *Builder) Ebreak() { b.Word(encodeI(SYSTEM, 0, 0x0, 0, 0x001)) }
+func (b *Builder) Mret()   { b.Word(encodeI(SYSTEM, 0, 0x0, 0, 0x302)) }
+func (b *Builder) Wfi()    { b.Word(encodeI(SYSTEM, 0, 0x0, 0, 0x105)) }
+
+func (b *Builder) Csrrw(rd, csr, rs1 uint32) { b.Word(encodeI(SYSTEM, rd, 0x1, rs1, csr)) }
+func (b *Builder) Csrrs(rd, csr, rs1 uint32) { b.Word(encodeI(SYSTEM, rd, 0x2, rs1, csr)) }
+func (b *Builder) Csrrc(rd, csr, rs1 uint32) { b.Word(encodeI(SYSTEM, rd, 0x3, rs1, csr)) }
+
+// InsnR emits an R-type instruction from its fields, like the assembler's
+// `.insn r opcode, funct3, funct7, rd, rs1, rs2` (for custom instructions)
+func (b *Builder) InsnR(opcode, funct3, funct7, rd, rs1, rs2 uint32) {
+	b.Word(encodeR(opcode&0x7F, rd, funct3&0x7, rs1, rs2, funct7&0x7F))
+}
+
+// InsnI emits an I-type instruction from its fields, like `.insn i opcode, funct3, rd, rs1, imm`
+func (b *Builder) InsnI(opcode, funct3, rd, rs1 uint32, imm int32) {
+	b.i(opcode&0x7F, funct3&0x7, rd, rs1, imm)
+}
+
+// ----------------------------------------------------------------------------
+// pseudo-instructions
+
+// Li loads a 32-bit constant (addi alone when it fits in 12 bits, lui + addi otherwise)
+func (b *Builder) Li(rd uint32, value int32) {
+	if value >= -2048 && value < 2048 {
+		b.Addi(rd, ZERO, value)
+		return
+	}
+	// addi sign-extends its immediate, so round the upper part up when bit 11 is set
+	upper := (uint32(value) + 0x800) >> 12
+	b.Lui(rd, upper)
+	if low := int32(SignExtend(uint32(value)&0xFFF, 11)); low != 0 {
+		b.Addi(rd, rd, low)
+	}
+}
+
+func (b *Builder) Mv(rd, rs uint32)             { b.Addi(rd, rs, 0) }
+func (b *Builder) Nop()                         { b.Addi(ZERO, ZERO, 0) }
+func (b *Builder) J(label string)               { b.Jal(ZERO, label) }
+func (b *Builder) Call(label string)            { b.Jal(RA, label) }
+func (b *Builder) Ret()                         { b.Jalr(ZERO, RA, 0) }
+func (b *Builder) Beqz(rs uint32, label string) { b.Beq(rs, ZERO, label) }
+func (b *Builder) Bnez(rs uint32, label string) { b.Bne(rs, ZERO, label) }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// the value relaxTest puts in t1 first, to see whether a relaxation overwrote it
+const t1Sentinel = 0x5A5
+
+// relaxTest is a program with a branch or jump that .space padding has pushed
+// out of range; it sets s0 to 7 at the target and stops at the ebreak after it,
+// the last instruction
+type relaxTest struct {
+	name    string
+	scratch uint32
+	build   func(b *Builder)
+	want    []Relaxation
+	ra      bool // the jump was a call, so ra holds the return address
+}
+
+var relaxTests = []relaxTest{
+	{
+		name: "branch over jal",
+		build: func(b *Builder) {
+			b.Bne(A0, A1, "far")
+			b.Ebreak()
+			b.Space(8 << 10)
+		},
+		want: []Relaxation{{Offset: 0x8, Label: "far", Form: "branch over jal"}},
+	},
+	{
+		name:    "branch over auipc+jalr",
+		scratch: T1,
+		build: func(b *Builder) {
+			b.Bne(A0, A1, "far")
+			b.Ebreak()
+			b.Space(1<<20 + 16)
+		},
+		want: []Relaxation{{Offset: 0x8, Label: "far", Form: "branch over auipc+jalr", Clobbered: T1}},
+	},
+	{
+		name:    "j through auipc+jalr",
+		scratch: T1,
+		build: func(b *Builder) {
+			b.J("far")
+			b.Ebreak()
+			b.Space(1<<20 + 16)
+		},
+		want: []Relaxation{{Offset: 0x8, Label: "far", Form: "auipc+jalr", Clobbered: T1}},
+	},
+	{
+		name: "call through auipc+jalr",
+		build: func(b *Builder) {
+			b.Call("far")
+			b.Ebreak()
+			b.Space(1<<20 + 16)
+		},
+		want: []Relaxation{{Offset: 0x8, Label: "far", Form: "auipc+jalr"}},
+		ra:   true,
+	},
+	{
+		// the bne reaches "near" until the beq's relaxation moves it a word further
+		name: "relaxing pushes another branch out",
+		build: func(b *Builder) {
+			b.J("first")
+			b.Label("back")
+			b.Bne(A0, A1, "near")
+			b.Ebreak()
+			b.Label("first")
+			b.Beq(A0, A1, "far")
+			b.J("back")
+			b.Space(4<<10 - 20)
+			b.Label("near")
+			b.J("far")
+			b.Space(8 << 10)
+		},
+		want: []Relaxation{
+			{Offset: 0xC, Label: "near", Form: "branch over jal"},
+			{Offset: 0x18, Label: "far", Form: "branch over jal"},
+		},
+	},
+}
+
+func TestRelaxation(t *testing.T) {
+	for _, tt := range relaxTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Builder
+			b.SetScratch(tt.scratch)
+			b.Li(A0, 1)
+			b.Li(T1, t1Sentinel)
+			tt.build(&b)
+			b.Label("far")
+			b.Li(S0, 7)
+			b.Ebreak()
+			program, err := b.Assemble()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := b.Relaxed(); !slices.Equal(got, tt.want) {
+				t.Fatalf("Relaxed() = %+v, want %+v", got, tt.want)
+			}
+
+			cpu := NewCPUWithMemory(len(program) + 0x1000)
+			cpu.LoadProgram(program)
+			runToEbreak(t, &cpu)
+			if want := len(program); cpu.PC != want || cpu.Regs[S0] != 7 {
+				t.Fatalf("stopped at pc=0x%X with s0=%d, want pc=0x%X and s0=7", cpu.PC, cpu.Regs[S0], want)
+			}
+			// the scratch register ends up with the target's upper part
+			if overwritten := cpu.Regs[T1] != t1Sentinel; overwritten != (tt.scratch == T1) {
+				t.Errorf("t1 = 0x%X, overwritten %v; want %v", cpu.Regs[T1], overwritten, !overwritten)
+			}
+			if tt.ra && cpu.Regs[RA] != tt.want[0].Offset+8 {
+				t.Errorf("ra = 0x%X, want 0x%X", cpu.Regs[RA], tt.want[0].Offset+8)
+			}
+		})
+	}
+}
+
+// the branches that fall through run the instruction after the relaxed sequence
+func TestRelaxationNotTaken(t *testing.T) {
+	for _, tt := range []struct {
+		scratch uint32
+		pad     int
+		words   int // in the relaxed branch
+	}{{ZERO, 8 << 10, 2}, {T1, 1<<20 + 16, 3}} {
+		var b Builder
+		b.SetScratch(tt.scratch)
+		b.Beq(ZERO, SP, "far")
+		b.Li(S0, 7)
+		b.Ebreak()
+		b.Space(tt.pad)
+		b.Label("far")
+		b.Ebreak()
+		program, err := b.Assemble()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cpu := NewCPUWithMemory(len(program))
+		cpu.LoadProgram(program)
+		cpu.Regs[SP] = 1
+		runToEbreak(t, &cpu)
+		if want := 4 * (tt.words + 2); len(b.Relaxed()) != 1 || cpu.PC != want || cpu.Regs[S0] != 7 {
+			t.Fatalf("scratch %s: relaxed %+v, stopped at pc=0x%X with s0=%d; want one site, falling through to pc=0x%X with s0=7",
+				abiNames[tt.scratch], b.Relaxed(), cpu.PC, cpu.Regs[S0], want)
+		}
+	}
+}
+
+func TestRelaxationNeedsScratch(t *testing.T) {
+	for _, build := range []func(b *Builder){
+		func(b *Builder) { b.Blt(A0, A1, "far") },
+		func(b *Builder) { b.J("far") },
+	} {
+		var b Builder
+		b.Nop()
+		build(&b)
+		b.Space(1<<20 + 16)
+		b.Label("far")
+		b.Ebreak()
+		_, err := b.Assemble()
+		if err == nil || !strings.Contains(err.Error(), `to "far" at 0x4 is beyond ±1MiB`) {
+			t.Fatalf("Assemble() = %v, want the missing scratch register reported", err)
+		}
+	}
+}
+
+func TestListingRelaxed(t *testing.T) {
+	var b Builder
+	b.SetScratch(T2)
+	b.Bge(A0, A1, "far")
+	b.Space(1<<20 + 16)
+	b.Label("far")
+	b.Ebreak()
+	program, err := b.Assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	writeListing(&out, program, 0, b.Relaxed())
+	first, _, _ := strings.Cut(out.String(), "\n")
+	if want := "# relaxed to reach far: branch over auipc+jalr, overwrites t2"; !strings.HasSuffix(first, want) {
+		t.Fatalf("listing starts %q, want it to end %q", first, want)
+	}
+	if !strings.Contains(out.String(), "auipc t2") {
+		t.Fatalf("listing doesn't use t2:\n%.300s", out.String())
+	}
+}
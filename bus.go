@@ -0,0 +1,74 @@
+package main
+
+import "fmt"
+
+// ============================================================================
+// Memory-mapped devices
+// ============================================================================
+// RAM starts at address RAMBase (0 by default) and covers len(cpu.Memory) bytes.
+// devices sit at addresses outside it: a load or store outside RAM is routed to
+// the device whose window contains the address, and is an access fault if there
+// is none
+
+// Device is a memory-mapped peripheral. offsets are relative to the device's base
+// address and size is the access width in bytes (1, 2 or 4)
+type Device interface {
+	Read(offset, size uint32) (uint32, error)
+	Write(offset, size, value uint32) error
+}
+
+// Ticker is implemented by devices that need to run after every instruction,
+// e.g. to raise an interrupt when a timer expires
+type Ticker interface {
+	Tick(cpu *CPU)
+}
+
+// deviceMapping is a device and the address window it answers to
+type deviceMapping struct {
+	name       string
+	base, size uint32
+	dev        Device
+}
+
+// AttachDevice maps dev at [base, base+size); the window must not overlap RAM or another device
+func (cpu *CPU) AttachDevice(name string, base, size uint32, dev Device) error {
+	end := uint64(base) + uint64(size)
+	if size == 0 || end > 1<<32 {
+		return fmt.Errorf("device %s has an invalid window 0x%08X+0x%X", name, base, size)
+	}
+	if ramEnd := uint64(cpu.ramBase) + uint64(len(cpu.Memory)); uint64(base) < ramEnd && uint64(cpu.ramBase) < end {
+		return fmt.Errorf("device %s at 0x%08X overlaps RAM", name, base)
+	}
+	for _, m := range cpu.devices {
+		if uint64(base) < uint64(m.base)+uint64(m.size) && uint64(m.base) < end {
+			return fmt.Errorf("device %s at 0x%08X overlaps device %s", name, base, m.name)
+		}
+	}
+
+	cpu.devices = append(cpu.devices, deviceMapping{name: name, base: base, size: size, dev: dev})
+	if t, ok := dev.(Ticker); ok {
+		cpu.tickers = append(cpu.tickers, t)
+	}
+	if r, ok := dev.(*BootROM); ok {
+		cpu.bootROM = r
+	}
+	return nil
+}
+
+// findDevice returns the device whose window holds the whole access [addr, addr+size)
+func (cpu *CPU) findDevice(addr, size uint32) (*deviceMapping, bool) {
+	for i := range cpu.devices {
+		m := &cpu.devices[i]
+		if addr >= m.base && uint64(addr)+uint64(size) <= uint64(m.base)+uint64(m.size) {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// tickDevices lets every Ticker device react to the instruction that just retired
+func (cpu *CPU) tickDevices() {
+	for _, t := range cpu.tickers {
+		t.Tick(cpu)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// Cache simulation
+// ============================================================================
+// CacheModel is an AccessObserver that runs the fetch stream through a model of
+// an instruction cache and the load/store stream through a model of a data
+// cache, and counts how they would have done. it only watches: memory is read
+// and written exactly as without it, so registers and memory come out the same.
+//
+// each cache is set-associative with LRU replacement, allocates a line on every
+// miss (stores included, there's no write-around) and, as nothing is ever
+// written back, doesn't care whether a line is dirty. an access that straddles
+// two lines counts as an access to each of them. the machine file sets a cache
+// up with
+//
+//	{"icache": {"size": 4096, "line_size": 32, "ways": 2}}
+
+// CacheConfig is the geometry of a cache
+type CacheConfig struct {
+	Size     uint32 `json:"size"`      // bytes of data the cache holds
+	LineSize uint32 `json:"line_size"` // bytes per line, a power of two
+	Ways     uint32 `json:"ways"`      // lines per set (1 for direct-mapped, Size/LineSize for fully associative)
+}
+
+// sets is how many sets the cache has
+func (c CacheConfig) sets() uint32 {
+	return c.Size / (c.LineSize * c.Ways)
+}
+
+// Validate checks that the geometry describes a cache we can model
+func (c CacheConfig) Validate() error {
+	if c.Size == 0 || c.LineSize == 0 || c.Ways == 0 {
+		return fmt.Errorf("size %d, line size %d and ways %d must all be set", c.Size, c.LineSize, c.Ways)
+	}
+	if c.LineSize&(c.LineSize-1) != 0 {
+		return fmt.Errorf("line size %d is not a power of two", c.LineSize)
+	}
+	if c.Size%(c.LineSize*c.Ways) != 0 {
+		return fmt.Errorf("size %d is not a multiple of %d ways of %d-byte lines", c.Size, c.Ways, c.LineSize)
+	}
+	if sets := c.sets(); sets&(sets-1) != 0 {
+		return fmt.Errorf("%d sets is not a power of two", sets)
+	}
+	return nil
+}
+
+func (c CacheConfig) String() string {
+	return fmt.Sprintf("%d:%d:%d", c.Size, c.LineSize, c.Ways)
+}
+
+// parseCacheConfig parses size:line_size:ways, e.g. 4096:32:2
+func parseCacheConfig(s string) (CacheConfig, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return CacheConfig{}, fmt.Errorf("%q is not size:line_size:ways", s)
+	}
+	var fields [3]uint32
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 0, 32)
+		if err != nil {
+			return CacheConfig{}, fmt.Errorf("bad number %q in %q", p, s)
+		}
+		fields[i] = uint32(v)
+	}
+	c := CacheConfig{Size: fields[0], LineSize: fields[1], Ways: fields[2]}
+	return c, c.Validate()
+}
+
+// CacheStats are the totals of a Cache
+type CacheStats struct {
+	Accesses  uint64 `json:"accesses"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"` // misses that replaced a valid line
+}
+
+// MissRate is the fraction of accesses that missed
+func (s CacheStats) MissRate() float64 {
+	if s.Accesses == 0 {
+		return 0
+	}
+	return float64(s.Misses) / float64(s.Accesses)
+}
+
+func (s CacheStats) String() string {
+	return fmt.Sprintf("%d accesses, %d hits, %d misses (%.2f%% miss rate), %d evictions",
+		s.Accesses, s.Hits, s.Misses, 100*s.MissRate(), s.Evictions)
+}
+
+// Cache is the model of one cache
+type Cache struct {
+	cfg   CacheConfig
+	stats CacheStats
+	lines []cacheLine // set after set, Ways lines each
+	clock uint64      // counts accesses, to find the least recently used line
+}
+
+type cacheLine struct {
+	valid bool
+	tag   uint32 // the line number (address / line size), which is unique across sets
+	used  uint64 // the clock of the last access
+}
+
+// NewCache creates an empty cache with the geometry cfg
+func NewCache(cfg CacheConfig) (*Cache, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &Cache{cfg: cfg, lines: make([]cacheLine, cfg.Size/cfg.LineSize)}, nil
+}
+
+// Stats returns the totals so far
+func (c *Cache) Stats() CacheStats {
+	return c.stats
+}
+
+// Access looks up the lines covering [addr, addr+size), filling any that miss
+func (c *Cache) Access(addr, size uint32) {
+	first := addr / c.cfg.LineSize
+	last := (uint64(addr) + uint64(max(size, 1)) - 1) / uint64(c.cfg.LineSize)
+	for line := uint64(first); line <= last; line++ {
+		c.accessLine(uint32(line))
+	}
+}
+
+// accessLine looks up the line with number tag
+func (c *Cache) accessLine(tag uint32) {
+	c.clock++
+	c.stats.Accesses++
+	set := tag & (c.cfg.sets() - 1)
+	ways := c.lines[set*c.cfg.Ways : (set+1)*c.cfg.Ways]
+	victim := 0
+	for i := range ways {
+		if ways[i].valid && ways[i].tag == tag {
+			ways[i].used = c.clock
+			c.stats.Hits++
+			return
+		}
+		// an invalid line is always the victim, otherwise the least recently used one
+		if ways[victim].valid && (!ways[i].valid || ways[i].used < ways[victim].used) {
+			victim = i
+		}
+	}
+	c.stats.Misses++
+	if ways[victim].valid {
+		c.stats.Evictions++
+	}
+	ways[victim] = cacheLine{valid: true, tag: tag, used: c.clock}
+}
+
+// CacheModel feeds a CPU's accesses to an instruction and a data cache; install it as the CPU's Observer
+type CacheModel struct {
+	I *Cache // sees the fetches, nil for no instruction cache
+	D *Cache // sees the loads and stores, nil for no data cache
+}
+
+// NewCacheModel creates a model with the caches that have a configuration (nil leaves one out)
+func NewCacheModel(icache, dcache *CacheConfig) (*CacheModel, error) {
+	m := &CacheModel{}
+	var err error
+	if icache != nil {
+		if m.I, err = NewCache(*icache); err != nil {
+			return nil, fmt.Errorf("icache: %w", err)
+		}
+	}
+	if dcache != nil {
+		if m.D, err = NewCache(*dcache); err != nil {
+			return nil, fmt.Errorf("dcache: %w", err)
+		}
+	}
+	return m, nil
+}
+
+func (m *CacheModel) Access(kind AccessKind, addr, size uint32) {
+	c := m.D
+	if kind == AccessFetch {
+		c = m.I
+	}
+	if c != nil {
+		c.Access(addr, size)
+	}
+}
+
+// CacheReport is what RunReport has to say about the caches
+type CacheReport struct {
+	ICache *CacheStats `json:"icache,omitempty"`
+	DCache *CacheStats `json:"dcache,omitempty"`
+}
+
+// Report returns the totals of the caches the model has
+func (m *CacheModel) Report() CacheReport {
+	var r CacheReport
+	if m.I != nil {
+		stats := m.I.Stats()
+		r.ICache = &stats
+	}
+	if m.D != nil {
+		stats := m.D.Stats()
+		r.DCache = &stats
+	}
+	return r
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+// stridedLoads loads 8 words stride bytes apart from 0x800, in a four-instruction loop at 0xC
+func stridedLoads(stride int32) func(b *Builder) {
+	return func(b *Builder) {
+		b.Li(T0, 0x800) // lui + addi
+		b.Li(T1, 8)
+		b.Label("loop")
+		b.Lw(A0, T0, 0)
+		b.Addi(T0, T0, stride)
+		b.Addi(T1, T1, -1)
+		b.Bnez(T1, "loop")
+		b.Ebreak()
+	}
+}
+
+func TestCacheModel(t *testing.T) {
+	for _, tt := range []struct {
+		stride int32
+		d      CacheStats
+	}{
+		// four loads to each of two lines, the first to each missing
+		{4, CacheStats{Accesses: 8, Hits: 6, Misses: 2}},
+		// a new line each time, and lines 64 bytes apart go to sets 0 and 4 by turns, so each
+		// of those two sets has its two ways filled and then evicted twice
+		{64, CacheStats{Accesses: 8, Misses: 8, Evictions: 4}},
+	} {
+		model, err := NewCacheModel(&CacheConfig{Size: 256, LineSize: 16, Ways: 1}, &CacheConfig{Size: 256, LineSize: 16, Ways: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cpu := NewCPUWithMemory(0x1000)
+		cpu.LoadProgram(assemble(t, stridedLoads(tt.stride)))
+		cpu.Observer = model
+		runToEbreak(t, &cpu)
+
+		// 3 fetches before the loop, 8 times round its 4 and the ebreak, from the
+		// lines at 0x0 and 0x10: the first fetch from each misses and the rest hit
+		if want := (CacheStats{Accesses: 36, Hits: 34, Misses: 2}); model.I.Stats() != want {
+			t.Errorf("stride %d: icache %v, want %v", tt.stride, model.I.Stats(), want)
+		}
+		if model.D.Stats() != tt.d {
+			t.Errorf("stride %d: dcache %v, want %v", tt.stride, model.D.Stats(), tt.d)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ============================================================================
+// Time base and the CLINT (core-local interruptor)
+// ============================================================================
+// mtime counts at TimebaseHz. where its ticks come from is the time source:
+//   - TimeWallClock: host time elapsed since the CPU was created (the default;
+//     timer-driven programs behave like on hardware, but runs aren't reproducible),
+//     optionally scaled to run faster or slower than the host clock
+//   - TimeInstructions: a number of ticks every so many retired instructions, or
+//     cycles with a cycle model; one tick per instruction unless configured
+//     otherwise (forced by WithDeterministic)
+//
+// the machine file picks the source and its rate, e.g. 25 ticks every 10 instructions:
+//
+//	{"time": {"source": "instructions", "increment": 25, "every": 10}}
+
+// TimebaseHz is the frequency mtime counts at (the same as qemu's virt machine)
+const TimebaseHz = 10_000_000
+
+// TimeSource selects what makes mtime advance
+type TimeSource int
+
+const (
+	TimeWallClock TimeSource = iota
+	TimeInstructions
+)
+
+// TimeBase is how mtime advances; fields left zero mean 1
+type TimeBase struct {
+	Source    string  `json:"source"`    // "wall" (the default) or "instructions"
+	Increment uint64  `json:"increment"` // instructions: ticks added every Every instructions
+	Every     uint64  `json:"every"`     // instructions: retired instructions (or cycles) per increment
+	Scale     float64 `json:"scale"`     // wall: how many times faster than the host clock mtime runs
+}
+
+// Validate checks that the time base is one we can provide
+func (t TimeBase) Validate() error {
+	switch t.Source {
+	case "", "wall":
+		if t.Increment != 0 || t.Every != 0 {
+			return errors.New("increment and every only apply to the instructions time source")
+		}
+	case "instructions":
+		if t.Scale != 0 {
+			return errors.New("scale only applies to the wall time source")
+		}
+	default:
+		return fmt.Errorf("unknown time source %q (want wall or instructions)", t.Source)
+	}
+	if t.Scale < 0 {
+		return fmt.Errorf("time scale %g is negative", t.Scale)
+	}
+	return nil
+}
+
+// WithTimeBase makes mtime advance as t says (WithDeterministic still forces the
+// instructions source, at t's rate). t must be valid
+func WithTimeBase(t TimeBase) Option {
+	return func(cpu *CPU) {
+		if t.Source == "instructions" {
+			cpu.timeSource = TimeInstructions
+		}
+		cpu.timeIncrement = max(t.Increment, 1)
+		cpu.timeEvery = max(t.Every, 1)
+		cpu.timeScale = 1
+		if t.Scale != 0 {
+			cpu.timeScale = t.Scale
+		}
+	}
+}
+
+// Time returns the current value of mtime
+func (cpu *CPU) Time() uint64 {
+	var ticks uint64
+	switch cpu.timeSource {
+	case TimeInstructions:
+		n := cpu.Retired
+		if cpu.cycleModel != nil {
+			n = cpu.Cycles
+		}
+		ticks = n / cpu.timeEvery * cpu.timeIncrement
+	default:
+		// one tick is a whole number of nanoseconds; dividing by it (rather than
+		// multiplying by TimebaseHz first) can't overflow
+		elapsed := float64(time.Since(cpu.startTime)) * cpu.timeScale
+		ticks = uint64(elapsed) / (uint64(time.Second) / TimebaseHz)
+	}
+	return uint64(int64(ticks) + cpu.timeAdjust)
+}
+
+// setTime makes mtime read as value from now on (guests may write mtime)
+func (cpu *CPU) setTime(value uint64) {
+	cpu.timeAdjust += int64(value) - int64(cpu.Time())
+}
+
+// register offsets inside the CLINT window (the SiFive layout every emulator uses)
+const (
+	clintMsip     = 0x0000
+	clintMtimecmp = 0x4000
+	clintMtime    = 0xBFF8
+	ClintSize     = 0x10000
+)
+
+// CLINT provides mtime, mtimecmp (raising the machine timer interrupt when mtime >= mtimecmp)
+// and msip (the machine software interrupt) for a single hart
+type CLINT struct {
+	cpu      *CPU
+	msip     uint32
+	mtimecmp uint64
+}
+
+// NewCLINT creates the CLINT of cpu; mtimecmp starts at its maximum so the timer doesn't fire until programmed
+func NewCLINT(cpu *CPU) *CLINT {
+	return &CLINT{cpu: cpu, mtimecmp: ^uint64(0)}
+}
+
+func (c *CLINT) Read(offset, size uint32) (uint32, error) {
+	var reg [8]byte
+	var base uint32
+	switch {
+	case offset < clintMsip+4:
+		binary.LittleEndian.PutUint32(reg[:], c.msip)
+		base = clintMsip
+	case offset >= clintMtimecmp && offset < clintMtimecmp+8:
+		binary.LittleEndian.PutUint64(reg[:], c.mtimecmp)
+		base = clintMtimecmp
+	case offset >= clintMtime && offset < clintMtime+8:
+		binary.LittleEndian.PutUint64(reg[:], c.cpu.Time())
+		base = clintMtime
+	default:
+		return 0, nil // unused space reads as zero
+	}
+	return readBytes(reg[offset-base:], size)
+}
+
+func (c *CLINT) Write(offset, size, value uint32) error {
+	var reg [8]byte
+	switch {
+	case offset < clintMsip+4:
+		binary.LittleEndian.PutUint32(reg[:], c.msip)
+		writeBytes(reg[offset-clintMsip:], size, value)
+		c.msip = binary.LittleEndian.Uint32(reg[:]) & 1
+		c.cpu.SetInterruptPending(InterruptSoftware, c.msip != 0)
+	case offset >= clintMtimecmp && offset < clintMtimecmp+8:
+		binary.LittleEndian.PutUint64(reg[:], c.mtimecmp)
+		writeBytes(reg[offset-clintMtimecmp:], size, value)
+		c.mtimecmp = binary.LittleEndian.Uint64(reg[:])
+		c.Tick(c.cpu)
+	case offset >= clintMtime && offset < clintMtime+8:
+		binary.LittleEndian.PutUint64(reg[:], c.cpu.Time())
+		writeBytes(reg[offset-clintMtime:], size, value)
+		c.cpu.setTime(binary.LittleEndian.Uint64(reg[:]))
+		c.Tick(c.cpu)
+	}
+	return nil
+}
+
+// Tick raises or clears the timer interrupt
+func (c *CLINT) Tick(cpu *CPU) {
+	cpu.SetInterruptPending(InterruptTimer, cpu.Time() >= c.mtimecmp)
+}
+
+// readBytes reads a little-endian value of size bytes from the start of b
+func readBytes(b []byte, size uint32) (uint32, error) {
+	if uint32(len(b)) < size {
+		return 0, fmt.Errorf("%d-byte access crosses a register boundary", size)
+	}
+	var v uint32
+	for i := int(size) - 1; i >= 0; i-- {
+		v = v<<8 | uint32(b[i])
+	}
+	return v, nil
+}
+
+// writeBytes stores the low size bytes of value at the start of b (truncated to b)
+func writeBytes(b []byte, size, value uint32) {
+	for i := uint32(0); i < size && int(i) < len(b); i++ {
+		b[i] = byte(value >> (8 * i))
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTimeAfterLongRuns(t *testing.T) {
+	for _, tt := range []struct {
+		elapsed time.Duration
+		scale   float64
+	}{
+		{time.Hour, 1},
+		{24 * time.Hour, 1},
+		{time.Hour, 1000}, // 1000 hours of scaled time
+	} {
+		cpu := NewCPU(WithTimeBase(TimeBase{Scale: tt.scale}))
+		cpu.startTime = time.Now().Add(-tt.elapsed)
+		want := uint64(tt.elapsed.Seconds() * tt.scale * TimebaseHz)
+		if got := cpu.Time(); got < want || got > want+uint64(TimebaseHz*tt.scale) {
+			t.Errorf("after %v at scale %v: mtime = %d, want about %d", tt.elapsed, tt.scale, got, want)
+		}
+	}
+}
+
+// timerProgram takes five timer interrupts, 40 ticks apart, while it reads the
+// RTC, the entropy device and the UART, then stops at an ebreak
+func timerProgram(b *Builder) {
+	b.J("start")
+
+	b.Label("handler") // at 4
+	b.Addi(S3, S3, 1)
+	b.Lw(T0, S1, 0)
+	b.Addi(T0, T0, 40)
+	b.Sw(T0, S2, 0)
+	b.Mret()
+
+	b.Label("start")
+	b.Li(T0, 4)
+	b.Csrrw(ZERO, CSR_MTVEC, T0)
+	b.Li(S1, 0x02000000+clintMtime)
+	b.Li(S2, 0x02000000+clintMtimecmp)
+	b.Lw(T0, S1, 0)
+	b.Addi(T0, T0, 40)
+	b.Sw(T0, S2, 0)
+	b.Sw(ZERO, S2, 4)
+	b.Li(T0, 0x80) // MTIE
+	b.Csrrs(ZERO, CSR_MIE, T0)
+	b.Li(T0, 0x8) // MIE
+	b.Csrrs(ZERO, CSR_MSTATUS, T0)
+
+	b.Label("loop")
+	b.Li(T1, 0x10001000) // RTC
+	b.Lw(T2, T1, 0)
+	b.Li(T1, 0x10002000) // entropy
+	b.Lw(T3, T1, 0)
+	b.Li(T1, 0x10000000) // UART
+	b.Lbu(T4, T1, uartLSR)
+	b.Andi(T4, T4, uartLSRDR)
+	b.Beqz(T4, "next")
+	b.Lbu(T5, T1, uartRBR)
+	b.Label("next")
+	b.Li(T0, 5)
+	b.Blt(S3, T0, "loop")
+	b.Ebreak()
+}
+
+// deterministicTrace runs timerProgram with WithDeterministic(seed) and returns its JSONL trace
+func deterministicTrace(t *testing.T, seed uint64) []byte {
+	t.Helper()
+	cpu, err := DefaultMachine().NewCPU(
+		WithDeterministic(seed),
+		WithConsole(nil, &bytes.Buffer{}),
+		WithUARTSchedule(UARTInput{At: 30, Data: []byte("ab")}, UARTInput{At: 120, Data: []byte("c")}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.LoadProgram(assemble(t, timerProgram))
+	var trace bytes.Buffer
+	if cpu.Tracer, err = NewTracer("jsonl", &trace); err != nil {
+		t.Fatal(err)
+	}
+	reason, err := cpu.Run(100_000)
+	if err != nil || reason != StopBreakpoint {
+		t.Fatalf("stopped with %v, %v; want the ebreak", reason, err)
+	}
+	if cpu.Regs[S3] != 5 {
+		t.Fatalf("%d timer interrupts, want 5", cpu.Regs[S3])
+	}
+	if cpu.Regs[T5] != 'c' {
+		t.Fatalf("last byte received %q, want 'c'", cpu.Regs[T5])
+	}
+	return trace.Bytes()
+}
+
+func TestDeterministicTraces(t *testing.T) {
+	first, second := deterministicTrace(t, 42), deterministicTrace(t, 42)
+	if !bytes.Equal(first, second) {
+		t.Errorf("two runs with the same seed traced differently (%d and %d bytes)", len(first), len(second))
+	}
+	if bytes.Equal(first, deterministicTrace(t, 43)) {
+		t.Error("a different seed gave the same trace; the entropy device isn't seeded")
+	}
+}
+
+// with instruction-driven time, the rate mtime advances at decides when a timer
+// interrupt for mtime 100 comes: the handler reads minstret into a1 and stops
+func TestTimeBaseRate(t *testing.T) {
+	program := assemble(t, func(b *Builder) {
+		b.J("start")
+
+		b.Label("handler") // at 4
+		b.Csrrs(A1, CSR_MINSTRET, ZERO)
+		b.Ebreak()
+
+		b.Label("start")
+		b.Li(T0, 4)
+		b.Csrrw(ZERO, CSR_MTVEC, T0)
+		b.Li(S2, 0x02000000+clintMtimecmp)
+		b.Li(T0, 100)
+		b.Sw(T0, S2, 0)
+		b.Sw(ZERO, S2, 4)
+		b.Li(T0, 0x80) // MTIE
+		b.Csrrs(ZERO, CSR_MIE, T0)
+		b.Li(T0, 0x8) // MIE
+		b.Csrrs(ZERO, CSR_MSTATUS, T0)
+
+		b.Label("loop")
+		b.Addi(A0, A0, 1)
+		b.J("loop")
+	})
+	for _, tt := range []struct {
+		increment, every uint64
+		minstret         uint32
+	}{
+		{1, 1, 100},
+		{25, 10, 40}, // 2.5 ticks an instruction, in steps of 25
+		{1, 4, 400},
+		{3, 1, 34}, // mtime 102
+	} {
+		machine := DefaultMachine()
+		machine.Time = &TimeBase{Source: "instructions", Increment: tt.increment, Every: tt.every}
+		// one instruction at a time, so the interrupt isn't held back to the end of a block
+		cpu, err := machine.NewCPU(WithoutBlockCache())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cpu.LoadProgram(program)
+		runToEbreak(t, cpu)
+		if cpu.Regs[A1] != tt.minstret {
+			t.Errorf("%d ticks every %d instructions: the interrupt came after %d instructions, want %d", tt.increment, tt.every, cpu.Regs[A1], tt.minstret)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+)
+
+// ============================================================================
+// Cloning a machine
+// ============================================================================
+// Clone forks a CPU: the copy has its own registers, PC, CSRs, counters and
+// memory, so running it never changes the original (and vice versa).
+//
+// what is shared rather than copied:
+//   - Tracer, Observer, Logger, EcallHook and EbreakHook: they're called with the clone, but
+//     any state they keep themselves (e.g. the program break of NewlibSyscalls) is
+//     the same for both machines. install fresh ones on the clone if that matters
+//   - the writer UART output goes to
+//
+// devices are copied through Cloner. all the built-in ones implement it; the UART
+// copy keeps its received and scheduled input but not a live input (which only
+// one goroutine can drain). a device that isn't a Cloner is replaced in the clone
+// by one that fails every access, so the original's device is never touched
+
+// Cloner is implemented by devices that can be copied along with their CPU.
+// CloneDevice returns an independent copy bound to cpu (the clone)
+type Cloner interface {
+	CloneDevice(cpu *CPU) Device
+}
+
+// Clone returns a fully independent copy of the machine
+func (cpu *CPU) Clone() *CPU {
+	clone := *cpu
+	clone.Memory = slices.Clone(cpu.Memory)
+	clone.RegNames = slices.Clone(cpu.RegNames)
+	clone.RegMap = maps.Clone(cpu.RegMap)
+	clone.console.schedule = slices.Clone(cpu.console.schedule)
+	clone.control = newRunControl()
+	clone.watchdog = nil
+	clone.breakpoints = maps.Clone(cpu.breakpoints)
+	clone.tracepoints = cloneTracepoints(cpu.tracepoints)
+	clone.custom = maps.Clone(cpu.custom)
+	clone.text = slices.Clone(cpu.text)
+	if cpu.dcache != nil {
+		clone.dcache = newDecodeCache(len(clone.Memory))
+		clone.dcache.base = cpu.dcache.base
+	}
+	if cpu.bcache != nil {
+		clone.bcache = newBlockCache()
+	}
+	if cpu.uninit != nil {
+		u := *cpu.uninit
+		u.written = slices.Clone(u.written)
+		clone.uninit = &u
+	}
+	if cpu.loops != nil {
+		l := *cpu.loops
+		clone.loops = &l
+	}
+	if cpu.stackGuard != nil {
+		g := *cpu.stackGuard
+		clone.stackGuard = &g
+	}
+
+	clone.devices = nil
+	clone.tickers = nil
+	clone.bootROM = nil
+	for _, m := range cpu.devices {
+		var dev Device = unclonedDevice{m.name}
+		if c, ok := m.dev.(Cloner); ok {
+			dev = c.CloneDevice(&clone)
+		}
+		// can't fail: the windows were already checked when attached to cpu
+		_ = clone.AttachDevice(m.name, m.base, m.size, dev)
+	}
+	return &clone
+}
+
+// cloneTracepoints copies the tracepoints, so changing the clone's doesn't
+// change the original's (the writers they print to are still shared)
+func cloneTracepoints(tracepoints map[int][]*Tracepoint) map[int][]*Tracepoint {
+	if tracepoints == nil {
+		return nil
+	}
+	clone := make(map[int][]*Tracepoint, len(tracepoints))
+	for addr, list := range tracepoints {
+		copies := make([]*Tracepoint, len(list))
+		for i, t := range list {
+			c := *t
+			c.parts = slices.Clone(t.parts)
+			copies[i] = &c
+		}
+		clone[addr] = copies
+	}
+	return clone
+}
+
+// unclonedDevice stands in for a device Clone couldn't copy
+type unclonedDevice struct{ name string }
+
+func (d unclonedDevice) Read(offset, size uint32) (uint32, error) {
+	return 0, fmt.Errorf("device %s was not cloned", d.name)
+}
+
+func (d unclonedDevice) Write(offset, size, value uint32) error {
+	return fmt.Errorf("device %s was not cloned", d.name)
+}
+
+func (c *CLINT) CloneDevice(cpu *CPU) Device {
+	clone := *c
+	clone.cpu = cpu
+	return &clone
+}
+
+func (u *UART) CloneDevice(cpu *CPU) Device {
+	clone := *u
+	clone.rx = slices.Clone(u.rx)
+	clone.schedule = slices.Clone(u.schedule)
+	clone.live = nil
+	return &clone
+}
+
+func (r *BootROM) CloneDevice(cpu *CPU) Device {
+	return &BootROM{base: r.base, image: slices.Clone(r.image)}
+}
+
+func (r *RTC) CloneDevice(cpu *CPU) Device {
+	clone := *r
+	clone.cpu = cpu
+	return &clone
+}
+
+func (r *RNG) CloneDevice(cpu *CPU) Device {
+	// both generators in use can save and restore their state
+	var src interface {
+		rand.Source
+		encoding.BinaryUnmarshaler
+	}
+	switch r.src.(type) {
+	case *rand.PCG:
+		src = new(rand.PCG)
+	case *rand.ChaCha8:
+		src = new(rand.ChaCha8)
+	default:
+		return unclonedDevice{"rng"}
+	}
+	state, err := r.src.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil || src.UnmarshalBinary(state) != nil {
+		return unclonedDevice{"rng"}
+	}
+	return &RNG{src: src}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+const cloneInput = 0x400 // where sumProgram reads its n
+
+// sumProgram adds up 1..n, rereading n from memory every iteration, and mixes in
+// a value from the entropy device each time; it stores the sum and stops at an ebreak
+func sumProgram(b *Builder) {
+	b.Li(S1, 0x10002000)
+	b.Label("loop")
+	b.Addi(T0, T0, 1)
+	b.Add(S0, S0, T0)
+	b.Lw(T2, S1, 0)
+	b.Xor(S2, S2, T2)
+	b.Lw(T1, ZERO, cloneInput)
+	b.Blt(T0, T1, "loop")
+	b.Sw(S0, ZERO, cloneInput+4)
+	b.Ebreak()
+}
+
+// newSumMachine loads sumProgram with input n
+func newSumMachine(t *testing.T, n uint32) *CPU {
+	t.Helper()
+	cpu, err := DefaultMachine().NewCPU(WithDeterministic(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.LoadProgram(assemble(t, sumProgram))
+	if err := cpu.Store(cloneInput, 4, n); err != nil {
+		t.Fatal(err)
+	}
+	return cpu
+}
+
+func TestCloneMidProgram(t *testing.T) {
+	control := newSumMachine(t, 10)
+	runToEbreak(t, control)
+
+	parent := newSumMachine(t, 10)
+	if _, err := parent.Run(20); err != nil {
+		t.Fatal(err)
+	}
+	clone := parent.Clone()
+	if err := clone.Store(cloneInput, 4, 20); err != nil {
+		t.Fatal(err)
+	}
+	runToEbreak(t, clone)
+	runToEbreak(t, parent)
+
+	if parent.Regs != control.Regs || parent.PC != control.PC || parent.Retired != control.Retired {
+		t.Errorf("parent: pc 0x%X, %d retired, regs %v\ncontrol: pc 0x%X, %d retired, regs %v", parent.PC, parent.Retired, parent.Regs, control.PC, control.Retired, control.Regs)
+	}
+	if !bytes.Equal(parent.Memory, control.Memory) {
+		t.Error("parent's memory differs from the control run's")
+	}
+	if parent.csrs != control.csrs {
+		t.Error("parent's CSRs differ from the control run's")
+	}
+	if sum, _ := parent.Load(cloneInput+4, 4); sum != 55 {
+		t.Errorf("parent's sum = %d, want 55", sum)
+	}
+	if sum, _ := clone.Load(cloneInput+4, 4); sum != 210 {
+		t.Errorf("clone's sum = %d, want 210", sum)
+	}
+	if clone.Regs[S2] == parent.Regs[S2] {
+		t.Error("the clone read the same entropy as the parent after drawing ten more values")
+	}
+}
+
+func TestCloneTracepoints(t *testing.T) {
+	parent := NewCPU()
+	var out bytes.Buffer
+	if _, err := parent.SetTracepoint(0x10, "", "first", &out); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parent.SetTracepoint(0x20, "a0 == 1", "a0 is {a0}", &out); err != nil {
+		t.Fatal(err)
+	}
+	before := tracepointStrings(parent.Tracepoints())
+
+	clone := parent.Clone()
+	if _, err := clone.SetTracepoint(0x10, "", "second", &out); err != nil {
+		t.Fatal(err)
+	}
+	clone.ClearTracepoints(0x20)
+	clone.Tracepoints()[0].Message = "changed"
+	clone.Tracepoints()[0].parts[0].text = "changed"
+
+	if after := tracepointStrings(parent.Tracepoints()); !slices.Equal(before, after) {
+		t.Errorf("changing the clone's tracepoints changed the parent's:\nbefore %q\nafter  %q", before, after)
+	}
+	if parent.tracepoints[0x10][0].parts[0].text != "first" {
+		t.Error("the parent's tracepoint message parts changed")
+	}
+	if got := len(clone.Tracepoints()); got != 2 {
+		t.Errorf("the clone has %d tracepoints, want 2", got)
+	}
+}
+
+func tracepointStrings(list []*Tracepoint) []string {
+	var s []string
+	for _, t := range list {
+		s = append(s, t.String())
+	}
+	return s
+}
+
+func TestCloneBreakpointsAndCustomOpcodes(t *testing.T) {
+	parent := NewCPU()
+	parent.SetBreakpoint(0x40)
+	handler := func(cpu *CPU, d DecodedInstruction) error { return nil }
+	if err := parent.RegisterCustomOpcode(CUSTOM_0, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	clone := parent.Clone()
+	clone.SetBreakpoint(0x80)
+	clone.RegisterCustomOpcode(CUSTOM_0, nil)
+	clone.Regs[A0] = 1
+	clone.Memory[0] = 0xFF
+
+	if len(parent.breakpoints) != 1 || parent.custom[CUSTOM_0] == nil {
+		t.Errorf("the parent has %d breakpoints and custom-0 handler %v after changing the clone's", len(parent.breakpoints), parent.custom[CUSTOM_0] != nil)
+	}
+	if parent.Regs[A0] != 0 || parent.Memory[0] != 0 {
+		t.Error("writing the clone's registers or memory changed the parent's")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// Pausing and inspecting a running CPU
+// ============================================================================
+// Run owns the CPU while it executes: nothing else may touch its state. another
+// goroutine (a UI, a status endpoint) gets access by pausing it:
+//
+//	cpu.Pause()   // returns once Run is stopped between two instructions
+//	... read or change the CPU ...
+//	cpu.Resume()
+//
+// or, for a quick look, cpu.Inspect(func(cpu *CPU) { ... }).
+// whoever paused the CPU has it to themselves until they resume it: a Pause or
+// Inspect on another goroutine waits for that, so two inspectors never see the
+// CPU at once (and a goroutine mustn't nest them). Resume may be called from a
+// different goroutine than its Pause. a paused CPU that isn't running stays
+// paused: a Run started meanwhile waits before its first instruction. never call
+// them from inside Run (a hook or a tracer): that deadlocks. only Run is paused,
+// a caller stepping the CPU itself (like the debugger) is its owner already
+//
+// breakpoints set with SetBreakpoint pause Run too: before executing an instruction at
+// a breakpoint, Run pauses itself as if Pause had been called, and continues with that
+// instruction once resumed (see ResumeBreakpoint). they're meant for a CPU driven from
+// elsewhere, like the control server; without anyone to resume it, Run waits forever
+
+// RunWithTimeout is Run with a wall-clock limit: once d has passed it stops at
+// the next instruction boundary (the next basic block's, when running blocks)
+// with StopTimeout, like it stops with StopLimit once maxInstructions have
+// retired, and the CPU can be run on from there. it bounds the time a harness
+// waits for a guest that keeps the host busy, e.g. with a slow trace writer;
+// an instruction that never returns (a hook or a tracer blocked for good) isn't
+// interrupted
+func (cpu *CPU) RunWithTimeout(maxInstructions uint64, d time.Duration) (StopReason, error) {
+	expired := new(atomic.Bool) // a new one each time, so a timer firing late can't stop the next run
+	timer := time.AfterFunc(d, func() { expired.Store(true) })
+	defer timer.Stop()
+	cpu.watchdog = expired
+	defer func() { cpu.watchdog = nil }()
+	return cpu.Run(maxInstructions)
+}
+
+// runControl is the synchronization between Run and Pause
+type runControl struct {
+	owner   sync.Mutex   // held from Pause to Resume, so paused access is exclusive
+	pauses  atomic.Int32 // outstanding holds: Pause calls, breakpoints and the control server's /pause
+	mu      sync.Mutex
+	cond    *sync.Cond // signalled when running or pauses change
+	running bool       // Run is between instructions it's allowed to execute
+	atBreak bool       // Run paused itself at a breakpoint
+}
+
+func newRunControl() *runControl {
+	c := &runControl{}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Pause stops Run at the next instruction boundary and blocks until it has
+// stopped and no other Pause is outstanding
+func (cpu *CPU) Pause() {
+	cpu.control.owner.Lock()
+	cpu.control.hold()
+}
+
+// Resume undoes Pause
+func (cpu *CPU) Resume() {
+	cpu.control.release()
+	cpu.control.owner.Unlock()
+}
+
+// Inspect pauses the CPU, calls f with exclusive access to it, and resumes it
+func (cpu *CPU) Inspect(f func(cpu *CPU)) {
+	cpu.Pause()
+	defer cpu.Resume()
+	f(cpu)
+}
+
+// hold keeps Run stopped (without exclusive access, which is Pause's job) and
+// waits until it is
+func (c *runControl) hold() {
+	c.pauses.Add(1)
+	c.mu.Lock()
+	for c.running {
+		c.cond.Wait()
+	}
+	c.mu.Unlock()
+}
+
+// release undoes one hold; Run continues once none is left
+func (c *runControl) release() {
+	c.mu.Lock()
+	if c.pauses.Add(-1) < 0 {
+		c.mu.Unlock()
+		panic("Resume without Pause")
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+// enter is called by Run before its first instruction
+func (c *runControl) enter() {
+	c.mu.Lock()
+	for c.pauses.Load() > 0 {
+		c.cond.Wait()
+	}
+	c.running = true
+	c.mu.Unlock()
+}
+
+// leave is called when Run returns
+func (c *runControl) leave() {
+	c.mu.Lock()
+	c.running = false
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+// checkpoint is called by Run between instructions; it parks while paused.
+// the common case (no Pause) is a single atomic load
+func (c *runControl) checkpoint() {
+	if c.pauses.Load() == 0 {
+		return
+	}
+	c.mu.Lock()
+	c.running = false
+	c.cond.Broadcast()
+	for c.pauses.Load() > 0 {
+		c.cond.Wait()
+	}
+	c.running = true
+	c.mu.Unlock()
+}
+
+// SetBreakpoint makes Run pause before executing the instruction at addr
+// (like everything else, only call it while Run is paused or not running)
+func (cpu *CPU) SetBreakpoint(addr int) {
+	if cpu.breakpoints == nil {
+		cpu.breakpoints = make(map[int]bool)
+	}
+	cpu.breakpoints[addr] = true
+}
+
+// ClearBreakpoint removes the breakpoint at addr
+func (cpu *CPU) ClearBreakpoint(addr int) {
+	delete(cpu.breakpoints, addr)
+}
+
+// Breakpoints lists the breakpoint addresses in increasing order
+func (cpu *CPU) Breakpoints() []int {
+	return slices.Sorted(maps.Keys(cpu.breakpoints))
+}
+
+// AtBreakpoint reports whether Run is paused at a breakpoint
+func (cpu *CPU) AtBreakpoint() bool {
+	c := cpu.control
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.atBreak
+}
+
+// ResumeBreakpoint lets Run continue after pausing at a breakpoint
+// (it does nothing if Run isn't paused at one)
+func (cpu *CPU) ResumeBreakpoint() {
+	c := cpu.control
+	c.mu.Lock()
+	if !c.atBreak {
+		c.mu.Unlock()
+		return
+	}
+	c.atBreak = false
+	c.mu.Unlock()
+	c.release()
+}
+
+// breakpoint is called by Run when the PC is at a breakpoint: it pauses until resumed
+func (c *runControl) breakpoint() {
+	c.mu.Lock()
+	c.atBreak = true
+	c.pauses.Add(1)
+	c.mu.Unlock()
+	c.checkpoint()
+}
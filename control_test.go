@@ -0,0 +1,214 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// spinProgram counts up in a0 forever, storing each value at 0x100
+func spinProgram(b *Builder) {
+	b.Label("loop")
+	b.Addi(A0, A0, 1)
+	b.Sw(A0, ZERO, 0x100)
+	b.J("loop")
+}
+
+// runInBackground starts Run on cpu and returns a channel with its result
+func runInBackground(cpu *CPU) <-chan StopReason {
+	done := make(chan StopReason, 1)
+	go func() {
+		reason, _ := cpu.Run(0)
+		done <- reason
+	}()
+	return done
+}
+
+// run with -race: the inspectors must never see the CPU at the same time as Run or each other
+func TestInspectRunningGuest(t *testing.T) {
+	cpu := NewCPU()
+	cpu.LoadProgram(assemble(t, spinProgram))
+	done := runInBackground(&cpu)
+
+	var active atomic.Int32
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := uint32(0)
+			for i := 0; i < 200; i++ {
+				cpu.Inspect(func(cpu *CPU) {
+					if n := active.Add(1); n != 1 {
+						t.Errorf("%d inspectors at once", n)
+					}
+					a0 := cpu.Regs[A0]
+					stored, _ := cpu.Load(0x100, 4)
+					if a0 < last {
+						t.Errorf("a0 went back from %d to %d", last, a0)
+					}
+					if stored != a0 && stored != a0-1 {
+						t.Errorf("a0 is %d but %d is stored", a0, stored)
+					}
+					last = a0
+					cpu.Regs[A1]++ // inspectors may write too
+					active.Add(-1)
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	cpu.Inspect(func(cpu *CPU) {
+		if cpu.Regs[A1] != 8*200 {
+			t.Errorf("a1 = %d, want %d increments", cpu.Regs[A1], 8*200)
+		}
+		if cpu.Regs[A0] == 0 {
+			t.Error("the guest never ran")
+		}
+		cpu.Halt(StopBreakpoint)
+	})
+	select {
+	case reason := <-done:
+		if reason != StopBreakpoint {
+			t.Errorf("Run stopped with %v, want the Halt's reason", reason)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't stop after Halt")
+	}
+}
+
+func TestPauseIsExclusive(t *testing.T) {
+	cpu := NewCPU()
+	cpu.Pause()
+	inspected := make(chan struct{})
+	go func() {
+		cpu.Inspect(func(*CPU) {})
+		close(inspected)
+	}()
+	select {
+	case <-inspected:
+		t.Fatal("Inspect ran while the CPU was paused by someone else")
+	case <-time.After(50 * time.Millisecond):
+	}
+	cpu.Resume()
+	<-inspected
+}
+
+func TestPausedRunWaits(t *testing.T) {
+	cpu := NewCPU()
+	cpu.LoadProgram(assemble(t, spinProgram))
+	cpu.Pause()
+	done := runInBackground(&cpu)
+	time.Sleep(20 * time.Millisecond)
+	if cpu.Retired != 0 {
+		t.Fatalf("Run executed %d instructions while paused", cpu.Retired)
+	}
+	cpu.Halt(StopBreakpoint)
+	cpu.Resume()
+	if reason := <-done; reason != StopBreakpoint {
+		t.Errorf("Run stopped with %v", reason)
+	}
+}
+
+func TestBreakpointPausesRun(t *testing.T) {
+	cpu := NewCPU()
+	cpu.LoadProgram(assemble(t, spinProgram))
+	cpu.SetBreakpoint(4) // the sw
+	done := runInBackground(&cpu)
+
+	for i := 0; i < 3; i++ {
+		deadline := time.Now().Add(10 * time.Second)
+		for !cpu.AtBreakpoint() {
+			if time.Now().After(deadline) {
+				t.Fatal("Run never reached the breakpoint")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		cpu.Inspect(func(cpu *CPU) {
+			if cpu.PC != 4 || cpu.Regs[A0] != uint32(i+1) {
+				t.Errorf("at the breakpoint pc = 0x%X, a0 = %d; want 0x4 and %d", cpu.PC, cpu.Regs[A0], i+1)
+			}
+		})
+		cpu.ResumeBreakpoint()
+	}
+
+	cpu.Inspect(func(cpu *CPU) {
+		cpu.ClearBreakpoint(4)
+		cpu.Halt(StopBreakpoint)
+	})
+	cpu.ResumeBreakpoint()
+	<-done
+}
+
+// slowTracer makes every instruction take a while, like a trace written to a slow disk
+type slowTracer struct{}
+
+func (slowTracer) Trace(cpu *CPU, pc int, instr uint32) { time.Sleep(20 * time.Microsecond) }
+
+// loopProgram spins forever, counting in a0
+func loopProgram(b *Builder) {
+	b.Label("loop")
+	b.Addi(A0, A0, 1)
+	b.J("loop")
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	const limit = 50 * time.Millisecond
+	for _, c := range []struct {
+		name   string
+		tracer Tracer
+	}{
+		{"blocks", nil},
+		{"slow tracer", slowTracer{}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cpu := NewCPU()
+			cpu.LoadProgram(assemble(t, loopProgram))
+			cpu.Tracer = c.tracer
+
+			start := time.Now()
+			reason, err := cpu.RunWithTimeout(0, limit)
+			elapsed := time.Since(start)
+			if err != nil || reason != StopTimeout {
+				t.Fatalf("RunWithTimeout = %v, %v; want a timeout", reason, err)
+			}
+			if elapsed < limit || elapsed > 10*limit {
+				t.Errorf("stopped after %v with a limit of %v", elapsed, limit)
+			}
+			if cpu.Retired == 0 || cpu.Regs[A0] != uint32(cpu.Retired+1)/2 || (cpu.PC != 0 && cpu.PC != 4) {
+				t.Errorf("stopped after %d instructions at pc 0x%X with a0 = %d", cpu.Retired, cpu.PC, cpu.Regs[A0])
+			}
+
+			// it stopped at an instruction boundary, and runs on from there
+			retired := cpu.Retired
+			if reason, err := cpu.Run(10); err != nil || reason != StopLimit || cpu.Retired != retired+10 {
+				t.Errorf("resuming: %v, %v, %d instructions", reason, err, cpu.Retired-retired)
+			}
+		})
+	}
+}
+
+func TestRunWithTimeoutBudget(t *testing.T) {
+	cpu := NewCPU()
+	cpu.LoadProgram(assemble(t, loopProgram))
+	if reason, _ := cpu.RunWithTimeout(1000, time.Hour); reason != StopLimit || cpu.Retired != 1000 {
+		t.Errorf("the budget: %v after %d instructions", reason, cpu.Retired)
+	}
+	// an earlier run's timer doesn't stop the next one
+	cpu.RunWithTimeout(0, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if reason, _ := cpu.Run(1000); reason != StopLimit {
+		t.Errorf("Run after a timed-out run stopped with %v", reason)
+	}
+}
+
+func TestRunTimeoutFlag(t *testing.T) {
+	image := writeTemp(t, "loop.bin", assemble(t, loopProgram))
+	code, stdout, _ := runCommand("run", "--timeout=50ms", "--trace", "--trace-out="+t.TempDir()+"/trace.log", image)
+	if code != 0 || !strings.HasPrefix(stdout, "stopped: timeout after ") {
+		t.Errorf("exit %d, stdout %q", code, stdout)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Control server
+// ============================================================================
+// ControlServer lets another process drive a running CPU over HTTP with JSON
+// bodies. every request is served inside Inspect, so it never races with Run.
+// there is no authentication: only serve it on a unix socket or a loopback
+// address you trust (ListenControl binds exactly where it's told).
+//
+//	POST   /pause                     pause Run until /resume
+//	POST   /resume                    undo /pause and continue from a breakpoint
+//	POST   /step        {"count": n}  execute n instructions (default 1), paused or not
+//	GET    /registers                 {"pc": ..., "zero": ..., "ra": ..., ...}
+//	GET    /registers/{name}          {"name": "a0", "value": 42}   (name is an ABI name or pc)
+//	PUT    /registers/{name}          {"value": 42}
+//	GET    /memory?addr=A&len=N       {"addr": A, "data": "<base64>"}
+//	PUT    /memory                    {"addr": A, "data": "<base64>"}
+//	GET    /breakpoints               {"breakpoints": [addr, ...]}
+//	PUT    /breakpoints/{addr}        set a breakpoint (Run pauses there, see SetBreakpoint)
+//	DELETE /breakpoints/{addr}
+//	GET    /stats                     see ControlStats
+//
+// errors come back as {"error": "..."} with a 4xx status
+
+// maxControlRead limits the size of a single /memory read
+const maxControlRead = 1 << 20
+
+// ControlServer is an http.Handler controlling one CPU
+type ControlServer struct {
+	cpu   *CPU
+	mux   *http.ServeMux
+	start time.Time
+
+	mu     sync.Mutex
+	pauses int // holds made by /pause and not released yet
+}
+
+// ControlStats is the body of GET /stats
+type ControlStats struct {
+	PC           uint32  `json:"pc"`
+	Retired      uint64  `json:"retired"`
+	Cycles       uint64  `json:"cycles"` // mcycle
+	Paused       bool    `json:"paused"`
+	AtBreakpoint bool    `json:"at_breakpoint"`
+	Exited       bool    `json:"exited"`
+	ExitCode     int     `json:"exit_code"`
+	Uptime       float64 `json:"uptime_seconds"`
+	MIPS         float64 `json:"mips"` // average since the server started
+}
+
+// NewControlServer creates the control server of cpu
+func NewControlServer(cpu *CPU) *ControlServer {
+	s := &ControlServer{cpu: cpu, mux: http.NewServeMux(), start: time.Now()}
+	s.mux.HandleFunc("POST /pause", s.pause)
+	s.mux.HandleFunc("POST /resume", s.resume)
+	s.mux.HandleFunc("POST /step", s.step)
+	s.mux.HandleFunc("GET /registers", s.registers)
+	s.mux.HandleFunc("GET /registers/{name}", s.register)
+	s.mux.HandleFunc("PUT /registers/{name}", s.setRegister)
+	s.mux.HandleFunc("GET /memory", s.memory)
+	s.mux.HandleFunc("PUT /memory", s.setMemory)
+	s.mux.HandleFunc("GET /breakpoints", s.breakpoints)
+	s.mux.HandleFunc("PUT /breakpoints/{addr}", s.setBreakpoint)
+	s.mux.HandleFunc("DELETE /breakpoints/{addr}", s.clearBreakpoint)
+	s.mux.HandleFunc("GET /stats", s.stats)
+	return s
+}
+
+func (s *ControlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenControl listens on addr: "unix:<path>" for a unix socket, otherwise a TCP host:port
+// (--gdb listens with it too)
+func ListenControl(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return net.Listen("unix", path)
+	}
+	if host, _, err := net.SplitHostPort(addr); err != nil || host == "" {
+		return nil, fmt.Errorf("address %q needs an explicit host (e.g. 127.0.0.1:7000) or unix:<path>", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// /pause keeps Run stopped without taking the CPU for itself (as Pause would),
+// so the requests that follow it can still get in with Inspect
+func (s *ControlServer) pause(w http.ResponseWriter, r *http.Request) {
+	s.cpu.control.hold()
+	s.mu.Lock()
+	s.pauses++
+	s.mu.Unlock()
+	writeJSON(w, map[string]bool{"paused": true})
+}
+
+func (s *ControlServer) resume(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	for ; s.pauses > 0; s.pauses-- {
+		s.cpu.control.release()
+	}
+	s.mu.Unlock()
+	s.cpu.ResumeBreakpoint()
+	writeJSON(w, map[string]bool{"paused": false})
+}
+
+func (s *ControlServer) step(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Count uint64 `json:"count"`
+	}{Count: 1}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	var err error
+	var stats ControlStats
+	s.cpu.Inspect(func(cpu *CPU) {
+		for n := uint64(0); n < req.Count && !cpu.Exited && err == nil; n++ {
+			err = cpu.Step()
+		}
+		stats = s.collectStats(cpu)
+	})
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+func (s *ControlServer) registers(w http.ResponseWriter, r *http.Request) {
+	regs := make(map[string]uint32, len(s.cpu.Regs)+1)
+	s.cpu.Inspect(func(cpu *CPU) {
+		for i, name := range cpu.RegNames {
+			regs[name] = cpu.Regs[i]
+		}
+		regs["pc"] = uint32(cpu.PC)
+	})
+	writeJSON(w, regs)
+}
+
+func (s *ControlServer) register(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var value uint32
+	var err error
+	s.cpu.Inspect(func(cpu *CPU) {
+		if name == "pc" {
+			value = uint32(cpu.PC)
+			return
+		}
+		value, err = cpu.GetRegisterValue(name)
+	})
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, map[string]any{"name": name, "value": value})
+}
+
+func (s *ControlServer) setRegister(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var req struct {
+		Value *uint32 `json:"value"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Value == nil {
+		writeError(w, http.StatusBadRequest, errors.New("missing value"))
+		return
+	}
+	var err error
+	s.cpu.Inspect(func(cpu *CPU) {
+		if name == "pc" {
+			cpu.PC = int(*req.Value)
+			return
+		}
+		err = cpu.SetRegisterValue(name, *req.Value)
+	})
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, map[string]any{"name": name, "value": *req.Value})
+}
+
+func (s *ControlServer) memory(w http.ResponseWriter, r *http.Request) {
+	addr, err := parseAddress(r.URL.Query().Get("addr"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	n, err := strconv.ParseUint(r.URL.Query().Get("len"), 0, 32)
+	if err != nil || n > maxControlRead {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("len must be a number up to %d", maxControlRead))
+		return
+	}
+	var data []byte
+	s.cpu.Inspect(func(cpu *CPU) {
+		data, err = cpu.ReadMemory(addr, uint32(n))
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, map[string]any{"addr": addr, "data": base64.StdEncoding.EncodeToString(data)})
+}
+
+func (s *ControlServer) setMemory(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Addr uint32 `json:"addr"`
+		Data []byte `json:"data"` // encoding/json reads []byte as base64
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	var err error
+	s.cpu.Inspect(func(cpu *CPU) {
+		err = cpu.WriteMemory(req.Addr, req.Data)
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, map[string]any{"addr": req.Addr, "len": len(req.Data)})
+}
+
+func (s *ControlServer) breakpoints(w http.ResponseWriter, r *http.Request) {
+	addrs := []int{} // an empty list rather than null
+	s.cpu.Inspect(func(cpu *CPU) {
+		addrs = append(addrs, cpu.Breakpoints()...)
+	})
+	writeJSON(w, map[string][]int{"breakpoints": addrs})
+}
+
+func (s *ControlServer) setBreakpoint(w http.ResponseWriter, r *http.Request) {
+	addr, err := parseAddress(r.PathValue("addr"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.cpu.Inspect(func(cpu *CPU) {
+		cpu.SetBreakpoint(int(addr))
+	})
+	s.breakpoints(w, r)
+}
+
+func (s *ControlServer) clearBreakpoint(w http.ResponseWriter, r *http.Request) {
+	addr, err := parseAddress(r.PathValue("addr"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.cpu.Inspect(func(cpu *CPU) {
+		cpu.ClearBreakpoint(int(addr))
+	})
+	s.breakpoints(w, r)
+}
+
+func (s *ControlServer) stats(w http.ResponseWriter, r *http.Request) {
+	var stats ControlStats
+	s.cpu.Inspect(func(cpu *CPU) {
+		stats = s.collectStats(cpu)
+	})
+	writeJSON(w, stats)
+}
+
+// collectStats must be called with exclusive access to cpu
+func (s *ControlServer) collectStats(cpu *CPU) ControlStats {
+	s.mu.Lock()
+	paused := s.pauses > 0
+	s.mu.Unlock()
+	uptime := time.Since(s.start).Seconds()
+	return ControlStats{
+		PC:           uint32(cpu.PC),
+		Retired:      cpu.Retired,
+		Cycles:       cpu.cycles(),
+		Paused:       paused,
+		AtBreakpoint: cpu.AtBreakpoint(),
+		Exited:       cpu.Exited,
+		ExitCode:     cpu.ExitCode,
+		Uptime:       uptime,
+		MIPS:         float64(cpu.Retired) / uptime / 1e6,
+	}
+}
+
+// readJSON decodes the request body into v (an empty body leaves v as it is),
+// answering with an error and returning false if it isn't valid
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad request body: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
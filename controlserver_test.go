@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// controlRequest sends a request to the control server at url and decodes the JSON answer into out
+func controlRequest(t *testing.T, method, url, body string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: %v in %q", method, url, err, data)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestControlServerStepAndRead(t *testing.T) {
+	cpu := NewCPU()
+	cpu.LoadProgram(assemble(t, spinProgram))
+	server := httptest.NewServer(NewControlServer(&cpu))
+	defer server.Close()
+	done := runInBackground(&cpu)
+
+	var paused map[string]bool
+	controlRequest(t, "POST", server.URL+"/pause", "", &paused)
+	var before struct{ Value uint32 }
+	controlRequest(t, "GET", server.URL+"/registers/a0", "", &before)
+
+	// three instructions from wherever Run stopped include exactly one addi
+	var stats ControlStats
+	if code := controlRequest(t, "POST", server.URL+"/step", `{"count": 3}`, &stats); code != http.StatusOK || !stats.Paused {
+		t.Fatalf("/step: status %d, stats %+v", code, stats)
+	}
+	var after struct {
+		Name  string
+		Value uint32
+	}
+	controlRequest(t, "GET", server.URL+"/registers/a0", "", &after)
+	if after.Name != "a0" || after.Value != before.Value+1 {
+		t.Errorf("a0 went from %d to %d (%+v) over three instructions, want one increment", before.Value, after.Value, after)
+	}
+
+	var regs map[string]uint32
+	controlRequest(t, "GET", server.URL+"/registers", "", &regs)
+	if regs["a0"] != after.Value || regs["pc"] != stats.PC {
+		t.Errorf("/registers: a0 %d, pc 0x%X; want %d and 0x%X", regs["a0"], regs["pc"], after.Value, stats.PC)
+	}
+
+	controlRequest(t, "PUT", server.URL+"/registers/a0", `{"value": 1000}`, nil)
+	controlRequest(t, "PUT", server.URL+"/registers/pc", `{"value": 0}`, nil)
+	controlRequest(t, "POST", server.URL+"/step", `{"count": 2}`, nil)
+	var mem struct{ Data []byte }
+	controlRequest(t, "GET", server.URL+"/memory?addr=0x100&len=4", "", &mem)
+	if !bytes.Equal(mem.Data, []byte{0xE9, 0x03, 0, 0}) {
+		t.Errorf("memory at 0x100 = % X, want 1001", mem.Data)
+	}
+
+	var errBody map[string]string
+	if code := controlRequest(t, "GET", server.URL+"/registers/q7", "", &errBody); code != http.StatusNotFound || errBody["error"] == "" {
+		t.Errorf("unknown register: status %d, body %v", code, errBody)
+	}
+
+	controlRequest(t, "POST", server.URL+"/resume", "", nil)
+	cpu.Inspect(func(cpu *CPU) { cpu.Halt(StopBreakpoint) })
+	<-done
+}
+
+// run with -race: steps and reads from concurrent requests must be serialized with each other and Run
+func TestControlServerConcurrentRequests(t *testing.T) {
+	cpu := NewCPU()
+	cpu.LoadProgram(assemble(t, spinProgram))
+	server := httptest.NewServer(NewControlServer(&cpu))
+	defer server.Close()
+	done := runInBackground(&cpu)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if code := controlRequest(t, "POST", server.URL+"/step", `{"count": 5}`, nil); code != http.StatusOK {
+					t.Errorf("/step: status %d", code)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				var regs map[string]uint32
+				controlRequest(t, "GET", server.URL+"/registers", "", &regs)
+				if regs["pc"] > 8 {
+					t.Errorf("pc 0x%X is outside the program", regs["pc"])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	cpu.Inspect(func(cpu *CPU) { cpu.Halt(StopBreakpoint) })
+	<-done
+}
+
+func TestRunWithControlServer(t *testing.T) {
+	image := writeTemp(t, "spin.bin", assemble(t, spinProgram))
+	socket := filepath.Join(t.TempDir(), "control.sock")
+	code, stdout, stderr := runCommand("run", "--control", "unix:"+socket, "--max-instructions=100000", image)
+	if code != 0 || !strings.HasPrefix(stdout, "stopped: instruction limit after 100000 instructions") {
+		t.Errorf("exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+}
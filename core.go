@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ============================================================================
+// Core dumps
+// ============================================================================
+// WriteCore saves the machine as an ELF core file, so a crashed guest can be
+// looked at with `gdb program core` (or riscv32-unknown-elf-gdb): the file is
+// ET_CORE for EM_RISCV with
+//   - a PT_NOTE holding one NT_PRSTATUS note in the rv32 Linux layout: the
+//     signal the failure maps to and the registers, pc first and then x1 to x31
+//   - a PT_LOAD segment with the whole of RAM at its address
+//
+// device registers aren't included (reading them could change them). `run
+// --core-dir` writes a core whenever execution fails, and the debugger's
+// `core` command writes one on demand
+
+// the layout of the rv32 elf_prstatus
+const (
+	prstatusSize   = 204
+	prstatusCursig = 12 // pr_cursig, after the 12-byte elf_siginfo
+	prstatusPID    = 24
+	prstatusRegs   = 72 // pr_reg: pc, x1..x31
+)
+
+// signals a failure is reported as
+const (
+	sigILL  = 4
+	sigTRAP = 5
+	sigBUS  = 7
+	sigSEGV = 11
+)
+
+// coreSignal is the signal a Linux kernel would kill a process with for err (SIGTRAP when err is nil)
+func coreSignal(err error) uint32 {
+	var exc *Exception
+	var stack *StackOverflowError
+	switch {
+	case err == nil:
+		return sigTRAP
+	case errors.As(err, &stack):
+		return sigSEGV
+	case errors.As(err, &exc):
+		switch exc.Cause {
+		case CauseIllegalInstruction:
+			return sigILL
+		case CauseBreakpoint:
+			return sigTRAP
+		case CauseMisalignedFetch:
+			return sigBUS
+		}
+		return sigSEGV
+	}
+	return sigTRAP
+}
+
+// WriteCore writes an ELF core file of the machine to w. cause is the error Run
+// failed with, which decides the signal and the pc recorded (see failedPC); nil
+// records the current PC, as for a snapshot of a machine that is fine
+func (cpu *CPU) WriteCore(w io.Writer, cause error) error {
+	pc := uint32(cpu.PC)
+	if cause != nil {
+		pc = failedPC(cpu, cause)
+	}
+
+	const headers = 52 + 2*32 // the ELF header, then the program headers
+	desc := make([]byte, prstatusSize)
+	binary.LittleEndian.PutUint16(desc[prstatusCursig:], uint16(coreSignal(cause)))
+	binary.LittleEndian.PutUint32(desc[prstatusPID:], 1)
+	binary.LittleEndian.PutUint32(desc[prstatusRegs:], pc)
+	for i := 1; i < len(cpu.Regs); i++ {
+		binary.LittleEndian.PutUint32(desc[prstatusRegs+4*i:], cpu.Regs[i])
+	}
+	var note []byte
+	note = binary.LittleEndian.AppendUint32(note, 5) // "CORE" and its NUL
+	note = binary.LittleEndian.AppendUint32(note, uint32(len(desc)))
+	note = binary.LittleEndian.AppendUint32(note, uint32(elf.NT_PRSTATUS))
+	note = append(note, "CORE\x00\x00\x00\x00"...) // padded to 4 bytes
+	note = append(note, desc...)
+	ramOff := uint32(headers+len(note)+0xFFF) &^ 0xFFF // page aligned, like the kernel does
+
+	b := bufio.NewWriter(w)
+	header := elf.Header32{
+		Type:      uint16(elf.ET_CORE),
+		Machine:   uint16(elf.EM_RISCV),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     52,
+		Ehsize:    52,
+		Phentsize: 32,
+		Phnum:     2,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	programs := []elf.Prog32{
+		{Type: uint32(elf.PT_NOTE), Off: headers, Filesz: uint32(len(note)), Align: 4},
+		{
+			Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_W | elf.PF_X), Off: ramOff,
+			Vaddr: cpu.ramBase, Paddr: cpu.ramBase, Filesz: uint32(len(cpu.Memory)), Memsz: uint32(len(cpu.Memory)), Align: 0x1000,
+		},
+	}
+	binary.Write(b, binary.LittleEndian, header)
+	binary.Write(b, binary.LittleEndian, programs)
+	b.Write(note)
+	b.Write(make([]byte, ramOff-headers-uint32(len(note))))
+	b.Write(cpu.Memory)
+	return b.Flush()
+}
+
+// DumpCore writes an ELF core file of the machine to path (see WriteCore),
+// removing it again if it couldn't be written completely (unless it isn't a
+// regular file, like DumpMemory)
+func (cpu *CPU) DumpCore(path string, cause error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		err = cpu.WriteCore(f, cause)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if info != nil && info.Mode().IsRegular() {
+			os.Remove(path)
+		}
+		return fmt.Errorf("writing core file %s: %w", path, err)
+	}
+	return nil
+}
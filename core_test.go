@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// coreFile is what a core file holds, read back with debug/elf
+type coreFile struct {
+	signal uint32
+	pid    uint32
+	pc     uint32
+	regs   [32]uint32 // x1 to x31 (x0 is zero)
+	base   uint32     // the address of the RAM segment
+	ram    []byte
+}
+
+// readCore checks the structure of the core file data and returns its contents
+func readCore(t *testing.T, data []byte) coreFile {
+	t.Helper()
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Type != elf.ET_CORE || f.Machine != elf.EM_RISCV || f.Class != elf.ELFCLASS32 || f.ByteOrder != binary.LittleEndian {
+		t.Fatalf("a %v %v %v %v file, want a little-endian 32-bit RISC-V core", f.Type, f.Machine, f.Class, f.ByteOrder)
+	}
+	if len(f.Progs) != 2 || f.Progs[0].Type != elf.PT_NOTE || f.Progs[1].Type != elf.PT_LOAD {
+		t.Fatalf("program headers %v, want a PT_NOTE and a PT_LOAD", f.Progs)
+	}
+
+	var core coreFile
+	load := f.Progs[1]
+	if load.Flags != elf.PF_R|elf.PF_W|elf.PF_X || load.Off%0x1000 != 0 || load.Filesz != load.Memsz || load.Vaddr != load.Paddr {
+		t.Errorf("the PT_LOAD segment is %+v", load.ProgHeader)
+	}
+	core.base = uint32(load.Vaddr)
+	if core.ram, err = io.ReadAll(load.Open()); err != nil {
+		t.Fatal(err)
+	}
+
+	note, err := io.ReadAll(f.Progs[0].Open())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(note) != 12+8+prstatusSize {
+		t.Fatalf("the note is %d bytes", len(note))
+	}
+	namesz, descsz, typ := binary.LittleEndian.Uint32(note), binary.LittleEndian.Uint32(note[4:]), binary.LittleEndian.Uint32(note[8:])
+	if namesz != 5 || descsz != prstatusSize || elf.NType(typ) != elf.NT_PRSTATUS || string(note[12:17]) != "CORE\x00" {
+		t.Fatalf("note %q, %d bytes of type %d", note[12:12+namesz], descsz, typ)
+	}
+	desc := note[20:]
+	core.signal = uint32(binary.LittleEndian.Uint16(desc[prstatusCursig:]))
+	core.pid = binary.LittleEndian.Uint32(desc[prstatusPID:])
+	core.pc = binary.LittleEndian.Uint32(desc[prstatusRegs:])
+	for i := 1; i < 32; i++ {
+		core.regs[i] = binary.LittleEndian.Uint32(desc[prstatusRegs+4*i:])
+	}
+	return core
+}
+
+// crashProgram leaves a mark in memory and then loads from outside it, at 0x10
+func crashProgram(b *Builder) {
+	b.Li(S0, 0x5EED)
+	b.Sw(S0, ZERO, 0x200)
+	b.Lui(T0, 0x10)
+	b.Lw(T1, T0, 4)
+}
+
+func TestWriteCore(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, crashProgram))
+	_, runErr := cpu.Run(100)
+	if runErr == nil {
+		t.Fatal("the crash didn't happen")
+	}
+	var buf bytes.Buffer
+	if err := cpu.WriteCore(&buf, runErr); err != nil {
+		t.Fatal(err)
+	}
+	core := readCore(t, buf.Bytes())
+	if core.signal != sigSEGV || core.pid != 1 || core.pc != 0x10 {
+		t.Errorf("signal %d, pid %d, pc 0x%X; want SIGSEGV in process 1 at 0x10", core.signal, core.pid, core.pc)
+	}
+	if core.regs != cpu.Regs || core.regs[S0] != 0x5EED {
+		t.Errorf("registers %v, want %v", core.regs, cpu.Regs)
+	}
+	if core.base != 0 || !bytes.Equal(core.ram, cpu.Memory) {
+		t.Errorf("RAM at 0x%X, %d bytes, not the machine's", core.base, len(core.ram))
+	}
+
+	// a snapshot records the current pc, and RAM where the machine has it
+	m := DefaultMachine()
+	m.RAMBase, m.MemSize = 0x80000000, 0x2000
+	snap, err := m.NewCPU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.PC = 0x80000123
+	buf.Reset()
+	snap.WriteCore(&buf, nil)
+	if core := readCore(t, buf.Bytes()); core.signal != sigTRAP || core.pc != 0x80000123 || core.base != 0x80000000 || len(core.ram) != 0x2000 {
+		t.Errorf("snapshot: signal %d, pc 0x%X, RAM 0x%X+%d", core.signal, core.pc, core.base, len(core.ram))
+	}
+}
+
+func TestCoreSignal(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want uint32
+	}{
+		{nil, sigTRAP},
+		{&Exception{Cause: CauseIllegalInstruction}, sigILL},
+		{&Exception{Cause: CauseBreakpoint}, sigTRAP},
+		{&Exception{Cause: CauseMisalignedFetch}, sigBUS},
+		{&Exception{Cause: CauseStoreAccessFault}, sigSEGV},
+		{&StackOverflowError{}, sigSEGV},
+		{errors.New("something else"), sigTRAP},
+	} {
+		if got := coreSignal(c.err); got != c.want {
+			t.Errorf("coreSignal(%v) = %d, want %d", c.err, got, c.want)
+		}
+	}
+}
+
+func TestRunCoreDir(t *testing.T) {
+	dir := t.TempDir()
+	image := writeTemp(t, "crash.bin", assemble(t, crashProgram))
+	code, _, stderr := runCommand("run", "--core-dir", dir, "--diagnostics=false", image)
+	path := filepath.Join(dir, "crash.bin.core")
+	if code != 1 || !strings.Contains(stderr, "core dumped to "+path) {
+		t.Errorf("exit %d, stderr %q", code, stderr)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if core := readCore(t, data); core.signal != sigSEGV || core.pc != 0x10 || binary.LittleEndian.Uint32(core.ram[0x200:]) != 0x5EED {
+		t.Errorf("signal %d, pc 0x%X", core.signal, core.pc)
+	}
+
+	fine := writeTemp(t, "fine.bin", assemble(t, exitProgram(0)))
+	if code, _, _ := runCommand("run", "--syscalls=newlib", "--core-dir", dir, fine); code != 0 {
+		t.Errorf("exit %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "fine.bin.core")); err == nil {
+		t.Error("a core was written for a program that didn't fail")
+	}
+	if code, _, stderr := runCommand("run", "--core-dir", filepath.Join(dir, "missing"), image); code != 1 || !strings.Contains(stderr, "riscv-emu run: open "+filepath.Join(dir, "missing")) {
+		t.Errorf("missing directory: exit %d, %q", code, stderr)
+	}
+}
+
+func TestDebuggerCore(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, crashProgram))
+	path := filepath.Join(t.TempDir(), "snap.core")
+	var out strings.Builder
+	if err := NewDebugger(&cpu, strings.NewReader("step 3\ncore "+path+"\ncore\nquit\n"), &out, 0).Loop(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "error: usage: core <file>") {
+		t.Errorf("core without a file:\n%s", out.String())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+	if core := readCore(t, data); core.signal != sigTRAP || core.pc != 0xC || core.regs[S0] != 0x5EED {
+		t.Errorf("signal %d, pc 0x%X, s0 0x%X", core.signal, core.pc, core.regs[S0])
+	}
+
+	if _, err := os.Stat("/dev/full"); err == nil {
+		if err := cpu.DumpCore("/dev/full", nil); err == nil {
+			t.Error("a core was written to /dev/full")
+		}
+		if _, err := os.Stat("/dev/full"); err != nil {
+			t.Errorf("the failed core removed /dev/full: %v", err)
+		}
+	}
+}
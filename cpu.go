@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"log/slog"
 	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 // references:
@@ -12,54 +17,189 @@ import (
 //  - https://github.com/jameslzhu/riscv-card
 
 type CPU struct {
-	Memory   []byte            // memory is an array of bytes
+	Memory   []byte            // memory is an array of bytes (RAM, Memory[0] is at RAMBase)
 	RegNames []string          // registerNames is an array of risc-v register names
 	Regs     [32]uint32        // registers is an array of 32-bit words (we use a fixed array to match the exact register count)
-	RegMap   map[string]uint32 // registerMap is a map of register names to register numbers (0-31)
+	RegMap   map[string]uint32 // registerMap is a map of register names (ABI names and x0-x31) to register numbers (0-31)
 	PC       int               // program counter
+	Retired  uint64            // number of instructions executed so far
+	Cycles   uint64            // cycles the timing model has counted (see WithCycleModel), 0 without one
+	Tracer   Tracer            // if set, called after every instruction executed by Step
+	Observer AccessObserver    // if set, told about every fetch, load and store Step makes
+	Logger   *slog.Logger      // diagnostics: errors at LevelError, every step at LevelDebug (discards everything by default)
+
+	// EcallHook handles the ecall instruction (e.g. NewlibSyscalls.Handle); without one, ecall is an error
+	EcallHook func(cpu *CPU) error
+	// EbreakHook handles the ebreak instruction (e.g. Semihosting.Handle); without one, ebreak halts with StopBreakpoint
+	EbreakHook func(cpu *CPU) error
+	Exited     bool // set by Exit
+	ExitCode   int  // the program's exit code, valid once Exited is set
+
+	halted     bool       // set by Halt, cleared when Run returns
+	haltReason StopReason // what Run returns when halted is set
+
+	csrs          [4096]uint32 // control and status registers, see csr.go
+	cycleAdjust   int64        // what the program added to mcycle by writing it
+	instretAdjust int64        // what the program added to minstret by writing it
+
+	hpm             [hpmCounters]uint64 // mhpmcounter3 and up, see hpm.go
+	hpmActive       bool                // some mhpmevent selects an event
+	hpmICacheMisses uint64              // the instruction cache misses already counted
+
+	triggers       [triggerCount]debugTrigger // see triggers.go
+	triggersActive bool                       // some trigger can fire
+	triggerSkip    bool                       // the instruction Step runs next stopped at a trigger: it doesn't match again
+
+	devices []deviceMapping // memory-mapped devices, see bus.go
+	tickers []Ticker        // the devices that run after every instruction
+	bootROM *BootROM        // the one device instructions can be fetched from, see bootrom.go
+
+	timeSource    TimeSource // what makes mtime advance, see clint.go
+	timeIncrement uint64     // the instructions source adds timeIncrement ticks...
+	timeEvery     uint64     // ...every timeEvery instructions
+	timeScale     float64    // the wall clock source runs this many times as fast as the host
+	startTime     time.Time  // when the CPU was created (the origin of wall-clock time)
+	timeAdjust    int64      // what the program added to mtime by writing it
+	deterministic bool       // set by WithDeterministic
+	ramBase       uint32     // the address of Memory[0], see WithRAMBase
+	htif          bool       // set by WithHTIF
+	gpFixed       bool       // set by WithGlobalPointer and WithoutGlobalPointer: LoadELF leaves gp alone
+	tohost        uint32     // the address of the HTIF tohost word
+	seed          uint64     // the deterministic entropy seed
+	console       consoleConfig
+
+	control    *runControl    // lets other goroutines pause Run, see control.go
+	watchdog   *atomic.Bool   // set once RunWithTimeout's time is up
+	stackGuard *StackGuard    // set by WithStackGuard
+	uninit     *uninitTracker // set by WithUninitCheck
+	loops      *loopDetector  // set by WithLoopDetection
+	dcache     *decodeCache   // decoded instructions, nil with WithoutDecodeCache
+	bcache     *blockCache    // basic blocks for Run, nil with WithoutBlockCache
+	backend    Backend        // how Run executes the blocks, see threaded.go
+	slowMemory bool           // set by WithoutFastMemory
+	cycleModel *CycleTable    // set by WithCycleModel
+
+	scratch     decoded                  // the instruction Step or Execute is running when it isn't in the decode cache (a local would escape to the heap)
+	access      MemAccess                // the load or store of the instruction being traced, see LastAccess
+	breakpoints map[int]bool             // where Run pauses itself, see SetBreakpoint
+	tracepoints map[int][]*Tracepoint    // where Step writes a message, see SetTracepoint
+	custom      map[uint32]CustomHandler // handlers of custom opcodes, see RegisterCustomOpcode
+	text        []memRange               // where the loaders put code, see Validate
+	writeLog    *[]memRange              // where MemoryWritten notes the RAM written, while SelfCheck wants it
 }
 
-func NewCPU() CPU {
+// DefaultMemorySize is the amount of memory NewCPU gives the machine
+const DefaultMemorySize = 65536 // 64KB memory (which is okay for this emulator)
+
+func NewCPU(opts ...Option) CPU {
+	return NewCPUWithMemory(DefaultMemorySize, opts...)
+}
+
+// NewCPUWithMemory creates a CPU with `size` bytes of memory
+func NewCPUWithMemory(size int, opts ...Option) CPU {
 	cpu := CPU{
-		Memory:   make([]byte, 65536), // 64KB memory (which is okay for this emulator)
-		RegNames: []string{"zero", "ra", "sp", "gp", "tp", "t0", "t1", "t2", "s0", "s1", "a0", "a1", "a2", "a3", "a4", "a5", "a6", "a7", "s2", "s3", "s4", "s5", "s6", "s7", "s8", "s9", "s10", "s11", "t3", "t4", "t5", "t6"},
-		RegMap:   make(map[string]uint32),
-		PC:       0,
+		Memory:    make([]byte, size),
+		RegNames:  slices.Clone(abiNames[:]),
+		RegMap:    make(map[string]uint32, 2*len(abiNames)),
+		PC:        0,
+		Logger:    slog.New(slog.DiscardHandler), // the library never writes anywhere unless given a logger
+		startTime: time.Now(),
+		control:   newRunControl(),
+		dcache:    newDecodeCache(size),
+		bcache:    newBlockCache(),
+
+		timeIncrement: 1,
+		timeEvery:     1,
+		timeScale:     1,
 	}
 
-	// populate registerMap
+	// populate registerMap, with the numeric names as aliases of the ABI ones
 	for i := 0; i < len(cpu.RegNames); i++ {
 		cpu.RegMap[cpu.RegNames[i]] = uint32(i)
+		cpu.RegMap["x"+strconv.Itoa(i)] = uint32(i)
 	}
 
+	cpu.csrs[CSR_MISA] = misaRV32I
+
+	for _, opt := range opts {
+		opt(&cpu)
+	}
 	return cpu
 }
 
 func (cpu *CPU) LoadProgram(program []byte) {
-	copy(cpu.Memory, program)
+	n := copy(cpu.Memory, program)
+	cpu.MemoryWritten(cpu.ramBase, uint32(n))
+	cpu.text = append(cpu.text, memRange{cpu.ramBase, uint32(n)})
 }
 
-// SetRegisterValue sets the value of a register
+// LoadProgramAt copies program into memory starting at addr
+func (cpu *CPU) LoadProgramAt(program []byte, addr uint32) error {
+	off, ok := cpu.ramOffset(addr, uint32(len(program)))
+	if !ok {
+		return fmt.Errorf("program of %d bytes at 0x%08X does not fit in %d bytes of memory at 0x%08X", len(program), addr, len(cpu.Memory), cpu.ramBase)
+	}
+	copy(cpu.Memory[off:], program)
+	cpu.MemoryWritten(addr, uint32(len(program)))
+	cpu.text = append(cpu.text, memRange{addr, uint32(len(program))})
+	return nil
+}
+
+// SetRegisterValue sets the value of a register, by ABI name (a0) or number (x10)
 func (cpu *CPU) SetRegisterValue(register string, value uint32) error {
-	if slices.Contains(cpu.RegNames, register) {
-		cpu.Regs[cpu.RegMap[register]] = value
+	if i, ok := cpu.RegMap[register]; ok {
+		cpu.Regs[i] = value
 		return nil
 	}
 	return errors.New("register not found")
 }
 
-// GetRegisterValue gets the value of a register
+// GetRegisterValue gets the value of a register, by ABI name (a0) or number (x10)
 func (cpu *CPU) GetRegisterValue(register string) (uint32, error) {
-	if slices.Contains(cpu.RegNames, register) {
-		return cpu.Regs[cpu.RegMap[register]], nil
+	if i, ok := cpu.RegMap[register]; ok {
+		return cpu.Regs[i], nil
 	}
 	return 0, errors.New("register not found")
 }
 
+// GetReg gets the value of register x<i>, for callers that already have the number
+func (cpu *CPU) GetReg(i int) (uint32, error) {
+	if i < 0 || i >= len(cpu.Regs) {
+		return 0, fmt.Errorf("register x%d does not exist", i)
+	}
+	return cpu.Regs[i], nil
+}
+
+// SetReg sets the value of register x<i>; like an instruction, writing x0 has no effect
+func (cpu *CPU) SetReg(i int, value uint32) error {
+	if i < 0 || i >= len(cpu.Regs) {
+		return fmt.Errorf("register x%d does not exist", i)
+	}
+	if i != ZERO {
+		cpu.Regs[i] = value
+	}
+	return nil
+}
+
 func (cpu *CPU) FetchAndDecode() (instr uint32, err error) {
+	// the whole 4-byte word must be inside memory, otherwise slicing below would panic
+	off := cpu.PC - int(cpu.ramBase)
+	if off < 0 || off+4 > len(cpu.Memory) {
+		if instr, ok := cpu.fetchROM(uint32(cpu.PC)); ok {
+			cpu.PC += 4
+			return instr, nil
+		}
+		return 0, &Exception{Cause: CauseFetchAccessFault, Tval: uint32(cpu.PC), Msg: fmt.Sprintf("pc 0x%08X is outside memory", cpu.PC)}
+	}
+	if cpu.uninit != nil {
+		if err := cpu.checkInitialized(uint32(cpu.PC), uint32(cpu.PC), 4, true); err != nil {
+			return 0, err
+		}
+	}
+
 	// fetch instruction from memory
 	// and convert it to a 32-bit word
-	instr = binary.LittleEndian.Uint32(cpu.Memory[cpu.PC : cpu.PC+4]) // hence for an R-type instruction, `instr` will now be ordered this way: [funct7][rs2][rs1][funct3][rd][opcode]
+	instr = binary.LittleEndian.Uint32(cpu.Memory[off : off+4]) // hence for an R-type instruction, `instr` will now be ordered this way: [funct7][rs2][rs1][funct3][rd][opcode]
 
 	// program counter is incremented by 4 bytes (32 bits) each time we fetch an instruction
 	// because each instruction is 4 bytes
@@ -67,88 +207,213 @@ func (cpu *CPU) FetchAndDecode() (instr uint32, err error) {
 	return instr, nil
 }
 
-func (cpu *CPU) Execute(instr uint32) error {
-	// the bit masking (instr & 0x7F) extracts the opcode from the instruction
-	// the bitwise AND op with 0x7F masks out all but the lowest 7 bits of the instruction, which is the opcode
-	// 7 bits because `0x7F` is `0111 1111` - 7 ones and 1 zero
-	// and remember an AND op is a binary operation that takes two operands and returns 1 if both are 1, otherwise 0
-	// so our `instr` which is a 32-bit word (4 bytes) will be masked to only the lowest 7 bits
-	// (according to the risc-v specs, the opcode takes up 7 bits)
-	opcode := instr & 0x7F // mask out all but the lowest 7 bits to get the opcode (as explained above)
-
-	// Decode and execute based on opcode
-	switch opcode {
-	case 0x0:
-		// No-op
-		return nil
-
-	case 0x33: // R-type arithmetic: add, sub, etc (they share the same opcode but are differentiated by funct3 and funct7, which tell the operation variant)
-		// R-type format: [funct7][rs2][rs1][funct3][rd][opcode]
-		// [31:25] funct7 | [24:20] rs2 | [19:15] rs1 | [14:12] funct3 | [11:7] rd | [6:0] opcode
-		// 7 bits for funct7, 5 bits for rs2, 5 bits for rs1, 3 bits for funct3, 5 bits for rd, 7 bits for opcode...togther they form a 32-bit word
-		//
-		// so we can extract the funct7, funct3, rs1, rs2, rd and opcode from the instruction by shifting and masking
-		// reference can be found here: https://github.com/jameslzhu/riscv-card
-		funct3 := (instr >> 12) & 0x7  // shift right by 12 bits and mask out all but the lowest 3 bits to get the funct3 (function code)
-		funct7 := (instr >> 25) & 0x7F // shift right by 25 bits and mask out all but the lowest 7 bits to get the funct7 (function code)
-		rs1 := (instr >> 15) & 0x1F    // shift right by 15 bits and mask out all but the lowest 5 bits to get the rs1 (source register 1)
-		rs2 := (instr >> 20) & 0x1F    // shift right by 20 bits and mask out all but the lowest 5 bits to get the rs2 (source register 2)
-		rd := (instr >> 7) & 0x1F      // shift right by 7 bits and mask out all but the lowest 5 bits to get the rd (destination register)
-
-		switch funct3 {
-		case 0x0:
-			switch funct7 {
-			case 0x00:
-				return cpu.executeAdd(rs1, rs2, rd)
-			case 0x20:
-				return cpu.executeSub(rs1, rs2, rd)
-			}
+// fetch returns the decoded instruction at the PC, from the decode cache when it's
+// there, and moves the PC past it like FetchAndDecode
+func (cpu *CPU) fetch() (*decoded, error) {
+	if cpu.dcache == nil {
+		instr, err := cpu.FetchAndDecode()
+		if err != nil {
+			return nil, err
 		}
-		return errors.New("unimplemented R-type instruction variant")
-
-	case ADDI:
-		// I-type format: [imm[11:0]][rs1][funct3][rd][opcode]
-		// [31:20] imm[11:0] | [19:15] rs1 | [14:12] funct3 | [11:7] rd | [6:0] opcode
-		imm := (instr >> 20) & 0xFFF // shift right by 20 bits and mask out all but the lowest 12 bits to get the imm (immediate value)
-		rs1 := (instr >> 15) & 0x1F  // shift right by 15 bits and mask out all but the lowest 5 bits to get the rs1 (source register 1)
-		rd := (instr >> 7) & 0x1F    // shift right by 7 bits and mask out all but the lowest 5 bits to get the rd (destination register)
-		return cpu.executeAddi(imm, rs1, rd)
+		cpu.scratch = decode(instr)
+		return &cpu.scratch, nil
+	}
+	if d := cpu.dcache.lookup(cpu.PC); d != nil {
+		cpu.PC += 4
+		return d, nil
+	}
+	pc := cpu.PC
+	instr, err := cpu.FetchAndDecode()
+	if err != nil {
+		return nil, err
+	}
+	if _, inRAM := cpu.ramOffset(uint32(pc), 4); inRAM && pc%4 == 0 { // not the boot ROM
+		cpu.dcache.insert(pc, decode(instr))
+		return cpu.dcache.lookup(pc), nil
+	}
+	cpu.scratch = decode(instr)
+	return &cpu.scratch, nil
+}
 
-	case SW:
-		// S-type format: [imm[11:5]][rs2][rs1][funct3][imm[4:0]][opcode]
-		// [31:25] imm[11:5] | [24:20] rs2 | [19:15] rs1 | [14:12] funct3 | [11:7] imm[4:0] | [6:0] opcode
-		// immediate is split: upper 7 bits in [31:25], lower 5 bits in [11:7]
-		imm11_5 := (instr >> 25) & 0x7F // extract imm[11:5] from bits [31:25]
-		imm4_0 := (instr >> 7) & 0x1F   // extract imm[4:0] from bits [11:7]
-		imm := (imm11_5 << 5) | imm4_0  // reassemble: imm[11:5] in upper bits, imm[4:0] in lower bits
-		rs2 := (instr >> 20) & 0x1F     // shift right by 20 bits and mask out all but the lowest 5 bits to get the rs2 (source register 2)
-		rs1 := (instr >> 15) & 0x1F     // shift right by 15 bits and mask out all but the lowest 5 bits to get the rs1 (source register 1)
-		return cpu.executeSw(imm, rs2, rs1)
+// Execute decodes and executes a single instruction (the PC must already point past it)
+func (cpu *CPU) Execute(instr uint32) error {
+	cpu.scratch = decode(instr)
+	return cpu.execute(&cpu.scratch)
+}
 
-	case LUI:
-		// U-type format: [imm[31:12]][rd][opcode]
-		// [31:12] imm[31:12] | [11:7] rd | [6:0] opcode
-		imm := (instr >> 12) & 0xFFFFF // shift right by 12 bits and mask out all but the lowest 20 bits to get the imm (immediate value)
-		rd := (instr >> 7) & 0x1F      // shift right by 7 bits and mask out all but the lowest 5 bits to get the rd (destination register)
-		return cpu.executeLui(imm, rd)
+// execute runs an instruction decode has taken apart, through the handler decode looked up
+func (cpu *CPU) execute(d *decoded) error {
+	// x0 is hardwired to zero: instructions may "write" it, we just undo that afterwards
+	defer func() { cpu.Regs[ZERO] = 0 }()
 
-	default:
-		return errors.New("invalid instruction")
+	if d.exec == nil {
+		if h, ok := cpu.custom[d.opcode]; ok {
+			return cpu.executeCustom(h, d)
+		}
+		return illegal(d)
 	}
+	return d.exec(cpu, d)
 }
 
 // ============================================================================
 // Fetch-Decode-Execute Cycle
 // ============================================================================
-func (cpu *CPU) Run() {
-	for {
-		instr, err := cpu.FetchAndDecode()
+
+// StopReason tells the caller of Run why execution stopped
+type StopReason int
+
+const (
+	StopError      StopReason = iota // fetching or executing an instruction failed
+	StopLimit                        // the instruction budget given to Run was used up
+	StopExit                         // the program asked to exit (see ExitCode)
+	StopBreakpoint                   // an ebreak instruction was executed
+	StopTimeout                      // the wall-clock limit given to RunWithTimeout passed
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopError:
+		return "error"
+	case StopLimit:
+		return "instruction limit"
+	case StopExit:
+		return "exit"
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopTimeout:
+		return "timeout"
+	}
+	return "unknown"
+}
+
+// Halt makes Run return reason once the current instruction finishes
+func (cpu *CPU) Halt(reason StopReason) {
+	cpu.halted = true
+	cpu.haltReason = reason
+}
+
+// Exit records the program's exit code and halts with StopExit
+func (cpu *CPU) Exit(code int) {
+	cpu.Exited = true
+	cpu.ExitCode = code
+	cpu.Halt(StopExit)
+}
+
+// Step fetches and executes a single instruction
+// (or takes a pending interrupt first, see trap.go for how exceptions are handled)
+func (cpu *CPU) Step() error {
+	cpu.takePendingInterrupt()
+
+	pc := cpu.PC
+	if cpu.tracepoints != nil {
+		cpu.fireTracepoints(pc)
+	}
+	if cpu.Observer != nil {
+		cpu.Observer.Access(AccessFetch, uint32(pc), 4)
+	}
+	if cpu.Tracer != nil {
+		cpu.access = MemAccess{}
+	}
+	d, err := cpu.fetch()
+	if err == nil && cpu.triggersActive {
+		err = cpu.checkTriggers(mcontrolExecute, uint32(pc), 4, uint32(pc))
+	}
+	if err == nil {
+		err = cpu.execute(d)
+	}
+	cpu.triggerSkip = false
+	if err != nil {
+		// a trigger halting Run leaves the PC at the instruction, which runs once Run is resumed
+		var halt *triggerHalt
+		if errors.As(err, &halt) {
+			cpu.PC = pc
+			cpu.triggerSkip = true
+			cpu.Halt(StopBreakpoint)
+			return nil
+		}
+		// a trapped exception doesn't retire the instruction, but devices still get to run
+		var exc *Exception
+		if errors.As(err, &exc) {
+			err = cpu.takeException(exc, uint32(pc))
+		}
+		if err == nil {
+			cpu.tickDevices()
+		}
+		return err
+	}
+	cpu.Retired++
+	if cpu.cycleModel != nil {
+		cpu.countCycles(d, uint32(pc))
+	}
+	if cpu.hpmActive {
+		cpu.countEvents(d, uint32(pc))
+	}
+	cpu.tickDevices()
+
+	// checking Enabled first keeps the arguments from being built when debug logging is off
+	if cpu.Logger.Enabled(context.Background(), slog.LevelDebug) {
+		cpu.Logger.Debug("step", "n", cpu.Retired, "pc", fmt.Sprintf("0x%08X", pc), "instr", fmt.Sprintf("0x%08X", d.instr))
+	}
+	if cpu.Tracer != nil {
+		cpu.Tracer.Trace(cpu, pc, d.instr)
+	}
+	return nil
+}
+
+// blocksUsable reports whether Run may execute a basic block next, rather than
+// going through Step (debug is whether debug logging is on)
+func (cpu *CPU) blocksUsable(debug bool) bool {
+	return cpu.bcache != nil && cpu.Tracer == nil && cpu.Observer == nil && len(cpu.breakpoints) == 0 && len(cpu.tracepoints) == 0 && !cpu.triggersActive && !debug
+}
+
+// Run executes instructions until one fails or maxInstructions have retired (0 means no limit).
+// straight-line code runs a basic block at a time, see blocks.go
+func (cpu *CPU) Run(maxInstructions uint64) (StopReason, error) {
+	cpu.control.enter()
+	defer cpu.control.leave()
+	debug := cpu.Logger.Enabled(context.Background(), slog.LevelDebug)
+	for n := uint64(0); maxInstructions == 0 || n < maxInstructions; {
+		cpu.control.checkpoint()
+		if cpu.watchdog != nil && cpu.watchdog.Load() {
+			return StopTimeout, nil
+		}
+		if cpu.breakpoints != nil && cpu.breakpoints[cpu.PC] {
+			cpu.control.breakpoint()
+		}
+
+		var err error
+		var b *block
+		if cpu.blocksUsable(debug) {
+			cpu.takePendingInterrupt()
+			b = cpu.blockAt()
+		}
+		pc, steps := cpu.PC, uint64(1)
+		if b != nil && (maxInstructions == 0 || maxInstructions-n >= uint64(len(b.instrs))) {
+			steps, err = cpu.runBlock(b)
+		} else {
+			err = cpu.Step()
+		}
+		n += steps
+		if err == nil && cpu.loops != nil {
+			err = cpu.loops.check(cpu, pc, steps)
+		}
+
 		if err != nil {
-			fmt.Println(err)
-			return
+			cpu.Logger.Error("execution failed", "pc", fmt.Sprintf("0x%08X", cpu.PC), "retired", cpu.Retired, "err", err)
+			return StopError, err
+		}
+		if cpu.halted {
+			cpu.halted = false
+			if debug {
+				cpu.Logger.Debug("halted", "reason", cpu.haltReason.String(), "retired", cpu.Retired)
+			}
+			return cpu.haltReason, nil
 		}
-		cpu.Execute(instr)
 	}
+	if debug {
+		cpu.Logger.Debug("instruction limit reached", "retired", cpu.Retired)
+	}
+	return StopLimit, nil
 }
 
 // ============================================================================
@@ -190,8 +455,88 @@ func (cpu *CPU) executeSw(imm uint32, rs2 uint32, rs1 uint32) error {
 	// store the value of rs2 into memory at the address specified by imm + rs1
 	// risc-v uses little-endian byte order, so we store 4 bytes in little-endian format
 	addr := imm + cpu.Regs[rs1]
-	binary.LittleEndian.PutUint32(cpu.Memory[addr:addr+4], cpu.Regs[rs2])
+	return cpu.storeOrFault(rs1, addr, 4, cpu.Regs[rs2])
+}
 
+// SB (store byte - stores the lowest 8 bits of a register into memory)
+func (cpu *CPU) executeSb(imm uint32, rs2 uint32, rs1 uint32) error {
+	return cpu.storeOrFault(rs1, imm+cpu.Regs[rs1], 1, cpu.Regs[rs2])
+}
+
+// SH (store halfword - stores the lowest 16 bits of a register into memory)
+func (cpu *CPU) executeSh(imm uint32, rs2 uint32, rs1 uint32) error {
+	return cpu.storeOrFault(rs1, imm+cpu.Regs[rs1], 2, cpu.Regs[rs2])
+}
+
+// storeOrFault stores for an instruction whose base register is rs1, turning a failed
+// access into a store access fault (after the stack guard, if any, has had a look)
+func (cpu *CPU) storeOrFault(rs1, addr, size, value uint32) error {
+	if cpu.triggersActive {
+		if err := cpu.checkTriggers(mcontrolStore, addr, size, uint32(cpu.PC-4)); err != nil {
+			return err
+		}
+	}
+	if cpu.Observer != nil {
+		cpu.Observer.Access(AccessStore, addr, size)
+	}
+	if size == 4 && cpu.stackGuard == nil {
+		if off, ok := cpu.fastWord(addr); ok {
+			binary.LittleEndian.PutUint32(cpu.Memory[off:], value)
+			cpu.MemoryWritten(addr, 4)
+			cpu.recordAccess(AccessStore, addr, 4, value)
+			return nil
+		}
+	}
+	if cpu.stackGuard != nil {
+		if err := cpu.stackGuard.check(cpu, rs1, addr, size); err != nil {
+			return err
+		}
+	}
+	if err := cpu.Store(addr, size, value); err != nil {
+		return accessFault(CauseStoreAccessFault, addr, err)
+	}
+	cpu.recordAccess(AccessStore, addr, size, value)
+	return nil
+}
+
+// LB, LH, LW, LBU, LHU (loads - funct3 encodes the width in its low 2 bits and "unsigned" in bit 2)
+func (cpu *CPU) executeLoad(funct3 uint32, imm uint32, rs1 uint32, rd uint32) error {
+	addr := imm + cpu.Regs[rs1]
+	size := uint32(1) << (funct3 & 0x3) // 0 -> 1 byte, 1 -> 2 bytes, 2 -> 4 bytes
+	if cpu.triggersActive {
+		if err := cpu.checkTriggers(mcontrolLoad, addr, size, uint32(cpu.PC-4)); err != nil {
+			return err
+		}
+	}
+	if cpu.Observer != nil {
+		cpu.Observer.Access(AccessLoad, addr, size)
+	}
+	if funct3 == 0x2 {
+		if off, ok := cpu.fastWord(addr); ok {
+			cpu.Regs[rd] = binary.LittleEndian.Uint32(cpu.Memory[off:])
+			cpu.recordAccess(AccessLoad, addr, 4, cpu.Regs[rd])
+			return nil
+		}
+	}
+
+	val, err := cpu.Load(addr, size)
+	if err != nil {
+		return accessFault(CauseLoadAccessFault, addr, err)
+	}
+	if cpu.uninit != nil && cpu.checkRange(addr, size) == nil {
+		if err := cpu.checkInitialized(uint32(cpu.PC-4), addr, size, false); err != nil {
+			return err
+		}
+	}
+
+	cpu.recordAccess(AccessLoad, addr, size, val)
+
+	// lb and lh sign-extend (lbu and lhu keep the zero-extension from Load)
+	signed := funct3&0x4 == 0
+	if signed && size < 4 {
+		val = SignExtend(val, uint(size*8-1))
+	}
+	cpu.Regs[rd] = val
 	return nil
 }
 
@@ -202,6 +547,218 @@ func (cpu *CPU) executeLui(imm uint32, rd uint32) error {
 	return nil
 }
 
+// AUIPC (add upper immediate to pc - like lui, but adds the address of this instruction)
+func (cpu *CPU) executeAuipc(imm uint32, rd uint32) error {
+	pc := uint32(cpu.PC) - 4 // FetchAndDecode has already moved the PC to the next instruction
+	cpu.Regs[rd] = pc + imm<<12
+	return nil
+}
+
+// SLT (set less than - rd = 1 if rs1 < rs2 as signed numbers, else 0)
+func (cpu *CPU) executeSlt(rs1 uint32, rs2 uint32, rd uint32) error {
+	cpu.Regs[rd] = boolToWord(int32(cpu.Regs[rs1]) < int32(cpu.Regs[rs2]))
+	return nil
+}
+
+// SLTU (set less than unsigned)
+func (cpu *CPU) executeSltu(rs1 uint32, rs2 uint32, rd uint32) error {
+	cpu.Regs[rd] = boolToWord(cpu.Regs[rs1] < cpu.Regs[rs2])
+	return nil
+}
+
+// XOR
+func (cpu *CPU) executeXor(rs1 uint32, rs2 uint32, rd uint32) error {
+	cpu.Regs[rd] = cpu.Regs[rs1] ^ cpu.Regs[rs2]
+	return nil
+}
+
+// OR
+func (cpu *CPU) executeOr(rs1 uint32, rs2 uint32, rd uint32) error {
+	cpu.Regs[rd] = cpu.Regs[rs1] | cpu.Regs[rs2]
+	return nil
+}
+
+// AND
+func (cpu *CPU) executeAnd(rs1 uint32, rs2 uint32, rd uint32) error {
+	cpu.Regs[rd] = cpu.Regs[rs1] & cpu.Regs[rs2]
+	return nil
+}
+
+// SLL (shift left logical - only the lowest 5 bits of rs2 are used as the shift amount)
+func (cpu *CPU) executeSll(rs1 uint32, rs2 uint32, rd uint32) error {
+	cpu.Regs[rd] = cpu.Regs[rs1] << (cpu.Regs[rs2] & 0x1F)
+	return nil
+}
+
+// SRL (shift right logical - fills the upper bits with zeros)
+func (cpu *CPU) executeSrl(rs1 uint32, rs2 uint32, rd uint32) error {
+	cpu.Regs[rd] = cpu.Regs[rs1] >> (cpu.Regs[rs2] & 0x1F)
+	return nil
+}
+
+// SRA (shift right arithmetic - fills the upper bits with copies of the sign bit)
+func (cpu *CPU) executeSra(rs1 uint32, rs2 uint32, rd uint32) error {
+	cpu.Regs[rd] = uint32(int32(cpu.Regs[rs1]) >> (cpu.Regs[rs2] & 0x1F))
+	return nil
+}
+
+// SLTI (set less than immediate, signed)
+func (cpu *CPU) executeSlti(imm uint32, rs1 uint32, rd uint32) error {
+	cpu.Regs[rd] = boolToWord(int32(cpu.Regs[rs1]) < int32(imm))
+	return nil
+}
+
+// SLTIU (set less than immediate unsigned - the immediate is sign-extended first, then compared as unsigned)
+func (cpu *CPU) executeSltiu(imm uint32, rs1 uint32, rd uint32) error {
+	cpu.Regs[rd] = boolToWord(cpu.Regs[rs1] < imm)
+	return nil
+}
+
+// XORI
+func (cpu *CPU) executeXori(imm uint32, rs1 uint32, rd uint32) error {
+	cpu.Regs[rd] = cpu.Regs[rs1] ^ imm
+	return nil
+}
+
+// ORI
+func (cpu *CPU) executeOri(imm uint32, rs1 uint32, rd uint32) error {
+	cpu.Regs[rd] = cpu.Regs[rs1] | imm
+	return nil
+}
+
+// ANDI
+func (cpu *CPU) executeAndi(imm uint32, rs1 uint32, rd uint32) error {
+	cpu.Regs[rd] = cpu.Regs[rs1] & imm
+	return nil
+}
+
+// SLLI (shift left logical by a 5-bit immediate)
+func (cpu *CPU) executeSlli(shamt uint32, rs1 uint32, rd uint32) error {
+	cpu.Regs[rd] = cpu.Regs[rs1] << shamt
+	return nil
+}
+
+// SRLI (shift right logical by a 5-bit immediate)
+func (cpu *CPU) executeSrli(shamt uint32, rs1 uint32, rd uint32) error {
+	cpu.Regs[rd] = cpu.Regs[rs1] >> shamt
+	return nil
+}
+
+// SRAI (shift right arithmetic by a 5-bit immediate)
+func (cpu *CPU) executeSrai(shamt uint32, rs1 uint32, rd uint32) error {
+	cpu.Regs[rd] = uint32(int32(cpu.Regs[rs1]) >> shamt)
+	return nil
+}
+
+// BEQ, BNE, BLT, BGE, BLTU, BGEU (conditional branches - jump by imm relative to this instruction if the condition holds)
+func (cpu *CPU) executeBranch(funct3 uint32, imm uint32, rs1 uint32, rs2 uint32) error {
+	a, b := cpu.Regs[rs1], cpu.Regs[rs2]
+
+	var taken bool
+	switch funct3 {
+	case 0x0: // beq
+		taken = a == b
+	case 0x1: // bne
+		taken = a != b
+	case 0x4: // blt
+		taken = int32(a) < int32(b)
+	case 0x5: // bge
+		taken = int32(a) >= int32(b)
+	case 0x6: // bltu
+		taken = a < b
+	case 0x7: // bgeu
+		taken = a >= b
+	}
+	if !taken {
+		return nil
+	}
+	return cpu.jump(uint32(cpu.PC) - 4 + imm)
+}
+
+// JAL (jump and link - rd = address of the next instruction, then jump by imm relative to this instruction)
+func (cpu *CPU) executeJal(imm uint32, rd uint32) error {
+	target := uint32(cpu.PC) - 4 + imm
+	link := uint32(cpu.PC)
+	if err := cpu.jump(target); err != nil {
+		return err
+	}
+	cpu.Regs[rd] = link
+	return nil
+}
+
+// JALR (jump and link register - like jal, but the target is rs1 + imm with the lowest bit cleared)
+func (cpu *CPU) executeJalr(imm uint32, rs1 uint32, rd uint32) error {
+	target := (cpu.Regs[rs1] + imm) &^ 1 // read rs1 before writing rd, they may be the same register
+	link := uint32(cpu.PC)
+	if err := cpu.jump(target); err != nil {
+		return err
+	}
+	cpu.Regs[rd] = link
+	return nil
+}
+
+// jump moves the PC to target, which must be 4-byte aligned
+func (cpu *CPU) jump(target uint32) error {
+	if target%4 != 0 {
+		return &Exception{Cause: CauseMisalignedFetch, Tval: target, Msg: fmt.Sprintf("jump to misaligned address 0x%08X", target)}
+	}
+	cpu.PC = int(target)
+	return nil
+}
+
+// ECALL (environment call - asks the execution environment for a service, e.g. a syscall)
+func (cpu *CPU) executeEcall() error {
+	if cpu.EcallHook == nil {
+		return &Exception{Cause: CauseEcallFromM, Msg: fmt.Sprintf("ecall at 0x%08X with no handler installed", cpu.PC-4)}
+	}
+	return cpu.EcallHook(cpu)
+}
+
+// ecall, ebreak, mret and wfi are I-type instructions with every field zero except the immediate
+func (cpu *CPU) executePrivileged(d *decoded) error {
+	if d.rs1 == 0 && d.rd == 0 {
+		switch d.instr >> 20 {
+		case 0x000:
+			return cpu.executeEcall()
+		case 0x001:
+			return cpu.executeEbreak()
+		case 0x302:
+			return cpu.executeMret()
+		case 0x105:
+			return cpu.executeWfi()
+		}
+	}
+	return illegalInstruction(d.instr, "unimplemented system instruction variant")
+}
+
+// FENCE.I (drops decoded instructions so stores to code are seen by fetch)
+func (cpu *CPU) executeFenceI() error {
+	if cpu.dcache != nil {
+		cpu.dcache.flush()
+	}
+	if cpu.bcache != nil {
+		cpu.bcache.flush()
+	}
+	return nil
+}
+
+// EBREAK (breakpoint - hands control back to whoever is running the CPU)
+func (cpu *CPU) executeEbreak() error {
+	if cpu.EbreakHook != nil {
+		return cpu.EbreakHook(cpu)
+	}
+	cpu.Halt(StopBreakpoint)
+	return nil
+}
+
+// boolToWord turns a comparison result into the 1 or 0 the set-less-than instructions write
+func boolToWord(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 /*
 Note:
 we'll use regMap, GetRegisterValue and SetRegisterValue for testing purposes.
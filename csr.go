@@ -0,0 +1,236 @@
+package main
+
+import "fmt"
+
+// ============================================================================
+// Control and status registers (CSRs)
+// ============================================================================
+// CSRs live in their own 12-bit address space and are accessed with the
+// csrrw/csrrs/csrrc instructions (and their immediate forms). we implement the
+// machine-mode registers a bare-metal program needs for traps and timing
+
+const (
+	// machine trap setup and handling
+	CSR_MSTATUS    = 0x300
+	CSR_MISA       = 0x301
+	CSR_MIE        = 0x304
+	CSR_MTVEC      = 0x305
+	CSR_MCOUNTEREN = 0x306
+	CSR_MSCRATCH   = 0x340
+	CSR_MEPC       = 0x341
+	CSR_MCAUSE     = 0x342
+	CSR_MTVAL      = 0x343
+	CSR_MIP        = 0x344
+
+	// machine counters (writable) and their read-only user-level shadows
+	CSR_MCYCLE    = 0xB00
+	CSR_MINSTRET  = 0xB02
+	CSR_MCYCLEH   = 0xB80
+	CSR_MINSTRETH = 0xB82
+	CSR_CYCLE     = 0xC00
+	CSR_TIME      = 0xC01
+	CSR_INSTRET   = 0xC02
+	CSR_CYCLEH    = 0xC80
+	CSR_TIMEH     = 0xC81
+	CSR_INSTRETH  = 0xC82
+
+	// debug triggers, see triggers.go
+	CSR_TSELECT = 0x7A0
+	CSR_TDATA1  = 0x7A1
+	CSR_TDATA2  = 0x7A2
+	CSR_TINFO   = 0x7A4
+
+	// hardware performance monitor, see hpm.go (each is the first of hpmCounters)
+	CSR_MCOUNTINHIBIT = 0x320
+	CSR_MHPMEVENT3    = 0x323
+	CSR_MHPMCOUNTER3  = 0xB03
+	CSR_MHPMCOUNTER3H = 0xB83
+	CSR_HPMCOUNTER3   = 0xC03
+	CSR_HPMCOUNTER3H  = 0xC83
+
+	// machine information registers (read-only)
+	CSR_MVENDORID = 0xF11
+	CSR_MARCHID   = 0xF12
+	CSR_MIMPID    = 0xF13
+	CSR_MHARTID   = 0xF14
+)
+
+// CSRNames maps the implemented CSRs to their names (for traces, reports and the debugger)
+var CSRNames = map[uint32]string{
+	CSR_MSTATUS: "mstatus", CSR_MISA: "misa", CSR_MIE: "mie", CSR_MTVEC: "mtvec",
+	CSR_MSCRATCH: "mscratch", CSR_MEPC: "mepc", CSR_MCAUSE: "mcause", CSR_MTVAL: "mtval", CSR_MIP: "mip",
+	CSR_MCYCLE: "mcycle", CSR_MINSTRET: "minstret", CSR_MCYCLEH: "mcycleh", CSR_MINSTRETH: "minstreth",
+	CSR_CYCLE: "cycle", CSR_TIME: "time", CSR_INSTRET: "instret",
+	CSR_CYCLEH: "cycleh", CSR_TIMEH: "timeh", CSR_INSTRETH: "instreth",
+	CSR_MVENDORID: "mvendorid", CSR_MARCHID: "marchid", CSR_MIMPID: "mimpid", CSR_MHARTID: "mhartid",
+	CSR_MCOUNTEREN: "mcounteren", CSR_MCOUNTINHIBIT: "mcountinhibit",
+	CSR_TSELECT: "tselect", CSR_TDATA1: "tdata1", CSR_TDATA2: "tdata2", CSR_TINFO: "tinfo",
+}
+
+func init() {
+	for i := uint32(0); i < hpmCounters; i++ {
+		n := i + hpmFirst
+		CSRNames[CSR_MHPMEVENT3+i] = fmt.Sprintf("mhpmevent%d", n)
+		CSRNames[CSR_MHPMCOUNTER3+i] = fmt.Sprintf("mhpmcounter%d", n)
+		CSRNames[CSR_MHPMCOUNTER3H+i] = fmt.Sprintf("mhpmcounter%dh", n)
+		CSRNames[CSR_HPMCOUNTER3+i] = fmt.Sprintf("hpmcounter%d", n)
+		CSRNames[CSR_HPMCOUNTER3H+i] = fmt.Sprintf("hpmcounter%dh", n)
+	}
+}
+
+// mstatus fields
+const (
+	mstatusMIEBit     = 3       // global machine interrupt enable
+	mstatusMPIEBit    = 7       // MIE before the last trap
+	mstatusMPPMachine = 3 << 11 // previous privilege = machine (the only mode we have)
+)
+
+// misaRV32I is the value of misa: MXL = 1 (32-bit) and the I extension bit
+const misaRV32I = 1<<30 | 1<<('I'-'A')
+
+// writable masks for the registers that don't accept arbitrary values
+const (
+	mstatusWritable = 1<<mstatusMIEBit | 1<<mstatusMPIEBit
+	mipWritable     = 1 << InterruptSoftware // the timer and external bits are driven by devices
+	interruptBits   = 1<<InterruptSoftware | 1<<InterruptTimer | 1<<InterruptExternal
+)
+
+// ReadCSR returns the value of a CSR, or an error if it isn't implemented
+func (cpu *CPU) ReadCSR(addr uint32) (uint32, error) {
+	switch addr {
+	case CSR_MCYCLE, CSR_CYCLE:
+		return uint32(cpu.cycles()), nil
+	case CSR_MCYCLEH, CSR_CYCLEH:
+		return uint32(cpu.cycles() >> 32), nil
+	case CSR_MINSTRET, CSR_INSTRET:
+		return uint32(cpu.instret()), nil
+	case CSR_MINSTRETH, CSR_INSTRETH:
+		return uint32(cpu.instret() >> 32), nil
+	case CSR_TIME:
+		return uint32(cpu.Time()), nil
+	case CSR_TIMEH:
+		return uint32(cpu.Time() >> 32), nil
+	case CSR_MSTATUS:
+		return cpu.csrs[addr] | mstatusMPPMachine, nil
+	case CSR_TSELECT, CSR_TDATA1, CSR_TDATA2, CSR_TINFO:
+		return cpu.readTriggerCSR(addr), nil
+	}
+	if i, ok := hpmCounterIndex(addr, CSR_MHPMCOUNTER3, CSR_HPMCOUNTER3); ok {
+		return uint32(cpu.hpm[i]), nil
+	}
+	if i, ok := hpmCounterIndex(addr, CSR_MHPMCOUNTER3H, CSR_HPMCOUNTER3H); ok {
+		return uint32(cpu.hpm[i] >> 32), nil
+	}
+	if _, ok := CSRNames[addr]; !ok {
+		return 0, fmt.Errorf("csr 0x%03X is not implemented", addr)
+	}
+	return cpu.csrs[addr], nil
+}
+
+// WriteCSR sets a CSR; read-only bits and fields keep their values
+func (cpu *CPU) WriteCSR(addr uint32, value uint32) error {
+	// the top two address bits are 0b11 for read-only registers
+	if addr>>10 == 0x3 {
+		return fmt.Errorf("csr 0x%03X is read-only", addr)
+	}
+	switch addr {
+	case CSR_MCYCLE:
+		cpu.cycleAdjust += int64(value) - int64(uint32(cpu.cycles()))
+	case CSR_MCYCLEH:
+		cpu.cycleAdjust += (int64(value) - int64(cpu.cycles()>>32)) << 32
+	case CSR_MINSTRET:
+		cpu.instretAdjust += int64(value) - int64(uint32(cpu.instret()))
+	case CSR_MINSTRETH:
+		cpu.instretAdjust += (int64(value) - int64(cpu.instret()>>32)) << 32
+	case CSR_MSTATUS:
+		cpu.csrs[addr] = value & mstatusWritable
+	case CSR_MIE:
+		cpu.csrs[addr] = value & interruptBits
+	case CSR_MIP:
+		cpu.csrs[addr] = cpu.csrs[addr]&^mipWritable | value&mipWritable
+	case CSR_MEPC:
+		cpu.csrs[addr] = value &^ 0x3 // instructions are 4-byte aligned
+	case CSR_MTVEC:
+		cpu.csrs[addr] = value &^ 0x2 // modes 2 and 3 are reserved
+	case CSR_MISA:
+		// writable in principle, but we can't turn extensions on or off, so writes are ignored
+	case CSR_MCOUNTEREN:
+		cpu.csrs[addr] = value & mcounterenWritable
+	case CSR_MCOUNTINHIBIT:
+		cpu.csrs[addr] = value & hpmCounterBits
+	case CSR_TSELECT, CSR_TDATA1, CSR_TDATA2:
+		cpu.writeTriggerCSR(addr, value)
+	case CSR_TINFO:
+		// read-only, though its address says otherwise
+	default:
+		if i, ok := hpmCounterIndex(addr, CSR_MHPMCOUNTER3, CSR_MHPMCOUNTER3); ok {
+			cpu.hpm[i] = cpu.hpm[i]&^0xFFFFFFFF | uint64(value)
+			return nil
+		}
+		if i, ok := hpmCounterIndex(addr, CSR_MHPMCOUNTER3H, CSR_MHPMCOUNTER3H); ok {
+			cpu.hpm[i] = cpu.hpm[i]&0xFFFFFFFF | uint64(value)<<32
+			return nil
+		}
+		if addr >= CSR_MHPMEVENT3 && addr < CSR_MHPMEVENT3+hpmCounters {
+			cpu.setHPMEvent(addr-CSR_MHPMEVENT3, value)
+			return nil
+		}
+		if _, ok := CSRNames[addr]; !ok {
+			return fmt.Errorf("csr 0x%03X is not implemented", addr)
+		}
+		cpu.csrs[addr] = value
+	}
+	return nil
+}
+
+// cycles is the value of mcycle: the cycles the timing model counted, or without one
+// a cycle per retired instruction, plus whatever the program wrote
+func (cpu *CPU) cycles() uint64 {
+	if cpu.cycleModel != nil {
+		return uint64(int64(cpu.Cycles) + cpu.cycleAdjust)
+	}
+	return uint64(int64(cpu.Retired) + cpu.cycleAdjust)
+}
+
+// instret is the value of minstret
+func (cpu *CPU) instret() uint64 {
+	return uint64(int64(cpu.Retired) + cpu.instretAdjust)
+}
+
+// CSRRW, CSRRS, CSRRC and their immediate forms CSRRWI, CSRRSI, CSRRCI.
+// funct3 bit 2 selects the immediate form, where the rs1 field is a 5-bit zero-extended value
+// instead of a register; the low two bits select write (1), set bits (2) or clear bits (3)
+func (cpu *CPU) executeCsr(instr uint32, funct3 uint32, csr uint32, rs1 uint32, rd uint32) error {
+	operand := rs1
+	if funct3&0x4 == 0 {
+		operand = cpu.Regs[rs1]
+	}
+	op := funct3 & 0x3
+
+	// csrrw with rd = x0 doesn't read, and csrrs/csrrc with rs1 = x0 (or uimm = 0) don't write,
+	// which matters for registers where the access itself has an effect
+	var old uint32
+	if op != 1 || rd != 0 {
+		v, err := cpu.ReadCSR(csr)
+		if err != nil {
+			return illegalInstruction(instr, err.Error())
+		}
+		old = v
+	}
+
+	if op == 1 || rs1 != 0 {
+		value := operand
+		switch op {
+		case 2:
+			value = old | operand
+		case 3:
+			value = old &^ operand
+		}
+		if err := cpu.WriteCSR(csr, value); err != nil {
+			return illegalInstruction(instr, err.Error())
+		}
+	}
+
+	cpu.Regs[rd] = old
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ============================================================================
+// CSR fields
+// ============================================================================
+// accessors for the fields of the trap CSRs, so neither the trap logic nor an
+// embedder has to know where the bits are. they read and write the same CSR
+// file the guest does, so a guest's csrw is seen through them and what they set
+// is what the guest reads back. with machine mode the only privilege level,
+// mstatus.MPP always reads as machine mode and the supervisor fields (SIE,
+// SPIE, SPP) don't exist
+
+// PrivMachine is machine mode, as MPP encodes it
+const PrivMachine = 3
+
+// mtvec modes
+const (
+	TVecDirect   = 0 // every trap goes to the base address
+	TVecVectored = 1 // interrupts go to base + 4*code, exceptions to base
+)
+
+// MStatus is mstatus, taken apart
+type MStatus struct {
+	MIE  bool   // machine interrupts are enabled
+	MPIE bool   // MIE before the last trap, restored by mret
+	MPP  uint32 // the privilege level before the last trap (always PrivMachine)
+}
+
+// MStatus returns the fields of mstatus
+func (cpu *CPU) MStatus() MStatus {
+	status := cpu.csrs[CSR_MSTATUS]
+	return MStatus{
+		MIE:  status&(1<<mstatusMIEBit) != 0,
+		MPIE: status&(1<<mstatusMPIEBit) != 0,
+		MPP:  PrivMachine,
+	}
+}
+
+// SetMStatus writes the fields of mstatus (MPP is read-only)
+func (cpu *CPU) SetMStatus(s MStatus) {
+	cpu.SetMStatusMIE(s.MIE)
+	cpu.SetMStatusMPIE(s.MPIE)
+}
+
+// MStatusMIE reports whether machine interrupts are enabled
+func (cpu *CPU) MStatusMIE() bool { return cpu.MStatus().MIE }
+
+// SetMStatusMIE enables or disables machine interrupts
+func (cpu *CPU) SetMStatusMIE(on bool) { cpu.setCSRBit(CSR_MSTATUS, mstatusMIEBit, on) }
+
+// MStatusMPIE reports what MIE was before the last trap
+func (cpu *CPU) MStatusMPIE() bool { return cpu.MStatus().MPIE }
+
+// SetMStatusMPIE sets what mret restores MIE to
+func (cpu *CPU) SetMStatusMPIE(on bool) { cpu.setCSRBit(CSR_MSTATUS, mstatusMPIEBit, on) }
+
+// MCause returns the fields of mcause: whether the last trap was an interrupt, and its
+// cause code (one of the Cause or Interrupt constants)
+func (cpu *CPU) MCause() (interrupt bool, code uint32) {
+	cause := cpu.csrs[CSR_MCAUSE]
+	return cause&mcauseInterrupt != 0, cause &^ mcauseInterrupt
+}
+
+// SetMCause writes mcause
+func (cpu *CPU) SetMCause(interrupt bool, code uint32) {
+	cause := code &^ mcauseInterrupt
+	if interrupt {
+		cause |= mcauseInterrupt
+	}
+	cpu.csrs[CSR_MCAUSE] = cause
+}
+
+// MTVec returns the fields of mtvec: the handler's base address and the mode (TVecDirect or TVecVectored)
+func (cpu *CPU) MTVec() (base, mode uint32) {
+	tvec := cpu.csrs[CSR_MTVEC]
+	return tvec &^ 0x3, tvec & 0x3
+}
+
+// SetMTVec writes mtvec; base must be 4-byte aligned
+func (cpu *CPU) SetMTVec(base, mode uint32) {
+	cpu.csrs[CSR_MTVEC] = base&^0x3 | mode&0x1 // modes 2 and 3 are reserved
+}
+
+// InterruptEnabled reports whether an interrupt's bit is set in mie
+func (cpu *CPU) InterruptEnabled(code uint32) bool {
+	return cpu.csrs[CSR_MIE]&(1<<code) != 0
+}
+
+// SetInterruptEnabled sets or clears an interrupt's bit in mie
+func (cpu *CPU) SetInterruptEnabled(code uint32, on bool) {
+	cpu.setCSRBit(CSR_MIE, code, on && 1<<code&interruptBits != 0)
+}
+
+// InterruptPending reports whether an interrupt's bit is set in mip (see SetInterruptPending)
+func (cpu *CPU) InterruptPending(code uint32) bool {
+	return cpu.csrs[CSR_MIP]&(1<<code) != 0
+}
+
+// setCSRBit sets or clears a bit of a CSR
+func (cpu *CPU) setCSRBit(addr, bit uint32, on bool) {
+	if on {
+		cpu.csrs[addr] |= 1 << bit
+	} else {
+		cpu.csrs[addr] &^= 1 << bit
+	}
+}
+
+// interruptNames are the mie/mip bits of the interrupts
+var interruptNames = map[uint32]string{InterruptSoftware: "MSI", InterruptTimer: "MTI", InterruptExternal: "MEI"}
+
+// causeNames describes the cause codes of mcause
+var causeNames = map[uint32]string{
+	CauseMisalignedFetch:    "instruction address misaligned",
+	CauseFetchAccessFault:   "instruction access fault",
+	CauseIllegalInstruction: "illegal instruction",
+	CauseBreakpoint:         "breakpoint",
+	CauseLoadAccessFault:    "load access fault",
+	CauseStoreAccessFault:   "store access fault",
+	CauseEcallFromM:         "environment call from M-mode",
+}
+
+// DescribeCSR returns the fields of the trap CSRs spelled out, e.g. "MIE=1 MPIE=0 MPP=M"
+// for mstatus; for any other CSR it returns ""
+func (cpu *CPU) DescribeCSR(addr uint32) string {
+	bit := func(on bool) int {
+		if on {
+			return 1
+		}
+		return 0
+	}
+	switch addr {
+	case CSR_MSTATUS:
+		s := cpu.MStatus()
+		return fmt.Sprintf("MIE=%d MPIE=%d MPP=M", bit(s.MIE), bit(s.MPIE))
+	case CSR_MCAUSE:
+		interrupt, code := cpu.MCause()
+		if interrupt {
+			name, ok := interruptNames[code]
+			if !ok {
+				name = "unknown"
+			}
+			return fmt.Sprintf("interrupt %d (%s)", code, name)
+		}
+		name, ok := causeNames[code]
+		if !ok {
+			name = "unknown"
+		}
+		return fmt.Sprintf("exception %d (%s)", code, name)
+	case CSR_MTVEC:
+		base, mode := cpu.MTVec()
+		name := "direct"
+		if mode == TVecVectored {
+			name = "vectored"
+		}
+		return fmt.Sprintf("base=0x%08X mode=%s", base, name)
+	case CSR_MIE, CSR_MIP:
+		var set []string
+		for _, code := range []uint32{InterruptSoftware, InterruptTimer, InterruptExternal} {
+			if cpu.csrs[addr]&(1<<code) != 0 {
+				set = append(set, interruptNames[code])
+			}
+		}
+		if set == nil {
+			return "none"
+		}
+		return strings.Join(set, " ")
+	}
+	return ""
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// csrw executes csrw csr, value as the guest would
+func csrw(t *testing.T, cpu *CPU, csr, value uint32) {
+	t.Helper()
+	cpu.Regs[T0] = value
+	cpu.PC += 4
+	if err := cpu.Execute(encodeI(SYSTEM, ZERO, 0x1, T0, csr)); err != nil {
+		t.Fatalf("csrw 0x%03X, 0x%08X: %v", csr, value, err)
+	}
+}
+
+// csrr executes csrr t1, csr as the guest would
+func csrr(t *testing.T, cpu *CPU, csr uint32) uint32 {
+	t.Helper()
+	cpu.PC += 4
+	if err := cpu.Execute(encodeI(SYSTEM, T1, 0x2, ZERO, csr)); err != nil {
+		t.Fatalf("csrr 0x%03X: %v", csr, err)
+	}
+	return cpu.Regs[T1]
+}
+
+func TestMStatusAccessors(t *testing.T) {
+	cpu := NewCPU()
+	if s := cpu.MStatus(); s != (MStatus{MPP: PrivMachine}) {
+		t.Errorf("MStatus at reset = %+v", s)
+	}
+	cpu.SetMStatusMIE(true)
+	if got := csrr(t, &cpu, CSR_MSTATUS); got != 0x1808 { // MPP=11 at bits 12:11, MIE at bit 3
+		t.Errorf("mstatus = 0x%08X after SetMStatusMIE, want 0x00001808", got)
+	}
+	cpu.SetMStatus(MStatus{MPIE: true})
+	if got := csrr(t, &cpu, CSR_MSTATUS); got != 0x1880 { // MPIE at bit 7
+		t.Errorf("mstatus = 0x%08X after SetMStatus(MPIE), want 0x00001880", got)
+	}
+
+	// only MIE and MPIE are writable
+	csrw(t, &cpu, CSR_MSTATUS, 0xFFFFFFFF)
+	if s := cpu.MStatus(); !s.MIE || !s.MPIE || s.MPP != PrivMachine || !cpu.MStatusMIE() || !cpu.MStatusMPIE() {
+		t.Errorf("MStatus = %+v after writing all ones", s)
+	}
+	if got := csrr(t, &cpu, CSR_MSTATUS); got != 0x1888 {
+		t.Errorf("mstatus = 0x%08X after writing all ones, want 0x00001888", got)
+	}
+	csrw(t, &cpu, CSR_MSTATUS, 1<<7)
+	if s := cpu.MStatus(); s.MIE || !s.MPIE {
+		t.Errorf("MStatus = %+v after writing MPIE alone", s)
+	}
+}
+
+func TestMCauseAndMTVecAccessors(t *testing.T) {
+	cpu := NewCPU()
+	csrw(t, &cpu, CSR_MCAUSE, 0x80000007)
+	if interrupt, code := cpu.MCause(); !interrupt || code != InterruptTimer {
+		t.Errorf("MCause = %v, %d after writing 0x80000007", interrupt, code)
+	}
+	cpu.SetMCause(false, CauseIllegalInstruction)
+	if got := csrr(t, &cpu, CSR_MCAUSE); got != 2 {
+		t.Errorf("mcause = 0x%08X after SetMCause(false, 2)", got)
+	}
+	cpu.SetMCause(true, InterruptExternal)
+	if got := csrr(t, &cpu, CSR_MCAUSE); got != 0x8000000B {
+		t.Errorf("mcause = 0x%08X after SetMCause(true, 11)", got)
+	}
+
+	csrw(t, &cpu, CSR_MTVEC, 0x1001)
+	if base, mode := cpu.MTVec(); base != 0x1000 || mode != TVecVectored {
+		t.Errorf("MTVec = 0x%X, %d after writing 0x1001", base, mode)
+	}
+	cpu.SetMTVec(0x2004, TVecDirect)
+	if got := csrr(t, &cpu, CSR_MTVEC); got != 0x2004 {
+		t.Errorf("mtvec = 0x%08X after SetMTVec(0x2004, direct)", got)
+	}
+	cpu.SetMTVec(0x2007, 3) // a misaligned base and a reserved mode
+	if got := csrr(t, &cpu, CSR_MTVEC); got != 0x2005 {
+		t.Errorf("mtvec = 0x%08X after SetMTVec(0x2007, 3), want 0x00002005", got)
+	}
+}
+
+func TestInterruptEnableAccessors(t *testing.T) {
+	cpu := NewCPU()
+	cpu.SetInterruptEnabled(InterruptTimer, true)
+	cpu.SetInterruptEnabled(5, true) // not a machine interrupt: ignored
+	if got := csrr(t, &cpu, CSR_MIE); got != 1<<7 {
+		t.Errorf("mie = 0x%08X, want 0x00000080", got)
+	}
+	csrw(t, &cpu, CSR_MIE, 1<<3|1<<11)
+	if !cpu.InterruptEnabled(InterruptSoftware) || !cpu.InterruptEnabled(InterruptExternal) || cpu.InterruptEnabled(InterruptTimer) {
+		t.Errorf("InterruptEnabled disagrees with mie = 0x%08X", cpu.csrs[CSR_MIE])
+	}
+	csrw(t, &cpu, CSR_MIP, 1<<3)
+	if !cpu.InterruptPending(InterruptSoftware) || cpu.InterruptPending(InterruptTimer) {
+		t.Errorf("InterruptPending disagrees with mip = 0x%08X", cpu.csrs[CSR_MIP])
+	}
+}
+
+// a trap and mret move MIE and MPIE, and the accessors see it
+func TestTrapThroughAccessors(t *testing.T) {
+	cpu := NewCPU()
+	cpu.LoadProgram(assemble(t, func(b *Builder) {
+		b.Ecall()
+		b.Label("handler")
+		b.Mret()
+	}))
+	cpu.SetMTVec(4, TVecDirect)
+	cpu.SetMStatusMIE(true)
+	if err := cpu.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if interrupt, code := cpu.MCause(); interrupt || code != CauseEcallFromM || cpu.MStatusMIE() || !cpu.MStatusMPIE() || cpu.PC != 4 {
+		t.Errorf("after ecall: mcause %v/%d, %+v, pc 0x%X", interrupt, code, cpu.MStatus(), cpu.PC)
+	}
+	if err := cpu.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if !cpu.MStatusMIE() || !cpu.MStatusMPIE() || cpu.PC != 0 {
+		t.Errorf("after mret: %+v, pc 0x%X", cpu.MStatus(), cpu.PC)
+	}
+}
+
+func TestDescribeCSR(t *testing.T) {
+	cpu := NewCPU()
+	cpu.SetMStatusMPIE(true)
+	cpu.SetMCause(false, CauseLoadAccessFault)
+	cpu.SetMTVec(0x100, TVecVectored)
+	cpu.SetInterruptEnabled(InterruptTimer, true)
+	cpu.SetInterruptEnabled(InterruptSoftware, true)
+	for addr, want := range map[uint32]string{
+		CSR_MSTATUS: "MIE=0 MPIE=1 MPP=M",
+		CSR_MCAUSE:  "exception 5 (load access fault)",
+		CSR_MTVEC:   "base=0x00000100 mode=vectored",
+		CSR_MIE:     "MSI MTI",
+		CSR_MIP:     "none",
+		CSR_MEPC:    "",
+	} {
+		if got := cpu.DescribeCSR(addr); got != want {
+			t.Errorf("DescribeCSR(%s) = %q, want %q", CSRNames[addr], got, want)
+		}
+	}
+	cpu.SetMCause(true, InterruptTimer)
+	if got := cpu.DescribeCSR(CSR_MCAUSE); got != "interrupt 7 (MTI)" {
+		t.Errorf("DescribeCSR(mcause) = %q for a timer interrupt", got)
+	}
+
+	// the debugger's csr command prints the fields
+	var out strings.Builder
+	NewDebugger(&cpu, strings.NewReader("csr mstatus\ncsr\nquit\n"), &out, 0).Loop()
+	for _, want := range []string{"mstatus   0x00001880  MIE=0 MPIE=1 MPP=M\n", "mtvec     0x00000101  base=0x00000100 mode=vectored\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("debugger output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// ============================================================================
+// Custom instructions
+// ============================================================================
+// the four major opcodes the ISA leaves to custom extensions (custom-0 to
+// custom-3) can be given handlers with RegisterCustomOpcode, to try out an
+// instruction without touching the decoder. an instruction with a registered
+// opcode runs its handler where it would otherwise be illegal; the handler gets
+// the fields decoded both ways the R and I formats have them, and works on the
+// machine through the usual accessors (Regs, Load, Store, ...). returning an
+// *Exception traps like any instruction's would, and the PC already points past
+// the instruction, so a handler may also jump by setting it.
+//
+// the handlers belong to the CPU (a Clone has the same ones). custom instructions
+// always go through Step, never into a basic block, so they're a little slower
+// than built-in ones. the Builder writes them with InsnR and InsnI, and the
+// disassembler shows them the way the GNU assembler's .insn directive takes them
+
+// the custom opcodes
+const (
+	CUSTOM_0 = 0x0B
+	CUSTOM_1 = 0x2B
+	CUSTOM_2 = 0x5B
+	CUSTOM_3 = 0x7B
+)
+
+// customOpcodes are the opcodes RegisterCustomOpcode accepts, in order
+var customOpcodes = []uint32{CUSTOM_0, CUSTOM_1, CUSTOM_2, CUSTOM_3}
+
+// DecodedInstruction is a custom instruction taken apart for its handler
+type DecodedInstruction struct {
+	Instr          uint32 // the whole encoding
+	Opcode         uint32
+	Rd, Rs1, Rs2   uint32 // register numbers (index Regs with them)
+	Funct3, Funct7 uint32
+	Imm            int32 // bits 31:20, sign-extended, as in an I-type instruction
+}
+
+// CustomHandler executes a custom instruction
+type CustomHandler func(cpu *CPU, d DecodedInstruction) error
+
+// RegisterCustomOpcode makes handler execute the instructions with opcode, which
+// must be one of the custom ones. a nil handler makes them illegal again
+func (cpu *CPU) RegisterCustomOpcode(opcode uint32, handler func(*CPU, DecodedInstruction) error) error {
+	if !slices.Contains(customOpcodes, opcode) {
+		return fmt.Errorf("opcode 0x%02X is not a custom opcode (0x0B, 0x2B, 0x5B or 0x7B)", opcode)
+	}
+	if handler == nil {
+		delete(cpu.custom, opcode)
+		return nil
+	}
+	if cpu.custom == nil {
+		cpu.custom = make(map[uint32]CustomHandler)
+	}
+	cpu.custom[opcode] = handler
+	return nil
+}
+
+// executeCustom runs d with h, its opcode's handler
+func (cpu *CPU) executeCustom(h CustomHandler, d *decoded) error {
+	return h(cpu, DecodedInstruction{
+		Instr:  d.instr,
+		Opcode: d.opcode,
+		Rd:     d.rd,
+		Rs1:    d.rs1,
+		Rs2:    d.rs2,
+		Funct3: d.funct3,
+		Funct7: d.funct7,
+		Imm:    int32(ImmI(d.instr)),
+	})
+}
+
+// disassembleCustom returns instr, if it has a custom opcode, as an R-type .insn directive
+func disassembleCustom(instr uint32) (string, bool) {
+	d := decode(instr)
+	i := slices.Index(customOpcodes, d.opcode)
+	if i < 0 {
+		return "", false
+	}
+	return fmt.Sprintf(".insn r CUSTOM_%d, %d, %d, %s, %s, %s", i, d.funct3, d.funct7, abiNames[d.rd], abiNames[d.rs1], abiNames[d.rs2]), true
+}
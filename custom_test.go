@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// customProgram runs a custom-0 multiply-add and a custom-1 add-immediate
+func customProgram(b *Builder) {
+	b.Li(A0, 6)
+	b.Li(A1, 7)
+	b.InsnR(CUSTOM_0, 1, 3, A2, A0, A1) // 0x8
+	b.InsnI(CUSTOM_1, 2, A3, A0, -5)    // 0xC
+	b.Ebreak()
+}
+
+// registerCustom gives cpu customProgram's handlers, a2 = a0*a1 + funct7 and
+// a3 = a0 + imm, which note what they get in seen
+func registerCustom(t *testing.T, cpu *CPU, seen *[]DecodedInstruction) {
+	t.Helper()
+	handlers := map[uint32]CustomHandler{
+		CUSTOM_0: func(cpu *CPU, d DecodedInstruction) error {
+			*seen = append(*seen, d)
+			cpu.Regs[d.Rd] = cpu.Regs[d.Rs1]*cpu.Regs[d.Rs2] + d.Funct7
+			return nil
+		},
+		CUSTOM_1: func(cpu *CPU, d DecodedInstruction) error {
+			*seen = append(*seen, d)
+			cpu.Regs[d.Rd] = cpu.Regs[d.Rs1] + uint32(d.Imm)
+			return nil
+		},
+	}
+	for opcode, h := range handlers {
+		if err := cpu.RegisterCustomOpcode(opcode, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCustomOpcode(t *testing.T) {
+	program := assemble(t, customProgram)
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(program)
+	var seen []DecodedInstruction
+	registerCustom(t, &cpu, &seen)
+	runToEbreak(t, &cpu)
+
+	if cpu.Regs[A2] != 6*7+3 || cpu.Regs[A3] != 1 {
+		t.Fatalf("a2=%d a3=%d, want 45 and 1", cpu.Regs[A2], cpu.Regs[A3])
+	}
+	r := binary.LittleEndian.Uint32(program[0x8:])
+	i := binary.LittleEndian.Uint32(program[0xC:])
+	want := []DecodedInstruction{
+		{Instr: r, Opcode: CUSTOM_0, Rd: A2, Rs1: A0, Rs2: A1, Funct3: 1, Funct7: 3, Imm: int32(A1 | 3<<5)},
+		{Instr: i, Opcode: CUSTOM_1, Rd: A3, Rs1: A0, Rs2: 0x1B, Funct3: 2, Funct7: 0x7F, Imm: -5},
+	}
+	if len(seen) != len(want) || seen[0] != want[0] || seen[1] != want[1] {
+		t.Fatalf("the handlers got %+v, want %+v", seen, want)
+	}
+
+	for _, tt := range []struct {
+		instr uint32
+		want  string
+	}{
+		{r, ".insn r CUSTOM_0, 1, 3, a2, a0, a1"},
+		{i, ".insn r CUSTOM_1, 2, 127, a3, a0, s11"},
+		{r&^0x7F | CUSTOM_3, ".insn r CUSTOM_3, 1, 3, a2, a0, a1"},
+	} {
+		// not ok, since whether it runs depends on the CPU
+		if text, ok := Disassemble(tt.instr, 0x8); ok || text != tt.want {
+			t.Errorf("Disassemble(0x%08X) = %q, %v; want %q, false", tt.instr, text, ok, tt.want)
+		}
+	}
+}
+
+// without a handler, or after a nil one, a custom instruction is illegal
+func TestCustomOpcodeIllegal(t *testing.T) {
+	program := assemble(t, customProgram)
+	instr := binary.LittleEndian.Uint32(program[0x8:])
+	var seen []DecodedInstruction
+	for _, register := range []bool{false, true} {
+		cpu := NewCPUWithMemory(0x1000)
+		cpu.LoadProgram(program)
+		if register {
+			registerCustom(t, &cpu, &seen)
+			if err := cpu.RegisterCustomOpcode(CUSTOM_0, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := cpu.Run(100)
+		var exc *Exception
+		if !errors.As(err, &exc) || exc.Cause != CauseIllegalInstruction || exc.Tval != instr {
+			t.Fatalf("registered %v: stopped with %v, want the custom-0 instruction illegal", register, err)
+		}
+	}
+	if len(seen) != 0 {
+		t.Fatalf("a removed handler ran: %+v", seen)
+	}
+
+	cpu := NewCPUWithMemory(0x1000)
+	for _, opcode := range []uint32{OP, CUSTOM_0 + 1, 0x77} {
+		if err := cpu.RegisterCustomOpcode(opcode, func(*CPU, DecodedInstruction) error { return nil }); err == nil {
+			t.Errorf("RegisterCustomOpcode(0x%02X) accepted a non-custom opcode", opcode)
+		}
+	}
+}
+
+// an *Exception from a handler traps to mtvec like any instruction's
+func TestCustomOpcodeTrap(t *testing.T) {
+	const trap = 0x40
+	program := assemble(t, func(b *Builder) {
+		b.Li(T0, trap)
+		b.Csrrw(ZERO, CSR_MTVEC, T0)
+		b.InsnR(CUSTOM_2, 0, 0, A0, ZERO, ZERO) // 0x8
+		b.Li(S0, 1)
+		b.Ebreak()
+		b.Space(trap - b.Len())
+		b.Csrrs(A1, CSR_MCAUSE, ZERO)
+		b.Csrrs(A2, CSR_MEPC, ZERO)
+		b.Csrrs(A3, CSR_MTVAL, ZERO)
+		b.Ebreak()
+	})
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(program)
+	err := cpu.RegisterCustomOpcode(CUSTOM_2, func(cpu *CPU, d DecodedInstruction) error {
+		return &Exception{Cause: CauseIllegalInstruction, Tval: d.Instr, Msg: "refused"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runToEbreak(t, &cpu)
+	instr := binary.LittleEndian.Uint32(program[0x8:])
+	if cpu.Regs[S0] != 0 || cpu.Regs[A1] != CauseIllegalInstruction || cpu.Regs[A2] != 0x8 || cpu.Regs[A3] != instr {
+		t.Fatalf("s0=%d mcause=%d mepc=0x%X mtval=0x%08X, want the trap from 0x8 with mtval 0x%08X",
+			cpu.Regs[S0], cpu.Regs[A1], cpu.Regs[A2], cpu.Regs[A3], instr)
+	}
+}
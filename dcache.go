@@ -0,0 +1,90 @@
+package main
+
+// ============================================================================
+// Decoded-instruction cache
+// ============================================================================
+// Step keeps the decoded form of every instruction it executes, so a loop only
+// pays for fetching and decoding its body once. entries are grouped in pages
+// that are allocated the first time code runs in them.
+//
+// coherence: every write to RAM (guest stores, loaders, syscall handlers, the
+// debugger) drops the entries it covers as it happens, so a program that rewrites
+// its own code sees the new instructions at once, with or without a FENCE.I.
+// FENCE.I flushes the whole cache, which is what the spec requires of it.
+// writes outside the range of addresses that have entries cost one comparison
+
+const dcachePageSize = 4096 // bytes of code per page
+
+type dcacheEntry struct {
+	decoded
+	valid bool
+}
+
+type decodeCache struct {
+	pages  [][]dcacheEntry // indexed by (address - base) / dcachePageSize, nil until used
+	base   uint32          // the address of RAM (see WithRAMBase)
+	lo, hi uint32          // every valid entry is inside [lo, hi)
+}
+
+// WithoutDecodeCache makes Step fetch and decode every instruction afresh (e.g. to rule the cache out while debugging)
+func WithoutDecodeCache() Option {
+	return func(cpu *CPU) {
+		cpu.dcache = nil
+	}
+}
+
+func newDecodeCache(memSize int) *decodeCache {
+	return &decodeCache{pages: make([][]dcacheEntry, (memSize+dcachePageSize-1)/dcachePageSize)}
+}
+
+// lookup returns the cached decode of the instruction at pc, or nil
+func (c *decodeCache) lookup(pc int) *decoded {
+	off := pc - int(c.base)
+	page := off / dcachePageSize
+	if off < 0 || off%4 != 0 || page >= len(c.pages) || c.pages[page] == nil {
+		return nil
+	}
+	e := &c.pages[page][off%dcachePageSize/4]
+	if !e.valid {
+		return nil
+	}
+	return &e.decoded
+}
+
+// insert caches d as the instruction at pc (which must be word aligned and inside memory)
+func (c *decodeCache) insert(pc int, d decoded) {
+	off := pc - int(c.base)
+	page := off / dcachePageSize
+	if page >= len(c.pages) {
+		return
+	}
+	if c.pages[page] == nil {
+		c.pages[page] = make([]dcacheEntry, dcachePageSize/4)
+	}
+	c.pages[page][off%dcachePageSize/4] = dcacheEntry{decoded: d, valid: true}
+	if c.lo == c.hi {
+		c.lo, c.hi = uint32(pc), uint32(pc)+4
+	} else {
+		c.lo, c.hi = min(c.lo, uint32(pc)), max(c.hi, uint32(pc)+4)
+	}
+}
+
+// invalidate drops the entries of instructions overlapping [addr, addr+n)
+func (c *decodeCache) invalidate(addr, n uint32) {
+	end := uint64(addr) + uint64(n)
+	if n == 0 || uint64(addr) >= uint64(c.hi) || end <= uint64(c.lo) {
+		return
+	}
+	for a := uint64(max(addr, c.lo)) &^ 3; a < min(end, uint64(c.hi)); a += 4 {
+		off := a - uint64(c.base)
+		if p := c.pages[off/dcachePageSize]; p != nil {
+			p[off%dcachePageSize/4].valid = false
+		}
+	}
+}
+
+// flush drops every entry
+func (c *decodeCache) flush() {
+	clear(c.pages)
+	c.lo, c.hi = 0, 0
+}
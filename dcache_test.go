@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+// selfModifyingProgram runs a loop three times that, each time round, rewrites
+// the instruction after its store (optionally with a fence.i between them) to
+// addi a0, zero, 5+i and adds the a0 it produces to s2. the first time the new
+// instruction is in the block being executed, and later it's been decoded too
+func selfModifyingProgram(fenceI bool) func(b *Builder) {
+	var target int32
+	build := func(b *Builder) {
+		b.Li(T0, target)
+		b.Li(T3, int32(encodeI(OP_IMM, A0, 0x0, ZERO, 5)))
+		b.Label("loop")
+		b.Slli(T2, S1, 20)
+		b.Add(T2, T2, T3)
+		b.Sw(T2, T0, 0)
+		if fenceI {
+			b.FenceI()
+		}
+		target = int32(b.Len())
+		b.Addi(A0, ZERO, 1)
+		b.Add(S2, S2, A0)
+		b.Addi(S1, S1, 1)
+		b.Li(T1, 3)
+		b.Blt(S1, T1, "loop")
+		b.Ebreak()
+	}
+	return func(b *Builder) {
+		var first Builder
+		build(&first) // to find the target's address
+		build(b)
+	}
+}
+
+// whichever caches are in use, a store to code is seen by the next fetch of it,
+// with or without a fence.i
+func TestSelfModifyingCode(t *testing.T) {
+	for _, fenceI := range []bool{false, true} {
+		program := assemble(t, selfModifyingProgram(fenceI))
+		for _, mode := range tortureModes {
+			cpu := NewCPUWithMemory(0x1000, mode.opts...)
+			cpu.LoadProgram(program)
+			runToEbreak(t, &cpu)
+			if cpu.Regs[A0] != 7 || cpu.Regs[S2] != 5+6+7 {
+				t.Errorf("fence.i %v, %s: a0=%d s2=%d, want the rewritten instructions' 7 and 18", fenceI, mode.name, cpu.Regs[A0], cpu.Regs[S2])
+			}
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Debugger is a small interactive REPL around a CPU, started by `run --debug`.
+// it reads one command per line from in and writes its answers to out
+type Debugger struct {
+	cpu         *CPU
+	in          *bufio.Scanner
+	out         io.Writer
+	breakpoints map[int]bool // addresses where `continue` stops
+	budget      uint64       // maximum instructions to execute in total (0 means no limit)
+}
+
+func NewDebugger(cpu *CPU, in io.Reader, out io.Writer, budget uint64) *Debugger {
+	return &Debugger{
+		cpu:         cpu,
+		in:          bufio.NewScanner(in),
+		out:         out,
+		breakpoints: make(map[int]bool),
+		budget:      budget,
+	}
+}
+
+const debuggerHelp = `commands:
+  step [n]                 (s)  execute n instructions (default 1)
+  continue                 (c)  run until a breakpoint, an error, or the instruction limit
+  break <addr>             (b)  set a breakpoint
+  trace <addr> [if <cond>] <message>
+                                print message (e.g. "i={a0} top={mem32[sp]:x}") whenever
+                                execution reaches addr and cond (an expression without
+                                spaces) holds, without stopping
+  delete <addr>            (d)  remove the breakpoint and the tracepoints at addr
+  breakpoints                   list breakpoints and tracepoints
+  regs                     (r)  show all registers
+  csr [name]                    show the trap CSRs (or the named one) with their fields
+  mem <addr> [n]           (x)  show n words of memory starting at addr (default 4)
+  dump <addr> <len> <file>      save len bytes of memory starting at addr to file
+  restore <file> <addr>         load file into memory starting at addr
+  core <file>                   write an ELF core file of the machine for gdb
+  pc                            show the program counter
+  help                     (h)  show this help
+  quit                     (q)  stop debugging
+`
+
+// Loop runs the REPL until `quit` or end of input.
+// it returns the error that stopped the guest, if any
+func (d *Debugger) Loop() error {
+	fmt.Fprintf(d.out, "debugging, pc=0x%08X (type `help` for commands)\n", d.cpu.PC)
+	for {
+		fmt.Fprint(d.out, "(rvdb) ")
+		if !d.in.Scan() {
+			fmt.Fprintln(d.out)
+			return d.in.Err()
+		}
+
+		fields := strings.Fields(d.in.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		quit, err := d.command(fields[0], fields[1:])
+		if err != nil {
+			fmt.Fprintf(d.out, "error: %v\n", err)
+		}
+		if quit {
+			return nil
+		}
+	}
+}
+
+// command executes a single REPL command and reports whether the REPL should exit
+func (d *Debugger) command(name string, args []string) (quit bool, err error) {
+	switch name {
+	case "step", "s":
+		n := uint64(1)
+		if len(args) > 0 {
+			if n, err = strconv.ParseUint(args[0], 0, 64); err != nil {
+				return false, fmt.Errorf("bad step count %q", args[0])
+			}
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := d.step(); err != nil {
+				return false, err
+			}
+		}
+		fmt.Fprintf(d.out, "pc=0x%08X\n", d.cpu.PC)
+
+	case "continue", "c":
+		for {
+			if err := d.step(); err != nil {
+				return false, err
+			}
+			if d.breakpoints[d.cpu.PC] {
+				fmt.Fprintf(d.out, "breakpoint at 0x%08X\n", d.cpu.PC)
+				return false, nil
+			}
+		}
+
+	case "break", "b", "delete", "d":
+		if len(args) != 1 {
+			return false, fmt.Errorf("usage: %s <addr>", name)
+		}
+		addr, err := parseAddress(args[0])
+		if err != nil {
+			return false, err
+		}
+		if name == "break" || name == "b" {
+			d.breakpoints[int(addr)] = true
+		} else {
+			delete(d.breakpoints, int(addr))
+			d.cpu.ClearTracepoints(int(addr))
+		}
+
+	case "trace":
+		if len(args) < 2 || args[1] == "if" && len(args) < 4 {
+			return false, fmt.Errorf("usage: trace <addr> [if <cond>] <message>")
+		}
+		addr, err := parseAddress(args[0])
+		if err != nil {
+			return false, err
+		}
+		cond, message := "", args[1:]
+		if message[0] == "if" {
+			cond, message = message[1], message[2:]
+		}
+		if _, err := d.cpu.SetTracepoint(int(addr), cond, strings.Join(message, " "), d.out); err != nil {
+			return false, err
+		}
+
+	case "breakpoints":
+		addrs := make([]int, 0, len(d.breakpoints))
+		for addr := range d.breakpoints {
+			addrs = append(addrs, addr)
+		}
+		sort.Ints(addrs)
+		for _, addr := range addrs {
+			fmt.Fprintf(d.out, "0x%08X\n", addr)
+		}
+		for _, t := range d.cpu.Tracepoints() {
+			fmt.Fprintf(d.out, "trace %s\n", t)
+		}
+
+	case "regs", "r":
+		printRegisters(d.out, d.cpu)
+
+	case "csr":
+		if len(args) > 1 {
+			return false, fmt.Errorf("usage: csr [name]")
+		}
+		addrs := reportedCSRs
+		if len(args) == 1 {
+			addr, ok := csrNamed(args[0])
+			if !ok {
+				return false, fmt.Errorf("unknown csr %q", args[0])
+			}
+			addrs = []uint32{addr}
+		}
+		for _, addr := range addrs {
+			v, err := d.cpu.ReadCSR(addr)
+			if err != nil {
+				return false, err
+			}
+			line := fmt.Sprintf("%-9s 0x%08X  %s", CSRNames[addr], v, d.cpu.DescribeCSR(addr))
+			fmt.Fprintln(d.out, strings.TrimRight(line, " "))
+		}
+
+	case "mem", "x":
+		if len(args) < 1 || len(args) > 2 {
+			return false, fmt.Errorf("usage: %s <addr> [n]", name)
+		}
+		addr, err := parseAddress(args[0])
+		if err != nil {
+			return false, err
+		}
+		n := uint64(4)
+		if len(args) == 2 {
+			if n, err = strconv.ParseUint(args[1], 0, 32); err != nil {
+				return false, fmt.Errorf("bad word count %q", args[1])
+			}
+		}
+		for i := uint64(0); i < n; i++ {
+			a := uint64(addr) + i*4
+			off, ok := d.cpu.ramOffset(uint32(a), 4)
+			if !ok || a+4 > 1<<32 {
+				return false, fmt.Errorf("address 0x%08X is outside memory", a)
+			}
+			fmt.Fprintf(d.out, "0x%08X: %08X\n", a, binary.LittleEndian.Uint32(d.cpu.Memory[off:off+4]))
+		}
+
+	case "dump":
+		if len(args) != 3 {
+			return false, fmt.Errorf("usage: dump <addr> <len> <file>")
+		}
+		addr, err := parseAddress(args[0])
+		if err != nil {
+			return false, err
+		}
+		length, err := strconv.ParseUint(args[1], 0, 32)
+		if err != nil {
+			return false, fmt.Errorf("bad length %q", args[1])
+		}
+		if err := d.cpu.DumpMemory(args[2], addr, uint32(length)); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(d.out, "wrote %d bytes from 0x%08X to %s\n", length, addr, args[2])
+
+	case "restore":
+		if len(args) != 2 {
+			return false, fmt.Errorf("usage: restore <file> <addr>")
+		}
+		addr, err := parseAddress(args[1])
+		if err != nil {
+			return false, err
+		}
+		n, err := d.cpu.LoadMemory(args[0], addr)
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(d.out, "loaded %d bytes from %s to 0x%08X\n", n, args[0], addr)
+
+	case "core":
+		if len(args) != 1 {
+			return false, fmt.Errorf("usage: core <file>")
+		}
+		if err := d.cpu.DumpCore(args[0], nil); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(d.out, "wrote a core file to %s\n", args[0])
+
+	case "pc":
+		fmt.Fprintf(d.out, "pc=0x%08X\n", d.cpu.PC)
+
+	case "help", "h":
+		fmt.Fprint(d.out, debuggerHelp)
+
+	case "quit", "q":
+		return true, nil
+
+	default:
+		return false, fmt.Errorf("unknown command %q (type `help` for commands)", name)
+	}
+	return false, nil
+}
+
+// step executes one instruction, respecting the instruction budget
+func (d *Debugger) step() error {
+	if d.budget != 0 && d.cpu.Retired >= d.budget {
+		return fmt.Errorf("instruction limit of %d reached", d.budget)
+	}
+	if d.cpu.Exited {
+		return fmt.Errorf("program has exited with code %d", d.cpu.ExitCode)
+	}
+	if err := d.cpu.Step(); err != nil {
+		return err
+	}
+	if d.cpu.halted {
+		d.cpu.halted = false
+		return fmt.Errorf("stopped: %s", d.cpu.haltReason)
+	}
+	return nil
+}
+
+// csrNamed looks a CSR up by name, or by number (e.g. 0x300)
+func csrNamed(s string) (uint32, bool) {
+	for addr, name := range CSRNames {
+		if name == s {
+			return addr, true
+		}
+	}
+	addr, err := strconv.ParseUint(s, 0, 12)
+	if err != nil {
+		return 0, false
+	}
+	_, ok := CSRNames[uint32(addr)]
+	return uint32(addr), ok
+}
+
+// parseAddress accepts decimal or 0x-prefixed hex addresses
+func parseAddress(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad address %q", s)
+	}
+	return uint32(v), nil
+}
+
+// printRegisters writes all 32 registers, four per line, in hex
+func printRegisters(w io.Writer, cpu *CPU) {
+	for i, name := range cpu.RegNames {
+		fmt.Fprintf(w, "%-4s = %08X", name, cpu.Regs[i])
+		if i%4 == 3 {
+			fmt.Fprintln(w)
+		} else {
+			fmt.Fprint(w, "  ")
+		}
+	}
+	fmt.Fprintf(w, "pc   = %08X\n", cpu.PC)
+}
@@ -0,0 +1,66 @@
+package main
+
+// ============================================================================
+// Instruction decoding
+// ============================================================================
+
+// decoded is an instruction taken apart into its fields. imm holds the immediate
+// of whichever format the opcode uses (already sign-extended where the format is signed)
+type decoded struct {
+	instr  uint32
+	opcode uint32
+	rd     uint32
+	funct3 uint32
+	rs1    uint32
+	rs2    uint32
+	funct7 uint32
+	imm    uint32
+	exec   handler // nil if it's not an implemented instruction
+}
+
+// decode extracts the fields of instr and finds its handler
+func decode(instr uint32) decoded {
+	// the bit masking (instr & 0x7F) extracts the opcode from the instruction
+	// the bitwise AND op with 0x7F masks out all but the lowest 7 bits of the instruction, which is the opcode
+	// 7 bits because `0x7F` is `0111 1111` - 7 ones and 1 zero
+	// and remember an AND op is a binary operation that takes two operands and returns 1 if both are 1, otherwise 0
+	// so our `instr` which is a 32-bit word (4 bytes) will be masked to only the lowest 7 bits
+	// (according to the risc-v specs, the opcode takes up 7 bits)
+	d := decoded{
+		instr:  instr,
+		opcode: instr & 0x7F, // mask out all but the lowest 7 bits to get the opcode (as explained above)
+
+		// these fields sit at the same position in every format that has them,
+		// so we extract them once up front (formats without them just ignore them)
+		rd:     (instr >> 7) & 0x1F,  // shift right by 7 bits and mask out all but the lowest 5 bits to get the rd (destination register)
+		funct3: (instr >> 12) & 0x7,  // shift right by 12 bits and mask out all but the lowest 3 bits to get the funct3 (function code)
+		rs1:    (instr >> 15) & 0x1F, // shift right by 15 bits and mask out all but the lowest 5 bits to get the rs1 (source register 1)
+		rs2:    (instr >> 20) & 0x1F, // shift right by 20 bits and mask out all but the lowest 5 bits to get the rs2 (source register 2)
+		funct7: (instr >> 25) & 0x7F, // shift right by 25 bits and mask out all but the lowest 7 bits to get the funct7 (function code)
+	}
+
+	// the immediate is laid out differently in each format, see bits.go
+	switch d.opcode {
+	case OP_IMM, LOAD, JALR, SYSTEM:
+		// I-type format: [imm[11:0]][rs1][funct3][rd][opcode]
+		d.imm = ImmI(instr)
+
+	case STORE:
+		// S-type format: [imm[11:5]][rs2][rs1][funct3][imm[4:0]][opcode]
+		d.imm = ImmS(instr)
+
+	case BRANCH:
+		// B-type format: [imm[12|10:5]][rs2][rs1][funct3][imm[4:1|11]][opcode]
+		d.imm = ImmB(instr)
+
+	case LUI, AUIPC:
+		// U-type format: [imm[31:12]][rd][opcode]
+		d.imm = ImmU(instr)
+
+	case JAL:
+		// J-type format: [imm[20|10:1|11|19:12]][rd][opcode]
+		d.imm = ImmJ(instr)
+	}
+	d.exec = lookup(&d)
+	return d
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestDemo compares the demo's output with testdata/demo.golden (-update rewrites it)
+func TestDemo(t *testing.T) {
+	var out bytes.Buffer
+	runDemo(&out)
+	golden := filepath.Join("testdata", "demo.golden")
+	if *update {
+		if err := os.WriteFile(golden, out.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != string(want) {
+		t.Errorf("the demo's output changed (run with -update if that's intended)\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// the demo's program computes what its output says it does
+func TestDemoProgram(t *testing.T) {
+	cpu, reason := RunAsm(t, func(b *Builder) {
+		for _, instr := range demoProgram {
+			b.Word(instr)
+		}
+		b.Ebreak()
+	})
+	if reason != StopBreakpoint {
+		t.Fatalf("stopped with %v, want the ebreak", reason)
+	}
+	RequireReg(t, cpu, "a0", 0x12345000)
+	RequireReg(t, cpu, "a1", 42)
+	RequireReg(t, cpu, "a2", 0x1234502A)
+	RequireReg(t, cpu, "a3", 0x12345000)
+	RequireWord(t, cpu, 0, 0x1234502A) // sp is 0, so the store overwrote the lui
+}
+
+func TestCmdDemo(t *testing.T) {
+	code, stdout, _ := runCommand("demo")
+	if code != 0 || !strings.HasPrefix(stdout, "RISC-V CPU Emulator\n") {
+		t.Errorf("exit %d:\n%s", code, stdout)
+	}
+	if code, _, stderr := runCommand("demo", "extra"); code != 2 || !strings.Contains(stderr, "takes no arguments") {
+		t.Errorf("with an argument: exit %d, stderr %q", code, stderr)
+	}
+}
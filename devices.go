@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/rand/v2"
+	"time"
+)
+
+// ============================================================================
+// Small devices: real-time clock and entropy source
+// ============================================================================
+
+// RTC is a Goldfish-style real-time clock: TIME_LOW and TIME_HIGH hold
+// nanoseconds since the Unix epoch. reading TIME_LOW latches the whole value so
+// a following read of TIME_HIGH is consistent with it.
+// in deterministic mode the time is derived from mtime (starting at the epoch)
+// instead of the host clock
+type RTC struct {
+	cpu     *CPU
+	latched uint64
+}
+
+const (
+	rtcTimeLow  = 0x00
+	rtcTimeHigh = 0x04
+	RTCSize     = 0x1000
+)
+
+func NewRTC(cpu *CPU) *RTC {
+	return &RTC{cpu: cpu}
+}
+
+// now returns the current time in nanoseconds since the epoch
+func (r *RTC) now() uint64 {
+	if r.cpu.deterministic {
+		return r.cpu.Time() * (uint64(time.Second) / TimebaseHz)
+	}
+	return uint64(time.Now().UnixNano())
+}
+
+func (r *RTC) Read(offset, size uint32) (uint32, error) {
+	switch offset {
+	case rtcTimeLow:
+		r.latched = r.now()
+		return uint32(r.latched), nil
+	case rtcTimeHigh:
+		return uint32(r.latched >> 32), nil
+	}
+	return 0, nil
+}
+
+func (r *RTC) Write(offset, size, value uint32) error {
+	return nil // the clock can't be set
+}
+
+// RNG is an entropy source: every read of its data register returns fresh random bits.
+// in deterministic mode the bits come from a generator seeded with the configured seed
+type RNG struct {
+	src rand.Source
+}
+
+const RNGSize = 0x1000
+
+func NewRNG(cpu *CPU) *RNG {
+	if cpu.deterministic {
+		return &RNG{src: rand.NewPCG(cpu.seed, cpu.seed^0x9E3779B97F4A7C15)}
+	}
+	var seed [32]byte
+	binary.LittleEndian.PutUint64(seed[:], rand.Uint64())
+	binary.LittleEndian.PutUint64(seed[8:], rand.Uint64())
+	binary.LittleEndian.PutUint64(seed[16:], rand.Uint64())
+	binary.LittleEndian.PutUint64(seed[24:], rand.Uint64())
+	return &RNG{src: rand.NewChaCha8(seed)}
+}
+
+func (r *RNG) Read(offset, size uint32) (uint32, error) {
+	return uint32(r.src.Uint64()), nil
+}
+
+func (r *RNG) Write(offset, size, value uint32) error {
+	return nil
+}
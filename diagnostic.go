@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ============================================================================
+// Diagnostic reports
+// ============================================================================
+// when Run fails, the error alone rarely says enough to find the bug. a
+// DiagnosticReport collects what's needed to start looking: the error, the
+// instruction that failed, the registers, the memory around the address a
+// memory error was about and around the pc, and, when a History was kept, the
+// calls still open and the last instructions executed before the failure.
+// `run` writes one to stderr whenever execution fails; the struct itself is
+// there for tools that want the pieces
+
+// DefaultHistorySize is the History size `run --history` suggests
+const DefaultHistorySize = 32
+
+// diagnosticWindow is how many bytes of memory the report shows on each side of an address
+const diagnosticWindow = 32
+
+// DiagnosticReport describes the state of a CPU whose Run failed
+type DiagnosticReport struct {
+	Err       error
+	PC        uint32 // the instruction that failed
+	Instr     uint32 // its encoding (0 when it couldn't be fetched)
+	Disasm    string // its disassembly (empty when it couldn't be fetched)
+	Retired   uint64
+	Registers [32]uint32
+	FaultAddr *uint32        // the address a memory error was about
+	Memory    []MemoryWindow // around FaultAddr (if any), then around PC
+	Backtrace []Frame        // the calls still open, innermost first (only with a History)
+	Recent    []HistoryEntry // the instructions executed before the failing one, oldest first (only with a History)
+}
+
+// MemoryWindow is a range of guest memory included in a DiagnosticReport
+type MemoryWindow struct {
+	Label string // what the window is around
+	Addr  uint32
+	Data  []byte
+}
+
+// NewDiagnosticReport describes cpu after its Run failed with err. history may be nil
+func NewDiagnosticReport(cpu *CPU, err error, history *History) *DiagnosticReport {
+	r := &DiagnosticReport{Err: err, PC: failedPC(cpu, err), Retired: cpu.Retired, Registers: cpu.Regs}
+	if word, err := cpu.ReadMemory(r.PC, 4); err == nil {
+		r.Instr = binary.LittleEndian.Uint32(word)
+		r.Disasm, _ = Disassemble(r.Instr, r.PC)
+	}
+	if addr, ok := faultAddr(err); ok {
+		r.FaultAddr = &addr
+		if w, ok := memoryWindow(cpu, fmt.Sprintf("the fault address 0x%08X", addr), addr); ok {
+			r.Memory = append(r.Memory, w)
+		}
+	}
+	if w, ok := memoryWindow(cpu, fmt.Sprintf("pc 0x%08X", r.PC), r.PC); ok {
+		r.Memory = append(r.Memory, w)
+	}
+	if history != nil {
+		r.Backtrace = history.Backtrace()
+		r.Recent = history.Recent()
+	}
+	return r
+}
+
+// failedPC works out the address of the instruction Run failed on. for most
+// errors the PC has already moved past it; a failed fetch leaves it in place
+func failedPC(cpu *CPU, err error) uint32 {
+	var exc *Exception
+	var loop *InfiniteLoopError
+	var stack *StackOverflowError
+	var uninit *UninitializedReadError
+	var diverged *Divergence
+	switch {
+	case errors.As(err, &diverged):
+		return diverged.PC
+	case errors.As(err, &loop):
+		return loop.PC
+	case errors.As(err, &stack):
+		return stack.PC
+	case errors.As(err, &uninit):
+		return uninit.PC
+	case errors.As(err, &exc) && exc.Cause == CauseFetchAccessFault:
+		return uint32(cpu.PC)
+	}
+	return uint32(cpu.PC - 4)
+}
+
+// faultAddr returns the memory address err is about, if it's a memory error
+func faultAddr(err error) (uint32, bool) {
+	var exc *Exception
+	var stack *StackOverflowError
+	var uninit *UninitializedReadError
+	switch {
+	case errors.As(err, &stack):
+		return stack.Addr, true
+	case errors.As(err, &uninit):
+		return uninit.Addr, true
+	case errors.As(err, &exc):
+		switch exc.Cause {
+		case CauseMisalignedFetch, CauseFetchAccessFault, CauseLoadAccessFault, CauseStoreAccessFault:
+			return exc.Tval, true
+		}
+	}
+	return 0, false
+}
+
+// memoryWindow is the memory within diagnosticWindow bytes of addr, in whole
+// 16-byte lines and clipped to RAM; ok is false when none of it is RAM
+func memoryWindow(cpu *CPU, label string, addr uint32) (MemoryWindow, bool) {
+	lo := max(int64(addr&^15)-diagnosticWindow, int64(cpu.ramBase))
+	hi := min(int64(addr&^15)+16+diagnosticWindow, int64(cpu.ramBase)+int64(len(cpu.Memory)))
+	if lo >= hi {
+		return MemoryWindow{}, false
+	}
+	data, err := cpu.ReadMemory(uint32(lo), uint32(hi-lo))
+	if err != nil {
+		return MemoryWindow{}, false
+	}
+	return MemoryWindow{Label: label, Addr: uint32(lo), Data: data}, true
+}
+
+// Write formats the report as text, one section after the other
+func (r *DiagnosticReport) Write(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "=== error ===\n%v\n", r.Err)
+
+	fmt.Fprintf(&b, "\n=== instruction ===\n")
+	if r.Disasm != "" {
+		fmt.Fprintf(&b, "pc=0x%08X  %08X  %s  (after %d instructions)\n", r.PC, r.Instr, r.Disasm, r.Retired)
+	} else {
+		fmt.Fprintf(&b, "pc=0x%08X  (not in memory, after %d instructions)\n", r.PC, r.Retired)
+	}
+
+	fmt.Fprintf(&b, "\n=== registers ===\n")
+	for i, v := range r.Registers {
+		fmt.Fprintf(&b, "%-4s = %08X", abiNames[i], v)
+		if i%4 == 3 {
+			b.WriteByte('\n')
+		} else {
+			b.WriteString("  ")
+		}
+	}
+
+	for _, m := range r.Memory {
+		fmt.Fprintf(&b, "\n=== memory around %s ===\n", m.Label)
+		writeHexdump(&b, m.Addr, m.Data)
+	}
+
+	if r.Backtrace != nil {
+		fmt.Fprintf(&b, "\n=== backtrace ===\n")
+		fmt.Fprintf(&b, "#0  0x%08X\n", r.PC)
+		for i, f := range r.Backtrace {
+			fmt.Fprintf(&b, "#%-2d 0x%08X  call to 0x%08X\n", i+1, f.Call, f.Target)
+		}
+	}
+
+	if r.Recent != nil {
+		fmt.Fprintf(&b, "\n=== last %d instructions ===\n", len(r.Recent))
+		for _, e := range r.Recent {
+			text, _ := Disassemble(e.Instr, e.PC)
+			fmt.Fprintf(&b, "   0x%08X  %08X  %s\n", e.PC, e.Instr, text)
+		}
+		if r.Disasm != "" {
+			fmt.Fprintf(&b, "=> 0x%08X  %08X  %s\n", r.PC, r.Instr, r.Disasm)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeHexdump writes data, which starts at addr, 16 bytes to a line with the printable ones on the right
+func writeHexdump(w io.Writer, addr uint32, data []byte) {
+	for i := 0; i < len(data); i += 16 {
+		line := data[i:min(i+16, len(data))]
+		text := []byte(string(line))
+		for j, c := range text {
+			if c < ' ' || c > '~' {
+				text[j] = '.'
+			}
+		}
+		fmt.Fprintf(w, "%08X  %-47s  |%s|\n", addr+uint32(i), fmt.Sprintf("% X", line), text)
+	}
+}
+
+// ============================================================================
+// Execution history
+// ============================================================================
+// a History is a Tracer remembering the last instructions executed, in a ring
+// buffer, and a shadow call stack built from the calling convention: a jal or
+// jalr writing ra (or t0, the alternate link register) is a call, a jalr
+// through one of them that writes zero is a return. code that doesn't follow
+// the convention (longjmp, a trap handler returning through mret) leaves
+// frames behind that never return, so the stack is capped at maxCallDepth,
+// dropping the outermost calls. like any tracer, it makes Run execute one
+// instruction at a time
+
+// maxCallDepth is how many open calls a History keeps
+const maxCallDepth = 256
+
+// HistoryEntry is an instruction executed
+type HistoryEntry struct {
+	PC    uint32
+	Instr uint32
+}
+
+// Frame is a call that hasn't returned yet
+type Frame struct {
+	Call   uint32 // the jal or jalr that made the call
+	Target uint32 // where it went
+}
+
+// History keeps the last instructions executed and the calls still open; see NewDiagnosticReport
+type History struct {
+	ring  []HistoryEntry
+	next  int // where the next entry goes
+	full  bool
+	calls []Frame // the open calls, outermost first
+}
+
+// NewHistory returns a History remembering the last n instructions
+func NewHistory(n int) *History {
+	return &History{ring: make([]HistoryEntry, max(n, 1))}
+}
+
+func (h *History) Trace(cpu *CPU, pc int, instr uint32) {
+	h.ring[h.next] = HistoryEntry{PC: uint32(pc), Instr: instr}
+	h.next++
+	if h.next == len(h.ring) {
+		h.next, h.full = 0, true
+	}
+
+	opcode, rd, rs1 := instr&0x7F, ExtractBits(instr, 11, 7), ExtractBits(instr, 19, 15)
+	if opcode != 0b1101111 && opcode != 0b1100111 {
+		return
+	}
+	isLink := func(r uint32) bool { return r == RA || r == T0 }
+	switch {
+	case isLink(rd):
+		if len(h.calls) == maxCallDepth {
+			h.calls = append(h.calls[:0], h.calls[1:]...)
+		}
+		h.calls = append(h.calls, Frame{Call: uint32(pc), Target: uint32(cpu.PC)})
+	case opcode == 0b1100111 && rd == ZERO && isLink(rs1) && len(h.calls) > 0:
+		h.calls = h.calls[:len(h.calls)-1]
+	}
+}
+
+// Recent returns the instructions remembered, oldest first
+func (h *History) Recent() []HistoryEntry {
+	if !h.full {
+		return append([]HistoryEntry{}, h.ring[:h.next]...)
+	}
+	return append(append([]HistoryEntry{}, h.ring[h.next:]...), h.ring[:h.next]...)
+}
+
+// Backtrace returns the calls still open, innermost first
+func (h *History) Backtrace() []Frame {
+	frames := make([]Frame, len(h.calls))
+	for i, f := range h.calls {
+		frames[len(frames)-1-i] = f
+	}
+	return frames
+}
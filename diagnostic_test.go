@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// callChainProgram calls outer, which calls inner, which runs an illegal instruction
+func callChainProgram(b *Builder) {
+	b.Li(SP, 0x1000)
+	b.Call("outer")
+	b.Ecall()
+	b.Label("outer")
+	b.Addi(SP, SP, -16)
+	b.Sw(RA, SP, 12)
+	b.Li(A0, 7)
+	b.Call("inner")
+	b.Lw(RA, SP, 12)
+	b.Addi(SP, SP, 16)
+	b.Ret()
+	b.Label("inner")
+	b.Addi(A0, A0, 1)
+	b.Word(0xFFFFFFFF)
+	b.Ret()
+}
+
+func TestDiagnosticReport(t *testing.T) {
+	program := assemble(t, callChainProgram)
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(program)
+	history := NewHistory(4)
+	cpu.Tracer = history
+	_, err := cpu.Run(100)
+	var exc *Exception
+	if !errors.As(err, &exc) || exc.Cause != CauseIllegalInstruction {
+		t.Fatalf("Run = %v, want an illegal instruction", err)
+	}
+
+	r := NewDiagnosticReport(&cpu, err, history)
+	illegalPC := uint32(len(program) - 8)
+	if r.PC != illegalPC || r.Instr != 0xFFFFFFFF || r.Registers[A0] != 8 || r.FaultAddr != nil {
+		t.Errorf("report = pc 0x%X, instr 0x%08X, a0 %d, fault address %v", r.PC, r.Instr, r.Registers[A0], r.FaultAddr)
+	}
+	if len(r.Backtrace) != 2 || r.Backtrace[0].Target != illegalPC-4 || r.Backtrace[1].Call != 4 {
+		t.Errorf("backtrace = %+v, want inner's call then outer's", r.Backtrace)
+	}
+	if len(r.Recent) != 4 || r.Recent[3].PC != illegalPC-4 {
+		t.Errorf("recent = %+v, want the 4 instructions up to 0x%X", r.Recent, illegalPC-4)
+	}
+	if len(r.Memory) != 1 || r.Memory[0].Addr > illegalPC || r.Memory[0].Addr+uint32(len(r.Memory[0].Data)) <= illegalPC {
+		t.Errorf("memory = %+v, want a window around the pc", r.Memory)
+	}
+
+	var out strings.Builder
+	if err := r.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	text := out.String()
+	for _, want := range []string{
+		"=== error ===\n",
+		"=== instruction ===\npc=0x000000",
+		"=== registers ===\nzero = 00000000",
+		"a0   = 00000008",
+		"=== memory around pc 0x",
+		"=== backtrace ===\n#0  0x",
+		"#2  0x00000004  call to 0x",
+		"=== last 4 instructions ===\n",
+		"=> 0x",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("report lacks %q:\n%s", want, text)
+		}
+	}
+
+	// without a History there's no backtrace or recent instructions
+	r = NewDiagnosticReport(&cpu, err, nil)
+	out.Reset()
+	r.Write(&out)
+	if r.Backtrace != nil || r.Recent != nil || strings.Contains(out.String(), "backtrace") {
+		t.Errorf("report without a history:\n%s", out.String())
+	}
+}
+
+func TestDiagnosticReportMemoryFault(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, func(b *Builder) {
+		b.Li(T0, 0x1004)
+		b.Lw(A0, T0, 0)
+	}))
+	_, err := cpu.Run(10)
+	r := NewDiagnosticReport(&cpu, err, nil)
+	if r.FaultAddr == nil || *r.FaultAddr != 0x1004 || len(r.Memory) != 2 || !strings.Contains(r.Memory[0].Label, "fault address 0x00001004") {
+		t.Fatalf("report of %v: fault address %v, memory %+v", err, r.FaultAddr, r.Memory)
+	}
+	// the window is clipped to the end of memory
+	if m := r.Memory[0]; m.Addr+uint32(len(m.Data)) != 0x1000 {
+		t.Errorf("fault window 0x%X+%d doesn't end at the end of memory", m.Addr, len(m.Data))
+	}
+}
+
+func TestRunWritesDiagnostics(t *testing.T) {
+	image := writeTemp(t, "chain.bin", assemble(t, callChainProgram))
+	code, _, stderr := runCommand("run", "--history=8", image)
+	if code != 1 {
+		t.Errorf("exit %d, want 1", code)
+	}
+	// the program runs 7 instructions before the illegal one, fewer than the history keeps
+	for _, want := range []string{"=== error ===", "=== backtrace ===", "=== last 7 instructions ==="} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("stderr lacks %q:\n%s", want, stderr)
+		}
+	}
+	if _, _, stderr := runCommand("run", "--diagnostics=false", image); strings.Contains(stderr, "=== error ===") {
+		t.Errorf("--diagnostics=false still wrote a report:\n%s", stderr)
+	}
+}
+
+func TestHistoryWraps(t *testing.T) {
+	h := NewHistory(3)
+	cpu := NewCPU()
+	for pc := 0; pc < 20; pc += 4 {
+		h.Trace(&cpu, pc, uint32(pc))
+	}
+	got := h.Recent()
+	if len(got) != 3 || got[0].PC != 8 || got[2].PC != 16 {
+		t.Errorf("Recent = %+v, want pcs 8, 12, 16", got)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// ============================================================================
+// Disassembler
+// ============================================================================
+// Disassemble turns an instruction back into assembly, in the same syntax the
+// GNU and LLVM assemblers accept (registers by ABI name, branch and jump targets
+// as absolute addresses). pseudo-instructions are not reconstructed: a `nop`
+// comes out as `addi zero, zero, 0`
+
+// abiNames are the registers' ABI names, in register number order
+var abiNames = [32]string{"zero", "ra", "sp", "gp", "tp", "t0", "t1", "t2", "s0", "s1", "a0", "a1", "a2", "a3", "a4", "a5", "a6", "a7", "s2", "s3", "s4", "s5", "s6", "s7", "s8", "s9", "s10", "s11", "t3", "t4", "t5", "t6"}
+
+var (
+	opMnemonics     = [8]string{"add", "sll", "slt", "sltu", "xor", "srl", "or", "and"}
+	opImmMnemonics  = [8]string{"addi", "slli", "slti", "sltiu", "xori", "srli", "ori", "andi"}
+	loadMnemonics   = [8]string{"lb", "lh", "lw", "", "lbu", "lhu", "", ""}
+	storeMnemonics  = [8]string{"sb", "sh", "sw", "", "", "", "", ""}
+	branchMnemonics = [8]string{"beq", "bne", "", "", "blt", "bge", "bltu", "bgeu"}
+	csrMnemonics    = [8]string{"", "csrrw", "csrrs", "csrrc", "", "csrrwi", "csrrsi", "csrrci"}
+)
+
+// Disassemble returns the assembly for the instruction instr located at pc.
+// ok is false if instr isn't an instruction this emulator implements; text then
+// says what it is as far as that can be told (e.g. which extension it belongs to)
+func Disassemble(instr, pc uint32) (text string, ok bool) {
+	d := decode(instr)
+	rd, rs1, rs2 := abiNames[d.rd], abiNames[d.rs1], abiNames[d.rs2]
+	imm := int32(d.imm)
+
+	switch d.opcode {
+	case OP:
+		switch {
+		case d.funct7 == 0x00:
+			return fmt.Sprintf("%s %s, %s, %s", opMnemonics[d.funct3], rd, rs1, rs2), true
+		case d.funct7 == 0x20 && d.funct3 == 0x0:
+			return fmt.Sprintf("sub %s, %s, %s", rd, rs1, rs2), true
+		case d.funct7 == 0x20 && d.funct3 == 0x5:
+			return fmt.Sprintf("sra %s, %s, %s", rd, rs1, rs2), true
+		}
+
+	case OP_IMM:
+		switch d.funct3 {
+		case 0x1:
+			if d.funct7 == 0x00 {
+				return fmt.Sprintf("slli %s, %s, %d", rd, rs1, d.rs2), true
+			}
+		case 0x5:
+			switch d.funct7 {
+			case 0x00:
+				return fmt.Sprintf("srli %s, %s, %d", rd, rs1, d.rs2), true
+			case 0x20:
+				return fmt.Sprintf("srai %s, %s, %d", rd, rs1, d.rs2), true
+			}
+		default:
+			return fmt.Sprintf("%s %s, %s, %d", opImmMnemonics[d.funct3], rd, rs1, imm), true
+		}
+
+	case LOAD:
+		if m := loadMnemonics[d.funct3]; m != "" {
+			return fmt.Sprintf("%s %s, %d(%s)", m, rd, imm, rs1), true
+		}
+
+	case STORE:
+		if m := storeMnemonics[d.funct3]; m != "" {
+			return fmt.Sprintf("%s %s, %d(%s)", m, rs2, imm, rs1), true
+		}
+
+	case BRANCH:
+		if m := branchMnemonics[d.funct3]; m != "" {
+			return fmt.Sprintf("%s %s, %s, 0x%08X", m, rs1, rs2, pc+d.imm), true
+		}
+
+	case LUI:
+		return fmt.Sprintf("lui %s, 0x%X", rd, d.imm), true
+
+	case AUIPC:
+		return fmt.Sprintf("auipc %s, 0x%X", rd, d.imm), true
+
+	case JAL:
+		return fmt.Sprintf("jal %s, 0x%08X", rd, pc+d.imm), true
+
+	case JALR:
+		if d.funct3 == 0x0 {
+			return fmt.Sprintf("jalr %s, %d(%s)", rd, imm, rs1), true
+		}
+
+	case MISC_MEM:
+		switch d.funct3 {
+		case 0x0:
+			return "fence", true
+		case 0x1:
+			return "fence.i", true
+		}
+
+	case SYSTEM:
+		if d.funct3 == 0x0 && d.rs1 == 0 && d.rd == 0 {
+			switch instr >> 20 {
+			case 0x000:
+				return "ecall", true
+			case 0x001:
+				return "ebreak", true
+			case 0x302:
+				return "mret", true
+			case 0x105:
+				return "wfi", true
+			}
+		}
+		if m := csrMnemonics[d.funct3]; m != "" {
+			csr := instr >> 20
+			name, known := CSRNames[csr]
+			if !known {
+				name = fmt.Sprintf("0x%03X", csr)
+			}
+			if d.funct3&0x4 != 0 {
+				return fmt.Sprintf("%s %s, %s, %d", m, rd, name, d.rs1), true
+			}
+			return fmt.Sprintf("%s %s, %s, %s", m, rd, name, rs1), true
+		}
+	}
+
+	if text, ok := disassembleCustom(instr); ok {
+		return text, false // whether it runs depends on the CPU
+	}
+	if ext := extensionOf(instr); ext != "" {
+		return fmt.Sprintf(".word 0x%08X (%s extension instruction)", instr, ext), false
+	}
+	return fmt.Sprintf(".word 0x%08X", instr), false
+}
+
+// extensionOf names the standard extension instr is encoded in, if it's one this
+// emulator doesn't implement ("" otherwise)
+func extensionOf(instr uint32) string {
+	if instr == 0 {
+		return "" // defined to be illegal in every extension
+	}
+	if instr&0x3 != 0x3 {
+		return "C" // the 16-bit encodings have something other than 11 in the two low bits
+	}
+	switch instr & 0x7F {
+	case OP:
+		if instr>>25 == 0x01 {
+			return "M"
+		}
+	case 0x2F:
+		return "A"
+	case 0x07, 0x27: // floating-point loads and stores, funct3 is the width
+		if (instr>>12)&0x7 == 0x3 {
+			return "D"
+		}
+		return "F"
+	case 0x43, 0x47, 0x4B, 0x4F, 0x53: // floating-point arithmetic, bits [26:25] are the format
+		if (instr>>25)&0x3 == 0x1 {
+			return "D"
+		}
+		return "F"
+	}
+	return ""
+}
+
+// writeListing disassembles program, loaded at base, one instruction per line,
+// marking where the Builder relaxed a branch or jump
+func writeListing(w io.Writer, program []byte, base uint32, relaxed []Relaxation) {
+	for off := 0; off+4 <= len(program); off += 4 {
+		pc := base + uint32(off)
+		text, _ := Disassemble(binary.LittleEndian.Uint32(program[off:]), pc)
+		if len(relaxed) > 0 && relaxed[0].Offset == uint32(off) {
+			text = fmt.Sprintf("%-28s # relaxed to reach %s: %s", text, relaxed[0].Label, relaxed[0].Form)
+			if r := relaxed[0].Clobbered; r != ZERO {
+				text += ", overwrites " + abiNames[r]
+			}
+			relaxed = relaxed[1:]
+		}
+		fmt.Fprintf(w, "  %08X  %s\n", pc, text)
+	}
+}
+
+// writeELFListing disassembles the executable segments of an ELF file, with a
+// label line before every address a function or untyped symbol names
+func writeELFListing(w io.Writer, f *elf.File) error {
+	if f.Class != elf.ELFCLASS32 || f.Machine != elf.EM_RISCV {
+		return fmt.Errorf("not a 32-bit RISC-V ELF file (%v, %v)", f.Class, f.Machine)
+	}
+	labels := make(map[uint32][]string)
+	symbols, _ := f.Symbols() // a stripped file simply has no labels
+	for _, sym := range symbols {
+		if t := elf.ST_TYPE(sym.Info); sym.Name != "" && (t == elf.STT_FUNC || t == elf.STT_NOTYPE) {
+			labels[uint32(sym.Value)] = append(labels[uint32(sym.Value)], sym.Name)
+		}
+	}
+
+	var segments []*elf.Prog
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD && prog.Flags&elf.PF_X != 0 && prog.Filesz > 0 {
+			segments = append(segments, prog)
+		}
+	}
+	if len(segments) == 0 {
+		return errors.New("no executable segments")
+	}
+	slices.SortFunc(segments, func(a, b *elf.Prog) int { return cmp.Compare(a.Vaddr, b.Vaddr) })
+
+	for i, prog := range segments {
+		code := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(code, 0); err != nil {
+			return fmt.Errorf("reading segment at 0x%08X: %w", prog.Vaddr, err)
+		}
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		for off := 0; off+4 <= len(code); off += 4 {
+			pc := uint32(prog.Vaddr) + uint32(off)
+			names := labels[pc]
+			slices.Sort(names)
+			for _, name := range names {
+				fmt.Fprintf(w, "%s:\n", name)
+			}
+			writeListing(w, code[off:off+4], pc, nil)
+		}
+	}
+	return nil
+}
+
+func cmdDisasm(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("disasm", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: riscv-emu disasm [flags] <image>")
+		fmt.Fprintln(stderr)
+		fmt.Fprintln(stderr, "disassembles the executable segments of an ELF file, or the whole of a raw binary image")
+		fmt.Fprintln(stderr)
+		fs.PrintDefaults()
+	}
+	base := addrFlag(DefaultMachine().loadAddress())
+	fs.Var(&base, "base", "address a raw image is loaded at (ELF files say where they go)")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(stderr, "riscv-emu disasm: exactly one image file is required")
+		fs.Usage()
+		return 2
+	}
+
+	path := fs.Arg(0)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "riscv-emu disasm: %v\n", err)
+		return 1
+	}
+	if !isELF(data) {
+		writeListing(stdout, data, uint32(base), nil)
+		return 0
+	}
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err == nil {
+		err = writeELFListing(stdout, f)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "riscv-emu disasm: %s: %v\n", path, err)
+		return 1
+	}
+	return 0
+}
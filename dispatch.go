@@ -0,0 +1,136 @@
+package main
+
+// ============================================================================
+// Instruction dispatch table
+// ============================================================================
+// every instruction is found by indexing tables with its fields: the opcode
+// picks a dispatchEntry, which either is a single instruction or splits further
+// by funct3 and, where that isn't enough, by funct3 and funct7.
+// decode resolves the handler once, so the decode cache also saves the lookup.
+//
+// adding an instruction means writing its handler and registering it in init below
+
+// handler executes one decoded instruction
+type handler func(cpu *CPU, d *decoded) error
+
+// dispatchEntry is how instructions with the same opcode are told apart.
+// lookup tries funct7, then funct3, then handler, and the first non-nil one wins
+type dispatchEntry struct {
+	handler handler          // the opcode is a single instruction
+	funct3  *[8]handler      // indexed by funct3
+	funct7  *[8][128]handler // indexed by funct3, then funct7
+	variant string           // names the format in "unimplemented ... instruction variant" errors
+}
+
+var dispatch [128]dispatchEntry
+
+// lookup returns the handler of d, or nil if it isn't an implemented instruction
+func lookup(d *decoded) handler {
+	e := &dispatch[d.opcode]
+	if e.funct7 != nil {
+		if h := e.funct7[d.funct3][d.funct7]; h != nil {
+			return h
+		}
+	}
+	if e.funct3 != nil {
+		if h := e.funct3[d.funct3]; h != nil {
+			return h
+		}
+	}
+	return e.handler
+}
+
+// illegal is the error for an instruction lookup found no handler for
+func illegal(d *decoded) error {
+	if v := dispatch[d.opcode].variant; v != "" {
+		return illegalInstruction(d.instr, "unimplemented "+v+" instruction variant")
+	}
+	return illegalInstruction(d.instr, "invalid instruction")
+}
+
+// setFunct3 registers h for opcode and funct3
+func setFunct3(opcode, funct3 uint32, h handler) {
+	e := &dispatch[opcode]
+	if e.funct3 == nil {
+		e.funct3 = new([8]handler)
+	}
+	e.funct3[funct3] = h
+}
+
+// setFunct7 registers h for opcode, funct3 and funct7
+func setFunct7(opcode, funct3, funct7 uint32, h handler) {
+	e := &dispatch[opcode]
+	if e.funct7 == nil {
+		e.funct7 = new([8][128]handler)
+	}
+	e.funct7[funct3][funct7] = h
+}
+
+func init() {
+	dispatch[0x0].handler = func(cpu *CPU, d *decoded) error { return nil } // No-op
+
+	// R-type arithmetic: add, sub, etc (they share the same opcode but are differentiated by funct3 and funct7, which tell the operation variant)
+	dispatch[OP].variant = "R-type"
+	setFunct7(OP, 0x0, 0x00, func(cpu *CPU, d *decoded) error { return cpu.executeAdd(d.rs1, d.rs2, d.rd) })
+	setFunct7(OP, 0x1, 0x00, func(cpu *CPU, d *decoded) error { return cpu.executeSll(d.rs1, d.rs2, d.rd) })
+	setFunct7(OP, 0x2, 0x00, func(cpu *CPU, d *decoded) error { return cpu.executeSlt(d.rs1, d.rs2, d.rd) })
+	setFunct7(OP, 0x3, 0x00, func(cpu *CPU, d *decoded) error { return cpu.executeSltu(d.rs1, d.rs2, d.rd) })
+	setFunct7(OP, 0x4, 0x00, func(cpu *CPU, d *decoded) error { return cpu.executeXor(d.rs1, d.rs2, d.rd) })
+	setFunct7(OP, 0x5, 0x00, func(cpu *CPU, d *decoded) error { return cpu.executeSrl(d.rs1, d.rs2, d.rd) })
+	setFunct7(OP, 0x6, 0x00, func(cpu *CPU, d *decoded) error { return cpu.executeOr(d.rs1, d.rs2, d.rd) })
+	setFunct7(OP, 0x7, 0x00, func(cpu *CPU, d *decoded) error { return cpu.executeAnd(d.rs1, d.rs2, d.rd) })
+	setFunct7(OP, 0x0, 0x20, func(cpu *CPU, d *decoded) error { return cpu.executeSub(d.rs1, d.rs2, d.rd) })
+	setFunct7(OP, 0x5, 0x20, func(cpu *CPU, d *decoded) error { return cpu.executeSra(d.rs1, d.rs2, d.rd) })
+
+	// I-type arithmetic: addi, slti, etc. the shifts keep their 5-bit shift amount
+	// where rs2 would be and tell srli and srai apart by funct7
+	dispatch[OP_IMM].variant = "I-type"
+	setFunct3(OP_IMM, 0x0, func(cpu *CPU, d *decoded) error { return cpu.executeAddi(d.imm, d.rs1, d.rd) })
+	setFunct3(OP_IMM, 0x2, func(cpu *CPU, d *decoded) error { return cpu.executeSlti(d.imm, d.rs1, d.rd) })
+	setFunct3(OP_IMM, 0x3, func(cpu *CPU, d *decoded) error { return cpu.executeSltiu(d.imm, d.rs1, d.rd) })
+	setFunct3(OP_IMM, 0x4, func(cpu *CPU, d *decoded) error { return cpu.executeXori(d.imm, d.rs1, d.rd) })
+	setFunct3(OP_IMM, 0x6, func(cpu *CPU, d *decoded) error { return cpu.executeOri(d.imm, d.rs1, d.rd) })
+	setFunct3(OP_IMM, 0x7, func(cpu *CPU, d *decoded) error { return cpu.executeAndi(d.imm, d.rs1, d.rd) })
+	setFunct7(OP_IMM, 0x1, 0x00, func(cpu *CPU, d *decoded) error { return cpu.executeSlli(d.rs2, d.rs1, d.rd) })
+	setFunct7(OP_IMM, 0x5, 0x00, func(cpu *CPU, d *decoded) error { return cpu.executeSrli(d.rs2, d.rs1, d.rd) })
+	setFunct7(OP_IMM, 0x5, 0x20, func(cpu *CPU, d *decoded) error { return cpu.executeSrai(d.rs2, d.rs1, d.rd) })
+
+	// the address is rs1 + imm and funct3 tells the width: 0x0 lb, 0x1 lh, 0x2 lw, 0x4 lbu, 0x5 lhu
+	dispatch[LOAD].variant = "load"
+	for _, funct3 := range []uint32{0x0, 0x1, 0x2, 0x4, 0x5} {
+		setFunct3(LOAD, funct3, func(cpu *CPU, d *decoded) error { return cpu.executeLoad(d.funct3, d.imm, d.rs1, d.rd) })
+	}
+
+	dispatch[STORE].variant = "store"
+	setFunct3(STORE, 0x0, func(cpu *CPU, d *decoded) error { return cpu.executeSb(d.imm, d.rs2, d.rs1) })
+	setFunct3(STORE, 0x1, func(cpu *CPU, d *decoded) error { return cpu.executeSh(d.imm, d.rs2, d.rs1) })
+	setFunct3(STORE, 0x2, func(cpu *CPU, d *decoded) error { return cpu.executeSw(d.imm, d.rs2, d.rs1) })
+
+	dispatch[BRANCH].variant = "branch"
+	for _, funct3 := range []uint32{0x0, 0x1, 0x4, 0x5, 0x6, 0x7} {
+		setFunct3(BRANCH, funct3, func(cpu *CPU, d *decoded) error { return cpu.executeBranch(d.funct3, d.imm, d.rs1, d.rs2) })
+	}
+
+	dispatch[LUI].handler = func(cpu *CPU, d *decoded) error { return cpu.executeLui(d.imm, d.rd) }
+	dispatch[AUIPC].handler = func(cpu *CPU, d *decoded) error { return cpu.executeAuipc(d.imm, d.rd) }
+	dispatch[JAL].handler = func(cpu *CPU, d *decoded) error { return cpu.executeJal(d.imm, d.rd) }
+
+	dispatch[JALR].variant = "jalr"
+	setFunct3(JALR, 0x0, func(cpu *CPU, d *decoded) error { return cpu.executeJalr(d.imm, d.rs1, d.rd) })
+
+	// fence orders memory accesses between harts and devices; with a single hart
+	// executing one instruction at a time, memory is always in order, so it's a no-op.
+	// fence.i makes earlier stores visible to instruction fetch
+	dispatch[MISC_MEM].variant = "misc-mem"
+	setFunct3(MISC_MEM, 0x0, func(cpu *CPU, d *decoded) error { return nil })
+	setFunct3(MISC_MEM, 0x1, func(cpu *CPU, d *decoded) error { return cpu.executeFenceI() })
+
+	// the CSR instructions are I-type, with the CSR address in the immediate field
+	dispatch[SYSTEM].variant = "system"
+	setFunct3(SYSTEM, 0x0, (*CPU).executePrivileged)
+	for _, funct3 := range []uint32{0x1, 0x2, 0x3, 0x5, 0x6, 0x7} {
+		setFunct3(SYSTEM, funct3, func(cpu *CPU, d *decoded) error {
+			return cpu.executeCsr(d.instr, d.funct3, d.instr>>20, d.rs1, d.rd)
+		})
+	}
+}
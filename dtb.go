@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// ============================================================================
+// Device tree
+// ============================================================================
+// with "device_tree": true in the machine file (or run --dtb), the machine
+// describes itself to the guest with a flattened device tree, the way firmware
+// hands one to an OS: the blob is placed at the top of RAM, the stack starts
+// below it (unless the machine sets its own stack top), and the program starts
+// with the hart id in a0 and the blob's address in a1. the tree has
+//
+//	/                     riscv-emu, 1 address cell and 1 size cell
+//	/chosen               stdout-path pointing at the UART
+//	/cpus                 timebase-frequency, one rv32i hart with its interrupt controller
+//	/memory@<ram base>    the RAM
+//	/soc                  the CLINT, UART, RTC and entropy source the machine has
+//
+// there is no PLIC: the UART drives the hart's external interrupt directly, so
+// its interrupts-extended points at the hart's controller (interrupt 11)
+
+// the devicetree specification's structure block tokens
+const (
+	fdtMagic     = 0xD00DFEED
+	fdtBeginNode = 1
+	fdtEndNode   = 2
+	fdtProp      = 3
+	fdtEnd       = 9
+
+	fdtVersion       = 17
+	fdtLastCompVer   = 16
+	fdtHeaderSize    = 40
+	fdtMemReserveEnd = 16 // the empty memory reservation block: one all-zero entry
+)
+
+// the phandle of the hart's interrupt controller, which the devices' interrupts refer to
+const intcPhandle = 1
+
+// fdtBuilder writes the structure and strings blocks of a device tree
+type fdtBuilder struct {
+	structure []byte
+	strings   []byte
+	offsets   map[string]uint32 // property name -> offset in strings
+}
+
+func (b *fdtBuilder) u32(v uint32) {
+	b.structure = binary.BigEndian.AppendUint32(b.structure, v)
+}
+
+// pad aligns the structure block to 4 bytes
+func (b *fdtBuilder) pad() {
+	for len(b.structure)%4 != 0 {
+		b.structure = append(b.structure, 0)
+	}
+}
+
+func (b *fdtBuilder) beginNode(name string) {
+	b.u32(fdtBeginNode)
+	b.structure = append(append(b.structure, name...), 0)
+	b.pad()
+}
+
+func (b *fdtBuilder) endNode() {
+	b.u32(fdtEndNode)
+}
+
+func (b *fdtBuilder) prop(name string, value []byte) {
+	off, ok := b.offsets[name]
+	if !ok {
+		off = uint32(len(b.strings))
+		b.strings = append(append(b.strings, name...), 0)
+		b.offsets[name] = off
+	}
+	b.u32(fdtProp)
+	b.u32(uint32(len(value)))
+	b.u32(off)
+	b.structure = append(b.structure, value...)
+	b.pad()
+}
+
+// propCells is a property of 32-bit cells
+func (b *fdtBuilder) propCells(name string, cells ...uint32) {
+	value := make([]byte, 0, 4*len(cells))
+	for _, c := range cells {
+		value = binary.BigEndian.AppendUint32(value, c)
+	}
+	b.prop(name, value)
+}
+
+// propStrings is a property of one or more NUL-terminated strings
+func (b *fdtBuilder) propStrings(name string, values ...string) {
+	b.prop(name, []byte(strings.Join(values, "\x00")+"\x00"))
+}
+
+// blob puts the header, the memory reservation block and the two blocks together
+func (b *fdtBuilder) blob() []byte {
+	b.u32(fdtEnd)
+	structOff := uint32(fdtHeaderSize + fdtMemReserveEnd) // the reservation block must be 8-byte aligned, and 40 is
+	stringsOff := structOff + uint32(len(b.structure))
+	total := stringsOff + uint32(len(b.strings))
+
+	header := make([]byte, 0, total)
+	for _, v := range []uint32{fdtMagic, total, structOff, stringsOff, fdtHeaderSize, fdtVersion, fdtLastCompVer,
+		0, // boot_cpuid_phys
+		uint32(len(b.strings)), uint32(len(b.structure))} {
+		header = binary.BigEndian.AppendUint32(header, v)
+	}
+	header = append(header, make([]byte, fdtMemReserveEnd)...)
+	return append(append(header, b.structure...), b.strings...)
+}
+
+// DeviceTreeBlob returns the flattened device tree describing the machine
+func (m MachineConfig) DeviceTreeBlob() []byte {
+	b := &fdtBuilder{offsets: make(map[string]uint32)}
+	b.beginNode("")
+	b.propCells("#address-cells", 1)
+	b.propCells("#size-cells", 1)
+	b.propStrings("compatible", "riscv-emu")
+	b.propStrings("model", "riscv-emu")
+
+	if m.UARTBase != 0 {
+		b.beginNode("chosen")
+		b.propStrings("stdout-path", fmt.Sprintf("/soc/serial@%x", m.UARTBase))
+		b.endNode()
+	}
+
+	b.beginNode("cpus")
+	b.propCells("#address-cells", 1)
+	b.propCells("#size-cells", 0)
+	b.propCells("timebase-frequency", TimebaseHz)
+	b.beginNode("cpu@0")
+	b.propStrings("device_type", "cpu")
+	b.propCells("reg", 0)
+	b.propStrings("status", "okay")
+	b.propStrings("compatible", "riscv")
+	b.propStrings("riscv,isa", "rv32i")
+	b.propStrings("mmu-type", "riscv,none")
+	b.beginNode("interrupt-controller")
+	b.propCells("#interrupt-cells", 1)
+	b.prop("interrupt-controller", nil)
+	b.propStrings("compatible", "riscv,cpu-intc")
+	b.propCells("phandle", intcPhandle)
+	b.endNode()
+	b.endNode()
+	b.endNode()
+
+	b.beginNode(fmt.Sprintf("memory@%x", m.RAMBase))
+	b.propStrings("device_type", "memory")
+	b.propCells("reg", m.RAMBase, m.MemSize)
+	b.endNode()
+
+	b.beginNode("soc")
+	b.propCells("#address-cells", 1)
+	b.propCells("#size-cells", 1)
+	b.propStrings("compatible", "simple-bus")
+	b.prop("ranges", nil)
+	if m.CLINTBase != 0 {
+		b.beginNode(fmt.Sprintf("clint@%x", m.CLINTBase))
+		b.propStrings("compatible", "sifive,clint0", "riscv,clint0")
+		b.propCells("reg", m.CLINTBase, ClintSize)
+		b.propCells("interrupts-extended", intcPhandle, InterruptSoftware, intcPhandle, InterruptTimer)
+		b.endNode()
+	}
+	if m.UARTBase != 0 {
+		b.beginNode(fmt.Sprintf("serial@%x", m.UARTBase))
+		b.propStrings("compatible", "ns16550a")
+		b.propCells("reg", m.UARTBase, UARTSize)
+		b.propCells("clock-frequency", 3686400)
+		b.propCells("interrupts-extended", intcPhandle, InterruptExternal)
+		b.endNode()
+	}
+	if m.RTCBase != 0 {
+		b.beginNode(fmt.Sprintf("rtc@%x", m.RTCBase))
+		b.propStrings("compatible", "google,goldfish-rtc")
+		b.propCells("reg", m.RTCBase, RTCSize)
+		b.endNode()
+	}
+	if m.RNGBase != 0 {
+		b.beginNode(fmt.Sprintf("rng@%x", m.RNGBase))
+		b.propStrings("compatible", "riscv-emu,rng")
+		b.propCells("reg", m.RNGBase, RNGSize)
+		b.endNode()
+	}
+	b.endNode()
+
+	b.endNode()
+	return b.blob()
+}
+
+// deviceTreeAddr is where the device tree goes: the top of RAM, 8-byte aligned
+func (m MachineConfig) deviceTreeAddr(size int) uint32 {
+	return (m.RAMBase + m.MemSize - uint32(size)) &^ 7
+}
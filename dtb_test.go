@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// fdtNodes reads a flattened device tree back: the properties of every node,
+// by path ("/" for the root), checking the header and the block layout on the way
+func fdtNodes(t *testing.T, blob []byte) map[string]map[string][]byte {
+	t.Helper()
+	be := binary.BigEndian
+	if len(blob) < fdtHeaderSize || be.Uint32(blob) != fdtMagic {
+		t.Fatalf("not a device tree: % X", blob[:min(len(blob), 8)])
+	}
+	total, structOff, stringsOff, rsvOff := be.Uint32(blob[4:]), be.Uint32(blob[8:]), be.Uint32(blob[12:]), be.Uint32(blob[16:])
+	version, lastComp, stringsSize, structSize := be.Uint32(blob[20:]), be.Uint32(blob[24:]), be.Uint32(blob[32:]), be.Uint32(blob[36:])
+	switch {
+	case total != uint32(len(blob)):
+		t.Fatalf("totalsize %d, but the blob is %d bytes", total, len(blob))
+	case version != 17 || lastComp != 16:
+		t.Fatalf("version %d, last compatible %d", version, lastComp)
+	case rsvOff%8 != 0 || structOff%4 != 0:
+		t.Fatalf("memory reservation block at %d, structure block at %d: misaligned", rsvOff, structOff)
+	case structOff+structSize > stringsOff || stringsOff+stringsSize > total:
+		t.Fatalf("blocks overlap or run past the end")
+	}
+	if rsv := blob[rsvOff : rsvOff+16]; !bytes.Equal(rsv, make([]byte, 16)) {
+		t.Fatalf("memory reservation block doesn't end right away: % X", rsv)
+	}
+
+	nodes := map[string]map[string][]byte{}
+	var path []string
+	structure, strs := blob[structOff:structOff+structSize], blob[stringsOff:stringsOff+stringsSize]
+	cstring := func(b []byte) string { return string(b[:bytes.IndexByte(b, 0)]) }
+	align := func(n int) int { return (n + 3) &^ 3 }
+	for off := 0; ; {
+		token := be.Uint32(structure[off:])
+		off += 4
+		switch token {
+		case fdtBeginNode:
+			name := cstring(structure[off:])
+			off += align(len(name) + 1)
+			path = append(path, name)
+			nodes["/"+strings.Join(path[1:], "/")] = map[string][]byte{}
+		case fdtEndNode:
+			path = path[:len(path)-1]
+		case fdtProp:
+			size, nameOff := be.Uint32(structure[off:]), be.Uint32(structure[off+4:])
+			off += 8
+			nodes["/"+strings.Join(path[1:], "/")][cstring(strs[nameOff:])] = structure[off : off+int(size)]
+			off += align(int(size))
+		case fdtEnd:
+			if len(path) != 0 || off != len(structure) {
+				t.Fatalf("FDT_END with %d nodes open at %d of %d", len(path), off, len(structure))
+			}
+			return nodes
+		default:
+			t.Fatalf("unknown token %d at %d", token, off-4)
+		}
+	}
+}
+
+// cells is a property's value as 32-bit cells
+func cells(value []byte) []uint32 {
+	c := make([]uint32, len(value)/4)
+	for i := range c {
+		c[i] = binary.BigEndian.Uint32(value[4*i:])
+	}
+	return c
+}
+
+func TestDeviceTreeBlob(t *testing.T) {
+	m := DefaultMachine()
+	m.RAMBase, m.MemSize = 0x80000000, 1<<20
+	nodes := fdtNodes(t, m.DeviceTreeBlob())
+
+	check := func(path, prop string, want any) {
+		t.Helper()
+		value, ok := nodes[path][prop]
+		if !ok {
+			t.Errorf("%s has no %s", path, prop)
+			return
+		}
+		var got any
+		switch want.(type) {
+		case string:
+			got = strings.TrimSuffix(string(value), "\x00")
+		default:
+			got = fmt.Sprint(cells(value))
+			want = fmt.Sprint(want)
+		}
+		if got != want {
+			t.Errorf("%s %s = %v, want %v", path, prop, got, want)
+		}
+	}
+	check("/", "#address-cells", []uint32{1})
+	check("/", "#size-cells", []uint32{1})
+	check("/chosen", "stdout-path", "/soc/serial@10000000")
+	check("/cpus", "timebase-frequency", []uint32{TimebaseHz})
+	check("/cpus/cpu@0", "riscv,isa", "rv32i")
+	check("/cpus/cpu@0", "reg", []uint32{0})
+	check("/cpus/cpu@0/interrupt-controller", "phandle", []uint32{intcPhandle})
+	check("/memory@80000000", "device_type", "memory")
+	check("/memory@80000000", "reg", []uint32{0x80000000, 1 << 20})
+	check("/soc/clint@2000000", "reg", []uint32{0x02000000, ClintSize})
+	check("/soc/clint@2000000", "interrupts-extended", []uint32{intcPhandle, InterruptSoftware, intcPhandle, InterruptTimer})
+	check("/soc/serial@10000000", "compatible", "ns16550a")
+	check("/soc/serial@10000000", "interrupts-extended", []uint32{intcPhandle, InterruptExternal})
+	check("/soc/rtc@10001000", "reg", []uint32{0x10001000, RTCSize})
+	check("/soc/rng@10002000", "reg", []uint32{0x10002000, RNGSize})
+	if _, ok := nodes["/cpus/cpu@0/interrupt-controller"]["interrupt-controller"]; !ok {
+		t.Error("the hart's controller lacks the interrupt-controller property")
+	}
+
+	// devices the machine leaves out aren't in the tree
+	m.UARTBase, m.RTCBase = 0, 0
+	nodes = fdtNodes(t, m.DeviceTreeBlob())
+	for _, path := range []string{"/chosen", "/soc/serial@10000000", "/soc/rtc@10001000"} {
+		if _, ok := nodes[path]; ok {
+			t.Errorf("%s is there without its device", path)
+		}
+	}
+}
+
+// the blob is placed at the top of RAM, with a0 the hart id and a1 its address
+func TestDeviceTreeBoot(t *testing.T) {
+	m := DefaultMachine()
+	m.DeviceTree = true
+	cpu, err := m.NewCPU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := m.DeviceTreeBlob()
+	addr := cpu.Regs[A1]
+	if cpu.Regs[A0] != 0 || addr%8 != 0 || addr+uint32(len(blob)) > m.MemSize || addr+uint32(len(blob)) <= m.MemSize-8 {
+		t.Fatalf("a0 = %d, a1 = 0x%X for a %d-byte blob in %d bytes of memory", cpu.Regs[A0], addr, len(blob), m.MemSize)
+	}
+	if got, _ := cpu.ReadMemory(addr, uint32(len(blob))); !bytes.Equal(got, blob) {
+		t.Error("the blob in memory differs from DeviceTreeBlob")
+	}
+	if cpu.Regs[SP] > addr {
+		t.Errorf("sp = 0x%X is above the blob at 0x%X", cpu.Regs[SP], addr)
+	}
+	fdtNodes(t, blob)
+}
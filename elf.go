@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ELFImage describes an ELF executable after LoadELF copied it into memory
+type ELFImage struct {
+	Entry   uint32            // address of the first instruction
+	End     uint32            // first address past the highest loaded segment (e.g. where the heap can start)
+	Symbols map[string]uint32 // symbol table, empty when the file is stripped
+}
+
+// isELF reports whether data starts with the ELF magic number
+func isELF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(elf.ELFMAG))
+}
+
+// LoadELF copies the loadable segments of a 32-bit RISC-V executable into memory
+// and points the PC at its entry point.
+// each PT_LOAD segment is copied to its physical address; the part of a segment
+// past the file contents (.bss) is zero-filled.
+// gp is set to the __global_pointer$ symbol if the file has one (see WithGlobalPointer)
+func (cpu *CPU) LoadELF(r io.ReaderAt) (*ELFImage, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if f.Class != elf.ELFCLASS32 {
+		return nil, errors.New("not a 32-bit ELF file")
+	}
+	if f.Machine != elf.EM_RISCV {
+		return nil, fmt.Errorf("ELF file is for %v, not RISC-V", f.Machine)
+	}
+	if f.Type != elf.ET_EXEC {
+		return nil, fmt.Errorf("ELF file is %v, want an executable", f.Type)
+	}
+
+	image := &ELFImage{Entry: uint32(f.Entry), Symbols: make(map[string]uint32)}
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Memsz == 0 {
+			continue
+		}
+		addr, size := prog.Paddr, prog.Memsz
+		off, ok := cpu.ramOffset(uint32(addr), uint32(size))
+		if size < prog.Filesz || addr+size > 1<<32 || !ok {
+			return nil, fmt.Errorf("segment at 0x%08X (%d bytes) does not fit in %d bytes of memory at 0x%08X", addr, size, len(cpu.Memory), cpu.ramBase)
+		}
+
+		segment := cpu.Memory[off : uint64(off)+size]
+		if _, err := prog.ReadAt(segment[:prog.Filesz], 0); err != nil {
+			return nil, fmt.Errorf("reading segment at 0x%08X: %w", addr, err)
+		}
+		clear(segment[prog.Filesz:])
+		cpu.MemoryWritten(uint32(addr), uint32(size)) // the zero-filled BSS counts as initialized
+		if prog.Flags&elf.PF_X != 0 {
+			cpu.text = append(cpu.text, memRange{uint32(addr), uint32(prog.Filesz)})
+		}
+
+		image.End = max(image.End, uint32(addr+size))
+	}
+
+	// a missing symbol table is not an error, it only means there are no symbols to look up
+	symbols, _ := f.Symbols()
+	for _, sym := range symbols {
+		if sym.Name != "" {
+			image.Symbols[sym.Name] = uint32(sym.Value)
+		}
+	}
+
+	if cpu.checkRange(image.Entry, 1) != nil {
+		return nil, fmt.Errorf("entry point 0x%08X is outside memory", image.Entry)
+	}
+	if gp, ok := image.Symbols[globalPointerSymbol]; ok && !cpu.gpFixed {
+		cpu.Regs[GP] = gp
+	}
+	cpu.PC = int(image.Entry)
+	return image, nil
+}
+
+// globalPointerSymbol is where the linker wants gp to point. code linked with
+// relaxation (the default) reaches the globals within 2 KiB of it through gp,
+// and crt0 normally loads gp itself, but a program without that startup code
+// expects to start with it set
+const globalPointerSymbol = "__global_pointer$"
+
+// WithGlobalPointer starts the program with gp set to value, instead of what
+// LoadELF finds in the file's __global_pointer$. it's also the only way to start
+// a raw binary, which has no symbols, with gp set: otherwise it starts at zero
+func WithGlobalPointer(value uint32) Option {
+	return func(cpu *CPU) {
+		cpu.Regs[GP] = value
+		cpu.gpFixed = true
+	}
+}
+
+// WithoutGlobalPointer starts every program, ELF files included, with gp at zero
+func WithoutGlobalPointer() Option {
+	return func(cpu *CPU) {
+		cpu.Regs[GP] = 0
+		cpu.gpFixed = true
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// buildELF wraps image, to be loaded at base, in a minimal RV32 executable: one
+// RWX PT_LOAD segment (a .text section) starting at the entry point, and a
+// symbol table with symbols (functions if their name is in funcs, untyped otherwise).
+// it stands in for a linker, since no RISC-V toolchain is needed to run the tests
+func buildELF(image []byte, base uint32, symbols map[string]uint32, funcs ...string) []byte {
+	const ehsize, phsize, shsize, symsize = 52, 32, 40, 16
+	textOff := uint32(ehsize + phsize)
+
+	strtab := []byte{0}
+	symtab := make([]byte, symsize) // symbol 0 is the null symbol
+	for _, name := range slices.Sorted(maps.Keys(symbols)) {
+		typ := elf.STT_NOTYPE
+		if slices.Contains(funcs, name) {
+			typ = elf.STT_FUNC
+		}
+		sym := elf.Sym32{
+			Name:  uint32(len(strtab)),
+			Value: symbols[name],
+			Info:  elf.ST_INFO(elf.STB_GLOBAL, typ),
+			Shndx: 1,
+		}
+		strtab = append(strtab, name+"\x00"...)
+		symtab, _ = binary.Append(symtab, binary.LittleEndian, sym)
+	}
+	shstrtab := []byte("\x00.text\x00.symtab\x00.strtab\x00.shstrtab\x00")
+
+	symtabOff := (textOff + uint32(len(image)) + 3) &^ 3
+	strtabOff := symtabOff + uint32(len(symtab))
+	shstrtabOff := strtabOff + uint32(len(strtab))
+	shOff := (shstrtabOff + uint32(len(shstrtab)) + 3) &^ 3
+
+	header := elf.Header32{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_RISCV),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     base,
+		Phoff:     ehsize,
+		Shoff:     shOff,
+		Ehsize:    ehsize,
+		Phentsize: phsize,
+		Phnum:     1,
+		Shentsize: shsize,
+		Shnum:     5,
+		Shstrndx:  4,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	prog := elf.Prog32{
+		Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_W | elf.PF_X), Off: textOff,
+		Vaddr: base, Paddr: base, Filesz: uint32(len(image)), Memsz: uint32(len(image)), Align: 4,
+	}
+	sections := []elf.Section32{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_PROGBITS), Flags: uint32(elf.SHF_ALLOC | elf.SHF_EXECINSTR | elf.SHF_WRITE), Addr: base, Off: textOff, Size: uint32(len(image)), Addralign: 4},
+		{Name: 7, Type: uint32(elf.SHT_SYMTAB), Off: symtabOff, Size: uint32(len(symtab)), Link: 3, Info: 1, Addralign: 4, Entsize: symsize},
+		{Name: 15, Type: uint32(elf.SHT_STRTAB), Off: strtabOff, Size: uint32(len(strtab)), Addralign: 1},
+		{Name: 23, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOff, Size: uint32(len(shstrtab)), Addralign: 1},
+	}
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, header)
+	binary.Write(&out, binary.LittleEndian, prog)
+	out.Write(image)
+	out.Write(make([]byte, symtabOff-uint32(out.Len())))
+	out.Write(symtab)
+	out.Write(strtab)
+	out.Write(shstrtab)
+	out.Write(make([]byte, shOff-uint32(out.Len())))
+	binary.Write(&out, binary.LittleEndian, sections)
+	return out.Bytes()
+}
+
+func TestLoadELF(t *testing.T) {
+	image := []byte{0x13, 0x05, 0xA0, 0x02, 0x73, 0x00, 0x10, 0x00, 0xAA, 0xBB, 0xCC, 0xDD} // li a0, 42; ebreak; a data word
+	data := buildELF(image, 0x100, map[string]uint32{"_start": 0x100, "value": 0x108, globalPointerSymbol: 0x900}, "_start")
+
+	cpu := NewCPUWithMemory(4096)
+	got, err := cpu.LoadELF(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Entry != 0x100 || got.End != 0x10C || cpu.PC != 0x100 {
+		t.Errorf("entry 0x%X, end 0x%X, pc 0x%X; want 0x100, 0x10C, 0x100", got.Entry, got.End, cpu.PC)
+	}
+	if got.Symbols["value"] != 0x108 {
+		t.Errorf("symbol value = 0x%X, want 0x108", got.Symbols["value"])
+	}
+	if cpu.Regs[GP] != 0x900 {
+		t.Errorf("gp = 0x%X, want __global_pointer$ (0x900)", cpu.Regs[GP])
+	}
+	if !bytes.Equal(cpu.Memory[0x100:0x10C], image) {
+		t.Errorf("memory at 0x100 = % X, want the image", cpu.Memory[0x100:0x10C])
+	}
+
+	small := NewCPUWithMemory(0x104)
+	if _, err := small.LoadELF(bytes.NewReader(data)); err == nil {
+		t.Error("loading a segment past the end of memory succeeded")
+	}
+}
+
+// gpELF reads a global 2 KiB below __global_pointer$, the way relaxed code
+// does, and exits with it
+func gpELF(t *testing.T) []byte {
+	const global, gp = 0x100, 0x900
+	image := assemble(t, func(b *Builder) {
+		b.Lw(A0, GP, global-gp)
+		b.Li(A7, newlibSysExit)
+		b.Ecall()
+	})
+	image = append(image, make([]byte, global-len(image))...)
+	image = append(image, 42, 0, 0, 0)
+	return buildELF(image, 0, map[string]uint32{"_start": 0, "global": global, globalPointerSymbol: gp}, "_start")
+}
+
+func TestGlobalPointer(t *testing.T) {
+	data := gpELF(t)
+	for _, c := range []struct {
+		name string
+		opts []Option
+		gp   uint32
+	}{
+		{"from __global_pointer$", nil, 0x900},
+		{"overridden", []Option{WithGlobalPointer(0x1234)}, 0x1234},
+		{"disabled", []Option{WithoutGlobalPointer()}, 0},
+	} {
+		cpu := NewCPU(c.opts...)
+		if _, err := cpu.LoadELF(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if cpu.Regs[GP] != c.gp {
+			t.Errorf("%s: gp = 0x%X, want 0x%X", c.name, cpu.Regs[GP], c.gp)
+		}
+	}
+
+	// the global is only read right with gp set
+	elf := writeTemp(t, "gp.elf", data)
+	if code, _, stderr := runCommand("run", "--syscalls=newlib", elf); code != 42 {
+		t.Errorf("exit %d, want the global's 42 (%s)", code, stderr)
+	}
+	if code, _, _ := runCommand("run", "--syscalls=newlib", "--gp=none", "--diagnostics=false", elf); code == 42 {
+		t.Error("--gp=none still read the global")
+	}
+	if code, _, _ := runCommand("run", "--syscalls=newlib", "--gp=0x904", elf); code != 0 {
+		t.Errorf("--gp=0x904 read 4 bytes past the global: exit %d, want 0", code)
+	}
+
+	// a raw binary has no symbols: gp starts at zero unless --gp says otherwise
+	raw := writeTemp(t, "gp.bin", assemble(t, func(b *Builder) {
+		b.Mv(A0, GP)
+		b.Li(A7, newlibSysExit)
+		b.Ecall()
+	}))
+	if code, _, _ := runCommand("run", "--syscalls=newlib", raw); code != 0 {
+		t.Errorf("raw binary: gp = %d, want 0", code)
+	}
+	if code, _, _ := runCommand("run", "--syscalls=newlib", "--gp=7", raw); code != 7 {
+		t.Errorf("raw binary with --gp=7: gp = %d", code)
+	}
+	if code, _, stderr := runCommand("run", "--gp=nowhere", raw); code != 2 || !strings.Contains(stderr, "bad --gp") {
+		t.Errorf("bad --gp: exit %d, %q", code, stderr)
+	}
+}
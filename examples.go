@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// ============================================================================
+// Example programs
+// ============================================================================
+// `riscv-emu examples` runs a handful of small, complete guest programs and
+// checks what each leaves behind: registers, memory, what it printed on the
+// UART. they're written with the Builder, since that is what this repository
+// writes programs with, and are meant to be read: `riscv-emu examples -show
+// fib` prints one with its disassembly. they also put the loader, the CPU and
+// the devices through a whole program at a time, so a failing example is a bug.
+//
+// every example starts with its data (if any) at exampleData, its code at 0
+// and sp at the top of memory, and exits through ecall with a0 as the code
+
+// exampleData is where an example's data is loaded
+const exampleData = 0x4000
+
+// example is one guest program and what it must produce
+type example struct {
+	name    string
+	summary string
+	build   func(b *Builder)
+	data    []byte                           // loaded at exampleData
+	check   func(cpu *CPU, out string) error // out is what the program sent to the UART
+	setup   func(cpu *CPU) error             // prepares the CPU before the program runs, if set
+}
+
+var examples = []example{
+	{name: "fib", summary: "the 20th Fibonacci number, iteratively", build: buildFib, check: wantA0(6765)},
+	{name: "factorial", summary: "10!, multiplying by shifts and adds in a function", build: buildFactorial, check: wantA0(3628800)},
+	{name: "memcpy", summary: "copy 64 bytes, a byte at a time", build: buildExampleMemcpy, data: exampleBytes(64), check: checkMemcpy},
+	{name: "strlen", summary: "the length of a NUL-terminated string", build: buildStrlen, data: []byte("hello, world\x00"), check: wantA0(12)},
+	{name: "sort", summary: "bubble sort an array of signed words in place", build: buildSort, data: exampleWords(sortInput...), check: checkSort},
+	{name: "hello", summary: "print a string on the UART", build: buildHello, data: []byte("Hello, RISC-V!\n\x00"), check: wantOutput("Hello, RISC-V!\n")},
+	{name: "hpm", summary: "count the loads and taken branches of a loop with the performance counters", build: buildHPM, data: exampleBytes(4 * hpmLoopWords), check: checkHPM},
+	{name: "trigger", summary: "count the debug triggers and catch an instruction with one", build: buildTrigger, check: checkTrigger},
+	{name: "mac", summary: "a dot product with a custom multiply-accumulate instruction", build: buildMAC, data: exampleWords(append(macA, macB...)...), setup: setupMAC, check: wantA0(macWant())},
+}
+
+// the vectors the mac example multiplies
+var (
+	macA = []int32{3, -1, 4, 1, -5, 9, 2, 6}
+	macB = []int32{2, 7, -1, 8, 2, 8, -1, 8}
+)
+
+func macWant() uint32 {
+	var sum int32
+	for i := range macA {
+		sum += macA[i] * macB[i]
+	}
+	return uint32(sum)
+}
+
+// hpmLoopWords is how many words the hpm example sums
+const hpmLoopWords = 8
+
+// sortInput is the array the sort example sorts
+var sortInput = []int32{42, -7, 19, 0, 2048, -1, 7, 19, 100000, -300}
+
+// buildFib leaves fib(20) in a0
+func buildFib(b *Builder) {
+	b.Li(T0, 20) // n
+	b.Li(A0, 0)  // fib(i)
+	b.Li(A1, 1)  // fib(i+1)
+	b.Label("loop")
+	b.Beqz(T0, "done")
+	b.Add(T1, A0, A1)
+	b.Mv(A0, A1)
+	b.Mv(A1, T1)
+	b.Addi(T0, T0, -1)
+	b.J("loop")
+	b.Label("done")
+	b.Ecall()
+}
+
+// buildFactorial leaves 10! in a0
+func buildFactorial(b *Builder) {
+	b.Li(S0, 10) // n
+	b.Li(S1, 1)  // the product so far
+	b.Label("loop")
+	b.Beqz(S0, "done")
+	b.Mv(A0, S1)
+	b.Mv(A1, S0)
+	b.Call("mul")
+	b.Mv(S1, A0)
+	b.Addi(S0, S0, -1)
+	b.J("loop")
+	b.Label("done")
+	b.Mv(A0, S1)
+	b.Ecall()
+
+	// mul(a0, a1) returns a0*a1: add a0 once for every bit set in a1, shifting it along
+	b.Label("mul")
+	b.Li(T0, 0)
+	b.Label("bit")
+	b.Beqz(A1, "ret")
+	b.Andi(T1, A1, 1)
+	b.Beqz(T1, "next")
+	b.Add(T0, T0, A0)
+	b.Label("next")
+	b.Slli(A0, A0, 1)
+	b.Srli(A1, A1, 1)
+	b.J("bit")
+	b.Label("ret")
+	b.Mv(A0, T0)
+	b.Ret()
+}
+
+// buildExampleMemcpy copies the 64 bytes at exampleData to exampleData+0x100
+func buildExampleMemcpy(b *Builder) {
+	b.Li(A0, exampleData+0x100) // dst
+	b.Li(A1, exampleData)       // src
+	b.Li(A2, 64)                // n
+	b.Label("loop")
+	b.Beqz(A2, "done")
+	b.Lbu(T0, A1, 0)
+	b.Sb(T0, A0, 0)
+	b.Addi(A0, A0, 1)
+	b.Addi(A1, A1, 1)
+	b.Addi(A2, A2, -1)
+	b.J("loop")
+	b.Label("done")
+	b.Li(A0, 0)
+	b.Ecall()
+}
+
+// buildStrlen leaves the length of the string at exampleData in a0
+func buildStrlen(b *Builder) {
+	b.Li(A1, exampleData)
+	b.Mv(A0, ZERO)
+	b.Label("loop")
+	b.Add(T0, A1, A0)
+	b.Lbu(T1, T0, 0)
+	b.Beqz(T1, "done")
+	b.Addi(A0, A0, 1)
+	b.J("loop")
+	b.Label("done")
+	b.Ecall()
+}
+
+// buildSort sorts the words at exampleData in place, smallest first
+func buildSort(b *Builder) {
+	b.Li(A0, exampleData)
+	b.Li(A1, int32(len(sortInput)))
+	b.Label("pass")
+	b.Li(T0, 0) // swapped anything
+	b.Mv(T1, A0)
+	b.Slli(T2, A1, 2)
+	b.Add(T2, T2, A0)
+	b.Addi(T2, T2, -4) // the last pair starts here
+	b.Label("pair")
+	b.Bgeu(T1, T2, "end")
+	b.Lw(T3, T1, 0)
+	b.Lw(T4, T1, 4)
+	b.Bge(T4, T3, "ordered")
+	b.Sw(T4, T1, 0)
+	b.Sw(T3, T1, 4)
+	b.Li(T0, 1)
+	b.Label("ordered")
+	b.Addi(T1, T1, 4)
+	b.J("pair")
+	b.Label("end")
+	b.Bnez(T0, "pass")
+	b.Li(A0, 0)
+	b.Ecall()
+}
+
+// buildHPM sums the words at exampleData with mhpmcounter3 counting loads and
+// mhpmcounter4 taken branches, and leaves the counts in a0 and a1. mhpmcounter5
+// counts loads too but is stopped by mcountinhibit, so a2 is left 0
+func buildHPM(b *Builder) {
+	for counter, event := range []uint32{HPMEventLoad, HPMEventBranchTaken, HPMEventLoad} {
+		b.Li(T0, int32(event))
+		b.Csrrw(ZERO, CSR_MHPMEVENT3+uint32(counter), T0)
+		b.Csrrw(ZERO, CSR_MHPMCOUNTER3+uint32(counter), ZERO)
+	}
+	b.Li(T0, 1<<5)
+	b.Csrrw(ZERO, CSR_MCOUNTINHIBIT, T0)
+
+	b.Li(T1, exampleData)
+	b.Li(T2, hpmLoopWords)
+	b.Li(A3, 0) // the sum
+	b.Label("loop")
+	b.Lw(T3, T1, 0)
+	b.Add(A3, A3, T3)
+	b.Addi(T1, T1, 4)
+	b.Addi(T2, T2, -1)
+	b.Bnez(T2, "loop")
+
+	b.Csrrs(A0, CSR_MHPMCOUNTER3, ZERO)
+	b.Csrrs(A1, CSR_HPMCOUNTER3+1, ZERO) // the read-only shadow reads the same
+	b.Csrrs(A2, CSR_MHPMCOUNTER3+2, ZERO)
+	b.Ecall()
+}
+
+// buildTrigger counts the triggers into a3 by writing tselect until it reads back
+// something else, then sets an execute trigger on the instruction at t1. the
+// trap handler saves mcause and mtval in a2 and a0 and disables the trigger, so
+// the instruction runs after the mret and sets a1
+func buildTrigger(b *Builder) {
+	b.J("main")
+	b.Label("handler") // at 4
+	b.Csrrs(A2, CSR_MCAUSE, ZERO)
+	b.Csrrs(A0, CSR_MTVAL, ZERO)
+	b.Csrrw(ZERO, CSR_TDATA1, ZERO)
+	b.Mret()
+
+	b.Label("main")
+	b.Li(T0, 4)
+	b.Csrrw(ZERO, CSR_MTVEC, T0)
+	b.Li(A3, 0)
+	b.Label("count")
+	b.Csrrw(ZERO, CSR_TSELECT, A3)
+	b.Csrrs(T0, CSR_TSELECT, ZERO)
+	b.Bne(T0, A3, "counted")
+	b.Addi(A3, A3, 1)
+	b.J("count")
+	b.Label("counted")
+	b.Csrrw(ZERO, CSR_TSELECT, ZERO)
+	b.Jal(T1, "arm") // t1 = the address of the instruction caught
+	b.Li(A1, 42)
+	b.Ecall()
+
+	b.Label("arm")
+	b.Csrrw(ZERO, CSR_TDATA2, T1)
+	b.Li(T0, mcontrolM|mcontrolExecute)
+	b.Csrrw(ZERO, CSR_TDATA1, T0)
+	b.Jalr(ZERO, T1, 0)
+}
+
+// setupMAC registers mac rd, rs1, rs2 (rd += rs1 * rs2) as custom-0 with funct3 and funct7 0
+func setupMAC(cpu *CPU) error {
+	return cpu.RegisterCustomOpcode(CUSTOM_0, func(cpu *CPU, d DecodedInstruction) error {
+		if d.Funct3 != 0 || d.Funct7 != 0 {
+			return illegalInstruction(d.Instr, "unknown custom-0 instruction")
+		}
+		cpu.Regs[d.Rd] += cpu.Regs[d.Rs1] * cpu.Regs[d.Rs2]
+		return nil
+	})
+}
+
+// buildMAC leaves the dot product of macA and macB, which follow each other at exampleData, in a0
+func buildMAC(b *Builder) {
+	b.Li(A0, 0)
+	b.Li(A1, exampleData)                    // macA
+	b.Li(A2, exampleData+4*int32(len(macA))) // macB
+	b.Li(T2, int32(len(macA)))
+	b.Label("loop")
+	b.Beqz(T2, "done")
+	b.Lw(T0, A1, 0)
+	b.Lw(T1, A2, 0)
+	b.InsnR(CUSTOM_0, 0, 0, A0, T0, T1) // mac a0, t0, t1
+	b.Addi(A1, A1, 4)
+	b.Addi(A2, A2, 4)
+	b.Addi(T2, T2, -1)
+	b.J("loop")
+	b.Label("done")
+	b.Ecall()
+}
+
+// buildHello writes the string at exampleData to the UART's transmit register
+func buildHello(b *Builder) {
+	b.Li(A0, exampleData)
+	b.Li(A1, int32(DefaultMachine().UARTBase))
+	b.Label("loop")
+	b.Lbu(T0, A0, 0)
+	b.Beqz(T0, "done")
+	b.Sb(T0, A1, uartRBR)
+	b.Addi(A0, A0, 1)
+	b.J("loop")
+	b.Label("done")
+	b.Li(A0, 0)
+	b.Ecall()
+}
+
+func wantA0(want uint32) func(cpu *CPU, out string) error {
+	return func(cpu *CPU, out string) error {
+		if cpu.Regs[A0] != want {
+			return fmt.Errorf("a0 = %d, want %d", cpu.Regs[A0], want)
+		}
+		return nil
+	}
+}
+
+func wantOutput(want string) func(cpu *CPU, out string) error {
+	return func(cpu *CPU, out string) error {
+		if out != want {
+			return fmt.Errorf("printed %q, want %q", out, want)
+		}
+		return nil
+	}
+}
+
+func checkHPM(cpu *CPU, out string) error {
+	got := [3]uint32{cpu.Regs[A0], cpu.Regs[A1], cpu.Regs[A2]}
+	if want := [3]uint32{hpmLoopWords, hpmLoopWords - 1, 0}; got != want {
+		return fmt.Errorf("loads, taken branches, inhibited loads = %v, want %v", got, want)
+	}
+	return nil
+}
+
+func checkTrigger(cpu *CPU, out string) error {
+	got := [4]uint32{cpu.Regs[A3], cpu.Regs[A2], cpu.Regs[A0], cpu.Regs[A1]}
+	if want := [4]uint32{triggerCount, CauseBreakpoint, cpu.Regs[T1], 42}; got != want {
+		return fmt.Errorf("triggers, mcause, mtval, a1 = %v, want %v", got, want)
+	}
+	return nil
+}
+
+func checkMemcpy(cpu *CPU, out string) error {
+	got, err := cpu.ReadMemory(exampleData+0x100, 64)
+	if err != nil {
+		return err
+	}
+	if want := exampleBytes(64); !bytes.Equal(got, want) {
+		return fmt.Errorf("copied % X, want % X", got, want)
+	}
+	return nil
+}
+
+func checkSort(cpu *CPU, out string) error {
+	data, err := cpu.ReadMemory(exampleData, uint32(4*len(sortInput)))
+	if err != nil {
+		return err
+	}
+	got := make([]int32, len(sortInput))
+	for i := range got {
+		got[i] = int32(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	want := slices.Sorted(slices.Values(sortInput))
+	if !slices.Equal(got, want) {
+		return fmt.Errorf("sorted to %v, want %v", got, want)
+	}
+	return nil
+}
+
+// exampleBytes is n bytes counting up from 1
+func exampleBytes(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	return data
+}
+
+// exampleWords lays words out as little-endian bytes
+func exampleWords(words ...int32) []byte {
+	data := make([]byte, 4*len(words))
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(data[4*i:], uint32(w))
+	}
+	return data
+}
+
+// run executes the example and checks its results
+func (e example) run() error {
+	var out strings.Builder
+	cpu, err := e.load(&out)
+	if err != nil {
+		return err
+	}
+	reason, err := cpu.Run(1_000_000)
+	if err != nil {
+		return err
+	}
+	if reason != StopExit {
+		return fmt.Errorf("stopped: %s after %d instructions at pc=0x%08X", reason, cpu.Retired, cpu.PC)
+	}
+	return e.check(cpu, out.String())
+}
+
+// load returns a CPU on the default machine with the example's program and
+// data loaded, ready to run, its UART writing to out
+func (e example) load(out io.Writer, opts ...Option) (*CPU, error) {
+	var b Builder
+	e.build(&b)
+	program, err := b.Assemble()
+	if err != nil {
+		return nil, err
+	}
+	cpu, err := DefaultMachine().NewCPU(append([]Option{WithConsole(nil, out)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	cpu.LoadProgram(program)
+	if err := cpu.WriteMemory(exampleData, e.data); err != nil {
+		return nil, err
+	}
+	if e.setup != nil {
+		if err := e.setup(cpu); err != nil {
+			return nil, err
+		}
+	}
+	cpu.EcallHook = func(cpu *CPU) error {
+		cpu.Exit(int(cpu.Regs[A0]))
+		return nil
+	}
+	return cpu, nil
+}
+
+// show writes the example's program and data
+func (e example) show(w io.Writer) error {
+	var b Builder
+	e.build(&b)
+	program, err := b.Assemble()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s: %s\n", e.name, e.summary)
+	writeListing(w, program, 0, b.Relaxed())
+	switch text := strings.TrimSuffix(string(e.data), "\x00"); {
+	case len(e.data) == 0:
+	case strings.IndexFunc(text, func(r rune) bool { return r != '\n' && (r < ' ' || r > '~') }) < 0:
+		fmt.Fprintf(w, "data at 0x%08X: %q, NUL-terminated\n", exampleData, text)
+	default:
+		fmt.Fprintf(w, "data at 0x%08X: % X\n", exampleData, e.data)
+	}
+	return nil
+}
+
+func cmdExamples(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("examples", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: riscv-emu examples [flags] [name...]")
+		fmt.Fprintln(stderr)
+		fmt.Fprintln(stderr, "runs the example programs (or the named ones) and checks their results")
+		fmt.Fprintln(stderr)
+		fs.PrintDefaults()
+	}
+	list := fs.Bool("list", false, "list the examples instead of running them")
+	show := fs.Bool("show", false, "print the examples' programs instead of running them")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	selected := examples
+	if fs.NArg() > 0 {
+		selected = nil
+		for _, name := range fs.Args() {
+			i := slices.IndexFunc(examples, func(e example) bool { return e.name == name })
+			if i < 0 {
+				fmt.Fprintf(stderr, "riscv-emu examples: no example %q\n", name)
+				return 2
+			}
+			selected = append(selected, examples[i])
+		}
+	}
+
+	failed := 0
+	for i, e := range selected {
+		switch {
+		case *list:
+			fmt.Fprintf(stdout, "%-10s %s\n", e.name, e.summary)
+		case *show:
+			if i > 0 {
+				fmt.Fprintln(stdout)
+			}
+			if err := e.show(stdout); err != nil {
+				fmt.Fprintf(stderr, "riscv-emu examples: %s: %v\n", e.name, err)
+				return 1
+			}
+		default:
+			if err := e.run(); err != nil {
+				fmt.Fprintf(stdout, "FAIL  %s: %v\n", e.name, err)
+				failed++
+			} else {
+				fmt.Fprintf(stdout, "PASS  %s\n", e.name)
+			}
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExamples(t *testing.T) {
+	for _, e := range examples {
+		t.Run(e.name, func(t *testing.T) {
+			if err := e.run(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// the checks must catch a program that doesn't do its job
+func TestExampleChecksFail(t *testing.T) {
+	for _, e := range examples {
+		t.Run(e.name, func(t *testing.T) {
+			e.build = func(b *Builder) {
+				b.Li(A0, 0x5A5A)
+				b.Ecall()
+			}
+			if err := e.run(); err == nil {
+				t.Error("a program that only exits passed the check")
+			}
+		})
+	}
+}
+
+func TestCmdExamples(t *testing.T) {
+	code, stdout, _ := runCommand("examples")
+	if code != 0 || strings.Count(stdout, "PASS  ") != len(examples) {
+		t.Errorf("exit %d:\n%s", code, stdout)
+	}
+	if code, stdout, _ := runCommand("examples", "-list"); code != 0 || !strings.Contains(stdout, "fib        the 20th Fibonacci number") {
+		t.Errorf("-list: exit %d:\n%s", code, stdout)
+	}
+	code, stdout, _ = runCommand("examples", "-show", "strlen", "sort")
+	for _, want := range []string{"strlen: ", `"hello, world", NUL-terminated`, "sort: ", "data at 0x00004000: 2A 00 00 00"} {
+		if code != 0 || !strings.Contains(stdout, want) {
+			t.Errorf("-show: exit %d, output lacks %q:\n%s", code, want, stdout)
+		}
+	}
+	if code, _, stderr := runCommand("examples", "nope"); code != 2 || !strings.Contains(stderr, `no example "nope"`) {
+		t.Errorf("unknown example: exit %d, stderr %q", code, stderr)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// Expressions
+// ============================================================================
+// a small expression language over the state of a CPU, for tracepoint
+// conditions and messages (see tracepoint.go). every value is a 32-bit word:
+//
+//	a0, x10, pc          a register (by ABI or numeric name) or the program counter
+//	42, 0x2A, -1         a number
+//	mem8[e] mem16[e]     the byte, halfword or word of memory at address e
+//	mem32[e]             (zero-extended)
+//	(e)  -e  ~e  !e      grouping, negation, complement, logical not
+//	e * e                multiplication
+//	e + e  e - e
+//	e << e  e >> e       shifts (>> is logical)
+//	e & e  e ^ e  e | e
+//	e == e  e != e       comparisons, 1 for true and 0 for false; the ordered ones
+//	e < e  e <= e ...    compare signed values
+//	e && e  e || e       logical and and or, nonzero being true
+//
+// operators bind like they do in C. mem reads only RAM (reading a device could
+// change it), an address outside it makes the whole expression fail
+
+// Expr is a compiled expression, see ParseExpr
+type Expr struct {
+	src  string
+	eval func(cpu *CPU) (uint32, error)
+}
+
+// ParseExpr compiles the expression src
+func ParseExpr(src string) (*Expr, error) {
+	p := exprParser{src: src}
+	p.next()
+	eval, err := p.parseBinary(0)
+	if err == nil && p.tok != "" {
+		err = fmt.Errorf("unexpected %q", p.tok)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	return &Expr{src: src, eval: eval}, nil
+}
+
+// Eval evaluates the expression against the current state of cpu
+func (e *Expr) Eval(cpu *CPU) (uint32, error) {
+	return e.eval(cpu)
+}
+
+func (e *Expr) String() string { return e.src }
+
+// exprOperators are the binary operators by precedence, lowest first
+var exprOperators = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*"},
+}
+
+// exprPunctuation are the tokens that aren't names or numbers, longest first so "<<" isn't read as "<"
+var exprPunctuation = []string{"||", "&&", "==", "!=", "<=", ">=", "<<", ">>",
+	"|", "^", "&", "<", ">", "+", "-", "*", "~", "!", "(", ")", "[", "]"}
+
+// exprParser is a recursive descent parser building the closures of an Expr
+type exprParser struct {
+	src string
+	pos int
+	tok string // the current token, "" at the end
+	err error  // a token that couldn't be read
+}
+
+// next moves to the next token
+func (p *exprParser) next() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+	p.tok = ""
+	if p.pos == len(p.src) {
+		return
+	}
+	start := p.pos
+	if c := p.src[p.pos]; c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+		for p.pos < len(p.src) {
+			c := p.src[p.pos]
+			if c != '_' && (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+				break
+			}
+			p.pos++
+		}
+		p.tok = p.src[start:p.pos]
+		return
+	}
+	for _, punct := range exprPunctuation {
+		if strings.HasPrefix(p.src[p.pos:], punct) {
+			p.pos += len(punct)
+			p.tok = punct
+			return
+		}
+	}
+	if p.err == nil {
+		p.err = fmt.Errorf("unexpected %q", p.src[p.pos:p.pos+1])
+	}
+	p.pos = len(p.src)
+}
+
+// parseBinary parses operators of precedence level and above
+func (p *exprParser) parseBinary(level int) (func(*CPU) (uint32, error), error) {
+	if level == len(exprOperators) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for slices.Contains(exprOperators[level], p.tok) {
+		op := p.tok
+		p.next()
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary(op, left, right)
+	}
+	return left, p.err
+}
+
+// exprBinary combines the values of left and right with op
+func exprBinary(op string, left, right func(*CPU) (uint32, error)) func(*CPU) (uint32, error) {
+	return func(cpu *CPU) (uint32, error) {
+		a, err := left(cpu)
+		if err != nil {
+			return 0, err
+		}
+		// && and || only look at the right side when the left doesn't decide
+		switch {
+		case op == "&&" && a == 0:
+			return 0, nil
+		case op == "||" && a != 0:
+			return 1, nil
+		}
+		b, err := right(cpu)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "&&", "||":
+			return boolToWord(b != 0), nil
+		case "|":
+			return a | b, nil
+		case "^":
+			return a ^ b, nil
+		case "&":
+			return a & b, nil
+		case "==":
+			return boolToWord(a == b), nil
+		case "!=":
+			return boolToWord(a != b), nil
+		case "<":
+			return boolToWord(int32(a) < int32(b)), nil
+		case "<=":
+			return boolToWord(int32(a) <= int32(b)), nil
+		case ">":
+			return boolToWord(int32(a) > int32(b)), nil
+		case ">=":
+			return boolToWord(int32(a) >= int32(b)), nil
+		case "<<":
+			return a << (b & 0x1F), nil
+		case ">>":
+			return a >> (b & 0x1F), nil
+		case "+":
+			return a + b, nil
+		case "-":
+			return a - b, nil
+		}
+		return a * b, nil
+	}
+}
+
+// parseUnary parses a prefix operator or a primary expression
+func (p *exprParser) parseUnary() (func(*CPU) (uint32, error), error) {
+	op := p.tok
+	if op != "-" && op != "~" && op != "!" {
+		return p.parsePrimary()
+	}
+	p.next()
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return func(cpu *CPU) (uint32, error) {
+		v, err := operand(cpu)
+		switch op {
+		case "-":
+			v = -v
+		case "~":
+			v = ^v
+		default:
+			v = boolToWord(v == 0)
+		}
+		return v, err
+	}, nil
+}
+
+// parsePrimary parses a number, a register, a memory read or a parenthesized expression
+func (p *exprParser) parsePrimary() (func(*CPU) (uint32, error), error) {
+	tok := p.tok
+	switch {
+	case p.err != nil:
+		return nil, p.err
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end")
+	case tok == "(":
+		p.next()
+		inner, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.next()
+		return inner, nil
+	case tok[0] >= '0' && tok[0] <= '9':
+		v, err := strconv.ParseUint(tok, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", tok)
+		}
+		p.next()
+		return func(*CPU) (uint32, error) { return uint32(v), nil }, nil
+	case tok == "pc":
+		p.next()
+		return func(cpu *CPU) (uint32, error) { return uint32(cpu.PC), nil }, nil
+	case tok == "mem8" || tok == "mem16" || tok == "mem32":
+		size := map[string]uint32{"mem8": 1, "mem16": 2, "mem32": 4}[tok]
+		p.next()
+		if p.tok != "[" {
+			return nil, fmt.Errorf("missing [ after %s", tok)
+		}
+		p.next()
+		addr, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != "]" {
+			return nil, fmt.Errorf("missing ]")
+		}
+		p.next()
+		return func(cpu *CPU) (uint32, error) {
+			a, err := addr(cpu)
+			if err != nil {
+				return 0, err
+			}
+			data, err := cpu.ReadMemory(a, size)
+			if err != nil {
+				return 0, err
+			}
+			var v uint32
+			for i := range data {
+				v |= uint32(data[i]) << (8 * i)
+			}
+			return v, nil
+		}, nil
+	}
+	// registers are looked up now, so a misspelled one is a parse error
+	reg := slices.Index(abiNames[:], tok)
+	if n, err := strconv.Atoi(strings.TrimPrefix(tok, "x")); err == nil && tok[0] == 'x' && n < len(abiNames) && tok == "x"+strconv.Itoa(n) {
+		reg = n
+	}
+	if reg < 0 {
+		return nil, fmt.Errorf("unknown name %q", tok)
+	}
+	p.next()
+	return func(cpu *CPU) (uint32, error) { return cpu.Regs[reg], nil }, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// fuzzSeeds are the demo program's instructions and one instruction of each format
+var fuzzSeeds = []uint32{
+	0x12345537, // lui  a0, 0x12345
+	0x02A00593, // addi a1, zero, 42
+	0x00B50633, // add  a2, a0, a1
+	0x40B606B3, // sub  a3, a2, a1
+	0x00C12023, // sw   a2, 0(sp)
+
+	encodeR(OP, A0, 0x5, A1, A2, 0x20),   // R: sra
+	encodeI(LOAD, A0, 0x1, SP, 0xFFE),    // I: lh
+	encodeS(STORE, 0x0, SP, A0, 0x801),   // S: sb
+	encodeB(BRANCH, 0x6, A0, A1, 0x1FFC), // B: bltu backwards
+	encodeU(AUIPC, RA, 0xFFFFF),          // U: auipc
+	encodeJ(JAL, RA, 0x1FFFFE),           // J: jal, misaligned
+	encodeI(JALR, ZERO, 0x0, RA, 0),      // ret
+	encodeI(SYSTEM, A0, 0x2, ZERO, CSR_MCYCLE),
+	encodeI(SYSTEM, 0, 0x0, 0, 1), // ebreak
+	encodeI(MISC_MEM, 0, 0x1, 0, 0),
+	0x0000000B, // custom-0
+	0x80A10073, // system with funct3 0 but no such instruction: the decoder finds a handler, which fails
+	0x00B50680, // opcode 0: a no-op
+	0x00000000,
+	0xFFFFFFFF,
+}
+
+// fuzzMemory is the memory size of the fuzzed CPUs: small, so the PC and
+// addresses often fall off its end
+const fuzzMemory = 256
+
+// fuzzCPU returns a CPU with fuzzMemory bytes and registers filled from seed
+func fuzzCPU(seed uint32, opts ...Option) *CPU {
+	cpu := NewCPUWithMemory(fuzzMemory, opts...)
+	for i := 1; i < len(cpu.Regs); i++ {
+		cpu.Regs[i] = seed * uint32(i) // many small values and a few large ones
+	}
+	cpu.Regs[SP] = fuzzMemory / 2
+	return &cpu
+}
+
+// checkStepped checks what must hold after any instruction: x0 is still zero,
+// and a PC that left memory without an error makes the next fetch fail (a jump
+// out of memory succeeds and the fetch at its target faults, as on hardware)
+func checkStepped(t *testing.T, cpu *CPU, err error, what string) {
+	t.Helper()
+	if cpu.Regs[ZERO] != 0 {
+		t.Fatalf("%s wrote x0 (0x%08X)", what, cpu.Regs[ZERO])
+	}
+	if err != nil || cpu.halted {
+		return
+	}
+	if _, ok := cpu.ramOffset(uint32(cpu.PC), 4); !ok {
+		next := cpu.Clone()
+		if next.Step() == nil {
+			t.Fatalf("%s moved the pc to 0x%08X, outside memory, and the next step fetched from there", what, cpu.PC)
+		}
+	}
+}
+
+// FuzzExecute executes arbitrary words on a fresh CPU
+func FuzzExecute(f *testing.F) {
+	for _, instr := range fuzzSeeds {
+		f.Add(instr, uint32(0x10), uint32(3))
+		f.Add(instr, uint32(fuzzMemory-4), uint32(0x80000001))
+	}
+	f.Fuzz(func(t *testing.T, instr, pc, seed uint32) {
+		cpu := fuzzCPU(seed)
+		cpu.PC = int(pc%fuzzMemory) + 4
+		err := cpu.Execute(instr)
+		text, ok := Disassemble(instr, pc)
+		checkStepped(t, cpu, err, text)
+
+		// Execute never succeeds on what the decoder or the disassembler calls
+		// illegal. the decoder only looks at the opcode and funct fields, so the
+		// disassembler's legal instructions are a subset of its. opcode 0 is the
+		// exception: it's a no-op here, whatever the other bits say
+		legal := decode(instr).exec != nil
+		if (!legal || !ok) && instr&0x7F != 0 && err == nil {
+			t.Fatalf("0x%08X (%s) is illegal but executed without an error", instr, text)
+		}
+		if ok && !legal {
+			t.Fatalf("0x%08X disassembles as %s but has no handler", instr, text)
+		}
+	})
+}
+
+// FuzzStep runs a few instructions of arbitrary memory contents from an
+// arbitrary PC, once with the decode cache and basic blocks and once with
+// neither, which must agree
+func FuzzStep(f *testing.F) {
+	for _, instr := range fuzzSeeds {
+		f.Add(binary.LittleEndian.AppendUint32(nil, instr), uint32(0), uint32(1))
+	}
+	var loop bytes.Buffer
+	for _, instr := range []uint32{0x00150513, 0xFE051EE3} { // addi a0, a0, 1; bnez a0, -4
+		binary.Write(&loop, binary.LittleEndian, instr)
+	}
+	f.Add(loop.Bytes(), uint32(0), uint32(7))
+	f.Add(loop.Bytes(), uint32(fuzzMemory-4), uint32(7))
+
+	f.Fuzz(func(t *testing.T, memory []byte, pc, seed uint32) {
+		const steps = 32
+		fast, slow := fuzzCPU(seed), fuzzCPU(seed, WithoutDecodeCache(), WithoutBlockCache())
+		for _, cpu := range []*CPU{fast, slow} {
+			copy(cpu.Memory, memory)
+			cpu.PC = int(pc)
+		}
+
+		var slowErr error
+		for n := 0; n < steps && slowErr == nil && !slow.halted; n++ {
+			slowErr = slow.Step()
+			checkStepped(t, slow, slowErr, "step")
+		}
+		_, fastErr := fast.Run(steps)
+		if fast.Regs[ZERO] != 0 {
+			t.Fatal("Run wrote x0")
+		}
+
+		if (fastErr == nil) != (slowErr == nil) {
+			t.Fatalf("Run returned %v but stepping %v", fastErr, slowErr)
+		}
+		if fast.Regs != slow.Regs || fast.PC != slow.PC || fast.Retired != slow.Retired || !bytes.Equal(fast.Memory, slow.Memory) {
+			t.Fatalf("Run and Step disagree:\nrun:  pc 0x%X, %d retired, %v\nstep: pc 0x%X, %d retired, %v", fast.PC, fast.Retired, fast.Regs, slow.PC, slow.Retired, slow.Regs)
+		}
+	})
+}
+
+// FuzzFetchAndDecode fetches from arbitrary PCs: it fails exactly when the word
+// isn't in memory, and otherwise returns that word and moves the PC past it
+func FuzzFetchAndDecode(f *testing.F) {
+	f.Add([]byte{0x37, 0x55, 0x34, 0x12}, uint32(0))
+	f.Add([]byte{0x37, 0x55, 0x34, 0x12}, uint32(fuzzMemory-3))
+	f.Add([]byte{}, uint32(0xFFFFFFFC))
+	f.Add([]byte{1, 2, 3, 4, 5}, uint32(1))
+	f.Fuzz(func(t *testing.T, memory []byte, pc uint32) {
+		cpu := fuzzCPU(1)
+		copy(cpu.Memory, memory)
+		cpu.PC = int(pc)
+		instr, err := cpu.FetchAndDecode()
+		inside := uint64(pc)+4 <= fuzzMemory
+		if !inside {
+			if err == nil {
+				t.Fatalf("fetched 0x%08X from pc 0x%08X, outside memory", instr, pc)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("fetch from 0x%08X failed: %v", pc, err)
+		}
+		if want := binary.LittleEndian.Uint32(cpu.Memory[pc:]); instr != want || cpu.PC != int(pc)+4 {
+			t.Fatalf("fetch from 0x%08X: 0x%08X, pc 0x%X; want 0x%08X, pc 0x%X", pc, instr, cpu.PC, want, pc+4)
+		}
+	})
+}
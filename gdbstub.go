@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// GDB stub
+// ============================================================================
+// GDBStub lets gdb debug the guest over the remote serial protocol, started by
+// `run --gdb <addr>` and attached with `target remote <addr>`. it serves one
+// connection and answers what gdb needs for the usual session:
+//
+//	?  g G  p P  m M       stop reason, registers (x0-x31, pc, then the CSRs
+//	                       at 65+their number) and memory (through the bus)
+//	c  s                   continue, step
+//	Z0 z0                  software breakpoints, kept by the stub
+//	Z1 z1                  hardware breakpoints: an execute trigger
+//	Z2 z2, Z3 z3, Z4 z4    watchpoints: a store, load or load/store trigger
+//	D  k                   detach, kill: both end the session
+//
+// anything else gets the empty reply gdb takes for "unsupported". Z1 to Z4
+// program the trigger module (triggers.go) with a free trigger each, leaving the
+// ones the guest uses alone and taking the last first (a guest tends to start
+// with trigger 0); when none is left gdb is told so and falls back to single
+// stepping. the triggers halt to the stub even when the guest has a trap
+// handler, and a watchpoint matches the address it was set at (not the rest of
+// its length). as with every trigger, a watchpoint stops before the access.
+//
+// a continuing guest runs until a breakpoint, a trigger, an error, the exit or
+// the instruction limit: gdb's interrupt (^C) is only read once it has stopped
+
+// gdbSignal numbers, as gdb reports the stop
+const (
+	gdbSIGINT  = 2
+	gdbSIGILL  = 4
+	gdbSIGTRAP = 5
+	gdbSIGSEGV = 11
+	gdbSIGXCPU = 24 // the instruction limit
+)
+
+// gdbPacketSize is the largest packet the stub takes or sends, as qSupported tells gdb
+const gdbPacketSize = 0x4000
+
+// gdbCSRBase is the register number gdb gives CSR 0
+const gdbCSRBase = 65
+
+// gdbTriggerKinds are the trigger accesses of Z1 to Z4, with the stop reason each reports
+var gdbTriggerKinds = [...]struct {
+	trigger Trigger
+	reason  string
+}{
+	1: {Trigger{Execute: true}, "hwbreak"},
+	2: {Trigger{Store: true}, "watch"},
+	3: {Trigger{Load: true}, "rwatch"},
+	4: {Trigger{Load: true, Store: true}, "awatch"},
+}
+
+// GDBStub serves gdb on one connection
+type GDBStub struct {
+	cpu         *CPU
+	in          *bufio.Reader
+	out         io.Writer
+	breakpoints map[int]bool      // Z0 breakpoints
+	triggers    [triggerCount]int // the Z type (1 to 4) each trigger was set for, 0 for none
+	budget      uint64            // maximum instructions to execute in total (0 means no limit)
+}
+
+// NewGDBStub creates a stub talking to gdb over conn
+func NewGDBStub(cpu *CPU, conn io.ReadWriter, budget uint64) *GDBStub {
+	return &GDBStub{
+		cpu:         cpu,
+		in:          bufio.NewReader(conn),
+		out:         conn,
+		breakpoints: make(map[int]bool),
+		budget:      budget,
+	}
+}
+
+// Serve answers gdb's packets until it detaches, kills the guest or hangs up
+func (s *GDBStub) Serve() error {
+	for {
+		packet, err := s.readPacket()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		reply, done := s.handle(packet)
+		if err := s.writePacket(reply); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// readPacket returns the next packet's data, acknowledging it. an interrupt
+// (^C) arriving while the guest is already stopped reads as the packet "\x03"
+func (s *GDBStub) readPacket() (string, error) {
+	for {
+		c, err := s.in.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0x03 {
+			return "\x03", nil
+		}
+		if c != '$' { // acknowledgements and noise
+			continue
+		}
+		data, err := s.in.ReadString('#')
+		if err != nil {
+			return "", err
+		}
+		data = data[:len(data)-1]
+		var sum [2]byte
+		if _, err := io.ReadFull(s.in, sum[:]); err != nil {
+			return "", err
+		}
+		if want, err := strconv.ParseUint(string(sum[:]), 16, 8); err != nil || byte(want) != gdbChecksum(data) {
+			if _, err := io.WriteString(s.out, "-"); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if _, err := io.WriteString(s.out, "+"); err != nil {
+			return "", err
+		}
+		return data, nil
+	}
+}
+
+// writePacket sends data as a packet (the stub doesn't wait for gdb's acknowledgement)
+func (s *GDBStub) writePacket(data string) error {
+	_, err := fmt.Fprintf(s.out, "$%s#%02x", data, gdbChecksum(data))
+	return err
+}
+
+func gdbChecksum(data string) byte {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+// handle answers one packet and reports whether the session is over
+func (s *GDBStub) handle(packet string) (reply string, done bool) {
+	if packet == "" {
+		return "", false
+	}
+	args := packet[1:]
+	switch packet[0] {
+	case 0x03:
+		return fmt.Sprintf("S%02x", gdbSIGINT), false
+	case '?':
+		return fmt.Sprintf("S%02x", gdbSIGTRAP), false
+	case 'g':
+		var b strings.Builder
+		for _, v := range append(s.cpu.Regs[:], uint32(s.cpu.PC)) {
+			b.WriteString(gdbHex32(v))
+		}
+		return b.String(), false
+	case 'G':
+		if len(args) != 33*8 {
+			return "E01", false
+		}
+		var values [33]uint32
+		for i := range values {
+			v, ok := parseGDBHex32(args[i*8 : i*8+8])
+			if !ok {
+				return "E01", false
+			}
+			values[i] = v
+		}
+		copy(s.cpu.Regs[1:], values[1:32])
+		s.cpu.PC = int(values[32])
+		return "OK", false
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 32)
+		if err != nil {
+			return "E01", false
+		}
+		v, err := s.readRegister(uint32(n))
+		if err != nil {
+			return "E01", false
+		}
+		return gdbHex32(v), false
+	case 'P':
+		num, value, ok := strings.Cut(args, "=")
+		n, err := strconv.ParseUint(num, 16, 32)
+		v, valid := parseGDBHex32(value)
+		if !ok || err != nil || !valid || s.writeRegister(uint32(n), v) != nil {
+			return "E01", false
+		}
+		return "OK", false
+	case 'm':
+		addr, length, ok := parseGDBRange(args)
+		if !ok {
+			return "E01", false
+		}
+		// two hex digits a byte must fit in a packet; gdb asks again for the rest
+		length = min(length, gdbPacketSize/2)
+		data, err := s.cpu.readBus(addr, length)
+		if err != nil {
+			return "E14", false
+		}
+		return hex.EncodeToString(data), false
+	case 'M':
+		where, value, _ := strings.Cut(args, ":")
+		addr, length, ok := parseGDBRange(where)
+		data, err := hex.DecodeString(value)
+		if !ok || err != nil || uint32(len(data)) != length {
+			return "E01", false
+		}
+		if s.cpu.writeBus(addr, data) != nil {
+			return "E14", false
+		}
+		return "OK", false
+	case 'c':
+		return s.resume(false), false
+	case 's':
+		return s.resume(true), false
+	case 'Z', 'z':
+		return s.breakpoint(packet[0] == 'Z', args), false
+	case 'D':
+		return "OK", true
+	case 'k':
+		return "", true
+	case 'H':
+		return "OK", false
+	case 'q':
+		switch {
+		case strings.HasPrefix(args, "Supported"):
+			return fmt.Sprintf("PacketSize=%x;swbreak+;hwbreak+", gdbPacketSize), false
+		case args == "Attached":
+			return "1", false
+		}
+	}
+	return "", false
+}
+
+// readRegister reads register n in gdb's numbering
+func (s *GDBStub) readRegister(n uint32) (uint32, error) {
+	switch {
+	case n < 32:
+		return s.cpu.Regs[n], nil
+	case n == 32:
+		return uint32(s.cpu.PC), nil
+	case n >= gdbCSRBase && n < gdbCSRBase+4096:
+		return s.cpu.ReadCSR(n - gdbCSRBase)
+	}
+	return 0, fmt.Errorf("no register %d", n)
+}
+
+// writeRegister writes register n in gdb's numbering
+func (s *GDBStub) writeRegister(n, v uint32) error {
+	switch {
+	case n == 0:
+	case n < 32:
+		s.cpu.Regs[n] = v
+	case n == 32:
+		s.cpu.PC = int(v)
+	case n >= gdbCSRBase && n < gdbCSRBase+4096:
+		return s.cpu.WriteCSR(n-gdbCSRBase, v)
+	default:
+		return fmt.Errorf("no register %d", n)
+	}
+	return nil
+}
+
+// breakpoint inserts (Z) or removes (z) the breakpoint or watchpoint "type,addr,kind"
+func (s *GDBStub) breakpoint(insert bool, args string) string {
+	fields := strings.Split(args, ",")
+	if len(fields) != 3 {
+		return "E01"
+	}
+	kind, err1 := strconv.ParseUint(fields[0], 16, 8)
+	addr, err2 := strconv.ParseUint(fields[1], 16, 32)
+	if err1 != nil || err2 != nil {
+		return "E01"
+	}
+	if kind == 0 {
+		if insert {
+			s.breakpoints[int(addr)] = true
+		} else {
+			delete(s.breakpoints, int(addr))
+		}
+		return "OK"
+	}
+	if kind >= uint64(len(gdbTriggerKinds)) {
+		return ""
+	}
+
+	want := gdbTriggerKinds[kind].trigger
+	want.Addr, want.Halt = uint32(addr), true
+	for i := triggerCount - 1; i >= 0; i-- {
+		owner := s.triggers[i]
+		t, _ := s.cpu.Trigger(i)
+		t.Hit = false
+		if insert && owner == 0 && !t.Execute && !t.Load && !t.Store {
+			s.cpu.SetTrigger(i, want)
+			s.triggers[i] = int(kind)
+			return "OK"
+		}
+		if !insert && owner == int(kind) && t == want {
+			s.cpu.SetTrigger(i, Trigger{})
+			s.triggers[i] = 0
+			return "OK"
+		}
+	}
+	if insert {
+		return "E28" // out of triggers: gdb falls back to something else
+	}
+	return "OK"
+}
+
+// resume continues the guest, or steps one instruction, and returns the stop reply
+func (s *GDBStub) resume(step bool) string {
+	for {
+		if s.budget != 0 && s.cpu.Retired >= s.budget {
+			return fmt.Sprintf("S%02x", gdbSIGXCPU)
+		}
+		if err := s.cpu.Step(); err != nil {
+			var exc *Exception
+			if errors.As(err, &exc) {
+				switch exc.Cause {
+				case CauseIllegalInstruction:
+					return fmt.Sprintf("S%02x", gdbSIGILL)
+				case CauseFetchAccessFault, CauseLoadAccessFault, CauseStoreAccessFault:
+					return fmt.Sprintf("S%02x", gdbSIGSEGV)
+				}
+			}
+			return fmt.Sprintf("S%02x", gdbSIGTRAP)
+		}
+		if s.cpu.Exited {
+			return fmt.Sprintf("W%02x", uint8(s.cpu.ExitCode))
+		}
+		if s.cpu.halted {
+			s.cpu.halted = false
+			if reply, ok := s.triggerStop(); ok {
+				return reply
+			}
+			return fmt.Sprintf("S%02x", gdbSIGTRAP)
+		}
+		if s.breakpoints[s.cpu.PC] {
+			return fmt.Sprintf("T%02xswbreak:;", gdbSIGTRAP)
+		}
+		if step {
+			return fmt.Sprintf("S%02x", gdbSIGTRAP)
+		}
+	}
+}
+
+// triggerStop returns the stop reply for a trigger of the stub's that has hit
+// (clearing its hit bit), if one has
+func (s *GDBStub) triggerStop() (string, bool) {
+	for i, kind := range s.triggers {
+		t, _ := s.cpu.Trigger(i)
+		if kind == 0 || !t.Hit {
+			continue
+		}
+		t.Hit = false
+		s.cpu.SetTrigger(i, t)
+		reason := gdbTriggerKinds[kind].reason
+		if kind == 1 {
+			return fmt.Sprintf("T%02x%s:;", gdbSIGTRAP, reason), true
+		}
+		return fmt.Sprintf("T%02x%s:%x;", gdbSIGTRAP, reason, t.Addr), true
+	}
+	return "", false
+}
+
+// gdbHex32 formats v the way gdb sends registers: little-endian bytes in hex
+func gdbHex32(v uint32) string {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return hex.EncodeToString(b[:])
+}
+
+// parseGDBHex32 parses a register value formatted like gdbHex32 does
+func parseGDBHex32(s string) (uint32, bool) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(b), true
+}
+
+// parseGDBRange parses the "addr,length" of m and M
+func parseGDBRange(s string) (addr, length uint32, ok bool) {
+	a, l, found := strings.Cut(s, ",")
+	addr64, err1 := strconv.ParseUint(a, 16, 32)
+	length64, err2 := strconv.ParseUint(l, 16, 32)
+	if !found || err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return uint32(addr64), uint32(length64), true
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gdbClient plays gdb's side of a session with a GDBStub
+type gdbClient struct {
+	t   *testing.T
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// newGDBSession starts a stub for cpu and returns the client talking to it
+// (and a channel with Serve's result)
+func newGDBSession(t *testing.T, cpu *CPU) (*gdbClient, <-chan error) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	done := make(chan error, 1)
+	go func() {
+		done <- NewGDBStub(cpu, server, 0).Serve()
+		server.Close()
+	}()
+	return &gdbClient{t: t, in: bufio.NewReader(client), out: client}, done
+}
+
+// send sends packet and returns the reply, checking the acknowledgement and checksum
+func (c *gdbClient) send(packet string) string {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.out, "$%s#%02x", packet, gdbChecksum(packet)); err != nil {
+		c.t.Fatal(err)
+	}
+	if ack, err := c.in.ReadByte(); err != nil || ack != '+' {
+		c.t.Fatalf("acknowledgement %q, %v", ack, err)
+	}
+	return c.reply()
+}
+
+// reply reads a packet from the stub
+func (c *gdbClient) reply() string {
+	c.t.Helper()
+	if dollar, err := c.in.ReadByte(); err != nil || dollar != '$' {
+		c.t.Fatalf("reply starts with %q, %v", dollar, err)
+	}
+	data, err := c.in.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	data = data[:len(data)-1]
+	var sum [2]byte
+	io.ReadFull(c.in, sum[:])
+	if want := fmt.Sprintf("%02x", gdbChecksum(data)); string(sum[:]) != want {
+		c.t.Fatalf("reply %q has checksum %s, want %s", data, sum[:], want)
+	}
+	return data
+}
+
+// expect sends packet and fails unless the reply is want
+func (c *gdbClient) expect(packet, want string) {
+	c.t.Helper()
+	if got := c.send(packet); got != want {
+		c.t.Errorf("%s: reply %q, want %q", packet, got, want)
+	}
+}
+
+func TestGDBStubRegistersAndMemory(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, triggerProgram(0)))
+	cpu.Regs[A0] = 0x11223344
+	gdb, done := newGDBSession(t, &cpu)
+
+	if got := gdb.send("qSupported:multiprocess+;hwbreak+"); !strings.Contains(got, "hwbreak+") {
+		t.Errorf("qSupported: %q", got)
+	}
+	gdb.expect("?", "S05")
+	regs := gdb.send("g")
+	if len(regs) != 33*8 || regs[A0*8:A0*8+8] != "44332211" {
+		t.Errorf("g: %q", regs)
+	}
+	gdb.expect("P20=00010000", "OK") // pc
+	gdb.expect("Pb=78563412", "OK")  // a1
+	gdb.expect("P0=01000000", "OK")  // x0 stays zero
+	if cpu.PC != 0x100 || cpu.Regs[A1] != 0x12345678 || cpu.Regs[ZERO] != 0 {
+		t.Errorf("pc 0x%X, a1 0x%X, zero 0x%X after P", cpu.PC, cpu.Regs[A1], cpu.Regs[ZERO])
+	}
+	gdb.expect("p20", "00010000")
+	gdb.expect(fmt.Sprintf("p%x", gdbCSRBase+CSR_TINFO), "04000000")
+	gdb.expect("p21", "E01")
+	gdb.expect("G"+strings.Repeat("00000000", 32)+"04000000", "OK")
+	if cpu.PC != 4 || cpu.Regs[A1] != 0 {
+		t.Errorf("pc 0x%X, a1 0x%X after G", cpu.PC, cpu.Regs[A1])
+	}
+
+	gdb.expect("M200,4:deadbeef", "OK")
+	gdb.expect("m200,6", "deadbeef0000")
+	gdb.expect("m2000,4", "E14")
+	gdb.expect("M200,4:dead", "E01")
+
+	gdb.expect("vMustReplyEmpty", "")
+	gdb.expect("D", "OK")
+	if err := <-done; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+}
+
+// a read longer than a packet holds is cut short rather than read in full,
+// and gdb asks for the rest
+func TestGDBStubLongRead(t *testing.T) {
+	cpu := NewCPUWithMemory(0x10000)
+	for i := range cpu.Memory {
+		cpu.Memory[i] = byte(i)
+	}
+	gdb, _ := newGDBSession(t, &cpu)
+	for _, packet := range []string{"m100,ffffffff", "m100,2000"} {
+		if got, want := gdb.send(packet), hex.EncodeToString(cpu.Memory[0x100:0x2100]); got != want {
+			t.Errorf("%s: a %d-digit reply, want the %d bytes at 0x100", packet, len(got), gdbPacketSize/2)
+		}
+	}
+	gdb.expect("m100,4", "00010203")
+	gdb.expect("D", "OK")
+}
+
+func TestGDBStubBreakpoints(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, triggerProgram(triggerTarget+8)))
+	gdb, _ := newGDBSession(t, &cpu)
+	pc := func(want uint32) {
+		t.Helper()
+		if uint32(cpu.PC) != want {
+			t.Errorf("stopped at 0x%X, want 0x%X", cpu.PC, want)
+		}
+	}
+
+	// a hardware breakpoint on the function stops both calls, before they run
+	gdb.expect("Z1,100,4", "OK")
+	if trig, _ := cpu.Trigger(triggerCount - 1); trig != (Trigger{Execute: true, Addr: triggerTarget, Halt: true}) {
+		t.Errorf("Z1 set the last trigger to %+v", trig)
+	}
+	for call := uint32(0); call < 2; call++ {
+		gdb.expect("c", "T05hwbreak:;")
+		pc(triggerTarget)
+		if cpu.Regs[S5] != call {
+			t.Errorf("the function ran %d times at stop %d", cpu.Regs[S5], call+1)
+		}
+	}
+	gdb.expect("z1,100,4", "OK")
+	if trig, _ := cpu.Trigger(triggerCount - 1); trig.Execute {
+		t.Errorf("z1 left the last trigger as %+v", trig)
+	}
+
+	// watchpoints: a load doesn't hit a store watchpoint, and the other way round
+	gdb.expect("Z2,204,4", "OK")
+	gdb.expect("Z3,200,4", "OK")
+	gdb.expect("Z4,200,4", "OK")
+	gdb.expect("c", "T05awatch:200;")
+	gdb.expect("z4,200,4", "OK")
+	gdb.expect("s", "S05") // the store runs once resumed
+	if v, _ := cpu.Load(0x200, 4); v != 2 {
+		t.Errorf("the stopped store wrote %d once stepped", v)
+	}
+	gdb.expect("z2,204,4", "OK")
+	gdb.expect("z3,200,4", "OK")
+
+	// with the guest's own trigger at the wrong address nothing else stops it
+	gdb.expect("c", "S05")
+	if cpu.Regs[S4] != 0 || cpu.Regs[S5] != 2 {
+		t.Errorf("%d traps, %d calls", cpu.Regs[S4], cpu.Regs[S5])
+	}
+}
+
+func TestGDBStubWatchpoints(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, triggerProgram(triggerTarget+8)))
+	gdb, _ := newGDBSession(t, &cpu)
+	gdb.expect("Z2,200,4", "OK") // the store
+	gdb.expect("Z3,204,4", "OK") // the load before it
+	gdb.expect("Z1,108,4", "OK") // never runs
+	gdb.expect("c", "T05rwatch:204;")
+	lw := uint32(cpu.PC)
+	gdb.expect("c", "T05watch:200;")
+	if uint32(cpu.PC) != lw+4 {
+		t.Errorf("the store watchpoint stopped at 0x%X, want 0x%X", cpu.PC, lw+4)
+	}
+	gdb.expect("c", "S05")
+}
+
+func TestGDBStubSoftwareBreakpointsAndSteps(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, triggerProgram(triggerTarget)))
+	gdb, _ := newGDBSession(t, &cpu)
+	gdb.expect("s", "S05")
+	if cpu.PC != 0x1C { // j main
+		t.Errorf("stepped to 0x%X", cpu.PC)
+	}
+	gdb.expect("Z0,104,4", "OK")
+	gdb.expect("c", "T05swbreak:;")
+	if cpu.PC != triggerTarget+4 || cpu.Regs[S4] != 1 {
+		t.Errorf("stopped at 0x%X after %d traps; want 0x%X after the guest's trigger", cpu.PC, cpu.Regs[S4], triggerTarget+4)
+	}
+	gdb.expect("z0,104,4", "OK")
+	gdb.expect("c", "S05")
+
+	// out of triggers: the guest's is free again once its handler disabled it
+	for i := range triggerCount {
+		gdb.expect(fmt.Sprintf("Z1,%x,4", 0x500+4*i), "OK")
+	}
+	gdb.expect("Z1,600,4", "E28")
+	gdb.expect("Z9,600,4", "")
+	gdb.expect("Z1,600", "E01")
+	gdb.expect("k", "")
+}
+
+func TestGDBStubExitAndFaults(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		build func(b *Builder)
+		want  string
+	}{
+		{"illegal", func(b *Builder) { b.Word(0xFFFFFFFF) }, "S04"},
+		{"fault", func(b *Builder) { b.Lw(T0, ZERO, 0x7F0); b.Lui(T0, 0x10); b.Lw(T0, T0, 0) }, "S0b"},
+	} {
+		cpu := NewCPUWithMemory(0x1000)
+		cpu.LoadProgram(assemble(t, tc.build))
+		gdb, _ := newGDBSession(t, &cpu)
+		gdb.expect("c", tc.want)
+	}
+
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, exitProgram(3)))
+	cpu.EcallHook = NewNewlibSyscalls(nil, io.Discard, io.Discard, 0x800, 0x1000).Handle
+	gdb, _ := newGDBSession(t, &cpu)
+	gdb.expect("c", "W03")
+
+	cpu = NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, loopProgram))
+	client, server := net.Pipe()
+	defer client.Close()
+	go NewGDBStub(&cpu, server, 100).Serve()
+	gdb = &gdbClient{t: t, in: bufio.NewReader(client), out: client}
+	gdb.expect("c", "S18")
+	if cpu.Retired != 100 {
+		t.Errorf("the instruction limit stopped at %d", cpu.Retired)
+	}
+
+	// a bad checksum is refused, and the packet sent again is answered
+	fmt.Fprint(client, "$?#00")
+	if nak, _ := gdb.in.ReadByte(); nak != '-' {
+		t.Errorf("bad checksum answered with %q", nak)
+	}
+	gdb.expect("?", "S05")
+	client.Write([]byte{0x03})
+	if got := gdb.reply(); got != "S02" {
+		t.Errorf("interrupt: %q", got)
+	}
+}
+
+func TestRunGDB(t *testing.T) {
+	image := writeTemp(t, "trig.bin", assemble(t, triggerProgram(triggerTarget+8)))
+	sock := filepath.Join(t.TempDir(), "gdb.sock")
+	type result struct {
+		code           int
+		stdout, stderr string
+	}
+	done := make(chan result, 1)
+	go func() {
+		code, stdout, stderr := runCommand("run", "--gdb=unix:"+sock, image)
+		done <- result{code, stdout, stderr}
+	}()
+
+	var conn net.Conn
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var err error
+		if conn, err = net.Dial("unix", sock); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing listening: %v", err)
+		}
+	}
+	defer conn.Close()
+	gdb := &gdbClient{t: t, in: bufio.NewReader(conn), out: conn}
+	gdb.expect("Z1,100,4", "OK")
+	gdb.expect("c", "T05hwbreak:;")
+	gdb.expect("p20", "00010000")
+	gdb.expect("D", "OK")
+	r := <-done
+	if r.code != 0 || !strings.Contains(r.stderr, "waiting for gdb on "+sock) {
+		t.Errorf("exit %d, stderr %q", r.code, r.stderr)
+	}
+
+	if code, _, stderr := runCommand("run", "--gdb=unix:"+sock, "--debug", image); code != 2 || !strings.Contains(stderr, "--gdb cannot be combined") {
+		t.Errorf("--gdb --debug: exit %d, %q", code, stderr)
+	}
+}
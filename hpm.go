@@ -0,0 +1,116 @@
+package main
+
+// ============================================================================
+// Hardware performance monitor
+// ============================================================================
+// besides mcycle and minstret there are four programmable counters,
+// mhpmcounter3 to mhpmcounter6 (with their high halves and the read-only
+// hpmcounter shadows). mhpmevent3 to mhpmevent6 pick what each one counts:
+//
+//	0  nothing: the counter is frozen (the reset value)
+//	1  retired loads
+//	2  retired stores
+//	3  taken conditional branches
+//	4  conditional branches, taken or not
+//	5  exceptions taken (interrupts aren't counted)
+//	6  instruction cache misses, with the cache model on (--icache); 0 without it
+//
+// writing any other event selects 0. a set bit 3 to 6 of mcountinhibit stops
+// the matching counter; the CY and IR bits aren't implemented, so mcycle and
+// minstret always count. mcounteren holds which counters lower privilege levels
+// may read, but with machine mode the only level, every read is allowed.
+//
+// the events are counted where the cycle model charges each retired instruction,
+// and only while some counter has an event, so a program that never programs
+// one pays a single check per instruction
+
+// HPM events, the values of mhpmevent
+const (
+	HPMEventNone        = 0
+	HPMEventLoad        = 1
+	HPMEventStore       = 2
+	HPMEventBranchTaken = 3
+	HPMEventBranch      = 4
+	HPMEventException   = 5
+	HPMEventICacheMiss  = 6
+	hpmEventCount       = 7 // events from here on are unsupported
+)
+
+const (
+	hpmFirst           = 3 // the number of the first counter
+	hpmCounters        = 4
+	hpmCounterBits     = (1<<hpmCounters - 1) << hpmFirst // their bits in mcountinhibit and mcounteren
+	mcounterenWritable = 0x7 | hpmCounterBits             // CY, TM, IR and the implemented counters
+)
+
+// hpmCounterIndex returns which counter addr is, for the range of the registers
+// starting at machine (mhpmcounter3...) or at its read-only shadow user
+func hpmCounterIndex(addr, machine, user uint32) (int, bool) {
+	for _, first := range []uint32{machine, user} {
+		if addr >= first && addr < first+hpmCounters {
+			return int(addr - first), true
+		}
+	}
+	return 0, false
+}
+
+// setHPMEvent selects the event counter i counts
+func (cpu *CPU) setHPMEvent(i, event uint32) {
+	if event >= hpmEventCount {
+		event = HPMEventNone
+	}
+	cpu.csrs[CSR_MHPMEVENT3+i] = event
+	cpu.hpmICacheMisses = cpu.icacheMisses() // misses from before the event was selected don't count
+	cpu.hpmActive = false
+	for j := uint32(0); j < hpmCounters; j++ {
+		if cpu.csrs[CSR_MHPMEVENT3+j] != HPMEventNone {
+			cpu.hpmActive = true
+		}
+	}
+}
+
+// HPMCounter returns the value of mhpmcounter<n>, for n from 3 to 6
+func (cpu *CPU) HPMCounter(n int) uint64 {
+	if n < hpmFirst || n >= hpmFirst+hpmCounters {
+		return 0
+	}
+	return cpu.hpm[n-hpmFirst]
+}
+
+// countEvent adds n to the counters counting event, unless mcountinhibit stops them
+func (cpu *CPU) countEvent(event uint32, n uint64) {
+	inhibit := cpu.csrs[CSR_MCOUNTINHIBIT]
+	for i := range cpu.hpm {
+		if cpu.csrs[CSR_MHPMEVENT3+uint32(i)] == event && inhibit&(1<<(hpmFirst+i)) == 0 {
+			cpu.hpm[i] += n
+		}
+	}
+}
+
+// countEvents counts the events of the instruction d at pc, which has just retired
+func (cpu *CPU) countEvents(d *decoded, pc uint32) {
+	switch d.opcode {
+	case LOAD:
+		cpu.countEvent(HPMEventLoad, 1)
+	case STORE:
+		cpu.countEvent(HPMEventStore, 1)
+	case BRANCH:
+		cpu.countEvent(HPMEventBranch, 1)
+		if uint32(cpu.PC) != pc+4 {
+			cpu.countEvent(HPMEventBranchTaken, 1)
+		}
+	}
+	// the misses since the last instruction, whose fetches they were
+	if misses := cpu.icacheMisses(); misses != cpu.hpmICacheMisses {
+		cpu.countEvent(HPMEventICacheMiss, misses-cpu.hpmICacheMisses)
+		cpu.hpmICacheMisses = misses
+	}
+}
+
+// icacheMisses is how many misses the instruction cache model has counted, 0 without one
+func (cpu *CPU) icacheMisses() uint64 {
+	if caches, ok := cpu.Observer.(*CacheModel); ok && caches.I != nil {
+		return caches.I.Stats().Misses
+	}
+	return 0
+}
@@ -0,0 +1,133 @@
+package main
+
+import "testing"
+
+// hpmProgram programs the counters, runs a loop of five loads, stores and
+// branches (four of them taken), and checks what they counted, exiting with
+// the number of the first check that fails (0 when they all pass)
+func hpmProgram(b *Builder) {
+	b.J("main")
+	// the trap handler (at 4) skips the instruction that trapped
+	b.Csrrs(T0, CSR_MEPC, ZERO)
+	b.Addi(T0, T0, 4)
+	b.Csrrw(ZERO, CSR_MEPC, T0)
+	b.Mret()
+
+	b.Label("main")
+	b.Li(T0, 4)
+	b.Csrrw(ZERO, CSR_MTVEC, T0)
+	for i, event := range []int32{HPMEventLoad, HPMEventBranchTaken, HPMEventBranch} {
+		b.Li(T0, event)
+		b.Csrrw(ZERO, CSR_MHPMEVENT3+uint32(i), T0)
+	}
+	b.Li(T0, 7)
+	b.Csrrw(ZERO, CSR_MHPMCOUNTER3+3, T0) // mhpmcounter6 has no event: it stays 7
+
+	b.Li(S0, 0x800)
+	b.Li(A1, 5)
+	b.Label("loop")
+	b.Lw(T1, S0, 0)
+	b.Sw(T1, S0, 4)
+	b.Addi(A0, A0, 1)
+	b.Blt(A0, A1, "loop")
+
+	// stop the counters, so the checks' own loads and branches aren't counted
+	b.Li(T0, hpmCounterBits)
+	b.Csrrw(ZERO, CSR_MCOUNTINHIBIT, T0)
+	b.Lw(T1, S0, 0)
+	b.Csrrs(S1, CSR_MHPMCOUNTER3, ZERO)
+	b.Csrrs(S2, CSR_HPMCOUNTER3+1, ZERO) // through the read-only shadow
+	b.Csrrs(S3, CSR_MHPMCOUNTER3+2, ZERO)
+	b.Csrrs(S4, CSR_MHPMCOUNTER3+3, ZERO)
+	b.Csrrs(S5, CSR_MHPMCOUNTER3H, ZERO)
+	check := func(n int32, reg uint32, want int32) {
+		b.Li(A0, n)
+		b.Li(T0, want)
+		b.Bne(reg, T0, "exit")
+	}
+	check(1, S1, 5)
+	check(2, S2, 4)
+	check(3, S3, 5)
+	check(4, S4, 7)
+	check(5, S5, 0)
+
+	// count two exceptions in mhpmcounter6, and not a third while inhibited
+	b.Csrrw(ZERO, CSR_MCOUNTINHIBIT, ZERO)
+	b.Li(T0, HPMEventException)
+	b.Csrrw(ZERO, CSR_MHPMEVENT3+3, T0)
+	b.Word(0xFFFFFFFF)
+	b.Word(0xFFFFFFFF)
+	b.Li(T0, hpmCounterBits)
+	b.Csrrw(ZERO, CSR_MCOUNTINHIBIT, T0)
+	b.Word(0xFFFFFFFF)
+	b.Csrrs(S4, CSR_MHPMCOUNTER3+3, ZERO)
+	check(6, S4, 9)
+	b.Li(A0, 0)
+
+	b.Label("exit")
+	b.Csrrw(ZERO, CSR_MTVEC, ZERO)
+	b.Li(A7, newlibSysExit)
+	b.Ecall()
+}
+
+func TestHPMGuest(t *testing.T) {
+	image := writeTemp(t, "hpm.bin", assemble(t, hpmProgram))
+	for _, flags := range [][]string{nil, {"--no-block-cache"}, {"--backend=table"}, {"--selfcheck"}} {
+		args := append(append([]string{"run", "--syscalls=newlib"}, flags...), image)
+		if code, _, stderr := runCommand(args...); code != 0 {
+			t.Errorf("%v: check %d failed (%s)", flags, code, stderr)
+		}
+	}
+}
+
+func TestHPMCounters(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	for _, addr := range []uint32{CSR_MHPMCOUNTER3, CSR_MHPMCOUNTER3H} {
+		csrw(t, &cpu, addr, 0x12345678)
+	}
+	if got := cpu.HPMCounter(3); got != 0x12345678_12345678 {
+		t.Errorf("mhpmcounter3 = 0x%X after writing both halves", got)
+	}
+	if got := csrr(t, &cpu, CSR_HPMCOUNTER3H); got != 0x12345678 {
+		t.Errorf("hpmcounter3h = 0x%08X", got)
+	}
+	if err := cpu.WriteCSR(CSR_HPMCOUNTER3, 0); err == nil {
+		t.Error("hpmcounter3 is writable")
+	}
+	if cpu.HPMCounter(2) != 0 || cpu.HPMCounter(7) != 0 {
+		t.Error("counters outside 3 to 6 aren't 0")
+	}
+
+	csrw(t, &cpu, CSR_MHPMEVENT3, hpmEventCount)
+	if got := csrr(t, &cpu, CSR_MHPMEVENT3); got != HPMEventNone {
+		t.Errorf("an unsupported event reads back as %d, want 0", got)
+	}
+	csrw(t, &cpu, CSR_MCOUNTEREN, 0xFFFFFFFF)
+	if got := csrr(t, &cpu, CSR_MCOUNTEREN); got != mcounterenWritable {
+		t.Errorf("mcounteren = 0x%08X, want 0x%08X", got, uint32(mcounterenWritable))
+	}
+}
+
+func TestHPMICacheMisses(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, func(b *Builder) {
+		b.Li(T0, HPMEventICacheMiss)
+		b.Csrrw(ZERO, CSR_MHPMEVENT3, T0)
+		for range 16 {
+			b.Nop()
+		}
+		b.Ebreak()
+	}))
+	caches, err := NewCacheModel(&CacheConfig{Size: 64, LineSize: 16, Ways: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.Observer = caches
+	runToEbreak(t, &cpu)
+
+	// the miss on the first line came before the event was selected
+	total := caches.I.Stats().Misses
+	if got := cpu.HPMCounter(3); got != total-1 || got == 0 {
+		t.Errorf("mhpmcounter3 = %d with %d misses in all", got, total)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "encoding/binary"
+
+// ============================================================================
+// HTIF (host-target interface)
+// ============================================================================
+// programs built for spike, the riscv-tests among them, stop by storing to a
+// word of RAM the ELF file calls tohost. the emulator watches that word: odd
+// values are the exit command, the exit code in the bits above the lowest
+// (riscv-tests write 1 for a pass and testnum<<1|1 for a failure). the other
+// HTIF commands (the syscall proxy, the console) aren't supported, storing
+// one does nothing
+
+// WithHTIF watches the tohost word at addr, a Store there exiting as described above
+func WithHTIF(tohost uint32) Option {
+	return func(cpu *CPU) {
+		cpu.tohost = tohost
+		cpu.htif = true
+	}
+}
+
+// checkToHost runs after [addr, addr+n) of RAM was written
+func (cpu *CPU) checkToHost(addr, n uint32) {
+	if cpu.tohost < addr || cpu.tohost-addr >= n {
+		return
+	}
+	off, ok := cpu.ramOffset(cpu.tohost, 4)
+	if !ok {
+		return
+	}
+	if v := binary.LittleEndian.Uint32(cpu.Memory[off:]); v&1 != 0 {
+		cpu.Exit(int(v >> 1))
+	}
+}
@@ -1,6 +1,6 @@
 package main
 
-// We'll define just the add, sub, addi, sw, and lui instructions for now
+// We define the RV32I base integer instruction set
 
 const (
 	// add and sub share the same opcode (they are both R-type instructions, but the funct3 field differentiates them)
@@ -11,3 +11,17 @@ const (
 	SW   = 0x23
 	LUI  = 0x37
 )
+
+// opcodes of the instruction groups, each group is told apart by funct3 (and funct7 for some)
+const (
+	LOAD     = 0x03 // lb, lh, lw, lbu, lhu
+	MISC_MEM = 0x0F // fence
+	OP_IMM   = 0x13 // addi, slti, sltiu, xori, ori, andi, slli, srli, srai
+	AUIPC    = 0x17
+	STORE    = 0x23 // sb, sh, sw
+	OP       = 0x33 // add, sub, sll, slt, sltu, xor, srl, sra, or, and
+	BRANCH   = 0x63 // beq, bne, blt, bge, bltu, bgeu
+	JALR     = 0x67
+	JAL      = 0x6F
+	SYSTEM   = 0x73 // ecall, ebreak
+)
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/binary"
+	"maps"
+	"slices"
+	"testing"
+)
+
+// instrPC is where each instruction case is placed and executed from
+const instrPC = 0x100
+
+// instrCase is one instruction executed on a fresh CPU: the state it starts
+// from and what must have changed afterwards. registers and memory words not
+// listed in the expectations must be unchanged
+type instrCase struct {
+	name    string
+	instr   uint32            // encoded with the builder's encoders
+	regs    map[uint32]uint32 // initial registers
+	mem     map[uint32]uint32 // initial memory words
+	want    map[uint32]uint32 // registers afterwards
+	wantMem map[uint32]uint32 // memory words afterwards
+	wantPC  uint32            // 0 means the next instruction
+	csrs    map[uint32]uint32 // initial CSRs
+	wantCSR map[uint32]uint32 // CSRs afterwards
+	fails   bool              // the instruction raises an exception
+}
+
+// r is shorthand for register maps
+type r = map[uint32]uint32
+
+var instrCases = []instrCase{
+	// OP
+	{name: "add", instr: encodeR(OP, A0, 0x0, A1, A2, 0x00), regs: r{A1: 5, A2: 7}, want: r{A0: 12}},
+	{name: "add wraps", instr: encodeR(OP, A0, 0x0, A1, A2, 0x00), regs: r{A1: 0xFFFFFFFF, A2: 2}, want: r{A0: 1}},
+	{name: "add wraps at the signed limit", instr: encodeR(OP, A0, 0x0, A1, A2, 0x00), regs: r{A1: 0x7FFFFFFF, A2: 1}, want: r{A0: 0x80000000}},
+	{name: "sub", instr: encodeR(OP, A0, 0x0, A1, A2, 0x20), regs: r{A1: 10, A2: 3}, want: r{A0: 7}},
+	{name: "sub through zero", instr: encodeR(OP, A0, 0x0, A1, A2, 0x20), regs: r{A1: 3, A2: 5}, want: r{A0: 0xFFFFFFFE}},
+	{name: "sub of the minimum", instr: encodeR(OP, A0, 0x0, ZERO, A2, 0x20), regs: r{A2: 0x80000000}, want: r{A0: 0x80000000}},
+	{name: "sll", instr: encodeR(OP, A0, 0x1, A1, A2, 0x00), regs: r{A1: 0x80000001, A2: 4}, want: r{A0: 0x10}},
+	{name: "sll uses the low 5 bits", instr: encodeR(OP, A0, 0x1, A1, A2, 0x00), regs: r{A1: 1, A2: 33}, want: r{A0: 2}},
+	{name: "slt", instr: encodeR(OP, A0, 0x2, A1, A2, 0x00), regs: r{A1: 0xFFFFFFFF, A2: 1}, want: r{A0: 1}},
+	{name: "slt equal", instr: encodeR(OP, A0, 0x2, A1, A2, 0x00), regs: r{A1: 5, A2: 5}, want: r{A0: 0}},
+	{name: "sltu", instr: encodeR(OP, A0, 0x3, A1, A2, 0x00), regs: r{A1: 0xFFFFFFFF, A2: 1}, want: r{A0: 0}},
+	{name: "sltu as snez", instr: encodeR(OP, A0, 0x3, ZERO, A2, 0x00), regs: r{A2: 9}, want: r{A0: 1}},
+	{name: "xor", instr: encodeR(OP, A0, 0x4, A1, A2, 0x00), regs: r{A1: 0xFF00FF00, A2: 0x0FF00FF0}, want: r{A0: 0xF0F0F0F0}},
+	{name: "srl", instr: encodeR(OP, A0, 0x5, A1, A2, 0x00), regs: r{A1: 0x80000000, A2: 31}, want: r{A0: 1}},
+	{name: "sra", instr: encodeR(OP, A0, 0x5, A1, A2, 0x20), regs: r{A1: 0x80000000, A2: 31}, want: r{A0: 0xFFFFFFFF}},
+	{name: "sra positive", instr: encodeR(OP, A0, 0x5, A1, A2, 0x20), regs: r{A1: 0x40000000, A2: 30}, want: r{A0: 1}},
+	{name: "or", instr: encodeR(OP, A0, 0x6, A1, A2, 0x00), regs: r{A1: 0xF0, A2: 0x0F}, want: r{A0: 0xFF}},
+	{name: "and", instr: encodeR(OP, A0, 0x7, A1, A2, 0x00), regs: r{A1: 0xF0F0, A2: 0xFF00}, want: r{A0: 0xF000}},
+	{name: "same source and destination", instr: encodeR(OP, A0, 0x0, A0, A0, 0x00), regs: r{A0: 21}, want: r{A0: 42}},
+	{name: "illegal funct7", instr: encodeR(OP, A0, 0x0, A1, A2, 0x10), fails: true},
+
+	// OP-IMM
+	{name: "addi", instr: encodeI(OP_IMM, A0, 0x0, A1, 100), regs: r{A1: 1}, want: r{A0: 101}},
+	{name: "addi negative", instr: encodeI(OP_IMM, A0, 0x0, A1, 0xFFF), regs: r{A1: 0}, want: r{A0: 0xFFFFFFFF}},
+	{name: "addi -2048", instr: encodeI(OP_IMM, A0, 0x0, A1, 0x800), regs: r{A1: 0}, want: r{A0: 0xFFFFF800}},
+	{name: "addi 2047", instr: encodeI(OP_IMM, A0, 0x0, A1, 0x7FF), regs: r{A1: 1}, want: r{A0: 0x800}},
+	{name: "slti", instr: encodeI(OP_IMM, A0, 0x2, A1, 0xFFF), regs: r{A1: 0xFFFFFFFE}, want: r{A0: 1}},
+	{name: "sltiu with -1 is everything but -1", instr: encodeI(OP_IMM, A0, 0x3, A1, 0xFFF), regs: r{A1: 0xFFFFFFFE}, want: r{A0: 1}},
+	{name: "sltiu 1 as seqz", instr: encodeI(OP_IMM, A0, 0x3, A1, 1), regs: r{A1: 0}, want: r{A0: 1}},
+	{name: "xori -1 as not", instr: encodeI(OP_IMM, A0, 0x4, A1, 0xFFF), regs: r{A1: 0x0F0F0F0F}, want: r{A0: 0xF0F0F0F0}},
+	{name: "ori", instr: encodeI(OP_IMM, A0, 0x6, A1, 0x800), regs: r{A1: 1}, want: r{A0: 0xFFFFF801}},
+	{name: "andi", instr: encodeI(OP_IMM, A0, 0x7, A1, 0xFF), regs: r{A1: 0x12345678}, want: r{A0: 0x78}},
+	{name: "slli", instr: encodeI(OP_IMM, A0, 0x1, A1, 31), regs: r{A1: 3}, want: r{A0: 0x80000000}},
+	{name: "srli", instr: encodeI(OP_IMM, A0, 0x5, A1, 4), regs: r{A1: 0xF0000000}, want: r{A0: 0x0F000000}},
+	{name: "srai", instr: encodeI(OP_IMM, A0, 0x5, A1, 0x400|4), regs: r{A1: 0xF0000000}, want: r{A0: 0xFF000000}},
+	{name: "slli with shamt[5] set", instr: encodeI(OP_IMM, A0, 0x1, A1, 32), fails: true},
+
+	// LOAD
+	{name: "lb sign-extends", instr: encodeI(LOAD, A0, 0x0, A1, 1), regs: r{A1: 0x200}, mem: r{0x200: 0x0000FF00}, want: r{A0: 0xFFFFFFFF}},
+	{name: "lb positive", instr: encodeI(LOAD, A0, 0x0, A1, 0), regs: r{A1: 0x200}, mem: r{0x200: 0x7F}, want: r{A0: 0x7F}},
+	{name: "lbu zero-extends", instr: encodeI(LOAD, A0, 0x4, A1, 1), regs: r{A1: 0x200}, mem: r{0x200: 0x0000FF00}, want: r{A0: 0xFF}},
+	{name: "lh sign-extends", instr: encodeI(LOAD, A0, 0x1, A1, 2), regs: r{A1: 0x200}, mem: r{0x200: 0x80000000}, want: r{A0: 0xFFFF8000}},
+	{name: "lhu zero-extends", instr: encodeI(LOAD, A0, 0x5, A1, 2), regs: r{A1: 0x200}, mem: r{0x200: 0x80000000}, want: r{A0: 0x8000}},
+	{name: "lw", instr: encodeI(LOAD, A0, 0x2, A1, 4), regs: r{A1: 0x200}, mem: r{0x204: 0xDEADBEEF}, want: r{A0: 0xDEADBEEF}},
+	{name: "lw with a negative offset", instr: encodeI(LOAD, A0, 0x2, A1, 0xFFC), regs: r{A1: 0x204}, mem: r{0x200: 0xCAFEF00D}, want: r{A0: 0xCAFEF00D}},
+	{name: "lw outside memory", instr: encodeI(LOAD, A0, 0x2, A1, 0), regs: r{A1: 0x00F00000}, fails: true},
+	{name: "illegal load width", instr: encodeI(LOAD, A0, 0x3, A1, 0), regs: r{A1: 0x200}, fails: true},
+
+	// STORE
+	{name: "sb", instr: encodeS(STORE, 0x0, A1, A2, 1), regs: r{A1: 0x200, A2: 0x123456AB}, mem: r{0x200: 0x11111111}, wantMem: r{0x200: 0x1111AB11}},
+	{name: "sh", instr: encodeS(STORE, 0x1, A1, A2, 2), regs: r{A1: 0x200, A2: 0x1234ABCD}, mem: r{0x200: 0x11111111}, wantMem: r{0x200: 0xABCD1111}},
+	{name: "sw", instr: encodeS(STORE, 0x2, A1, A2, 0), regs: r{A1: 0x200, A2: 0xDEADBEEF}, wantMem: r{0x200: 0xDEADBEEF}},
+	{name: "sw with a negative offset", instr: encodeS(STORE, 0x2, A1, A2, 0xFFC), regs: r{A1: 0x204, A2: 7}, wantMem: r{0x200: 7}},
+	{name: "sw outside memory", instr: encodeS(STORE, 0x2, A1, A2, 0), regs: r{A1: 0x00F00000}, fails: true},
+
+	// BRANCH
+	{name: "beq taken", instr: encodeB(BRANCH, 0x0, A0, A1, 16), regs: r{A0: 3, A1: 3}, wantPC: instrPC + 16},
+	{name: "beq not taken", instr: encodeB(BRANCH, 0x0, A0, A1, 16), regs: r{A0: 3, A1: 4}},
+	{name: "bne taken backwards", instr: encodeB(BRANCH, 0x1, A0, A1, 0x1FF8), regs: r{A0: 3, A1: 4}, wantPC: instrPC - 8},
+	{name: "blt signed", instr: encodeB(BRANCH, 0x4, A0, A1, 8), regs: r{A0: 0xFFFFFFFF, A1: 0}, wantPC: instrPC + 8},
+	{name: "bge equal", instr: encodeB(BRANCH, 0x5, A0, A1, 8), regs: r{A0: 5, A1: 5}, wantPC: instrPC + 8},
+	{name: "bge not taken", instr: encodeB(BRANCH, 0x5, A0, A1, 8), regs: r{A0: 0xFFFFFFFF, A1: 0}},
+	{name: "bltu unsigned", instr: encodeB(BRANCH, 0x6, A0, A1, 8), regs: r{A0: 0xFFFFFFFF, A1: 0}},
+	{name: "bgeu unsigned", instr: encodeB(BRANCH, 0x7, A0, A1, 8), regs: r{A0: 0xFFFFFFFF, A1: 0}, wantPC: instrPC + 8},
+	{name: "illegal branch", instr: encodeB(BRANCH, 0x2, A0, A1, 8), fails: true},
+
+	// U-type and jumps
+	{name: "lui", instr: encodeU(LUI, A0, 0xFFFFF), want: r{A0: 0xFFFFF000}},
+	{name: "auipc", instr: encodeU(AUIPC, A0, 1), want: r{A0: instrPC + 0x1000}},
+	{name: "jal", instr: encodeJ(JAL, RA, 0x40), wantPC: instrPC + 0x40, want: r{RA: instrPC + 4}},
+	{name: "jal backwards", instr: encodeJ(JAL, RA, 0x1FFF80), wantPC: instrPC - 0x80, want: r{RA: instrPC + 4}},
+	{name: "jalr clears bit 0", instr: encodeI(JALR, RA, 0x0, A0, 1), regs: r{A0: 0x200}, wantPC: 0x200, want: r{RA: instrPC + 4}},
+	{name: "jalr to a misaligned target", instr: encodeI(JALR, RA, 0x0, A0, 2), regs: r{A0: 0x200}, fails: true},
+	{name: "jalr through its own destination", instr: encodeI(JALR, A0, 0x0, A0, 0), regs: r{A0: 0x300}, wantPC: 0x300, want: r{A0: instrPC + 4}},
+
+	// x0 stays zero
+	{name: "addi to x0", instr: encodeI(OP_IMM, ZERO, 0x0, A1, 5), regs: r{A1: 1}, want: r{ZERO: 0}},
+	{name: "lui to x0", instr: encodeU(LUI, ZERO, 0x12345), want: r{ZERO: 0}},
+	{name: "lw to x0", instr: encodeI(LOAD, ZERO, 0x2, A1, 0), regs: r{A1: 0x200}, mem: r{0x200: 0xFFFFFFFF}, want: r{ZERO: 0}},
+	{name: "jal to x0", instr: encodeJ(JAL, ZERO, 8), wantPC: instrPC + 8, want: r{ZERO: 0}},
+	{name: "csrrs to x0", instr: encodeI(SYSTEM, ZERO, 0x2, ZERO, CSR_MSCRATCH), csrs: r{CSR_MSCRATCH: 9}, want: r{ZERO: 0}},
+
+	// SYSTEM and MISC-MEM
+	{name: "csrrw", instr: encodeI(SYSTEM, A0, 0x1, A1, CSR_MSCRATCH), regs: r{A1: 0x55}, csrs: r{CSR_MSCRATCH: 0x11}, want: r{A0: 0x11}, wantCSR: r{CSR_MSCRATCH: 0x55}},
+	{name: "csrrs", instr: encodeI(SYSTEM, A0, 0x2, A1, CSR_MSCRATCH), regs: r{A1: 0xF0}, csrs: r{CSR_MSCRATCH: 0x0F}, want: r{A0: 0x0F}, wantCSR: r{CSR_MSCRATCH: 0xFF}},
+	{name: "csrrc", instr: encodeI(SYSTEM, A0, 0x3, A1, CSR_MSCRATCH), regs: r{A1: 0x0F}, csrs: r{CSR_MSCRATCH: 0xFF}, want: r{A0: 0xFF}, wantCSR: r{CSR_MSCRATCH: 0xF0}},
+	{name: "csrrwi", instr: encodeI(SYSTEM, A0, 0x5, 31, CSR_MSCRATCH), csrs: r{CSR_MSCRATCH: 1}, want: r{A0: 1}, wantCSR: r{CSR_MSCRATCH: 31}},
+	{name: "csrrsi", instr: encodeI(SYSTEM, A0, 0x6, 0x10, CSR_MSCRATCH), csrs: r{CSR_MSCRATCH: 1}, want: r{A0: 1}, wantCSR: r{CSR_MSCRATCH: 0x11}},
+	{name: "csrrci", instr: encodeI(SYSTEM, A0, 0x7, 1, CSR_MSCRATCH), csrs: r{CSR_MSCRATCH: 3}, want: r{A0: 3}, wantCSR: r{CSR_MSCRATCH: 2}},
+	{name: "ecall without a handler", instr: encodeI(SYSTEM, 0, 0x0, 0, 0), fails: true},
+	{name: "fence", instr: encodeI(MISC_MEM, 0, 0x0, 0, 0x0FF)},
+	{name: "fence.i", instr: encodeI(MISC_MEM, 0, 0x1, 0, 0)},
+	{name: "all zeros is a no-op here", instr: 0}, // illegal on hardware; Validate warns about it
+	{name: "all ones is illegal", instr: 0xFFFFFFFF, fails: true},
+}
+
+// cpu returns a CPU made with opts in the case's initial state, about to execute its instruction
+func (c instrCase) cpu(opts ...Option) *CPU {
+	cpu := NewCPU(opts...)
+	binary.LittleEndian.PutUint32(cpu.Memory[instrPC:], c.instr)
+	cpu.PC = instrPC
+	for reg, v := range c.regs {
+		cpu.Regs[reg] = v
+	}
+	for addr, v := range c.mem {
+		binary.LittleEndian.PutUint32(cpu.Memory[addr:], v)
+	}
+	for csr, v := range c.csrs {
+		cpu.csrs[csr] = v
+	}
+	return &cpu
+}
+
+func TestInstructions(t *testing.T) {
+	for _, c := range instrCases {
+		t.Run(c.name, func(t *testing.T) {
+			cpu := c.cpu()
+			wantRegs := cpu.Regs
+			for reg, v := range c.want {
+				wantRegs[reg] = v
+			}
+			wantMemory := slices.Clone(cpu.Memory)
+			for addr, v := range c.wantMem {
+				binary.LittleEndian.PutUint32(wantMemory[addr:], v)
+			}
+
+			text, _ := Disassemble(c.instr, instrPC)
+			err := cpu.Step()
+			if c.fails {
+				if err == nil {
+					t.Fatalf("%s (0x%08X) succeeded, want an exception", text, c.instr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s (0x%08X): %v", text, c.instr, err)
+			}
+			if cpu.Regs != wantRegs {
+				for i := range cpu.Regs {
+					if cpu.Regs[i] != wantRegs[i] {
+						t.Errorf("%s: %s = 0x%08X, want 0x%08X", text, abiNames[i], cpu.Regs[i], wantRegs[i])
+					}
+				}
+			}
+			wantPC := c.wantPC
+			if wantPC == 0 {
+				wantPC = instrPC + 4
+			}
+			if uint32(cpu.PC) != wantPC {
+				t.Errorf("%s: pc = 0x%X, want 0x%X", text, cpu.PC, wantPC)
+			}
+			for _, addr := range slices.Sorted(maps.Keys(c.wantMem)) {
+				if got := binary.LittleEndian.Uint32(cpu.Memory[addr:]); got != c.wantMem[addr] {
+					t.Errorf("%s: word at 0x%X = 0x%08X, want 0x%08X", text, addr, got, c.wantMem[addr])
+				}
+			}
+			if !slices.Equal(cpu.Memory, wantMemory) {
+				t.Errorf("%s changed memory other than the expected words", text)
+			}
+			for csr, want := range c.wantCSR {
+				if got := cpu.csrs[csr]; got != want {
+					t.Errorf("%s: CSR 0x%03X = 0x%X, want 0x%X", text, csr, got, want)
+				}
+			}
+		})
+	}
+}
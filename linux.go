@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// linux rv32 syscall numbers (the asm-generic table), passed in a7.
+// rv32 only has the 64-bit variants of calls involving file offsets and time,
+// so e.g. 62 is llseek and 222 is mmap2
+const (
+	linuxSysIoctl          = 29
+	linuxSysOpenat         = 56
+	linuxSysClose          = 57
+	linuxSysLlseek         = 62
+	linuxSysRead           = 63
+	linuxSysWrite          = 64
+	linuxSysReadv          = 65
+	linuxSysWritev         = 66
+	linuxSysExit           = 93
+	linuxSysExitGroup      = 94
+	linuxSysSetTidAddress  = 96
+	linuxSysSetRobustList  = 99
+	linuxSysClockGettime   = 113
+	linuxSysSigaltstack    = 132
+	linuxSysRtSigaction    = 134
+	linuxSysRtSigprocmask  = 135
+	linuxSysBrk            = 214
+	linuxSysMunmap         = 215
+	linuxSysMmap2          = 222
+	linuxSysMadvise        = 233
+	linuxSysClockGettime64 = 403
+)
+
+// more errno values (see newlib.go for the shared ones)
+const (
+	errnoENOENT = 2
+	errnoEIO    = 5
+	errnoENOMEM = 12
+	errnoEACCES = 13
+	errnoEFAULT = 14 // a pointer argument points outside guest memory
+	errnoEEXIST = 17
+	errnoEMFILE = 24
+	errnoENOTTY = 25
+
+	errnoENAMETOOLONG = 36
+)
+
+// open flags and other constants guests pass in, as the rv32 kernel defines them
+const (
+	linuxAtFdcwd    = -100
+	linuxOWronly    = 0o1
+	linuxORdwr      = 0o2
+	linuxOCreat     = 0o100
+	linuxOExcl      = 0o200
+	linuxOTrunc     = 0o1000
+	linuxOAppend    = 0o2000
+	linuxMapFixed   = 0x10
+	linuxMapAnon    = 0x20
+	linuxPageSize   = 4096
+	linuxMaxOpen    = 64 // size of the file descriptor table
+	linuxMaxIOVecs  = 1024
+	linuxMaxPathLen = 4096
+
+	linuxStackReserve = 1 << 20 // how much room the CLI leaves for the stack below the initial sp
+)
+
+// LinuxSyscalls emulates the subset of the Linux rv32 user-mode system call
+// interface a simple static binary (e.g. a musl hello world) needs.
+// the syscall number is in a7, arguments in a0-a5, and the result goes back in
+// a0 as a value in [-4095, -1] holding -errno on failure, like the kernel does.
+// files opened with openat are confined to the Root directory on the host.
+// install it with cpu.EcallHook = syscalls.Handle
+type LinuxSyscalls struct {
+	Stdin  io.Reader // fd 0
+	Stdout io.Writer // fd 1
+	Stderr io.Writer // fd 2
+	Root   *os.Root  // openat resolves paths here; nil means openat always fails with ENOENT
+
+	Now         func() time.Time // source of clock_gettime, time.Now by default
+	LogUnknown  bool             // log unimplemented syscalls to the CPU's logger at warning level
+	HeapStart   uint32           // lowest program break
+	HeapLimit   uint32           // the heap and mmap area share [HeapStart, HeapLimit)
+	brk         uint32           // current program break, grows up
+	mmapBottom  uint32           // lowest mmap'd address, grows down from HeapLimit
+	files       map[int32]*os.File
+	nextFileNum int32
+}
+
+// NewLinuxSyscalls creates a handler whose heap grows up from heapStart and
+// whose anonymous mappings grow down from heapLimit
+func NewLinuxSyscalls(stdin io.Reader, stdout, stderr io.Writer, heapStart, heapLimit uint32) *LinuxSyscalls {
+	return &LinuxSyscalls{
+		Stdin:       stdin,
+		Stdout:      stdout,
+		Stderr:      stderr,
+		Now:         time.Now,
+		HeapStart:   heapStart,
+		HeapLimit:   heapLimit,
+		brk:         heapStart,
+		mmapBottom:  heapLimit &^ (linuxPageSize - 1),
+		files:       make(map[int32]*os.File),
+		nextFileNum: 3,
+	}
+}
+
+// Close closes every file the guest left open
+func (s *LinuxSyscalls) Close() error {
+	var errs []error
+	for fd, f := range s.files {
+		errs = append(errs, f.Close())
+		delete(s.files, fd)
+	}
+	return errors.Join(errs...)
+}
+
+// Handle services one ecall
+func (s *LinuxSyscalls) Handle(cpu *CPU) error {
+	a0, a1, a2, a3, a4 := cpu.Regs[A0], cpu.Regs[A1], cpu.Regs[A2], cpu.Regs[A3], cpu.Regs[A4]
+
+	var ret int32
+	switch cpu.Regs[A7] {
+	case linuxSysExit, linuxSysExitGroup:
+		cpu.Exit(int(int32(a0)))
+		return nil
+
+	case linuxSysWrite:
+		ret = s.write(cpu, int32(a0), a1, a2)
+
+	case linuxSysRead:
+		ret = s.read(cpu, int32(a0), a1, a2)
+
+	case linuxSysWritev:
+		ret = s.vector(cpu, a0, a1, a2, s.write)
+
+	case linuxSysReadv:
+		ret = s.vector(cpu, a0, a1, a2, s.read)
+
+	case linuxSysOpenat:
+		ret = s.openat(cpu, int32(a0), a1, a2, a3)
+
+	case linuxSysClose:
+		ret = s.close(int32(a0))
+
+	case linuxSysLlseek:
+		ret = s.llseek(cpu, int32(a0), a1, a2, a3, a4)
+
+	case linuxSysBrk:
+		// the kernel's brk returns the new break on success and the old one on failure, never an errno
+		if a0 >= s.HeapStart && a0 <= s.mmapBottom {
+			if a0 > s.brk {
+				cpu.MemoryWritten(s.brk, a0-s.brk) // the kernel hands out zeroed memory
+			}
+			s.brk = a0
+		}
+		ret = int32(s.brk)
+
+	case linuxSysMmap2:
+		ret = s.mmap(cpu, a0, a1, cpu.Regs[A3])
+
+	case linuxSysMunmap:
+		// mapped memory is never reused, so unmapping only has to be accepted
+		ret = 0
+
+	case linuxSysClockGettime, linuxSysClockGettime64:
+		ret = s.clockGettime(cpu, a1, cpu.Regs[A7] == linuxSysClockGettime64)
+
+	case linuxSysSetTidAddress:
+		ret = 1 // the thread id of the only thread
+
+	case linuxSysIoctl:
+		ret = -errnoENOTTY // none of our files is a terminal
+
+	case linuxSysSetRobustList, linuxSysRtSigaction, linuxSysRtSigprocmask, linuxSysSigaltstack, linuxSysMadvise:
+		// there are no signals or other threads, so these can safely pretend to succeed
+		ret = 0
+
+	default:
+		if s.LogUnknown {
+			cpu.Logger.Warn("unimplemented linux syscall", "number", cpu.Regs[A7], "pc", fmt.Sprintf("0x%08X", cpu.PC-4))
+		}
+		ret = -errnoENOSYS
+	}
+
+	cpu.Regs[A0] = uint32(ret)
+	return nil
+}
+
+// write(fd, buf, count)
+func (s *LinuxSyscalls) write(cpu *CPU, fd int32, buf, count uint32) int32 {
+	var w io.Writer
+	switch fd {
+	case 1:
+		w = s.Stdout
+	case 2:
+		w = s.Stderr
+	default:
+		if f, ok := s.files[fd]; ok {
+			w = f
+		}
+	}
+	if w == nil {
+		return -errnoEBADF
+	}
+
+	data, err := cpu.ReadMemory(buf, count)
+	if err != nil {
+		return -errnoEFAULT
+	}
+	n, err := w.Write(data)
+	if err != nil && n == 0 {
+		return -errnoEIO
+	}
+	return int32(n)
+}
+
+// read(fd, buf, count)
+func (s *LinuxSyscalls) read(cpu *CPU, fd int32, buf, count uint32) int32 {
+	var r io.Reader
+	switch fd {
+	case 0:
+		r = s.Stdin
+	default:
+		if f, ok := s.files[fd]; ok {
+			r = f
+		}
+	}
+	if r == nil {
+		return -errnoEBADF
+	}
+	if err := cpu.checkRange(buf, count); err != nil {
+		return -errnoEFAULT
+	}
+
+	data := make([]byte, count)
+	n, err := r.Read(data)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return -errnoEIO
+	}
+	cpu.WriteMemory(buf, data[:n])
+	return int32(n)
+}
+
+// vector implements readv/writev(fd, iov, iovcnt) on top of read or write.
+// each struct iovec is {void *base; size_t len}, 8 bytes on rv32
+func (s *LinuxSyscalls) vector(cpu *CPU, fd, iov, iovcnt uint32, op func(*CPU, int32, uint32, uint32) int32) int32 {
+	if iovcnt > linuxMaxIOVecs {
+		return -errnoEINVAL
+	}
+	total := int32(0)
+	for i := uint32(0); i < iovcnt; i++ {
+		base, err1 := cpu.Load(iov+i*8, 4)
+		length, err2 := cpu.Load(iov+i*8+4, 4)
+		if err1 != nil || err2 != nil {
+			return -errnoEFAULT
+		}
+		n := op(cpu, int32(fd), base, length)
+		if n < 0 {
+			if total > 0 {
+				return total // report the partial transfer, like the kernel does
+			}
+			return n
+		}
+		total += n
+		if uint32(n) < length {
+			break
+		}
+	}
+	return total
+}
+
+// openat(dirfd, pathname, flags, mode) - only AT_FDCWD or absolute paths, both resolved inside Root
+func (s *LinuxSyscalls) openat(cpu *CPU, dirfd int32, pathAddr, flags, mode uint32) int32 {
+	path, err := cpu.ReadString(pathAddr, linuxMaxPathLen)
+	if err != nil {
+		if cpu.checkRange(pathAddr, linuxMaxPathLen) == nil {
+			return -errnoENAMETOOLONG // no NUL within the limit
+		}
+		return -errnoEFAULT
+	}
+	if dirfd != linuxAtFdcwd && (path == "" || path[0] != '/') {
+		return -errnoEBADF
+	}
+	if s.Root == nil {
+		return -errnoENOENT
+	}
+	if len(s.files) >= linuxMaxOpen {
+		return -errnoEMFILE
+	}
+
+	hostFlags := os.O_RDONLY
+	switch flags & 0x3 {
+	case linuxOWronly:
+		hostFlags = os.O_WRONLY
+	case linuxORdwr:
+		hostFlags = os.O_RDWR
+	}
+	for _, f := range []struct {
+		linux uint32
+		host  int
+	}{
+		{linuxOCreat, os.O_CREATE},
+		{linuxOExcl, os.O_EXCL},
+		{linuxOTrunc, os.O_TRUNC},
+		{linuxOAppend, os.O_APPEND},
+	} {
+		if flags&f.linux != 0 {
+			hostFlags |= f.host
+		}
+	}
+
+	// os.Root refuses paths (and symlinks) that would escape the directory
+	name := path
+	for len(name) > 0 && name[0] == '/' {
+		name = name[1:]
+	}
+	if name == "" {
+		name = "."
+	}
+	f, err := s.Root.OpenFile(name, hostFlags, os.FileMode(mode&0o777))
+	if err != nil {
+		return -errnoFromError(err)
+	}
+
+	fd := s.nextFileNum
+	for s.files[fd] != nil {
+		fd++
+	}
+	s.files[fd] = f
+	s.nextFileNum = fd + 1
+	return fd
+}
+
+// close(fd)
+func (s *LinuxSyscalls) close(fd int32) int32 {
+	if fd >= 0 && fd <= 2 {
+		return 0 // closing the standard streams is harmless
+	}
+	f, ok := s.files[fd]
+	if !ok {
+		return -errnoEBADF
+	}
+	delete(s.files, fd)
+	s.nextFileNum = min(s.nextFileNum, fd) // like the kernel, reuse the lowest free descriptor
+	if err := f.Close(); err != nil {
+		return -errnoEIO
+	}
+	return 0
+}
+
+// llseek(fd, offset_high, offset_low, result, whence) stores the new 64-bit offset at result
+func (s *LinuxSyscalls) llseek(cpu *CPU, fd int32, high, low, result, whence uint32) int32 {
+	f, ok := s.files[fd]
+	if !ok {
+		if fd >= 0 && fd <= 2 {
+			return -errnoESPIPE
+		}
+		return -errnoEBADF
+	}
+	if whence > 2 {
+		return -errnoEINVAL
+	}
+	pos, err := f.Seek(int64(uint64(high)<<32|uint64(low)), int(whence))
+	if err != nil {
+		return -errnoEINVAL
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(pos))
+	if err := cpu.WriteMemory(result, buf[:]); err != nil {
+		return -errnoEFAULT
+	}
+	return 0
+}
+
+// mmap2(addr, length, prot, flags, fd, pgoffset) - anonymous mappings only.
+// mappings are carved downwards from HeapLimit, page-aligned and zero-filled
+func (s *LinuxSyscalls) mmap(cpu *CPU, addr, length, flags uint32) int32 {
+	if flags&linuxMapAnon == 0 {
+		return -errnoENOSYS // file mappings are not supported
+	}
+	if flags&linuxMapFixed != 0 || length == 0 {
+		return -errnoEINVAL
+	}
+	size := (uint64(length) + linuxPageSize - 1) &^ (linuxPageSize - 1)
+	if size > uint64(s.mmapBottom) || uint32(uint64(s.mmapBottom)-size) < s.brk {
+		return -errnoENOMEM
+	}
+
+	s.mmapBottom -= uint32(size)
+	off, _ := cpu.ramOffset(s.mmapBottom, uint32(size)) // below the stack, so inside RAM
+	clear(cpu.Memory[off : uint64(off)+size])
+	cpu.MemoryWritten(s.mmapBottom, uint32(size)) // anonymous mappings are zero-filled
+	return int32(s.mmapBottom)
+}
+
+// clock_gettime(clockid, tp) / clock_gettime64(clockid, tp).
+// every clock reads the same source; the 64-bit variant writes a struct __kernel_timespec
+// ({s64 tv_sec; s64 tv_nsec}) and the old one a struct of two 32-bit fields
+func (s *LinuxSyscalls) clockGettime(cpu *CPU, tp uint32, time64 bool) int32 {
+	now := s.Now()
+	sec, nsec := now.Unix(), int64(now.Nanosecond())
+
+	var buf []byte
+	if time64 {
+		buf = make([]byte, 16)
+		binary.LittleEndian.PutUint64(buf[0:], uint64(sec))
+		binary.LittleEndian.PutUint64(buf[8:], uint64(nsec))
+	} else {
+		buf = make([]byte, 8)
+		binary.LittleEndian.PutUint32(buf[0:], uint32(sec))
+		binary.LittleEndian.PutUint32(buf[4:], uint32(nsec))
+	}
+	if err := cpu.WriteMemory(tp, buf); err != nil {
+		return -errnoEFAULT
+	}
+	return 0
+}
+
+// errnoFromError maps a host file error to the errno a guest would see
+func errnoFromError(err error) int32 {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return errnoENOENT
+	case errors.Is(err, os.ErrExist):
+		return errnoEEXIST
+	case errors.Is(err, os.ErrPermission):
+		return errnoEACCES
+	}
+	return errnoEIO
+}
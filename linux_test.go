@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	linuxTIOCGWINSZ = 0x5413
+	muslMessage     = "Hello from musl\n"
+)
+
+// muslStandIn is testdata/musl-standin.elf. like newlibStandIn it is a synthetic
+// stand-in, not a static musl binary: a few Builder instructions making the
+// system calls a musl hello world makes (set_tid_address at startup, the
+// TIOCGWINSZ ioctl stdout uses to decide on line buffering, a writev of the
+// buffered text and exit_group), for want of a toolchain to build the real one.
+// regenerate it with `go test -run TestLinuxStandIn -update`
+func muslStandIn(t testing.TB) []byte {
+	build := func(msg int32) func(b *Builder) {
+		return func(b *Builder) {
+			b.Label("_start")
+			b.Addi(SP, SP, -32)
+			b.Addi(A0, SP, 28)
+			b.Li(A7, linuxSysSetTidAddress)
+			b.Ecall()
+			b.Li(A0, 1)
+			b.Li(A1, linuxTIOCGWINSZ)
+			b.Addi(A2, SP, 16)
+			b.Li(A7, linuxSysIoctl)
+			b.Ecall()
+			// two iovecs, like musl's buffer and the text that didn't fit
+			half := int32(len(muslMessage) / 2)
+			b.Li(T0, msg)
+			b.Li(T1, half)
+			b.Sw(T0, SP, 0)
+			b.Sw(T1, SP, 4)
+			b.Addi(T0, T0, half)
+			b.Li(T1, int32(len(muslMessage))-half)
+			b.Sw(T0, SP, 8)
+			b.Sw(T1, SP, 12)
+			b.Li(A0, 1)
+			b.Mv(A1, SP)
+			b.Li(A2, 2)
+			b.Li(A7, linuxSysWritev)
+			b.Ecall()
+			b.Li(A0, 0)
+			b.Li(A7, linuxSysExitGroup)
+			b.Ecall()
+		}
+	}
+	code := assemble(t, build(0))
+	code = assemble(t, build(int32(len(code))))
+	image := append(code, muslMessage...)
+	return buildELF(image, 0, map[string]uint32{"_start": 0, "message": uint32(len(code))}, "_start")
+}
+
+func TestLinuxStandIn(t *testing.T) {
+	path := filepath.Join("testdata", "musl-standin.elf")
+	if *update {
+		if err := os.WriteFile(path, muslStandIn(t), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, err := os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, muslStandIn(t)) {
+		t.Errorf("%s is out of date, regenerate it with -update", path)
+	}
+
+	code, stdout, stderr := runCommand("run", "--syscalls=linux", path)
+	if code != 0 {
+		t.Fatalf("exit %d, stderr:\n%s", code, stderr)
+	}
+	if want := muslMessage + "exited with code 0 after 26 instructions\n"; stdout != want {
+		t.Errorf("stdout = %q, want %q", stdout, want)
+	}
+	if stderr != "" {
+		t.Errorf("stderr = %q, want nothing (no unknown syscalls)", stderr)
+	}
+}
+
+func TestLinuxSyscalls(t *testing.T) {
+	const (
+		bad   = 0xFFFF0000 // a pointer outside guest memory
+		fdcwd = linuxAtFdcwd & 0xFFFFFFFF
+	)
+
+	cpu := NewCPUWithMemory(0x8000)
+	cpu.Regs[SP] = 0x8000
+	var out, errOut bytes.Buffer
+	s := NewLinuxSyscalls(bytes.NewReader([]byte("input")), &out, &errOut, 0x2000, 0x4000)
+	root, err := os.OpenRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	s.Root = root
+	defer s.Close()
+	s.Now = func() time.Time { return time.Unix(1700000000, 123456789) }
+
+	copy(cpu.Memory[0x100:], "text")
+	copy(cpu.Memory[0x180:], "/file.txt\x00")
+	copy(cpu.Memory[0x1A0:], "/missing\x00")
+	binary.LittleEndian.PutUint32(cpu.Memory[0x1C0:], 0x100) // iovecs: "te", "xt"
+	binary.LittleEndian.PutUint32(cpu.Memory[0x1C4:], 2)
+	binary.LittleEndian.PutUint32(cpu.Memory[0x1C8:], 0x102)
+	binary.LittleEndian.PutUint32(cpu.Memory[0x1CC:], 2)
+	binary.LittleEndian.PutUint32(cpu.Memory[0x1D0:], bad) // an iovec pointing outside memory
+	binary.LittleEndian.PutUint32(cpu.Memory[0x1D4:], 4)
+	binary.LittleEndian.PutUint32(cpu.Memory[0x1D8:], 0x208) // where readv reads to
+	binary.LittleEndian.PutUint32(cpu.Memory[0x1DC:], 2)
+
+	call := func(number uint32, args ...uint32) int32 {
+		t.Helper()
+		cpu.Regs[A7] = number
+		copy(cpu.Regs[A0:A6], append(args, 0, 0, 0, 0, 0, 0))
+		if err := s.Handle(&cpu); err != nil {
+			t.Fatal(err)
+		}
+		return int32(cpu.Regs[A0])
+	}
+
+	for _, tt := range []struct {
+		name   string
+		number uint32
+		args   []uint32
+		want   int32
+	}{
+		{"write stdout", linuxSysWrite, []uint32{1, 0x100, 4}, 4},
+		{"write bad fd", linuxSysWrite, []uint32{9, 0x100, 4}, -errnoEBADF},
+		{"write bad buffer", linuxSysWrite, []uint32{1, bad, 4}, -errnoEFAULT},
+		{"read stdin", linuxSysRead, []uint32{0, 0x200, 3}, 3},
+		{"read bad buffer", linuxSysRead, []uint32{0, bad, 3}, -errnoEFAULT},
+		{"writev stderr", linuxSysWritev, []uint32{2, 0x1C0, 2}, 4},
+		{"writev bad iovec array", linuxSysWritev, []uint32{2, bad, 1}, -errnoEFAULT},
+		{"writev bad buffer", linuxSysWritev, []uint32{2, 0x1D0, 1}, -errnoEFAULT},
+		{"writev partial", linuxSysWritev, []uint32{2, 0x1C8, 2}, 2},
+		{"writev too many", linuxSysWritev, []uint32{2, 0x1C0, linuxMaxIOVecs + 1}, -errnoEINVAL},
+		{"readv stdin", linuxSysReadv, []uint32{0, 0x1D8, 1}, 2},
+		{"openat missing", linuxSysOpenat, []uint32{fdcwd, 0x1A0, 0, 0}, -errnoENOENT},
+		{"openat bad path", linuxSysOpenat, []uint32{fdcwd, bad, 0, 0}, -errnoEFAULT},
+		{"openat create", linuxSysOpenat, []uint32{fdcwd, 0x180, linuxOCreat | linuxORdwr, 0o644}, 3},
+		{"write file", linuxSysWrite, []uint32{3, 0x100, 4}, 4},
+		{"llseek", linuxSysLlseek, []uint32{3, 0, 1, 0x300, 0}, 0},
+		{"llseek bad result", linuxSysLlseek, []uint32{3, 0, 0, bad, 0}, -errnoEFAULT},
+		{"llseek bad whence", linuxSysLlseek, []uint32{3, 0, 0, 0x300, 3}, -errnoEINVAL},
+		{"llseek stdout", linuxSysLlseek, []uint32{1, 0, 0, 0x300, 0}, -errnoESPIPE},
+		{"close file", linuxSysClose, []uint32{3}, 0},
+		{"close again", linuxSysClose, []uint32{3}, -errnoEBADF},
+		{"brk query", linuxSysBrk, []uint32{0}, 0x2000},
+		{"brk grow", linuxSysBrk, []uint32{0x2100}, 0x2100},
+		{"brk past the limit", linuxSysBrk, []uint32{0x4100}, 0x2100},
+		{"mmap2 anonymous", linuxSysMmap2, []uint32{0, 100, 3, linuxMapAnon}, 0x3000},
+		{"mmap2 file", linuxSysMmap2, []uint32{0, 100, 3, 0}, -errnoENOSYS},
+		{"mmap2 fixed", linuxSysMmap2, []uint32{0x400, 100, 3, linuxMapAnon | linuxMapFixed}, -errnoEINVAL},
+		{"clock_gettime", linuxSysClockGettime, []uint32{0, 0x400}, 0},
+		{"clock_gettime64", linuxSysClockGettime64, []uint32{0, 0x410}, 0},
+		{"clock_gettime bad pointer", linuxSysClockGettime, []uint32{0, bad}, -errnoEFAULT},
+		{"clock_gettime64 bad pointer", linuxSysClockGettime64, []uint32{0, bad}, -errnoEFAULT},
+		{"ioctl", linuxSysIoctl, []uint32{1, linuxTIOCGWINSZ, 0x500}, -errnoENOTTY},
+		{"set_tid_address", linuxSysSetTidAddress, []uint32{0x500}, 1},
+		{"rt_sigprocmask", linuxSysRtSigprocmask, []uint32{0, 0, 0}, 0},
+		{"unknown", 1234, nil, -errnoENOSYS},
+	} {
+		if got := call(tt.number, tt.args...); got != tt.want {
+			t.Errorf("%s: a0 = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	if out.String() != "text" || errOut.String() != "textxt" {
+		t.Errorf("stdout %q, stderr %q; want \"text\" and \"textxt\"", out.String(), errOut.String())
+	}
+	if read, readv := string(cpu.Memory[0x200:0x203]), string(cpu.Memory[0x208:0x20A]); read != "inp" || readv != "ut" {
+		t.Errorf("read stored %q and readv %q, want \"inp\" and \"ut\"", read, readv)
+	}
+	if pos := binary.LittleEndian.Uint64(cpu.Memory[0x300:]); pos != 1 {
+		t.Errorf("llseek stored offset %d, want 1", pos)
+	}
+	if data, err := os.ReadFile(filepath.Join(root.Name(), "file.txt")); err != nil || string(data) != "text" {
+		t.Errorf("file.txt = %q (%v), want \"text\"", data, err)
+	}
+	if sec, nsec := binary.LittleEndian.Uint32(cpu.Memory[0x400:]), binary.LittleEndian.Uint32(cpu.Memory[0x404:]); sec != 1700000000 || nsec != 123456789 {
+		t.Errorf("clock_gettime stored %d.%09d", sec, nsec)
+	}
+	if sec, nsec := binary.LittleEndian.Uint64(cpu.Memory[0x410:]), binary.LittleEndian.Uint64(cpu.Memory[0x418:]); sec != 1700000000 || nsec != 123456789 {
+		t.Errorf("clock_gettime64 stored %d.%09d", sec, nsec)
+	}
+
+	call(linuxSysExitGroup, 5)
+	if !cpu.halted || cpu.haltReason != StopExit || cpu.ExitCode != 5 {
+		t.Errorf("exit_group(5): halted %v, reason %v, exit code %d", cpu.halted, cpu.haltReason, cpu.ExitCode)
+	}
+}
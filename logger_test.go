@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+// loggedProgram adds two numbers and stops at an ebreak
+func loggedProgram(b *Builder) {
+	b.Li(A0, 2)
+	b.Addi(A0, A0, 3)
+	b.Ebreak()
+}
+
+// captureOutput runs fn with os.Stdout and os.Stderr redirected, and returns what it wrote to them
+func captureOutput(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+	done := make(chan []byte)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- out
+	}()
+	fn()
+	w.Close()
+	return string(<-done)
+}
+
+// the library's default logger discards everything, even a failing run's error
+func TestSilentLogger(t *testing.T) {
+	out := captureOutput(t, func() {
+		cpu := NewCPUWithMemory(0x1000)
+		cpu.LoadProgram(assemble(t, func(b *Builder) {
+			b.Li(A0, 1)
+			b.Word(0xFFFFFFFF) // illegal, and with mtvec 0 it stops Run
+		}))
+		if reason, err := cpu.Run(100); reason != StopError || err == nil {
+			t.Errorf("Run() = %v, %v; want the illegal instruction", reason, err)
+		}
+
+		cpu = NewCPUWithMemory(0x1000)
+		cpu.LoadProgram(assemble(t, loggedProgram))
+		runToEbreak(t, &cpu)
+	})
+	if out != "" {
+		t.Fatalf("the default logger wrote %q", out)
+	}
+}
+
+func TestDebugLogger(t *testing.T) {
+	program := assemble(t, loggedProgram)
+	for _, tt := range []struct {
+		level slog.Level
+		want  string
+	}{
+		{slog.LevelDebug, `level=DEBUG msg=step n=1 pc=0x00000000 instr=0x00200513
+level=DEBUG msg=step n=2 pc=0x00000004 instr=0x00350513
+level=DEBUG msg=step n=3 pc=0x00000008 instr=0x00100073
+level=DEBUG msg=halted reason=breakpoint retired=3
+`},
+		{slog.LevelInfo, ""},
+	} {
+		var buf bytes.Buffer
+		cpu := NewCPUWithMemory(0x1000)
+		cpu.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+			Level: tt.level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}))
+		cpu.LoadProgram(program)
+		runToEbreak(t, &cpu)
+		if buf.String() != tt.want {
+			t.Errorf("at level %v the log is\n%s\nwant\n%s", tt.level, buf.String(), tt.want)
+		}
+	}
+}
+
+// run logs errors always and every step with --verbose, to stderr
+func TestRunVerbose(t *testing.T) {
+	path := writeTemp(t, "prog.bin", assemble(t, func(b *Builder) {
+		b.Li(A0, 1)
+		b.Word(0xFFFFFFFF)
+	}))
+	for _, verbose := range []bool{false, true} {
+		args := []string{"run", path}
+		if verbose {
+			args = []string{"run", "--verbose", path}
+		}
+		_, stdout, stderr := runCommand(args...)
+		if strings.Contains(stdout, "msg=") {
+			t.Errorf("verbose %v: the log went to stdout: %q", verbose, stdout)
+		}
+		if !strings.Contains(stderr, `level=ERROR msg="execution failed" pc=0x00000008`) {
+			t.Errorf("verbose %v: stderr doesn't log the failure:\n%s", verbose, stderr)
+		}
+		if steps := strings.Contains(stderr, "msg=step n=1 pc=0x00000000"); steps != verbose {
+			t.Errorf("verbose %v: stderr logs the steps %v:\n%s", verbose, steps, stderr)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ============================================================================
+// Infinite loop detection
+// ============================================================================
+// a program that is done, or lost, often ends up on an instruction jumping to
+// itself (`j .`, `beq a0, a0, .`, many a crt0's exit path) and Run would spin
+// there forever. with detection on, Run stops with an InfiniteLoopError once an
+// instruction has jumped to itself the threshold number of times in a row
+// without the registers changing, which for an instruction that does nothing
+// but jump means nothing ever will.
+//
+// nothing but an interrupt can get such a loop going again, so while one can
+// be taken (mstatus.MIE, an enabled source in mie and a trap handler) the loop
+// is left alone: that's an idle loop waiting for it. (wfi is the better way to
+// wait, and it's a loop of its own that's never flagged)
+
+// DefaultLoopThreshold is how many times in a row a loop must change nothing before it's reported
+const DefaultLoopThreshold = 1000
+
+// InfiniteLoopError reports an instruction that keeps jumping to itself with nothing changing
+type InfiniteLoopError struct {
+	PC    uint32
+	Instr uint32
+	Count uint64 // how many times in a row it ran without changing anything
+}
+
+func (e *InfiniteLoopError) Error() string {
+	text, _ := Disassemble(e.Instr, e.PC)
+	return fmt.Sprintf("infinite loop: %s at pc=0x%08X jumped to itself %d times without changing anything", text, e.PC, e.Count)
+}
+
+// WithLoopDetection stops Run with an InfiniteLoopError once an instruction has jumped to
+// itself threshold times in a row without changing the registers (0 turns detection off)
+func WithLoopDetection(threshold uint64) Option {
+	return func(cpu *CPU) {
+		if threshold == 0 {
+			cpu.loops = nil
+			return
+		}
+		cpu.loops = &loopDetector{threshold: threshold}
+	}
+}
+
+// loopDetector watches for the same instruction running over and over
+type loopDetector struct {
+	threshold uint64
+	pc        int        // the instruction that last jumped to itself
+	count     uint64     // how many times in a row it did with regs unchanged
+	regs      [32]uint32 // the registers after the first of them
+}
+
+// check runs after Run executed n instructions, the first at pc
+func (l *loopDetector) check(cpu *CPU, pc int, n uint64) error {
+	if n != 1 || cpu.PC != pc || cpu.interruptible() {
+		l.count = 0
+		return nil
+	}
+	if l.count == 0 || l.pc != pc || l.regs != cpu.Regs {
+		l.pc, l.regs, l.count = pc, cpu.Regs, 1
+		return nil
+	}
+	l.count++
+	if l.count < l.threshold {
+		return nil
+	}
+	var instr uint32
+	if off, ok := cpu.ramOffset(uint32(pc), 4); ok {
+		instr = binary.LittleEndian.Uint32(cpu.Memory[off:])
+	}
+	l.count = 0
+	return &InfiniteLoopError{PC: uint32(pc), Instr: instr, Count: l.threshold}
+}
+
+// interruptible reports whether an interrupt could be taken, were its source to raise it
+func (cpu *CPU) interruptible() bool {
+	return cpu.trapsEnabled() && cpu.MStatusMIE() && cpu.csrs[CSR_MIE] != 0
+}
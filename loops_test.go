@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// runLoop runs program with loop detection at a threshold of 100 and returns why
+// it stopped
+func runLoop(t *testing.T, build func(b *Builder), opts ...Option) (*CPU, StopReason, error) {
+	t.Helper()
+	machine := DefaultMachine()
+	machine.MemSize = 0x1000
+	cpu, err := machine.NewCPU(append([]Option{WithLoopDetection(100), instructionTime}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.LoadProgram(assemble(t, build))
+	reason, err := cpu.Run(100_000)
+	return cpu, reason, err
+}
+
+// an instruction jumping to itself is reported once it has done so the threshold
+// number of times with nothing changing, however it jumps
+func TestLoopDetectionSelfJump(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		build func(b *Builder)
+		want  string
+	}{
+		{"j .", func(b *Builder) {
+			b.Li(A0, 1)
+			b.Label("self") // 0x4
+			b.J("self")
+		}, "infinite loop: jal zero, 0x00000004 at pc=0x00000004 jumped to itself 100 times without changing anything"},
+		{"beq a0, a0, .", func(b *Builder) {
+			b.Li(A0, 1)
+			b.Label("self")
+			b.Beq(A0, A0, "self")
+		}, "infinite loop: beq a0, a0, 0x00000004 at pc=0x00000004 jumped to itself 100 times without changing anything"},
+		// the first jump changes ra, the rest don't
+		{"jal ra, .", func(b *Builder) {
+			b.Li(A0, 1)
+			b.Label("self")
+			b.Jal(RA, "self")
+		}, "infinite loop: jal ra, 0x00000004 at pc=0x00000004 jumped to itself 100 times without changing anything"},
+	} {
+		for _, mode := range tortureModes {
+			cpu, _, err := runLoop(t, tt.build, mode.opts...)
+			var loop *InfiniteLoopError
+			if !errors.As(err, &loop) || loop.PC != 0x4 || loop.Count != 100 {
+				t.Fatalf("%s, %s: stopped with %v, want an InfiniteLoopError at 0x4", tt.name, mode.name, err)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("%s, %s: Error() = %q, want %q", tt.name, mode.name, err, tt.want)
+			}
+			// the li and 100 jumps, one more when the first jump ran in a block with the li
+			if cpu.Retired != 101 && cpu.Retired != 102 {
+				t.Errorf("%s, %s: reported after %d instructions, want 101 or 102", tt.name, mode.name, cpu.Retired)
+			}
+		}
+	}
+}
+
+// a loop that keeps going for many times the threshold isn't reported as long as
+// it changes something, and neither is an idle loop an interrupt can end
+func TestLoopDetectionProgress(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		build func(b *Builder)
+	}{
+		{"a countdown", func(b *Builder) {
+			b.Li(A0, 5000)
+			b.Label("loop")
+			b.Addi(A0, A0, -1)
+			b.Bnez(A0, "loop")
+			b.Ebreak()
+		}},
+		{"an idle loop waiting for the timer", func(b *Builder) {
+			b.J("start")
+			b.Label("handler") // at 4
+			b.Ebreak()
+			b.Label("start")
+			b.Li(T0, 4)
+			b.Csrrw(ZERO, CSR_MTVEC, T0)
+			b.Li(S2, 0x02000000+clintMtimecmp)
+			b.Li(T0, 1000)
+			b.Sw(T0, S2, 0)
+			b.Sw(ZERO, S2, 4)
+			b.Li(T0, 0x80) // MTIE
+			b.Csrrs(ZERO, CSR_MIE, T0)
+			b.Li(T0, 0x8) // MIE
+			b.Csrrs(ZERO, CSR_MSTATUS, T0)
+			b.Label("idle")
+			b.J("idle")
+		}},
+	} {
+		for _, mode := range tortureModes {
+			cpu, reason, err := runLoop(t, tt.build, mode.opts...)
+			if err != nil || reason != StopBreakpoint {
+				t.Errorf("%s, %s: stopped with %v, %v after %d instructions, want the ebreak", tt.name, mode.name, reason, err, cpu.Retired)
+			}
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// MachineConfig describes the machine a program runs on.
+// it can be loaded from a JSON file with --machine, e.g.
+//
+//	{"mem_size": 131072, "load_addr": 0, "entry": 0, "stack_top": 0,
+//	 "clint_base": 33554432, "uart_base": 268435456, "rtc_base": 268439552, "rng_base": 268443648}
+//
+// and any flag given on the command line overrides the matching field.
+// devices must sit outside RAM; a device base of 0 leaves that device out
+type MachineConfig struct {
+	RAMBase  uint32 `json:"ram_base"`  // address of the first byte of memory, a multiple of 4096
+	MemSize  uint32 `json:"mem_size"`  // bytes of memory
+	LoadAddr uint32 `json:"load_addr"` // where the image is copied to (ignored for ELF files), 0 means the start of memory
+	Entry    uint32 `json:"entry"`     // initial program counter (ignored for ELF files), 0 means the start of memory
+	StackTop uint32 `json:"stack_top"` // the stack grows down from here, 0 means the top of memory
+	// StackLimit is the lowest address the stack may reach; setting it turns on the
+	// stack guard (see StackGuard), which also rejects any store into the
+	// StackGuard bytes just below it
+	StackLimit uint32 `json:"stack_limit"`
+	StackGuard uint32 `json:"stack_guard"`
+
+	CLINTBase uint32 `json:"clint_base"` // mtime, mtimecmp and msip
+	UARTBase  uint32 `json:"uart_base"`  // 16550 serial console
+	RTCBase   uint32 `json:"rtc_base"`   // real-time clock
+	RNGBase   uint32 `json:"rng_base"`   // entropy source
+
+	// Cycles turns the cycle timing model on with these latencies (see CycleTable);
+	// fields the file leaves out keep their DefaultCycleTable value
+	Cycles *CycleTable `json:"cycles,omitempty"`
+
+	// Time is how mtime advances (see TimeBase), one tick per 100ns of host time if left out
+	Time *TimeBase `json:"time,omitempty"`
+
+	// ICache and DCache turn on the cache model with these caches (see CacheModel)
+	ICache *CacheConfig `json:"icache,omitempty"`
+	DCache *CacheConfig `json:"dcache,omitempty"`
+
+	// DeviceTree places a device tree describing the machine at the top of memory (see dtb.go)
+	DeviceTree bool `json:"device_tree"`
+
+	// BootROM starts the machine in a boot ROM at ROMBase (0 means DefaultROMBase)
+	// that sets up the registers and jumps to the program (see bootrom.go)
+	BootROM bool   `json:"boot_rom"`
+	ROMBase uint32 `json:"rom_base"`
+}
+
+// DefaultMachine is the machine used when no --machine file is given
+func DefaultMachine() MachineConfig {
+	return MachineConfig{
+		MemSize:  DefaultMemorySize,
+		LoadAddr: 0,
+		Entry:    0,
+
+		// the same addresses as qemu's virt machine where it has the device
+		CLINTBase: 0x02000000,
+		UARTBase:  0x10000000,
+		RTCBase:   0x10001000,
+		RNGBase:   0x10002000,
+	}
+}
+
+// LoadMachineConfig reads a machine description from a JSON file.
+// fields missing from the file keep their default values
+func LoadMachineConfig(path string) (MachineConfig, error) {
+	cfg := DefaultMachine()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing machine config %s: %w", path, err)
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate checks that the configuration describes a machine we can build
+func (m MachineConfig) Validate() error {
+	if m.MemSize < 32 {
+		return fmt.Errorf("memory size %d is too small to hold an instruction", m.MemSize)
+	}
+	if m.RAMBase%4096 != 0 {
+		return fmt.Errorf("ram base 0x%08X is not a multiple of 4096", m.RAMBase)
+	}
+	if uint64(m.RAMBase)+uint64(m.MemSize) > 1<<32 {
+		return fmt.Errorf("%d bytes of memory at 0x%08X go past the end of the address space", m.MemSize, m.RAMBase)
+	}
+	if m.DeviceTree && uint64(len(m.DeviceTreeBlob())) > uint64(m.MemSize)/2 {
+		return fmt.Errorf("the device tree doesn't fit in %d bytes of memory", m.MemSize)
+	}
+	if !m.inRAM(m.loadAddress()) {
+		return fmt.Errorf("load address 0x%08X is outside %d bytes of memory", m.loadAddress(), m.MemSize)
+	}
+	if !m.inRAM(m.entry()) {
+		return fmt.Errorf("entry point 0x%08X is outside %d bytes of memory", m.entry(), m.MemSize)
+	}
+	if !m.inRAM(m.stackTop() - 1) {
+		return fmt.Errorf("stack top 0x%08X is outside %d bytes of memory", m.StackTop, m.MemSize)
+	}
+	if m.StackLimit != 0 && m.StackLimit >= m.stackTop() {
+		return fmt.Errorf("stack limit 0x%08X is not below the stack top 0x%08X", m.StackLimit, m.stackTop())
+	}
+	if m.StackGuard > m.StackLimit {
+		return fmt.Errorf("stack guard of %d bytes doesn't fit below the stack limit 0x%08X", m.StackGuard, m.StackLimit)
+	}
+	if m.romBase()%4 != 0 {
+		return fmt.Errorf("rom base 0x%08X is not word aligned", m.ROMBase)
+	}
+	if m.Time != nil {
+		if err := m.Time.Validate(); err != nil {
+			return err
+		}
+	}
+	if _, err := NewCacheModel(m.ICache, m.DCache); err != nil {
+		return err
+	}
+	// attaching the devices to a throwaway CPU without memory checks they don't overlap each other
+	probe := CPU{}
+	for _, d := range m.devices(&probe) {
+		if d.base != 0 && uint64(d.base) < uint64(m.RAMBase)+uint64(m.MemSize) && m.RAMBase < d.base+d.size {
+			return fmt.Errorf("%s at 0x%08X overlaps %d bytes of memory", d.name, d.base, m.MemSize)
+		}
+		if d.base != 0 {
+			if err := probe.AttachDevice(d.name, d.base, d.size, d.dev); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// devices lists the machine's devices for cpu (a base of 0 means the device is left out)
+func (m MachineConfig) devices(cpu *CPU) []deviceMapping {
+	uart := NewUART(cpu.console.out)
+	uart.Schedule(cpu.console.schedule...)
+	if cpu.console.in != nil && !cpu.deterministic {
+		uart.SetLiveInput(cpu.console.in)
+	}
+	return []deviceMapping{
+		{name: "clint", base: m.CLINTBase, size: ClintSize, dev: NewCLINT(cpu)},
+		{name: "uart", base: m.UARTBase, size: UARTSize, dev: uart},
+		{name: "rtc", base: m.RTCBase, size: RTCSize, dev: NewRTC(cpu)},
+		{name: "rng", base: m.RNGBase, size: RNGSize, dev: NewRNG(cpu)},
+		{name: "bootrom", base: m.romBase(), size: BootROMSize, dev: NewBootROM(m.romBase())},
+	}
+}
+
+// romBase is where the boot ROM is, 0 if the machine has none
+func (m MachineConfig) romBase() uint32 {
+	switch {
+	case !m.BootROM:
+		return 0
+	case m.ROMBase == 0:
+		return DefaultROMBase
+	}
+	return m.ROMBase
+}
+
+// InitialSP is the stack pointer a program starts with: 16 bytes below the
+// 16-byte aligned stack top, so 0(sp) holds argc = 0 and 4(sp) an empty argv
+// the way a crt0 expects to find them
+func (m MachineConfig) InitialSP() uint32 {
+	return m.stackTop()&^0xF - 16
+}
+
+// stackTop is where the stack starts
+func (m MachineConfig) stackTop() uint32 {
+	if m.StackTop == 0 && m.DeviceTree {
+		return m.deviceTreeAddr(len(m.DeviceTreeBlob()))
+	}
+	if m.StackTop == 0 {
+		return m.RAMBase + m.MemSize
+	}
+	return m.StackTop
+}
+
+// loadAddress is where a raw image is loaded
+func (m MachineConfig) loadAddress() uint32 {
+	if m.LoadAddr == 0 {
+		return m.RAMBase
+	}
+	return m.LoadAddr
+}
+
+// entry is the initial program counter for a raw image
+func (m MachineConfig) entry() uint32 {
+	if m.Entry == 0 {
+		return m.RAMBase
+	}
+	return m.Entry
+}
+
+// inRAM reports whether addr is in the machine's memory
+func (m MachineConfig) inRAM(addr uint32) bool {
+	return addr >= m.RAMBase && addr-m.RAMBase < m.MemSize
+}
+
+// NewCPU builds a CPU for this machine with its devices attached, the program
+// counter at the entry point and the stack pointer at InitialSP (and the device
+// tree in memory, a0 = 0 and a1 = its address, if the machine has one).
+// (it returns a pointer because the devices keep one to the CPU they belong to)
+func (m MachineConfig) NewCPU(opts ...Option) (*CPU, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	if m.Cycles != nil {
+		opts = append([]Option{WithCycleModel(*m.Cycles)}, opts...)
+	}
+	if m.Time != nil {
+		opts = append([]Option{WithTimeBase(*m.Time)}, opts...)
+	}
+	if m.RAMBase != 0 {
+		opts = append([]Option{WithRAMBase(m.RAMBase)}, opts...)
+	}
+	cpu := NewCPUWithMemory(int(m.MemSize), opts...)
+	cpu.PC = int(m.entry())
+	cpu.Regs[SP] = m.InitialSP()
+	cpu.MemoryWritten(cpu.Regs[SP], 16) // argc and argv
+	if m.DeviceTree {
+		blob := m.DeviceTreeBlob()
+		addr := m.deviceTreeAddr(len(blob))
+		if err := cpu.WriteMemory(addr, blob); err != nil {
+			return nil, err
+		}
+		cpu.Regs[A0] = 0 // the hart id
+		cpu.Regs[A1] = addr
+	}
+	if m.ICache != nil || m.DCache != nil {
+		caches, err := NewCacheModel(m.ICache, m.DCache)
+		if err != nil {
+			return nil, err
+		}
+		cpu.Observer = caches
+	}
+	if m.StackLimit != 0 {
+		WithStackGuard(StackGuard{Top: m.stackTop(), Limit: m.StackLimit, Band: m.StackGuard})(&cpu)
+	}
+
+	for _, d := range m.devices(&cpu) {
+		if d.base == 0 {
+			continue
+		}
+		if err := cpu.AttachDevice(d.name, d.base, d.size, d.dev); err != nil {
+			return nil, err
+		}
+	}
+	return &cpu, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// update makes the tests that compare with a file in testdata rewrite it instead
+var update = flag.Bool("update", false, "rewrite the expected output files in testdata")
+
+// assemble builds a program with the Builder, failing the test if it doesn't assemble
+func assemble(t testing.TB, build func(b *Builder)) []byte {
+	t.Helper()
+	var b Builder
+	build(&b)
+	program, err := b.Assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return program
+}
+
+// runAsmBudget is how many instructions RunAsm runs before giving up
+const runAsmBudget = 1_000_000
+
+// RunAsm assembles the program build writes, loads it at address 0 of a CPU made
+// with opts and runs it until it halts or has run runAsmBudget instructions,
+// returning the CPU and why it stopped. if it fails, so does the test, with the
+// diagnostic report and the last DefaultHistorySize instructions executed.
+// (keeping that history means the program runs an instruction at a time)
+func RunAsm(t testing.TB, build func(b *Builder), opts ...Option) (*CPU, StopReason) {
+	t.Helper()
+	cpu := NewCPU(opts...)
+	cpu.LoadProgram(assemble(t, build))
+	history := NewHistory(DefaultHistorySize)
+	cpu.Tracer = history
+	reason, err := cpu.Run(runAsmBudget)
+	if err != nil {
+		var report strings.Builder
+		NewDiagnosticReport(&cpu, err, history).Write(&report)
+		t.Fatalf("the program failed:\n%s", report.String())
+	}
+	return &cpu, reason
+}
+
+// RequireReg fails the test unless the register called name (a0, x10) holds want
+func RequireReg(t testing.TB, cpu *CPU, name string, want uint32) {
+	t.Helper()
+	got, err := cpu.GetRegisterValue(name)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if got != want {
+		t.Fatalf("%s = 0x%08X (%d), want 0x%08X (%d)", name, got, int32(got), want, int32(want))
+	}
+}
+
+// RequireWord fails the test unless the word at addr is want
+func RequireWord(t testing.TB, cpu *CPU, addr, want uint32) {
+	t.Helper()
+	data, err := cpu.ReadMemory(addr, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.LittleEndian.Uint32(data); got != want {
+		t.Fatalf("the word at 0x%08X = 0x%08X, want 0x%08X", addr, got, want)
+	}
+}
+
+// writeTemp writes data to a file called name in a fresh temporary directory
+func writeTemp(t testing.TB, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// runCommand runs the emulator with args, as if from the command line
+func runCommand(args ...string) (code int, stdout, stderr string) {
+	var out, errOut bytes.Buffer
+	code = runMain(args, &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+// exitProgram exits with code through the newlib exit call
+func exitProgram(code int32) func(b *Builder) {
+	return func(b *Builder) {
+		b.Li(A0, code)
+		b.Li(A7, newlibSysExit)
+		b.Ecall()
+	}
+}
+
+func TestRunMainDispatch(t *testing.T) {
+	if code, _, stderr := runCommand(); code != 2 || !strings.Contains(stderr, "usage:") {
+		t.Errorf("no arguments: exit %d, stderr %q; want 2 and the usage", code, stderr)
+	}
+	code, stdout, _ := runCommand("help")
+	if code != 0 {
+		t.Errorf("help: exit %d, want 0", code)
+	}
+	for _, c := range commands {
+		if !strings.Contains(stdout, "  "+c.name+" ") {
+			t.Errorf("usage doesn't list %q:\n%s", c.name, stdout)
+		}
+	}
+	if code, _, stderr := runCommand("frobnicate"); code != 2 || !strings.Contains(stderr, `unknown command "frobnicate"`) {
+		t.Errorf("unknown command: exit %d, stderr %q", code, stderr)
+	}
+	if code, _, _ := runCommand("run", "-h"); code != 0 {
+		t.Errorf("run -h: exit %d, want 0", code)
+	}
+}
+
+func TestParseRunFlags(t *testing.T) {
+	opts, err := parseRunFlags([]string{"--trace=spike", "prog.bin", "--max-instructions", "100", "--mem-size", "0x2000", "--entry=0x100", "--syscalls", "newlib", "--gp", "none"}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.image != "prog.bin" || opts.traceFormat != "spike" || opts.maxInstructions != 100 || opts.syscalls != "newlib" || opts.gp != "none" {
+		t.Errorf("options = %+v", opts)
+	}
+	if opts.machine.MemSize != 0x2000 || opts.machine.Entry != 0x100 {
+		t.Errorf("machine: mem-size 0x%X, entry 0x%X; want 0x2000 and 0x100", opts.machine.MemSize, opts.machine.Entry)
+	}
+
+	if opts, err := parseRunFlags([]string{"--trace", "prog.bin"}, &bytes.Buffer{}); err != nil || opts.traceFormat == "" {
+		t.Errorf("--trace without a format: format %q, error %v", opts.traceFormat, err)
+	}
+
+	// a flag given explicitly beats the machine file
+	machine := writeTemp(t, "machine.json", []byte(`{"mem_size": 16384, "entry": 64}`))
+	opts, err = parseRunFlags([]string{"--machine", machine, "--entry", "0x80", "prog.bin"}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.machine.MemSize != 16384 || opts.machine.Entry != 0x80 {
+		t.Errorf("machine file and flags: mem-size %d, entry 0x%X; want 16384 and 0x80", opts.machine.MemSize, opts.machine.Entry)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want string // part of the error
+	}{
+		{[]string{}, "usage shown"},
+		{[]string{"a.bin", "b.bin"}, "usage shown"},
+		{[]string{"--no-such-flag", "a.bin"}, "usage shown"},
+		{[]string{"--dump-mem", "0:4", "a.bin"}, "--dump-mem needs --json"},
+		{[]string{"--json", "--debug", "a.bin"}, "cannot be combined"},
+		{[]string{"--timeout", "1s", "--debug", "a.bin"}, "cannot be combined"},
+		{[]string{"--selfcheck", "--timeout", "1s", "a.bin"}, "--selfcheck cannot be combined"},
+		{[]string{"--syscalls", "windows", "a.bin"}, `unknown --syscalls "windows"`},
+		{[]string{"--uninit", "maybe", "a.bin"}, `unknown --uninit "maybe"`},
+		{[]string{"--pipeline", "deep", "a.bin"}, `unknown --pipeline "deep"`},
+		{[]string{"--pipeline-diagram", "a.bin"}, "--pipeline-diagram needs --pipeline"},
+		{[]string{"--gp", "high", "a.bin"}, `bad --gp "high"`},
+		{[]string{"--sandbox", ".", "a.bin"}, "--sandbox needs --syscalls=linux"},
+		{[]string{"--uart-stdin", "--deterministic", "a.bin"}, "cannot be combined"},
+		{[]string{"--trace=nonsense", "a.bin"}, "nonsense"},
+		{[]string{"--icache", "12", "a.bin"}, "--icache"},
+		{[]string{"--ram-base", "zero", "a.bin"}, "usage shown"},
+	} {
+		_, err := parseRunFlags(tt.args, &bytes.Buffer{})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseRunFlags(%q) = %v, want an error containing %q", tt.args, err, tt.want)
+		}
+	}
+}
+
+func TestCmdRun(t *testing.T) {
+	image := writeTemp(t, "exit.bin", assemble(t, exitProgram(7)))
+
+	code, stdout, stderr := runCommand("run", "--syscalls=newlib", image)
+	if code != 7 {
+		t.Errorf("exit code %d, want the program's 7 (stderr %q)", code, stderr)
+	}
+	if want := "exited with code 7 after 3 instructions\n"; stdout != want {
+		t.Errorf("stdout = %q, want %q", stdout, want)
+	}
+
+	// without a syscall handler the ecall is an exception the guest has no handler for
+	if code, _, stderr := runCommand("run", "--diagnostics=false", image); code != 1 || stderr == "" {
+		t.Errorf("unhandled ecall: exit %d, stderr %q; want 1 and an error", code, stderr)
+	}
+
+	code, stdout, _ = runCommand("run", "--syscalls=newlib", "--json", "--dump-mem", "0:4", image)
+	if code != 7 {
+		t.Errorf("--json: exit code %d, want 7", code)
+	}
+	var report RunReport
+	if err := json.Unmarshal([]byte(stdout), &report); err != nil {
+		t.Fatalf("--json output isn't a report: %v\n%s", err, stdout)
+	}
+	if report.StopReason != "exit" || report.ExitCode == nil || *report.ExitCode != 7 || report.Retired != 3 || report.Registers["a0"] != 7 {
+		t.Errorf("report = %+v", report)
+	}
+	if len(report.Memory) != 1 || report.Memory[0].Addr != 0 || report.Memory[0].Len != 4 {
+		t.Errorf("report memory = %+v, want the 4 bytes at 0", report.Memory)
+	}
+
+	limited := writeTemp(t, "spin.bin", assemble(t, func(b *Builder) {
+		b.Label("spin")
+		b.J("spin")
+	}))
+	code, stdout, _ = runCommand("run", "--max-instructions=10", limited)
+	if code != 0 || !strings.HasPrefix(stdout, "stopped: instruction limit after 10 instructions at pc=0x00000000") {
+		t.Errorf("instruction limit: exit %d, stdout %q", code, stdout)
+	}
+
+	if code, _, stderr := runCommand("run", filepath.Join(t.TempDir(), "missing.bin")); code != 1 || !strings.Contains(stderr, "missing.bin") {
+		t.Errorf("missing image: exit %d, stderr %q", code, stderr)
+	}
+}
+
+func TestCmdDisasm(t *testing.T) {
+	program := assemble(t, func(b *Builder) {
+		b.Label("start")
+		b.Addi(A0, ZERO, 1)
+		b.Label("loop")
+		b.Bne(A0, ZERO, "loop")
+	})
+
+	raw := writeTemp(t, "prog.bin", program)
+	code, stdout, stderr := runCommand("disasm", "--base", "0x1000", raw)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	want := "  00001000  addi a0, zero, 1\n  00001004  bne a0, zero, 0x00001004\n"
+	if stdout != want {
+		t.Errorf("raw image:\n%s\nwant:\n%s", stdout, want)
+	}
+
+	elfFile := writeTemp(t, "prog.elf", buildELF(program, 0x2000, map[string]uint32{"_start": 0x2000, "loop": 0x2004}, "_start"))
+	code, stdout, stderr = runCommand("disasm", elfFile)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	want = "_start:\n  00002000  addi a0, zero, 1\nloop:\n  00002004  bne a0, zero, 0x00002004\n"
+	if stdout != want {
+		t.Errorf("ELF file:\n%s\nwant:\n%s", stdout, want)
+	}
+
+	if code, _, _ := runCommand("disasm"); code != 2 {
+		t.Errorf("no image: exit %d, want 2", code)
+	}
+}
+
+// runToEbreak runs cpu until the program's ebreak
+func runToEbreak(t *testing.T, cpu *CPU) {
+	t.Helper()
+	if reason, err := cpu.Run(100_000); err != nil || reason != StopBreakpoint {
+		t.Fatalf("stopped with %v, %v; want the ebreak", reason, err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// Memory files
+// ============================================================================
+// DumpMemory saves a range of guest memory to a raw binary file and LoadMemory
+// puts one back, for looking at a program's data after it ran and for
+// preparing the inputs of the next run. both go through the bus, like the
+// guest's loads and stores do: a range may cover RAM and device registers, and
+// a device sees the reads and writes (word-sized where the range allows, byte
+// by byte elsewhere), side effects included. a range must lie entirely inside
+// RAM and the devices' windows; that's checked before anything is accessed
+
+// DumpMemory writes the length bytes of guest memory at addr to the file at path,
+// which is replaced. a dump that can't be written completely (e.g. the disk is
+// full) is removed instead of being left behind truncated
+func (cpu *CPU) DumpMemory(path string, addr, length uint32) error {
+	data, err := cpu.readBus(addr, length)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil && info.Mode().IsRegular() {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if info != nil && info.Mode().IsRegular() { // not e.g. a device file
+			os.Remove(path)
+		}
+		return fmt.Errorf("dumping 0x%08X+%d to %s: %w", addr, length, path, err)
+	}
+	return nil
+}
+
+// LoadMemory writes the contents of the file at path to guest memory starting at addr,
+// the inverse of DumpMemory. it returns how many bytes were loaded
+func (cpu *CPU) LoadMemory(path string, addr uint32) (uint32, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if uint64(len(data)) >= 1<<32 {
+		return 0, fmt.Errorf("%s is too large to load", path)
+	}
+	if err := cpu.writeBus(addr, data); err != nil {
+		return 0, fmt.Errorf("loading %s: %w", path, err)
+	}
+	return uint32(len(data)), nil
+}
+
+// checkBus returns an error unless every byte of [addr, addr+n) is in RAM or a device's window
+func (cpu *CPU) checkBus(addr, n uint32) error {
+	if uint64(addr)+uint64(n) > 1<<32 {
+		return fmt.Errorf("memory range 0x%08X+%d goes past the end of the address space", addr, n)
+	}
+	for i := uint32(0); i < n; {
+		a := addr + i
+		if off, ok := cpu.ramOffset(a, 1); ok {
+			i += min(n-i, uint32(len(cpu.Memory))-off)
+			continue
+		}
+		m, ok := cpu.findDevice(a, 1)
+		if !ok {
+			return fmt.Errorf("memory range 0x%08X+%d is outside memory at 0x%08X", addr, n, a)
+		}
+		i += min(n-i, m.base+(m.size-1)-a+1)
+	}
+	return nil
+}
+
+// busAccessSize is the width to access a device at addr with, rest bytes of the range remaining
+func (cpu *CPU) busAccessSize(addr, rest uint32) uint32 {
+	if addr%4 == 0 && rest >= 4 {
+		if _, ok := cpu.findDevice(addr, 4); ok {
+			return 4
+		}
+	}
+	return 1
+}
+
+// readBus reads n bytes starting at addr the way the guest's loads would see them
+func (cpu *CPU) readBus(addr, n uint32) ([]byte, error) {
+	if err := cpu.checkBus(addr, n); err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	for i := uint32(0); i < n; {
+		a := addr + i
+		if off, ok := cpu.ramOffset(a, 1); ok {
+			i += uint32(copy(data[i:], cpu.Memory[off:]))
+			continue
+		}
+		size := cpu.busAccessSize(a, n-i)
+		v, err := cpu.Load(a, size)
+		if err != nil {
+			return nil, err
+		}
+		var word [4]byte
+		binary.LittleEndian.PutUint32(word[:], v)
+		copy(data[i:i+size], word[:])
+		i += size
+	}
+	return data, nil
+}
+
+// writeBus writes data starting at addr the way the guest's stores would
+func (cpu *CPU) writeBus(addr uint32, data []byte) error {
+	n := uint32(len(data))
+	if err := cpu.checkBus(addr, n); err != nil {
+		return err
+	}
+	for i := uint32(0); i < n; {
+		a := addr + i
+		if off, ok := cpu.ramOffset(a, 1); ok {
+			run := uint32(copy(cpu.Memory[off:], data[i:]))
+			cpu.MemoryWritten(a, run)
+			i += run
+			continue
+		}
+		size := cpu.busAccessSize(a, n-i)
+		var word [4]byte
+		copy(word[:], data[i:i+size])
+		if err := cpu.Store(a, size, binary.LittleEndian.Uint32(word[:])); err != nil {
+			return err
+		}
+		i += size
+	}
+	return nil
+}
+
+// memFile is one --save-mem argument
+type memFile struct {
+	memRange
+	path string
+}
+
+// memFilesFlag collects repeated --save-mem addr:len:path flags
+type memFilesFlag []memFile
+
+func (m *memFilesFlag) String() string {
+	parts := make([]string, len(*m))
+	for i, f := range *m {
+		parts[i] = fmt.Sprintf("0x%X:%d:%s", f.addr, f.len, f.path)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *memFilesFlag) Set(s string) error {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return fmt.Errorf("%q is not addr:len:path", s)
+	}
+	addr, err := strconv.ParseUint(parts[0], 0, 32)
+	if err != nil {
+		return fmt.Errorf("bad address in %q", s)
+	}
+	length, err := strconv.ParseUint(parts[1], 0, 32)
+	if err != nil {
+		return fmt.Errorf("bad length in %q", s)
+	}
+	*m = append(*m, memFile{memRange{uint32(addr), uint32(length)}, parts[2]})
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpAndLoadMemory(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i*7 + i>>8)
+	}
+	copy(cpu.Memory[0x123:], data)
+
+	path := filepath.Join(t.TempDir(), "region.bin")
+	if err := cpu.DumpMemory(path, 0x123, uint32(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if file, err := os.ReadFile(path); err != nil || !bytes.Equal(file, data) {
+		t.Fatalf("dump = % X, %v", file, err)
+	}
+
+	restored := NewCPUWithMemory(0x1000)
+	n, err := restored.LoadMemory(path, 0x801)
+	if err != nil || n != uint32(len(data)) {
+		t.Fatalf("LoadMemory = %d, %v", n, err)
+	}
+	if !bytes.Equal(restored.Memory[0x801:0x801+len(data)], data) {
+		t.Error("the loaded region differs from the dumped one")
+	}
+	if restored.Memory[0x800] != 0 || restored.Memory[0x801+len(data)] != 0 {
+		t.Error("LoadMemory wrote outside the region")
+	}
+}
+
+func TestDumpMemoryBounds(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "past.bin")
+	err := cpu.DumpMemory(path, 0xF00, 0x200)
+	if err == nil || !strings.Contains(err.Error(), "outside memory at 0x00001000") {
+		t.Errorf("dumping past the end of memory: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("a failed dump left %s behind", path)
+	}
+	if err := cpu.DumpMemory(path, 0xFFFFFFF0, 0x20); err == nil || !strings.Contains(err.Error(), "end of the address space") {
+		t.Errorf("dumping past the end of the address space: %v", err)
+	}
+
+	big := writeTemp(t, "big.bin", make([]byte, 0x101))
+	if _, err := cpu.LoadMemory(big, 0xF00); err == nil || !strings.Contains(err.Error(), "outside memory") {
+		t.Errorf("loading past the end of memory: %v", err)
+	}
+	if _, err := cpu.LoadMemory(filepath.Join(dir, "missing.bin"), 0); err == nil {
+		t.Error("loading a missing file succeeded")
+	}
+
+	if _, err := os.Stat("/dev/full"); err == nil {
+		if err := cpu.DumpMemory("/dev/full", 0, 16); err == nil || !strings.Contains(err.Error(), "dumping 0x00000000+16 to /dev/full") {
+			t.Errorf("dumping to a full disk: %v", err)
+		}
+	}
+}
+
+// a range may cover device registers, which see the accesses as the guest's would
+func TestDumpMemoryThroughBus(t *testing.T) {
+	cpu, err := DefaultMachine().NewCPU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const mtimecmp = 0x02004000 // the CLINT's, all ones at reset
+	path := filepath.Join(t.TempDir(), "mtimecmp.bin")
+	if err := cpu.DumpMemory(path, mtimecmp, 8); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, bytes.Repeat([]byte{0xFF}, 8)) {
+		t.Errorf("mtimecmp dumped as % X", data)
+	}
+	os.WriteFile(path, []byte{1, 2, 3, 4, 0, 0, 0, 0}, 0o644)
+	if _, err := cpu.LoadMemory(path, mtimecmp); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := cpu.Load(mtimecmp, 4); v != 0x04030201 {
+		t.Errorf("mtimecmp = 0x%08X after loading", v)
+	}
+}
+
+func TestDebuggerDumpRestore(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	copy(cpu.Memory[0x40:], "debugger")
+	path := filepath.Join(t.TempDir(), "d.bin")
+	var out strings.Builder
+	in := "dump 0x40 8 " + path + "\nrestore " + path + " 0x80\ndump 0xFFC 8 " + path + "\nquit\n"
+	if err := NewDebugger(&cpu, strings.NewReader(in), &out, 0).Loop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"wrote 8 bytes from 0x00000040 to ", "loaded 8 bytes from ", "error: memory range 0x00000FFC+8 is outside memory"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+	if string(cpu.Memory[0x80:0x88]) != "debugger" {
+		t.Errorf("restored % X", cpu.Memory[0x80:0x88])
+	}
+}
+
+func TestRunSaveMem(t *testing.T) {
+	image := writeTemp(t, "exit.bin", assemble(t, exitProgram(0)))
+	path := filepath.Join(t.TempDir(), "code.bin")
+	if code, _, stderr := runCommand("run", "--syscalls=newlib", "--save-mem=0:8:"+path, image); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	want, _ := os.ReadFile(image)
+	if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, want[:8]) {
+		t.Errorf("--save-mem wrote % X, %v; want % X", got, err, want[:8])
+	}
+	if code, _, stderr := runCommand("run", "--save-mem=0:8", image); code != 2 || !strings.Contains(stderr, "addr:len:path") {
+		t.Errorf("bad --save-mem: exit %d, %q", code, stderr)
+	}
+}
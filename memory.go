@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ============================================================================
+// Guest memory access helpers
+// ============================================================================
+// loads, stores and anything outside the CPU that touches guest memory
+// (syscall handlers, the debugger, reports) go through these so bounds are
+// always checked in one place
+
+// MemoryWritten tells the CPU that [addr, addr+n) of RAM has been written. everything
+// that changes memory through Store, WriteMemory or a loader calls it; code writing to
+// cpu.Memory directly must too, so decoded instructions there are dropped from the
+// decode and block caches, (with WithUninitCheck) the bytes count as initialized,
+// (with WithHTIF) a write to tohost is acted on and SelfCheck compares them
+func (cpu *CPU) MemoryWritten(addr, n uint32) {
+	if cpu.dcache != nil {
+		cpu.dcache.invalidate(addr, n)
+	}
+	if cpu.bcache != nil {
+		cpu.bcache.invalidate(addr, n)
+	}
+	if cpu.uninit != nil && addr >= cpu.ramBase {
+		cpu.uninit.markInitialized(addr-cpu.ramBase, n, len(cpu.Memory))
+	}
+	if cpu.htif {
+		cpu.checkToHost(addr, n)
+	}
+	if cpu.writeLog != nil {
+		*cpu.writeLog = append(*cpu.writeLog, memRange{addr: addr, len: n})
+	}
+}
+
+// AccessKind is what kind of access an AccessObserver is told about
+type AccessKind int
+
+const (
+	AccessFetch AccessKind = iota // an instruction fetch
+	AccessLoad                    // a load instruction reading memory
+	AccessStore                   // a store instruction writing memory
+)
+
+func (k AccessKind) String() string {
+	switch k {
+	case AccessFetch:
+		return "fetch"
+	case AccessLoad:
+		return "load"
+	}
+	return "store"
+}
+
+// AccessObserver watches the accesses the program makes: every instruction fetch, load and
+// store, before it happens (so faulting ones are seen too). accesses made on the program's
+// behalf, by syscall handlers, the debugger and the like, aren't reported. like a Tracer,
+// an observer makes Run execute one instruction at a time
+type AccessObserver interface {
+	Access(kind AccessKind, addr, size uint32)
+}
+
+// WithRAMBase puts RAM at base instead of address 0, so cpu.Memory[0] is the byte at base
+// (e.g. 0x80000000, where spike and qemu's virt machine have it). base must be a multiple of 4096,
+// and RAM must end at or below the top of the address space
+func WithRAMBase(base uint32) Option {
+	return func(cpu *CPU) {
+		cpu.ramBase = base
+		if cpu.dcache != nil {
+			cpu.dcache.base = base
+		}
+	}
+}
+
+// RAMBase is the address of the first byte of RAM
+func (cpu *CPU) RAMBase() uint32 {
+	return cpu.ramBase
+}
+
+// ramOffset returns where in cpu.Memory the access [addr, addr+n) is, if it's entirely inside RAM.
+// (an address below RAM wraps around to an offset past its end, RAM can't reach the top of the
+// address space and beyond, so one comparison covers both sides)
+func (cpu *CPU) ramOffset(addr, n uint32) (uint32, bool) {
+	off := addr - cpu.ramBase
+	return off, uint64(off)+uint64(n) <= uint64(len(cpu.Memory))
+}
+
+// WithoutFastMemory sends every load and store through Load and Store, instead of
+// handling aligned words inside RAM directly (to rule the fast path out, and to
+// check it against the general one)
+func WithoutFastMemory() Option {
+	return func(cpu *CPU) {
+		cpu.slowMemory = true
+	}
+}
+
+// fastWord reports whether a word access at addr can take the fast path, and where in
+// cpu.Memory it is: it's aligned, entirely inside RAM (which takes precedence over devices),
+// and there is no uninitialized memory tracking to do. fetches don't need it, FetchAndDecode
+// already reads RAM directly
+func (cpu *CPU) fastWord(addr uint32) (uint32, bool) {
+	off := addr - cpu.ramBase
+	return off, addr%4 == 0 && uint64(off)+4 <= uint64(len(cpu.Memory)) && !cpu.slowMemory && cpu.uninit == nil
+}
+
+// checkRange returns an error unless [addr, addr+n) lies inside memory
+func (cpu *CPU) checkRange(addr, n uint32) error {
+	if _, ok := cpu.ramOffset(addr, n); !ok {
+		return fmt.Errorf("memory access of %d bytes at 0x%08X is outside memory", n, addr)
+	}
+	return nil
+}
+
+// ReadMemory returns a copy of n bytes of guest memory starting at addr
+func (cpu *CPU) ReadMemory(addr, n uint32) ([]byte, error) {
+	off, ok := cpu.ramOffset(addr, n)
+	if !ok {
+		return nil, cpu.checkRange(addr, n)
+	}
+	return append([]byte(nil), cpu.Memory[off:off+n]...), nil
+}
+
+// WriteMemory copies data into guest memory starting at addr
+func (cpu *CPU) WriteMemory(addr uint32, data []byte) error {
+	off, ok := cpu.ramOffset(addr, uint32(len(data)))
+	if !ok {
+		return cpu.checkRange(addr, uint32(len(data)))
+	}
+	copy(cpu.Memory[off:], data)
+	cpu.MemoryWritten(addr, uint32(len(data)))
+	return nil
+}
+
+// ReadString reads a NUL-terminated string of at most max bytes starting at addr
+func (cpu *CPU) ReadString(addr, max uint32) (string, error) {
+	for n := uint32(0); n < max; n++ {
+		off, ok := cpu.ramOffset(addr+n, 1)
+		if !ok {
+			return "", cpu.checkRange(addr+n, 1)
+		}
+		if cpu.Memory[off] == 0 {
+			return string(cpu.Memory[off-n : off]), nil
+		}
+	}
+	return "", fmt.Errorf("string at 0x%08X is longer than %d bytes", addr, max)
+}
+
+// Load reads a little-endian value of size 1, 2 or 4 bytes (zero-extended to 32 bits)
+// from RAM or a memory-mapped device
+func (cpu *CPU) Load(addr, size uint32) (uint32, error) {
+	off, ok := cpu.ramOffset(addr, size)
+	if !ok {
+		if m, ok := cpu.findDevice(addr, size); ok {
+			return m.dev.Read(addr-m.base, size)
+		}
+		return 0, cpu.checkRange(addr, size)
+	}
+	switch size {
+	case 1:
+		return uint32(cpu.Memory[off]), nil
+	case 2:
+		return uint32(binary.LittleEndian.Uint16(cpu.Memory[off:])), nil
+	case 4:
+		return binary.LittleEndian.Uint32(cpu.Memory[off:]), nil
+	}
+	return 0, fmt.Errorf("unsupported load size %d", size)
+}
+
+// Store writes the low size bytes (1, 2 or 4) of value in little-endian order
+// to RAM or a memory-mapped device
+func (cpu *CPU) Store(addr, size, value uint32) error {
+	off, ok := cpu.ramOffset(addr, size)
+	if !ok {
+		if m, ok := cpu.findDevice(addr, size); ok {
+			return m.dev.Write(addr-m.base, size, value)
+		}
+		return cpu.checkRange(addr, size)
+	}
+	switch size {
+	case 1:
+		cpu.Memory[off] = byte(value)
+	case 2:
+		binary.LittleEndian.PutUint16(cpu.Memory[off:], uint16(value))
+	case 4:
+		binary.LittleEndian.PutUint32(cpu.Memory[off:], value)
+	default:
+		return fmt.Errorf("unsupported store size %d", size)
+	}
+	cpu.MemoryWritten(addr, size)
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// memoryEdges are single loads and stores at the addresses the fast path has to
+// leave to the general one, on 4 KiB of RAM at 0x1000 with the CLINT attached
+func memoryEdges() []diffProgram {
+	var programs []diffProgram
+	for _, addr := range []uint32{
+		0x1800,                              // an ordinary aligned word
+		0x1802,                              // misaligned
+		0x1FFC,                              // the last word of RAM
+		0x1FFE,                              // straddling the end of RAM
+		0x2000,                              // just past it
+		0x0FFC,                              // just below RAM
+		0xFFFFFFFC,                          // the top of the address space
+		DefaultMachine().CLINTBase + 0x4000, // mtimecmp
+	} {
+		for _, store := range []bool{false, true} {
+			name := fmt.Sprintf("lw at 0x%08X", addr)
+			if store {
+				name = fmt.Sprintf("sw at 0x%08X", addr)
+			}
+			programs = append(programs, diffProgram{name, func(opts ...Option) (*CPU, error) {
+				machine := DefaultMachine()
+				machine.RAMBase = 0x1000
+				machine.MemSize = 0x1000
+				cpu, err := machine.NewCPU(append([]Option{instructionTime}, opts...)...)
+				if err != nil {
+					return nil, err
+				}
+				cpu.Memory[0x802] = 0x5A // so the loads read something
+				var b Builder
+				b.Li(T0, int32(addr))
+				b.Li(T1, 0x12345678)
+				if store {
+					b.Sw(T1, T0, 0)
+				} else {
+					b.Lw(A0, T0, 0)
+				}
+				b.Ebreak()
+				program, err := b.Assemble()
+				if err != nil {
+					return nil, err
+				}
+				if err := cpu.LoadProgramAt(program, 0x1000); err != nil {
+					return nil, err
+				}
+				cpu.PC = 0x1000
+				_, err = cpu.Run(10)
+				return cpu, err
+			}})
+		}
+	}
+	return programs
+}
+
+// the fast path for aligned words gets exactly what Load and Store do, for every
+// instruction case, every program in the corpus and the accesses at its edges
+func TestFastMemoryMatchesGeneralPath(t *testing.T) {
+	modes := []runMode{
+		{"without fast memory", []Option{WithoutFastMemory()}},
+		{"fast memory", nil},
+	}
+	var programs []diffProgram
+	for _, c := range instrCases {
+		programs = append(programs, diffProgram{"instruction " + c.name, func(opts ...Option) (*CPU, error) {
+			cpu := c.cpu(append([]Option{instructionTime}, opts...)...)
+			return cpu, cpu.Step()
+		}})
+	}
+	programs = append(programs, programCorpus()...)
+	programs = append(programs, memoryEdges()...)
+	for _, p := range programs {
+		requireSameState(t, p, modes)
+	}
+}
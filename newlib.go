@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// newlib (libgloss) syscall numbers, passed in a7
+const (
+	newlibSysClose = 57
+	newlibSysLseek = 62
+	newlibSysRead  = 63
+	newlibSysWrite = 64
+	newlibSysFstat = 80
+	newlibSysExit  = 93
+	newlibSysBrk   = 214
+)
+
+// errno values returned (negated) in a0, the way libgloss expects them
+const (
+	errnoEBADF  = 9
+	errnoEINVAL = 22
+	errnoESPIPE = 29
+	errnoENOSYS = 38
+)
+
+// NewlibSyscalls emulates the small set of system calls a bare-metal program
+// built with riscv32-unknown-elf-gcc and newlib makes through ecall:
+// the syscall number is in a7, arguments in a0-a2 and the result goes back in a0
+// (a negative errno on failure).
+// install it with cpu.EcallHook = syscalls.Handle
+type NewlibSyscalls struct {
+	Stdin  io.Reader // fd 0
+	Stdout io.Writer // fd 1
+	Stderr io.Writer // fd 2
+
+	HeapStart uint32 // lowest program break, usually the end of the loaded image
+	HeapLimit uint32 // brk refuses to move the break past this address
+	brk       uint32 // current program break
+}
+
+// NewNewlibSyscalls creates a handler whose heap grows from heapStart up to heapLimit
+func NewNewlibSyscalls(stdin io.Reader, stdout, stderr io.Writer, heapStart, heapLimit uint32) *NewlibSyscalls {
+	return &NewlibSyscalls{
+		Stdin:     stdin,
+		Stdout:    stdout,
+		Stderr:    stderr,
+		HeapStart: heapStart,
+		HeapLimit: heapLimit,
+		brk:       heapStart,
+	}
+}
+
+// Handle services one ecall
+func (s *NewlibSyscalls) Handle(cpu *CPU) error {
+	a0, a1, a2 := cpu.Regs[A0], cpu.Regs[A1], cpu.Regs[A2]
+
+	var ret int32
+	switch cpu.Regs[A7] {
+	case newlibSysExit:
+		cpu.Exit(int(int32(a0)))
+		return nil
+
+	case newlibSysWrite:
+		ret = s.write(cpu, a0, a1, a2)
+
+	case newlibSysRead:
+		ret = s.read(cpu, a0, a1, a2)
+
+	case newlibSysBrk:
+		// brk(0) asks for the current break; otherwise the break moves to a0 if that's allowed
+		// (never past the limit or into the live stack).
+		// either way the result is the (possibly unchanged) break, which is how newlib's sbrk detects failure
+		sp := cpu.Regs[SP]
+		if a0 >= s.HeapStart && a0 <= s.HeapLimit && (sp == 0 || a0 < sp) {
+			s.brk = a0
+		}
+		ret = int32(s.brk)
+
+	case newlibSysFstat:
+		ret = s.fstat(cpu, a0, a1)
+
+	case newlibSysClose:
+		// the standard streams are the only files and closing them is harmless
+		ret = 0
+		if a0 > 2 {
+			ret = -errnoEBADF
+		}
+
+	case newlibSysLseek:
+		ret = -errnoESPIPE // the standard streams are character devices
+
+	default:
+		cpu.Logger.Warn("unimplemented newlib syscall", "number", cpu.Regs[A7], "pc", fmt.Sprintf("0x%08X", cpu.PC-4))
+		ret = -errnoENOSYS
+	}
+
+	cpu.Regs[A0] = uint32(ret)
+	return nil
+}
+
+// write(fd, buf, count)
+func (s *NewlibSyscalls) write(cpu *CPU, fd, buf, count uint32) int32 {
+	var w io.Writer
+	switch fd {
+	case 1:
+		w = s.Stdout
+	case 2:
+		w = s.Stderr
+	}
+	if w == nil {
+		return -errnoEBADF
+	}
+
+	data, err := cpu.ReadMemory(buf, count)
+	if err != nil {
+		return -errnoEINVAL
+	}
+	n, err := w.Write(data)
+	if err != nil && n == 0 {
+		return -errnoEINVAL
+	}
+	return int32(n)
+}
+
+// read(fd, buf, count)
+func (s *NewlibSyscalls) read(cpu *CPU, fd, buf, count uint32) int32 {
+	if fd != 0 || s.Stdin == nil {
+		return -errnoEBADF
+	}
+	if err := cpu.checkRange(buf, count); err != nil {
+		return -errnoEINVAL
+	}
+
+	data := make([]byte, count)
+	n, err := s.Stdin.Read(data)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return -errnoEINVAL
+	}
+	cpu.WriteMemory(buf, data[:n])
+	return int32(n)
+}
+
+// kernelStatSize is the size of libgloss's struct kernel_stat on rv32
+// and kernelStatModeOffset the position of its st_mode field
+const (
+	kernelStatSize       = 128
+	kernelStatModeOffset = 16
+	statModeCharDevice   = 0o020000 // S_IFCHR
+)
+
+// fstat(fd, statbuf) reports the standard streams as character devices,
+// which is what makes newlib's stdio line-buffer them and printf work
+func (s *NewlibSyscalls) fstat(cpu *CPU, fd, statbuf uint32) int32 {
+	if fd > 2 {
+		return -errnoEBADF
+	}
+	stat := make([]byte, kernelStatSize)
+	binary.LittleEndian.PutUint32(stat[kernelStatModeOffset:], statModeCharDevice)
+	if err := cpu.WriteMemory(statbuf, stat); err != nil {
+		return -errnoEINVAL
+	}
+	return 0
+}
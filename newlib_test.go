@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const helloMessage = "Hello, world!\n"
+
+// newlibStandIn is testdata/newlib-standin.elf. it is not a newlib-linked
+// binary but a synthetic stand-in for one: a few Builder instructions making,
+// with raw ecalls, the calls a newlib printf("Hello, world!\n") makes on its way
+// to exit(0) (fstat of stdout to pick its buffering, brk to allocate the buffer,
+// write, exit). there's no RISC-V toolchain to build the real thing with, so
+// this only checks the emulator against our reading of what newlib does.
+// regenerate the file with `go test -run TestNewlibStandIn -update`
+func newlibStandIn(t testing.TB) []byte {
+	build := func(msg int32) func(b *Builder) {
+		return func(b *Builder) {
+			b.Label("_start")
+			b.Addi(SP, SP, -kernelStatSize)
+			b.Li(A0, 1)
+			b.Mv(A1, SP)
+			b.Li(A7, newlibSysFstat)
+			b.Ecall()
+			b.Li(A0, 0)
+			b.Li(A7, newlibSysBrk)
+			b.Ecall()
+			b.Addi(A0, A0, 1024)
+			b.Ecall()
+			b.Li(A0, 1)
+			b.Li(A1, msg)
+			b.Li(A2, int32(len(helloMessage)))
+			b.Li(A7, newlibSysWrite)
+			b.Ecall()
+			b.Li(A0, 0)
+			b.Li(A7, newlibSysExit)
+			b.Ecall()
+		}
+	}
+	code := assemble(t, build(0))
+	code = assemble(t, build(int32(len(code)))) // the message follows the code
+	image := append(code, helloMessage...)
+	return buildELF(image, 0, map[string]uint32{"_start": 0, "message": uint32(len(code))}, "_start")
+}
+
+func TestNewlibStandIn(t *testing.T) {
+	path := filepath.Join("testdata", "newlib-standin.elf")
+	if *update {
+		if err := os.WriteFile(path, newlibStandIn(t), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, err := os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, newlibStandIn(t)) {
+		t.Errorf("%s is out of date, regenerate it with -update", path)
+	}
+
+	code, stdout, stderr := runCommand("run", "--syscalls=newlib", path)
+	if code != 0 {
+		t.Fatalf("exit %d, stderr:\n%s", code, stderr)
+	}
+	if want := helloMessage + "exited with code 0 after 18 instructions\n"; stdout != want {
+		t.Errorf("stdout = %q, want %q", stdout, want)
+	}
+}
+
+func TestNewlibSyscalls(t *testing.T) {
+	cpu := NewCPUWithMemory(4096)
+	cpu.Regs[SP] = 4096
+	var out, errOut bytes.Buffer
+	s := NewNewlibSyscalls(bytes.NewReader([]byte("input")), &out, &errOut, 0x800, 0xC00)
+	copy(cpu.Memory[0x100:], "text")
+
+	call := func(number uint32, args ...uint32) int32 {
+		t.Helper()
+		cpu.Regs[A7] = number
+		copy(cpu.Regs[A0:A3], append(args, 0, 0, 0))
+		if err := s.Handle(&cpu); err != nil {
+			t.Fatal(err)
+		}
+		return int32(cpu.Regs[A0])
+	}
+
+	for _, tt := range []struct {
+		name   string
+		number uint32
+		args   []uint32
+		want   int32
+	}{
+		{"write stdout", newlibSysWrite, []uint32{1, 0x100, 4}, 4},
+		{"write stderr", newlibSysWrite, []uint32{2, 0x100, 2}, 2},
+		{"write bad fd", newlibSysWrite, []uint32{3, 0x100, 4}, -errnoEBADF},
+		{"read stdin", newlibSysRead, []uint32{0, 0x200, 16}, 5},
+		{"read bad fd", newlibSysRead, []uint32{1, 0x200, 16}, -errnoEBADF},
+		{"brk query", newlibSysBrk, []uint32{0}, 0x800},
+		{"brk grow", newlibSysBrk, []uint32{0x900}, 0x900},
+		{"brk past the limit", newlibSysBrk, []uint32{0xD00}, 0x900},
+		{"fstat stdout", newlibSysFstat, []uint32{1, 0x300}, 0},
+		{"fstat bad fd", newlibSysFstat, []uint32{5, 0x300}, -errnoEBADF},
+		{"close stdout", newlibSysClose, []uint32{1}, 0},
+		{"close bad fd", newlibSysClose, []uint32{7}, -errnoEBADF},
+		{"lseek", newlibSysLseek, []uint32{1, 0, 0}, -errnoESPIPE},
+		{"unknown", 1234, nil, -errnoENOSYS},
+	} {
+		if got := call(tt.number, tt.args...); got != tt.want {
+			t.Errorf("%s: a0 = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if out.String() != "text" || errOut.String() != "te" {
+		t.Errorf("stdout %q, stderr %q; want \"text\" and \"te\"", out.String(), errOut.String())
+	}
+	if got := string(cpu.Memory[0x200:0x205]); got != "input" {
+		t.Errorf("read stored %q, want \"input\"", got)
+	}
+	if mode := cpu.Memory[0x300+kernelStatModeOffset+1]; mode != statModeCharDevice>>8 {
+		t.Errorf("fstat st_mode byte 1 = 0x%X, want a character device", mode)
+	}
+
+	call(newlibSysExit, 3)
+	if reason := cpu.haltReason; !cpu.halted || reason != StopExit || cpu.ExitCode != 3 {
+		t.Errorf("exit(3): halted %v, reason %v, exit code %d", cpu.halted, reason, cpu.ExitCode)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import "io"
+
+// Option configures a CPU when it's created (see NewCPU and MachineConfig.NewCPU)
+type Option func(cpu *CPU)
+
+// WithDeterministic makes every run of the same program identical:
+//   - mtime advances with retired instructions (one tick each, unless WithTimeBase says
+//     otherwise) instead of following the host clock
+//   - the RTC derives its time from mtime (starting at the Unix epoch)
+//   - the entropy device is a pseudo-random generator seeded with seed
+//   - the UART only receives the input given with WithUARTSchedule, never live input
+//   - Run doesn't execute basic blocks (which would move interrupts to block boundaries)
+func WithDeterministic(seed uint64) Option {
+	return func(cpu *CPU) {
+		cpu.deterministic = true
+		cpu.bcache = nil
+		cpu.seed = seed
+		cpu.timeSource = TimeInstructions
+	}
+}
+
+// WithConsole connects the UART: transmitted bytes go to out and, unless the CPU
+// is deterministic, bytes read from in are received as they arrive (in may be nil)
+func WithConsole(in io.Reader, out io.Writer) Option {
+	return func(cpu *CPU) {
+		cpu.console.in = in
+		cpu.console.out = out
+	}
+}
+
+// WithUARTSchedule delivers each chunk of input to the UART once its At instructions have retired
+func WithUARTSchedule(events ...UARTInput) Option {
+	return func(cpu *CPU) {
+		cpu.console.schedule = append(cpu.console.schedule, events...)
+	}
+}
+
+// consoleConfig is what the console options collected, used when the UART is attached
+type consoleConfig struct {
+	in       io.Reader
+	out      io.Writer
+	schedule []UARTInput
+}
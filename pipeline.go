@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ============================================================================
+// Five-stage pipeline model
+// ============================================================================
+// Pipeline is a Tracer that works out how the executed instruction stream
+// would flow through the classic IF ID EX MEM WB pipeline. it only watches:
+// the functional emulator still executes every instruction on its own, so
+// registers and memory come out exactly the same with or without it.
+//
+// the rules are the textbook ones:
+//   - an instruction reads its source registers in EX. with forwarding, an ALU
+//     result can be used by the very next instruction and a loaded value one
+//     instruction later (the load-use hazard, one bubble); without forwarding,
+//     a value can only be read in the cycle its producer writes it back (two
+//     bubbles when the producer is right before)
+//   - the fetch after a taken branch, a jump or a trap is only known when that
+//     instruction reaches EX, so the instructions fetched behind it are flushed
+//     (Flush of them, DefaultPipelineFlush for this pipeline)
+//
+// there are no structural hazards and every memory access takes one cycle.
+// with a diagram writer set, one line per instruction shows the cycles it
+// spends in each stage, "--" marking a cycle it waits in the stage before:
+//
+//	00000004  lw t1, 0(a0)                    IF ID EX ME WB
+//	00000008  add t2, t1, t1                     IF ID -- EX ME WB
+
+// DefaultPipelineFlush is how many instructions are fetched behind a jump before it resolves in EX
+const DefaultPipelineFlush = 2
+
+// PipelineConfig is how a Pipeline is set up
+type PipelineConfig struct {
+	Forwarding   bool      // forward results to EX instead of waiting for write-back
+	Flush        int       // instructions flushed after a taken branch or jump
+	Diagram      io.Writer // where the pipeline diagram goes, nil for none
+	DiagramLimit int       // instructions drawn in the diagram, 64 if zero
+}
+
+// PipelineStats are the totals of a Pipeline
+type PipelineStats struct {
+	Instructions uint64 `json:"instructions"`
+	Cycles       uint64 `json:"cycles"`  // from the first fetch to the last write-back
+	Stalls       uint64 `json:"stalls"`  // bubbles inserted for data hazards
+	Flushes      uint64 `json:"flushes"` // cycles lost to instructions flushed after a jump
+}
+
+// CPI is the average number of cycles per instruction
+func (s PipelineStats) CPI() float64 {
+	if s.Instructions == 0 {
+		return 0
+	}
+	return float64(s.Cycles) / float64(s.Instructions)
+}
+
+func (s PipelineStats) String() string {
+	return fmt.Sprintf("%d cycles for %d instructions (CPI %.2f), %d cycles stalled, %d cycles flushed",
+		s.Cycles, s.Instructions, s.CPI(), s.Stalls, s.Flushes)
+}
+
+// Pipeline is the pipeline model; install it as (or, with MultiTracer, next to) the CPU's Tracer
+type Pipeline struct {
+	cfg   PipelineConfig
+	stats PipelineStats
+
+	started bool
+	lastPC  int
+	lastEX  uint64     // the cycle the last instruction was in EX
+	lastID  uint64     // the cycle the last instruction moved to ID, freeing IF
+	ready   [32]uint64 // the first cycle an instruction can be in EX using each register
+}
+
+// NewPipeline creates a pipeline model
+func NewPipeline(cfg PipelineConfig) *Pipeline {
+	if cfg.DiagramLimit == 0 {
+		cfg.DiagramLimit = 64
+	}
+	return &Pipeline{cfg: cfg}
+}
+
+// Stats returns the totals so far
+func (p *Pipeline) Stats() PipelineStats {
+	return p.stats
+}
+
+// Trace accounts for the instruction instr at pc, which has just been executed
+func (p *Pipeline) Trace(cpu *CPU, pc int, instr uint32) {
+	d := decode(instr)
+
+	// the earliest cycle it could be in EX, before looking at its operands
+	var ex, fetch uint64
+	switch {
+	case !p.started:
+		ex, fetch = 3, 1
+		p.started = true
+	case pc != p.lastPC+4: // the previous instruction jumped (or trapped) here
+		flush := uint64(p.cfg.Flush)
+		ex = p.lastEX + 1 + flush
+		fetch = ex - 2
+		p.stats.Flushes += flush
+	default:
+		ex, fetch = p.lastEX+1, p.lastID
+	}
+	decode := max(fetch+1, p.lastEX) // it moves to ID when the instruction ahead moves to EX
+	earliest := ex
+	for _, r := range sourceRegs(&d) {
+		ex = max(ex, p.ready[r])
+	}
+	p.stats.Stalls += ex - earliest
+
+	if rd, ok := destReg(&d); ok {
+		switch {
+		case !p.cfg.Forwarding:
+			p.ready[rd] = ex + 3 // read in ID in the cycle it's written back
+		case d.opcode == LOAD:
+			p.ready[rd] = ex + 2 // forwarded from the end of MEM
+		default:
+			p.ready[rd] = ex + 1 // forwarded from the end of EX
+		}
+	}
+
+	if p.cfg.Diagram != nil && p.stats.Instructions < uint64(p.cfg.DiagramLimit) {
+		p.draw(d.instr, uint32(pc), fetch, decode, ex)
+	}
+	p.stats.Instructions++
+	p.stats.Cycles = ex + 2
+	p.lastPC, p.lastEX, p.lastID = pc, ex, decode
+}
+
+// draw writes the diagram line of an instruction fetched in cycle fetch, decoded from
+// cycle decode and executed in cycle ex
+func (p *Pipeline) draw(instr, pc uint32, fetch, decode, ex uint64) {
+	text, _ := Disassemble(instr, pc)
+	var line strings.Builder
+	fmt.Fprintf(&line, "%08X  %-28s", pc, text)
+	line.WriteString(strings.Repeat("   ", int(fetch-1)))
+	stage := func(name string, from, to uint64) {
+		for c := from; c < to; c++ {
+			if c == from {
+				line.WriteString(name + " ")
+			} else {
+				line.WriteString("-- ")
+			}
+		}
+	}
+	stage("IF", fetch, decode)
+	stage("ID", decode, ex)
+	line.WriteString("EX ME WB\n")
+	io.WriteString(p.cfg.Diagram, line.String())
+}
+
+// sourceRegs are the registers d reads (x0 is left out, it's never waited for)
+func sourceRegs(d *decoded) []uint32 {
+	var regs []uint32
+	switch d.opcode {
+	case OP, STORE, BRANCH:
+		regs = []uint32{d.rs1, d.rs2}
+	case OP_IMM, LOAD, JALR:
+		regs = []uint32{d.rs1}
+	case SYSTEM:
+		if d.funct3 >= 0x1 && d.funct3 <= 0x3 { // the immediate forms have no source register
+			regs = []uint32{d.rs1}
+		}
+	}
+	out := regs[:0]
+	for _, r := range regs {
+		if r != ZERO {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// destReg is the register d writes, if any
+func destReg(d *decoded) (uint32, bool) {
+	switch d.opcode {
+	case OP, OP_IMM, LOAD, LUI, AUIPC, JAL, JALR:
+	case SYSTEM:
+		if d.funct3 == 0 {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	return d.rd, d.rd != ZERO
+}
+
+// MultiTracer calls each of tracers in turn
+func MultiTracer(tracers ...Tracer) Tracer {
+	return multiTracer(tracers)
+}
+
+type multiTracer []Tracer
+
+func (m multiTracer) Trace(cpu *CPU, pc int, instr uint32) {
+	for _, t := range m {
+		t.Trace(cpu, pc, instr)
+	}
+}
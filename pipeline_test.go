@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// runPipeline runs program with a pipeline model set up with cfg and returns its totals
+func runPipeline(t *testing.T, cfg PipelineConfig, build func(b *Builder)) (*CPU, PipelineStats) {
+	t.Helper()
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, build))
+	p := NewPipeline(cfg)
+	cpu.Tracer = p
+	runToEbreak(t, &cpu)
+	return &cpu, p.Stats()
+}
+
+func TestPipelineLoadUse(t *testing.T) {
+	// nothing but the add depends on an instruction right before it
+	loadUse := func(b *Builder) {
+		b.Lw(T1, ZERO, 0x100)
+		b.Add(T2, T1, T1) // uses the load's result straight away
+		b.Ebreak()
+	}
+	apart := func(b *Builder) {
+		b.Lw(T1, ZERO, 0x100)
+		b.Nop()
+		b.Add(T2, T1, T1)
+		b.Ebreak()
+	}
+	for _, tt := range []struct {
+		name       string
+		build      func(b *Builder)
+		forwarding bool
+		stalls     uint64
+	}{
+		{"load-use with forwarding", loadUse, true, 1},
+		{"load-use without forwarding", loadUse, false, 2},
+		{"an instruction apart with forwarding", apart, true, 0},
+		{"an instruction apart without forwarding", apart, false, 1},
+	} {
+		_, stats := runPipeline(t, PipelineConfig{Forwarding: tt.forwarding, Flush: DefaultPipelineFlush}, tt.build)
+		if stats.Stalls != tt.stalls || stats.Flushes != 0 {
+			t.Errorf("%s: %d stalls and %d flushes, want %d and none", tt.name, stats.Stalls, stats.Flushes, tt.stalls)
+		}
+	}
+
+	// the bubble is in the diagram, and the results are the functional model's
+	var diagram bytes.Buffer
+	cpu, _ := runPipeline(t, PipelineConfig{Forwarding: true, Diagram: &diagram}, func(b *Builder) {
+		b.Addi(A0, ZERO, 0x7F0)
+		b.Sw(A0, A0, 0)
+		b.Lw(T1, A0, 0)
+		b.Add(T2, T1, T1)
+		b.Ebreak()
+	})
+	want := "00000000  addi a0, zero, 2032         IF ID EX ME WB\n" +
+		"00000004  sw a0, 0(a0)                   IF ID EX ME WB\n" +
+		"00000008  lw t1, 0(a0)                      IF ID EX ME WB\n" +
+		"0000000C  add t2, t1, t1                       IF ID -- EX ME WB\n" +
+		"00000010  ebreak                                  IF -- ID EX ME WB\n"
+	if diagram.String() != want {
+		t.Errorf("diagram:\n%s\nwant\n%s", diagram.String(), want)
+	}
+	if cpu.Regs[T2] != 2*0x7F0 {
+		t.Errorf("t2 = 0x%X, want 0x%X", cpu.Regs[T2], 2*0x7F0)
+	}
+}
+
+// a taken branch flushes the configured number of instructions fetched behind it, and one
+// that isn't taken flushes nothing
+func TestPipelineBranchFlush(t *testing.T) {
+	branch := func(taken bool) func(b *Builder) {
+		return func(b *Builder) {
+			if taken {
+				b.Li(T0, 1)
+			} else {
+				b.Li(T0, 0)
+			}
+			b.Bnez(T0, "target")
+			b.Nop()
+			b.Nop()
+			b.Label("target")
+			b.Ebreak()
+		}
+	}
+	for _, tt := range []struct {
+		taken   bool
+		flush   int
+		flushes uint64
+	}{
+		{true, DefaultPipelineFlush, 2},
+		{true, 1, 1},
+		{true, 3, 3},
+		{false, DefaultPipelineFlush, 0},
+	} {
+		_, stats := runPipeline(t, PipelineConfig{Forwarding: true, Flush: tt.flush}, branch(tt.taken))
+		if stats.Flushes != tt.flushes || stats.Stalls != 0 {
+			t.Errorf("taken %v, flush %d: %d cycles flushed and %d stalled, want %d and none", tt.taken, tt.flush, stats.Flushes, stats.Stalls, tt.flushes)
+		}
+	}
+}
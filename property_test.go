@@ -0,0 +1,152 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// ============================================================================
+// Property tests
+// ============================================================================
+// identities the ISA guarantees, checked over random operands. testing/quick
+// reports the operands of a case that fails. (MULH and MUL reconstructing the
+// 64-bit product would belong here too, once the M extension is implemented)
+
+// propertyConfig runs each property, whose operands are all uint32, a few
+// thousand times. the generator favours values near 0 and the most negative
+// one, where sign bugs live
+var propertyConfig = &quick.Config{
+	MaxCount: 4000,
+	Values: func(args []reflect.Value, rnd *rand.Rand) {
+		for i := range args {
+			var v uint32
+			switch rnd.Intn(4) {
+			case 0:
+				v = uint32(rnd.Intn(9)) - 4 // -4 to 4
+			case 1:
+				v = 0x80000000 + uint32(rnd.Intn(9)) - 4 // around the most negative value
+			default:
+				v = rnd.Uint32()
+			}
+			args[i] = reflect.ValueOf(v)
+		}
+	},
+}
+
+// propertyPC is where the instructions run
+const propertyPC = 0x100
+
+// execOperands executes instrs one after another on a fresh CPU whose a0 and a1 hold a and b
+func execOperands(t *testing.T, a, b uint32, instrs ...uint32) *CPU {
+	t.Helper()
+	cpu := NewCPUWithMemory(0x200)
+	cpu.Regs[A0], cpu.Regs[A1] = a, b
+	cpu.PC = propertyPC
+	for _, instr := range instrs {
+		cpu.PC += 4
+		if err := cpu.Execute(instr); err != nil {
+			t.Fatalf("0x%08X: %v", instr, err)
+		}
+	}
+	return &cpu
+}
+
+func checkProperty(t *testing.T, property any) {
+	t.Helper()
+	if err := quick.Check(property, propertyConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddSubInverse(t *testing.T) {
+	add := encodeR(OP, A2, 0x0, A0, A1, 0x00) // a2 = a0 + a1
+	sub := encodeR(OP, A3, 0x0, A2, A1, 0x20) // a3 = a2 - a1
+	checkProperty(t, func(a, b uint32) bool {
+		return execOperands(t, a, b, add, sub).Regs[A3] == a
+	})
+	subFirst := encodeR(OP, A2, 0x0, A0, A1, 0x20)
+	addBack := encodeR(OP, A3, 0x0, A2, A1, 0x00)
+	checkProperty(t, func(a, b uint32) bool {
+		return execOperands(t, a, b, subFirst, addBack).Regs[A3] == a
+	})
+}
+
+func TestAddiNegativeIsSub(t *testing.T) {
+	checkProperty(t, func(a, imm uint32) bool {
+		magnitude := imm%2048 + 1 // 1 to 2048, so -magnitude fits the 12-bit immediate
+		addi := encodeI(OP_IMM, A2, 0x0, A0, -magnitude&0xFFF)
+		sub := encodeR(OP, A3, 0x0, A0, A1, 0x20)
+		cpu := execOperands(t, a, magnitude, addi, sub)
+		return cpu.Regs[A2] == cpu.Regs[A3] && cpu.Regs[A2] == a-magnitude
+	})
+}
+
+// bge and bgeu are the only "greater or equal" comparisons in RV32I, so SGE is a taken branch
+func TestSltIsNotSge(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		funct3 uint32 // of slt or sltu
+		branch uint32 // the matching bge or bgeu
+		less   func(a, b uint32) bool
+	}{
+		{"slt", 0x2, 0x5, func(a, b uint32) bool { return int32(a) < int32(b) }},
+		{"sltu", 0x3, 0x7, func(a, b uint32) bool { return a < b }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			slt := encodeR(OP, A2, c.funct3, A0, A1, 0)
+			bge := encodeB(BRANCH, c.branch, A0, A1, 0x40)
+			checkProperty(t, func(a, b uint32) bool {
+				cpu := execOperands(t, a, b, slt, bge)
+				taken := cpu.PC == propertyPC+4+0x40
+				return (cpu.Regs[A2] == 1) == !taken && (cpu.Regs[A2] == 1) == c.less(a, b)
+			})
+		})
+	}
+}
+
+func TestShiftsTwosComplement(t *testing.T) {
+	// shifting right arithmetically is dividing by a power of two, rounding down
+	checkProperty(t, func(a, shamt uint32) bool {
+		s := shamt % 32
+		sra := encodeR(OP, A2, 0x5, A0, A1, 0x20)
+		srai := encodeI(OP_IMM, A3, 0x5, A0, s|0x400)
+		cpu := execOperands(t, a, s, sra, srai)
+		want := uint32(int32(a) >> s)
+		floor := int64(int32(a)) / (1 << s)
+		if int64(int32(a))%(1<<s) < 0 {
+			floor--
+		}
+		return cpu.Regs[A2] == want && cpu.Regs[A3] == want && int64(int32(cpu.Regs[A2])) == floor
+	})
+	// for a negative number, SRA then SLL clears the low bits and keeps the sign,
+	// while SRL fills with zeros; only the register's low 5 bits count
+	checkProperty(t, func(a, amount uint32) bool {
+		a |= 0x80000000
+		s := amount & 0x1F
+		sra := encodeR(OP, A2, 0x5, A0, A1, 0x20)
+		sll := encodeR(OP, A3, 0x1, A2, A1, 0x00)
+		srl := encodeR(OP, A4, 0x5, A0, A1, 0x00)
+		cpu := execOperands(t, a, amount, sra, sll, srl)
+		return cpu.Regs[A3] == a&^(1<<s-1) && int32(cpu.Regs[A2]) < 0 && cpu.Regs[A4] == a>>s
+	})
+}
+
+// sltiu sign-extends its immediate, then compares unsigned: -1 is 0xFFFFFFFF, so
+// sltiu rd, rs, -1 is 1 for anything but 0xFFFFFFFF, and sltiu rd, rs, 1 is seqz
+func TestSltiuSignExtends(t *testing.T) {
+	checkProperty(t, func(a, imm uint32) bool {
+		imm12 := imm & 0xFFF
+		sltiu := encodeI(OP_IMM, A2, 0x3, A0, imm12)
+		want := uint32(0)
+		if a < SignExtend(imm12, 11) {
+			want = 1
+		}
+		return execOperands(t, a, 0, sltiu).Regs[A2] == want
+	})
+	checkProperty(t, func(a uint32) bool {
+		cpu := execOperands(t, a, 0, encodeI(OP_IMM, A2, 0x3, A0, 0xFFF), encodeI(OP_IMM, A3, 0x3, A0, 1))
+		return (cpu.Regs[A2] == 1) == (a != 0xFFFFFFFF) && (cpu.Regs[A3] == 1) == (a == 0)
+	})
+}
@@ -5,7 +5,7 @@ const (
 	ZERO = iota // zero register
 	RA   = iota // return address
 	SP   = iota // stack pointer - set, but not used
-	GP   = iota // global pointer - not used
+	GP   = iota // global pointer - set from __global_pointer$ by LoadELF
 	TP   = iota // thread pointer - not used
 	T0   = iota // temporary register (t0-t6)
 	T1   = iota
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RunReport is the document `run --json` writes to stdout when the program stops.
+// the schema is (all numbers are unsigned decimal JSON numbers):
+//
+//	{
+//	  "stop_reason": "instruction limit",   // StopReason.String() of why Run returned
+//	  "error": "pc 0x00010000 is ...",       // only present when execution failed
+//	  "exit_code": 0,                        // only present when the program exited
+//	  "retired": 5,                          // instructions executed
+//	  "cycles": 7,                           // mcycle (the same as retired without a cycle model)
+//	  "pc": 20,                              // program counter when execution stopped
+//	  "registers": {"zero": 0, "ra": 0, ...}, // all 32 registers keyed by ABI name
+//	  "csrs": {"minstret": 5, ...},          // selected control and status registers
+//	  "memory": [                            // one entry per --dump-mem, in flag order
+//	    {"addr": 0, "len": 8, "data": "3755341293..."} // data is lowercase hex, lowest address first
+//	  ],
+//	  "pipeline": {"instructions": 5, "cycles": 11, "stalls": 2, "flushes": 0}, // only with --pipeline
+//	  "caches": {                            // only with a cache model, each cache only if modelled
+//	    "icache": {"accesses": 5, "hits": 4, "misses": 1, "evictions": 0},
+//	    "dcache": {"accesses": 2, "hits": 1, "misses": 1, "evictions": 0}
+//	  },
+//	  "branches": {"predictor": "2bit", "branches": 10, "predicted": 8, // only with --branch-predictor
+//	    "sites": [{"pc": 12, "executed": 10, "taken": 9, "predicted": 8}]} // the most executed first
+//	}
+type RunReport struct {
+	StopReason string            `json:"stop_reason"`
+	Error      string            `json:"error,omitempty"`
+	ExitCode   *int              `json:"exit_code,omitempty"`
+	Retired    uint64            `json:"retired"`
+	Cycles     uint64            `json:"cycles"`
+	PC         uint32            `json:"pc"`
+	Registers  map[string]uint32 `json:"registers"`
+	CSRs       map[string]uint32 `json:"csrs"`
+	Memory     []MemoryDump      `json:"memory,omitempty"`
+	Pipeline   *PipelineStats    `json:"pipeline,omitempty"` // with --pipeline
+	Caches     *CacheReport      `json:"caches,omitempty"`   // with --icache, --dcache or the machine file's caches
+	Branches   *BranchStats      `json:"branches,omitempty"` // with --branch-predictor
+}
+
+// MemoryDump is a range of guest memory requested with --dump-mem addr:len
+type MemoryDump struct {
+	Addr uint32 `json:"addr"`
+	Len  uint32 `json:"len"`
+	Data string `json:"data"`
+}
+
+// memRange is one --dump-mem argument
+type memRange struct {
+	addr, len uint32
+}
+
+// memRangesFlag collects repeated --dump-mem addr:len flags
+type memRangesFlag []memRange
+
+func (m *memRangesFlag) String() string {
+	parts := make([]string, len(*m))
+	for i, r := range *m {
+		parts[i] = fmt.Sprintf("0x%X:%d", r.addr, r.len)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *memRangesFlag) Set(s string) error {
+	addrStr, lenStr, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("%q is not addr:len", s)
+	}
+	addr, err := strconv.ParseUint(addrStr, 0, 32)
+	if err != nil {
+		return fmt.Errorf("bad address in %q", s)
+	}
+	length, err := strconv.ParseUint(lenStr, 0, 32)
+	if err != nil {
+		return fmt.Errorf("bad length in %q", s)
+	}
+	*m = append(*m, memRange{uint32(addr), uint32(length)})
+	return nil
+}
+
+// NewRunReport captures the final state of cpu after Run returned reason and err
+func NewRunReport(cpu *CPU, reason StopReason, err error, ranges []memRange) (RunReport, error) {
+	report := RunReport{
+		StopReason: reason.String(),
+		Retired:    cpu.Retired,
+		Cycles:     cpu.cycles(),
+		PC:         uint32(cpu.PC),
+		Registers:  make(map[string]uint32, len(cpu.RegNames)),
+		CSRs:       selectedCSRs(cpu),
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	if cpu.Exited {
+		code := cpu.ExitCode
+		report.ExitCode = &code
+	}
+	for i, name := range cpu.RegNames {
+		report.Registers[name] = cpu.Regs[i]
+	}
+	for _, r := range ranges {
+		data, err := cpu.ReadMemory(r.addr, r.len)
+		if err != nil {
+			return report, fmt.Errorf("memory range 0x%08X:%d is outside memory", r.addr, r.len)
+		}
+		report.Memory = append(report.Memory, MemoryDump{
+			Addr: r.addr,
+			Len:  r.len,
+			Data: hex.EncodeToString(data),
+		})
+	}
+	return report, nil
+}
+
+// reportedCSRs are the CSRs included in the report
+var reportedCSRs = []uint32{CSR_MSTATUS, CSR_MIE, CSR_MIP, CSR_MTVEC, CSR_MEPC, CSR_MCAUSE, CSR_MTVAL, CSR_MCYCLE, CSR_MINSTRET}
+
+// selectedCSRs returns the values of reportedCSRs keyed by name
+func selectedCSRs(cpu *CPU) map[string]uint32 {
+	csrs := make(map[string]uint32, len(reportedCSRs))
+	for _, addr := range reportedCSRs {
+		v, _ := cpu.ReadCSR(addr) // all of them are implemented
+		csrs[CSRNames[addr]] = v
+	}
+	return csrs
+}
+
+// WriteJSON writes the report as a single indented JSON document
+func (r RunReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ============================================================================
+// riscv-tests
+// ============================================================================
+// `riscv-emu riscv-tests [dir]` runs the rv32ui-p-* binaries built by the
+// riscv-tests repository (https://github.com/riscv-software-src/riscv-tests),
+// the standard conformance check for the base integer instructions. they're
+// linked for RAM at 0x80000000 and report through HTIF: tohost = 1 is a pass,
+// testnum<<1|1 says which numbered case inside the test failed.
+//
+// the binaries aren't part of this repository. the directory comes from the
+// argument or the RISCV_TESTS environment variable (e.g. riscv-tests/isa after
+// building them) and, when there's none, the command says so and succeeds, so
+// it can sit in a script that runs on machines without them.
+//
+// rv32ui.expected lists the tests that must pass. a listed test failing is
+// a regression and makes the command fail; the result of any other test is only
+// reported, so a test added upstream, or for something not implemented yet,
+// doesn't break the run. when one starts passing, add it to the list
+
+//go:embed rv32ui.expected
+var rv32uiExpectedFile string
+
+// rv32uiExpected are the tests (without the rv32ui-p- prefix) expected to pass
+var rv32uiExpected = parseExpected(rv32uiExpectedFile)
+
+// parseExpected returns the names in an expectations file, one per line,
+// skipping blank lines and # comments
+func parseExpected(file string) []string {
+	var names []string
+	for _, line := range strings.Split(file, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			names = append(names, line)
+		}
+	}
+	return names
+}
+
+// the machine the tests are linked for
+const (
+	riscvTestsRAMBase = 0x80000000
+	riscvTestsMemSize = 1 << 20
+)
+
+// runRISCVTest runs the test binary at path and returns nil if it passed
+func runRISCVTest(path string, maxInstructions uint64) error {
+	cpu, err := loadRISCVTest(path)
+	if err != nil {
+		return err
+	}
+	reason, err := cpu.Run(maxInstructions)
+	switch {
+	case err != nil:
+		return err
+	case reason == StopExit && cpu.ExitCode == 0:
+		return nil
+	case reason == StopExit:
+		return fmt.Errorf("test %d failed", cpu.ExitCode)
+	}
+	return fmt.Errorf("stopped: %s after %d instructions at pc=0x%08X", reason, cpu.Retired, cpu.PC)
+}
+
+// loadRISCVTest returns a CPU with opts, set up the way the riscv-tests expect
+// and with the test binary at path loaded
+func loadRISCVTest(path string, opts ...Option) (*CPU, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	machine := DefaultMachine()
+	machine.RAMBase = riscvTestsRAMBase
+	machine.MemSize = riscvTestsMemSize
+	cpu, err := machine.NewCPU(append([]Option{WithConsole(nil, io.Discard)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	image, err := cpu.LoadELF(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	tohost, ok := image.Symbols["tohost"]
+	if !ok {
+		return nil, errors.New("no tohost symbol")
+	}
+	WithHTIF(tohost)(cpu)
+	return cpu, nil
+}
+
+// riscvTestPaths returns the rv32ui-p-* binaries in dir, leaving out their objdump listings
+func riscvTestPaths(dir string) []string {
+	paths, _ := filepath.Glob(filepath.Join(dir, "rv32ui-p-*"))
+	return slices.DeleteFunc(paths, func(p string) bool { return strings.HasSuffix(p, ".dump") })
+}
+
+func cmdRISCVTests(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("riscv-tests", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: riscv-emu riscv-tests [flags] [dir]")
+		fmt.Fprintln(stderr)
+		fmt.Fprintln(stderr, "runs the rv32ui-p-* binaries of riscv-tests found in dir ($RISCV_TESTS if not given)")
+		fmt.Fprintln(stderr, "and fails if one that is expected to pass doesn't")
+		fmt.Fprintln(stderr)
+		fs.PrintDefaults()
+	}
+	maxInstructions := fs.Uint64("max-instructions", 1_000_000, "give up on a test after this many instructions")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fmt.Fprintln(stderr, "riscv-emu riscv-tests: takes at most one directory")
+		return 2
+	}
+
+	dir := os.Getenv("RISCV_TESTS")
+	if fs.NArg() == 1 {
+		dir = fs.Arg(0)
+	}
+	if dir == "" {
+		fmt.Fprintln(stdout, "no riscv-tests directory given (pass one or set RISCV_TESTS), skipping")
+		return 0
+	}
+	paths := riscvTestPaths(dir)
+	if len(paths) == 0 {
+		fmt.Fprintf(stdout, "no rv32ui-p-* tests in %s, skipping\n", dir)
+		return 0
+	}
+
+	var passed, failed, regressions int
+	for _, path := range paths {
+		name := filepath.Base(path)
+		expected := slices.Contains(rv32uiExpected, strings.TrimPrefix(name, "rv32ui-p-"))
+		err := runRISCVTest(path, *maxInstructions)
+		switch {
+		case err == nil && expected:
+			fmt.Fprintf(stdout, "PASS  %s\n", name)
+		case err == nil:
+			fmt.Fprintf(stdout, "PASS  %s (not expected to, add it to rv32ui.expected)\n", name)
+		case expected:
+			fmt.Fprintf(stdout, "FAIL  %s: %v (regression)\n", name, err)
+			regressions++
+		default:
+			fmt.Fprintf(stdout, "FAIL  %s: %v (expected)\n", name, err)
+		}
+		if err == nil {
+			passed++
+		} else {
+			failed++
+		}
+	}
+	fmt.Fprintf(stdout, "%d passed, %d failed, %d regressions\n", passed, failed, regressions)
+	if regressions > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestRISCVTests runs the real rv32ui-p-* binaries from $RISCV_TESTS, and is
+// skipped when they aren't there
+func TestRISCVTests(t *testing.T) {
+	dir := os.Getenv("RISCV_TESTS")
+	if dir == "" {
+		t.Skip("RISCV_TESTS isn't set")
+	}
+	paths := riscvTestPaths(dir)
+	if len(paths) == 0 {
+		t.Skipf("no rv32ui-p-* tests in %s", dir)
+	}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		t.Run(strings.TrimPrefix(name, "rv32ui-p-"), func(t *testing.T) {
+			err := runRISCVTest(path, 1_000_000)
+			expected := slices.Contains(rv32uiExpected, strings.TrimPrefix(name, "rv32ui-p-"))
+			switch {
+			case err != nil && expected:
+				t.Errorf("%s: %v (regression)", name, err)
+			case err != nil:
+				t.Logf("%s: %v (expected)", name, err)
+			case !expected:
+				t.Logf("%s passes but isn't in rv32ui.expected", name)
+			}
+		})
+	}
+}
+
+// riscvTestELF is a stand-in for a riscv-tests binary: it stores result to tohost
+func riscvTestELF(t *testing.T, result int32) []byte {
+	var tohost uint32 = riscvTestsRAMBase + 0x100
+	image := assemble(t, func(b *Builder) {
+		b.Li(T0, int32(tohost))
+		b.Li(T1, result)
+		b.Sw(T1, T0, 0)
+		b.Label("hang")
+		b.J("hang")
+	})
+	return buildELF(image, riscvTestsRAMBase, map[string]uint32{"tohost": tohost})
+}
+
+func TestParseExpected(t *testing.T) {
+	got := parseExpected("# comment\nadd\n\n  sub \n#lw\n")
+	if !slices.Equal(got, []string{"add", "sub"}) {
+		t.Errorf("parseExpected = %q", got)
+	}
+	if !slices.Contains(rv32uiExpected, "simple") || slices.ContainsFunc(rv32uiExpected, func(s string) bool { return strings.HasPrefix(s, "#") }) {
+		t.Errorf("rv32ui.expected parsed as %q", rv32uiExpected)
+	}
+}
+
+func TestCmdRISCVTests(t *testing.T) {
+	t.Setenv("RISCV_TESTS", "")
+	if code, stdout, _ := runCommand("riscv-tests"); code != 0 || !strings.Contains(stdout, "skipping") {
+		t.Errorf("without a directory: exit %d, %q", code, stdout)
+	}
+	if code, stdout, _ := runCommand("riscv-tests", t.TempDir()); code != 0 || !strings.Contains(stdout, "no rv32ui-p-* tests") {
+		t.Errorf("with an empty directory: exit %d, %q", code, stdout)
+	}
+
+	// add is expected to pass, mul (not implemented) isn't
+	dir := t.TempDir()
+	write := func(name string, result int32) {
+		if err := os.WriteFile(filepath.Join(dir, name), riscvTestELF(t, result), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("rv32ui-p-add", 1)
+	write("rv32ui-p-mul", 5)
+	write("rv32ui-p-add.dump", 0)
+
+	code, stdout, _ := runCommand("riscv-tests", dir)
+	if code != 0 {
+		t.Errorf("exit %d, want 0:\n%s", code, stdout)
+	}
+	for _, want := range []string{"PASS  rv32ui-p-add\n", "FAIL  rv32ui-p-mul: test 2 failed (expected)", "1 passed, 1 failed, 0 regressions"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("output lacks %q:\n%s", want, stdout)
+		}
+	}
+
+	// through the environment variable, and with a listed test failing
+	write("rv32ui-p-add", 7)
+	t.Setenv("RISCV_TESTS", dir)
+	code, stdout, _ = runCommand("riscv-tests")
+	if code != 1 || !strings.Contains(stdout, "FAIL  rv32ui-p-add: test 3 failed (regression)") {
+		t.Errorf("regression: exit %d:\n%s", code, stdout)
+	}
+}
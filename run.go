@@ -0,0 +1,714 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// errUsageShown is returned by flag parsing once the error and the usage summary were already printed
+var errUsageShown = errors.New("usage shown")
+
+// controlShutdownTimeout bounds how long the end of a run waits for control requests in progress
+const controlShutdownTimeout = 10 * time.Second
+
+// stdin is where the --debug REPL reads its commands from
+var stdin io.Reader = os.Stdin
+
+// runOptions holds everything `run` needs, after flags and the machine file are combined
+type runOptions struct {
+	image           string
+	machine         MachineConfig
+	traceFormat     string // empty means tracing is off
+	traceOut        string // empty means stdout
+	maxInstructions uint64
+	timeout         time.Duration // stop running after this long, 0 for no limit
+	debug           bool
+	json            bool       // print a RunReport instead of the human summary
+	dumpMem         []memRange // memory ranges included in the RunReport
+	saveMem         []memFile  // memory ranges written to files when the run ends
+	verbose         bool       // log every executed instruction
+	syscalls        string     // ecall handler: "" for none, "newlib" or "linux"
+	sandbox         string     // host directory the linux syscalls may open files in
+	semihosting     bool       // serve semihosting calls made through ebreak
+	uartStdin       bool       // feed stdin to the UART
+	deterministic   bool       // see WithDeterministic
+	seed            uint64     // entropy seed in deterministic mode
+	uninit          string     // "", "warn" or "error": report reads of uninitialized memory
+	noDecodeCache   bool       // see WithoutDecodeCache
+	noBlockCache    bool       // see WithoutBlockCache
+	backend         Backend    // see WithBackend
+	noFastMemory    bool       // see WithoutFastMemory
+	pipeline        string     // "", "forward" or "stall": model the pipeline, with or without forwarding
+	pipelineFlush   int        // see PipelineConfig.Flush
+	pipelineDiagram bool       // draw the pipeline diagram
+	predictor       string     // "", or the branch predictor to model (see PredictorNames)
+	predictorSize   int        // counters of the 2bit predictor
+	control         string     // serve the control server here while running
+	gdb             string     // wait for gdb here and let it drive the run
+	check           bool       // validate the image instead of running it
+	signature       string     // write the architectural test signature to this file
+	loopThreshold   uint64     // see WithLoopDetection
+	gp              string     // "" for __global_pointer$, "none" or the value to start gp with
+	diagnostics     bool       // write a DiagnosticReport to stderr when execution fails
+	history         int        // instructions the History for the report keeps, 0 for none
+	coreDir         string     // write an ELF core file here when execution fails
+	selfcheck       bool       // run in lockstep with a reference, see SelfCheck
+}
+
+// guestError wraps an error raised by the guest program; the CPU's logger has already reported it
+type guestError struct {
+	err error
+}
+
+func (e *guestError) Error() string { return e.err.Error() }
+func (e *guestError) Unwrap() error { return e.err }
+
+// addrFlag is a uint32 flag value accepting decimal or 0x-prefixed hex
+type addrFlag uint32
+
+func (a *addrFlag) String() string { return fmt.Sprintf("0x%X", uint32(*a)) }
+
+func (a *addrFlag) Set(s string) error {
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return fmt.Errorf("%q is not a 32-bit number", s)
+	}
+	*a = addrFlag(v)
+	return nil
+}
+
+// traceFlag implements --trace[=format]: a bare --trace selects the human format
+type traceFlag string
+
+func (t *traceFlag) String() string { return string(*t) }
+
+func (t *traceFlag) Set(s string) error {
+	switch s {
+	case "true":
+		s = "human"
+	case "false":
+		s = ""
+	}
+	*t = traceFlag(s)
+	return nil
+}
+
+// IsBoolFlag lets the flag package accept --trace without a value
+func (t *traceFlag) IsBoolFlag() bool { return true }
+
+// parseRunFlags turns the arguments of `run` into options
+func parseRunFlags(args []string, stderr io.Writer) (runOptions, error) {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: riscv-emu run [flags] <image>")
+		fmt.Fprintln(stderr)
+		fmt.Fprintln(stderr, "loads an ELF executable or a raw binary image into memory and executes it;")
+		fmt.Fprintln(stderr, "when the program exits, its exit code becomes the exit code of riscv-emu")
+		fmt.Fprintln(stderr)
+		fmt.Fprintln(stderr, "flags:")
+		fs.PrintDefaults()
+	}
+
+	var (
+		defaults   = DefaultMachine()
+		ramBase    = addrFlag(defaults.RAMBase)
+		memSize    = addrFlag(defaults.MemSize)
+		loadAddr   = addrFlag(defaults.LoadAddr)
+		entry      = addrFlag(defaults.Entry)
+		stackLimit = addrFlag(defaults.StackLimit)
+		stackGuard = addrFlag(defaults.StackGuard)
+		romBase    = addrFlag(DefaultROMBase)
+		trace      traceFlag
+		opts       runOptions
+		machine    string
+		cycles     bool
+		dtb        bool
+		bootROM    bool
+		icache     string
+		dcache     string
+		dumpMem    memRangesFlag
+		saveMem    memFilesFlag
+	)
+	fs.Var(&ramBase, "ram-base", "address memory starts at")
+	fs.Var(&memSize, "mem-size", "memory size in bytes")
+	fs.Var(&loadAddr, "load-addr", "address the image is loaded at (0 means the start of memory)")
+	fs.Var(&entry, "entry", "initial program counter (0 means the start of memory)")
+	fs.BoolVar(&dtb, "dtb", false, "place a device tree describing the machine at the top of memory and pass its address in a1")
+	fs.BoolVar(&bootROM, "boot-rom", false, "start in a boot ROM that sets up sp, gp, a0 and a1 and jumps to the entry point (RAM must not cover --rom-base)")
+	fs.Var(&romBase, "rom-base", "with --boot-rom, the address of the boot ROM (the reset vector)")
+	fs.Var(&stackLimit, "stack-limit", "stop with a stack overflow error when a store through sp or fp goes below this address")
+	fs.Var(&stackGuard, "stack-guard", "with --stack-limit, also reject any store into this many bytes below the limit")
+	fs.Var(&trace, "trace", fmt.Sprintf("trace every instruction; --trace=<format> picks one of %v", TraceFormats))
+	fs.StringVar(&opts.traceOut, "trace-out", "", "write the trace to this file instead of stdout")
+	fs.Uint64Var(&opts.maxInstructions, "max-instructions", 0, "stop after this many instructions (0 means no limit)")
+	fs.DurationVar(&opts.timeout, "timeout", 0, "stop after running this long in wall-clock time, e.g. 10s (0 means no limit)")
+	fs.BoolVar(&opts.debug, "debug", false, "start an interactive debugger instead of running")
+	fs.StringVar(&opts.gdb, "gdb", "", "wait for gdb to connect on `addr` (host:port or unix:<path>) and let it drive the run (`target remote addr`)")
+	fs.StringVar(&machine, "machine", "", "JSON machine description (flags override its fields)")
+	fs.BoolVar(&cycles, "cycles", false, "estimate cycles with the default latency table (a machine file's \"cycles\" sets its own)")
+	fs.StringVar(&icache, "icache", "", "model an instruction cache of `size:line_size:ways` bytes, bytes and lines per set, and report its hits and misses")
+	fs.StringVar(&dcache, "dcache", "", "model a data cache of `size:line_size:ways` (see --icache)")
+	fs.BoolVar(&opts.json, "json", false, "print the final state as a JSON document on stdout (human output goes to stderr)")
+	fs.StringVar(&opts.syscalls, "syscalls", "", "emulate system calls made with ecall: `newlib` (bare-metal newlib programs) or linux (static linux binaries)")
+	fs.StringVar(&opts.sandbox, "sandbox", "", "with --syscalls=linux, the host `dir` the guest may open files in")
+	fs.BoolVar(&opts.semihosting, "semihosting", false, "serve RISC-V semihosting calls (slli/ebreak/srai sequences)")
+	fs.BoolVar(&opts.uartStdin, "uart-stdin", false, "send stdin to the UART's receiver")
+	fs.BoolVar(&opts.deterministic, "deterministic", false, "make runs reproducible: instruction-driven time, seeded entropy, no live UART input")
+	fs.Uint64Var(&opts.seed, "seed", 0, "entropy seed for --deterministic")
+	fs.StringVar(&opts.uninit, "uninit", "", "report loads and fetches of memory never written: `warn` (log each location once) or error (stop)")
+	fs.Uint64Var(&opts.loopThreshold, "detect-loops", 0, fmt.Sprintf("stop with an error once an instruction has jumped to itself this many times in a row without changing anything (0 means off, %d is a good start)", DefaultLoopThreshold))
+	fs.BoolVar(&opts.diagnostics, "diagnostics", true, "when execution fails, write a report of the error, registers and nearby memory to stderr")
+	fs.StringVar(&opts.coreDir, "core-dir", "", "when execution fails, write an ELF core file for gdb to `dir` (named after the image, with .core)")
+	fs.IntVar(&opts.history, "history", 0, fmt.Sprintf("keep the last `n` instructions and the open calls for the failure report (slower; %d is a good start)", DefaultHistorySize))
+	fs.StringVar(&opts.gp, "gp", "", "start gp at this `addr`, or none to leave it zero (default: an ELF file's __global_pointer$, zero for raw images)")
+	fs.BoolVar(&opts.noDecodeCache, "no-decode-cache", false, "decode every instruction each time it runs")
+	fs.StringVar(&opts.control, "control", "", "serve the HTTP control API while running, on `addr` (host:port or unix:<path>)")
+	fs.BoolVar(&opts.check, "check", false, "list problems Validate finds in the image and exit without running it (status 1 if there are errors)")
+	fs.BoolVar(&opts.noBlockCache, "no-block-cache", false, "execute one instruction at a time instead of whole basic blocks")
+	fs.BoolVar(&opts.noFastMemory, "no-fast-memory", false, "send aligned word loads and stores through the general memory path too")
+	fs.BoolVar(&opts.selfcheck, "selfcheck", false, "check every basic block against a plain reference interpreter running alongside, and stop at the first difference")
+	backend := fs.String("backend", "threaded", "how basic blocks are executed: `threaded` (compiled closures) or table (dispatch table)")
+	fs.StringVar(&opts.pipeline, "pipeline", "", "model a five-stage pipeline and report its cycles: `forward` (with forwarding) or stall (without)")
+	fs.IntVar(&opts.pipelineFlush, "pipeline-flush", DefaultPipelineFlush, "with --pipeline, instructions flushed after a taken branch or jump")
+	fs.BoolVar(&opts.pipelineDiagram, "pipeline-diagram", false, "with --pipeline, draw the pipeline diagram of the first 64 instructions")
+	fs.StringVar(&opts.predictor, "branch-predictor", "", fmt.Sprintf("model a branch predictor and report how often it's right, one of %v", PredictorNames))
+	fs.IntVar(&opts.predictorSize, "branch-predictor-size", DefaultPredictorSize, "with --branch-predictor=2bit, the number of counters (a power of two)")
+	fs.BoolVar(&opts.verbose, "verbose", false, "log every executed instruction to stderr")
+	fs.StringVar(&opts.signature, "signature", "", "write the region between the ELF's begin_signature and end_signature symbols to `path`, one hex word per line (riscv-arch-test)")
+	fs.Var(&dumpMem, "dump-mem", "include memory `addr:len` in the --json output (repeatable)")
+	fs.Var(&saveMem, "save-mem", "when the run ends, write memory `addr:len:path` to the file path as raw binary (repeatable)")
+
+	rest, err := parseInterspersed(fs, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return opts, err
+	}
+	if err != nil {
+		// the flag package has already printed the error and the usage
+		return opts, errUsageShown
+	}
+	if len(rest) != 1 {
+		fmt.Fprintln(stderr, "riscv-emu run: exactly one image file is required")
+		fs.Usage()
+		return opts, errUsageShown
+	}
+	opts.image = rest[0]
+	opts.traceFormat = string(trace)
+	opts.dumpMem = dumpMem
+	opts.saveMem = saveMem
+	if len(opts.dumpMem) > 0 && !opts.json {
+		return opts, errors.New("--dump-mem needs --json")
+	}
+	if opts.json && opts.debug {
+		return opts, errors.New("--json and --debug cannot be combined")
+	}
+	if opts.signature != "" && opts.debug {
+		return opts, errors.New("--signature and --debug cannot be combined")
+	}
+	if opts.timeout > 0 && opts.debug {
+		return opts, errors.New("--timeout and --debug cannot be combined")
+	}
+	if opts.selfcheck && (opts.debug || opts.timeout > 0) {
+		return opts, errors.New("--selfcheck cannot be combined with --debug or --timeout")
+	}
+	if opts.control != "" && opts.debug {
+		return opts, errors.New("--control and --debug cannot be combined")
+	}
+	if opts.gdb != "" && (opts.debug || opts.json || opts.signature != "" || opts.timeout > 0 || opts.selfcheck || opts.control != "") {
+		return opts, errors.New("--gdb cannot be combined with --debug, --json, --signature, --timeout, --selfcheck or --control")
+	}
+	switch opts.syscalls {
+	case "", "newlib", "linux":
+	default:
+		return opts, fmt.Errorf("unknown --syscalls %q (want newlib or linux)", opts.syscalls)
+	}
+	switch opts.uninit {
+	case "", "warn", "error":
+	default:
+		return opts, fmt.Errorf("unknown --uninit %q (want warn or error)", opts.uninit)
+	}
+	switch opts.pipeline {
+	case "", "forward", "stall":
+	default:
+		return opts, fmt.Errorf("unknown --pipeline %q (want forward or stall)", opts.pipeline)
+	}
+	if opts.gp != "" && opts.gp != "none" {
+		if _, err := strconv.ParseUint(opts.gp, 0, 32); err != nil {
+			return opts, fmt.Errorf("bad --gp %q (want an address or none)", opts.gp)
+		}
+	}
+	if opts.pipelineDiagram && opts.pipeline == "" {
+		return opts, errors.New("--pipeline-diagram needs --pipeline")
+	}
+	if opts.pipelineFlush < 0 {
+		return opts, errors.New("--pipeline-flush cannot be negative")
+	}
+	if opts.predictor != "" {
+		if _, err := NewBranchPredictor(opts.predictor, opts.predictorSize); err != nil {
+			return opts, err
+		}
+	}
+	if opts.backend, err = parseBackend(*backend); err != nil {
+		return opts, err
+	}
+	if opts.uartStdin && opts.deterministic {
+		return opts, errors.New("--uart-stdin cannot be combined with --deterministic")
+	}
+	if opts.sandbox != "" && opts.syscalls != "linux" {
+		return opts, errors.New("--sandbox needs --syscalls=linux")
+	}
+
+	opts.machine = defaults
+	if machine != "" {
+		if opts.machine, err = LoadMachineConfig(machine); err != nil {
+			return opts, err
+		}
+	}
+
+	// flags given explicitly win over the machine file
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "ram-base":
+			opts.machine.RAMBase = uint32(ramBase)
+		case "mem-size":
+			opts.machine.MemSize = uint32(memSize)
+		case "load-addr":
+			opts.machine.LoadAddr = uint32(loadAddr)
+		case "entry":
+			opts.machine.Entry = uint32(entry)
+		case "stack-limit":
+			opts.machine.StackLimit = uint32(stackLimit)
+		case "stack-guard":
+			opts.machine.StackGuard = uint32(stackGuard)
+		case "dtb":
+			opts.machine.DeviceTree = dtb
+		case "boot-rom":
+			opts.machine.BootROM = bootROM
+		case "rom-base":
+			opts.machine.ROMBase = uint32(romBase)
+		}
+	})
+	if cycles && opts.machine.Cycles == nil {
+		table := DefaultCycleTable()
+		opts.machine.Cycles = &table
+	}
+	for _, c := range []struct {
+		flag  string
+		value string
+		cfg   **CacheConfig
+	}{{"icache", icache, &opts.machine.ICache}, {"dcache", dcache, &opts.machine.DCache}} {
+		if c.value == "" {
+			continue
+		}
+		cfg, err := parseCacheConfig(c.value)
+		if err != nil {
+			return opts, fmt.Errorf("--%s: %w", c.flag, err)
+		}
+		*c.cfg = &cfg
+	}
+	if err := opts.machine.Validate(); err != nil {
+		return opts, err
+	}
+	if opts.traceFormat != "" {
+		if _, err := NewTracer(opts.traceFormat, io.Discard); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// parseInterspersed parses flags that may appear before or after positional arguments
+// (the flag package alone stops at the first non-flag argument)
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func cmdRun(args []string, stdout, stderr io.Writer) int {
+	opts, err := parseRunFlags(args, stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if errors.Is(err, errUsageShown) {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "riscv-emu run: %v\n", err)
+		return 2
+	}
+	code, err := runImage(opts, stdout, stderr)
+	if err != nil {
+		var ge *guestError
+		if !errors.As(err, &ge) {
+			fmt.Fprintf(stderr, "riscv-emu run: %v\n", err)
+		}
+		return 1
+	}
+	return code
+}
+
+// runImage builds the machine, loads the image and executes it according to opts.
+// it returns the program's exit code (0 unless it exited with another one)
+func runImage(opts runOptions, stdout, stderr io.Writer) (int, error) {
+	data, err := os.ReadFile(opts.image)
+	if err != nil {
+		return 0, err
+	}
+
+	// in --json mode stdout carries only the report
+	human := stdout
+	if opts.json {
+		human = stderr
+	}
+
+	var consoleIn io.Reader
+	if opts.uartStdin {
+		consoleIn = stdin
+	}
+	cpuOpts := []Option{WithConsole(consoleIn, human)}
+	if opts.deterministic {
+		cpuOpts = append(cpuOpts, WithDeterministic(opts.seed))
+	}
+	if opts.noDecodeCache {
+		cpuOpts = append(cpuOpts, WithoutDecodeCache())
+	}
+	if opts.noBlockCache {
+		cpuOpts = append(cpuOpts, WithoutBlockCache())
+	}
+	if opts.noFastMemory {
+		cpuOpts = append(cpuOpts, WithoutFastMemory())
+	}
+	cpuOpts = append(cpuOpts, WithBackend(opts.backend))
+	if opts.uninit != "" {
+		cpuOpts = append(cpuOpts, WithUninitCheck(opts.uninit == "error"))
+	}
+	if opts.loopThreshold > 0 {
+		cpuOpts = append(cpuOpts, WithLoopDetection(opts.loopThreshold))
+	}
+	switch opts.gp {
+	case "":
+	case "none":
+		cpuOpts = append(cpuOpts, WithoutGlobalPointer())
+	default:
+		gp, _ := strconv.ParseUint(opts.gp, 0, 32) // checked by parseRunFlags
+		cpuOpts = append(cpuOpts, WithGlobalPointer(uint32(gp)))
+	}
+	cpu, err := opts.machine.NewCPU(cpuOpts...)
+	if err != nil {
+		return 0, err
+	}
+	cpu.Logger = newLogger(stderr, opts.verbose)
+
+	// ELF files say where they go, raw images are copied to --load-addr
+	imageEnd := opts.machine.loadAddress() + uint32(len(data))
+	var signature Signature
+	if isELF(data) {
+		image, err := cpu.LoadELF(bytes.NewReader(data))
+		if err != nil {
+			return 0, fmt.Errorf("loading %s: %w", opts.image, err)
+		}
+		imageEnd = image.End
+		if opts.machine.DeviceTree && imageEnd > opts.machine.deviceTreeAddr(len(opts.machine.DeviceTreeBlob())) {
+			return 0, fmt.Errorf("loading %s: the image overlaps the device tree at the top of memory", opts.image)
+		}
+		if tohost, ok := image.Symbols["tohost"]; ok { // built for spike, see htif.go
+			WithHTIF(tohost)(cpu)
+		}
+		if opts.signature != "" {
+			if signature, err = signatureOf(image.Symbols); err != nil {
+				return 0, fmt.Errorf("--signature: %s: %w", opts.image, err)
+			}
+			if err := cpu.checkRange(signature.Begin, signature.End-signature.Begin); err != nil {
+				return 0, fmt.Errorf("--signature: %w", err)
+			}
+		}
+	} else if opts.signature != "" {
+		return 0, errors.New("--signature needs an ELF file")
+	} else if err := cpu.LoadProgramAt(data, opts.machine.loadAddress()); err != nil {
+		return 0, err
+	}
+
+	if opts.check {
+		return checkImage(cpu, stdout), nil
+	}
+
+	heapStart := (imageEnd + 0xF) &^ 0xF
+	switch opts.syscalls {
+	case "newlib":
+		cpu.EcallHook = NewNewlibSyscalls(stdin, human, stderr, heapStart, cpu.Regs[SP]).Handle
+	case "linux":
+		// leave the stack some room below the initial sp before anonymous mappings start
+		heapLimit := cpu.Regs[SP] - min(cpu.Regs[SP]/4, linuxStackReserve)
+		syscalls := NewLinuxSyscalls(stdin, human, stderr, heapStart, heapLimit)
+		syscalls.LogUnknown = true
+		if opts.sandbox != "" {
+			if syscalls.Root, err = os.OpenRoot(opts.sandbox); err != nil {
+				return 0, err
+			}
+			defer syscalls.Root.Close()
+		}
+		defer syscalls.Close()
+		cpu.EcallHook = syscalls.Handle
+	}
+
+	if opts.semihosting {
+		cpu.EbreakHook = NewSemihosting(stdin, human, stderr).Handle
+	}
+	if opts.machine.BootROM {
+		if err := cpu.BootFromROM(); err != nil {
+			return 0, err
+		}
+	}
+
+	if opts.traceFormat != "" {
+		w := human
+		if opts.traceOut != "" {
+			f, err := os.Create(opts.traceOut)
+			if err != nil {
+				return 0, err
+			}
+			defer f.Close()
+			w = f
+		}
+		if cpu.Tracer, err = NewTracer(opts.traceFormat, w); err != nil {
+			return 0, err
+		}
+	}
+	var pipeline *Pipeline
+	if opts.pipeline != "" {
+		cfg := PipelineConfig{Forwarding: opts.pipeline == "forward", Flush: opts.pipelineFlush}
+		if opts.pipelineDiagram {
+			cfg.Diagram = human
+		}
+		pipeline = NewPipeline(cfg)
+		addTracer(cpu, pipeline)
+	}
+	var branches *BranchModel
+	if opts.predictor != "" {
+		predictor, err := NewBranchPredictor(opts.predictor, opts.predictorSize)
+		if err != nil {
+			return 0, err
+		}
+		branches = NewBranchModel(opts.predictor, predictor)
+		addTracer(cpu, branches)
+	}
+	var history *History
+	if opts.history > 0 {
+		history = NewHistory(opts.history)
+		addTracer(cpu, history)
+	}
+
+	if opts.debug {
+		return cpu.ExitCode, NewDebugger(cpu, stdin, stdout, opts.maxInstructions).Loop()
+	}
+	if opts.gdb != "" {
+		ln, err := ListenControl(opts.gdb)
+		if err != nil {
+			return 0, err
+		}
+		fmt.Fprintf(stderr, "waiting for gdb on %s\n", ln.Addr())
+		conn, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		return cpu.ExitCode, NewGDBStub(cpu, conn, opts.maxInstructions).Serve()
+	}
+
+	for _, r := range opts.dumpMem {
+		if cpu.checkRange(r.addr, r.len) != nil {
+			return 0, fmt.Errorf("--dump-mem 0x%08X:%d is outside memory", r.addr, r.len)
+		}
+	}
+	for _, f := range opts.saveMem {
+		if err := cpu.checkBus(f.addr, f.len); err != nil {
+			return 0, fmt.Errorf("--save-mem: %w", err)
+		}
+	}
+
+	var control *http.Server
+	if opts.control != "" {
+		ln, err := ListenControl(opts.control)
+		if err != nil {
+			return 0, err
+		}
+		control = &http.Server{Handler: NewControlServer(cpu)}
+		go control.Serve(ln)
+	}
+
+	caches, _ := cpu.Observer.(*CacheModel)
+	var reason StopReason
+	var runErr error
+	if opts.selfcheck {
+		reason, runErr = cpu.SelfCheck(opts.maxInstructions, nil)
+	} else if opts.timeout > 0 {
+		reason, runErr = cpu.RunWithTimeout(opts.maxInstructions, opts.timeout)
+	} else {
+		reason, runErr = cpu.Run(opts.maxInstructions)
+	}
+	if control != nil {
+		// nothing may touch the CPU once Run is no longer its owner: Shutdown stops
+		// accepting requests and waits for the ones being served (they're all short)
+		ctx, cancel := context.WithTimeout(context.Background(), controlShutdownTimeout)
+		err := control.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			return 0, fmt.Errorf("stopping the control server: %w", err)
+		}
+	}
+	if runErr != nil {
+		if opts.diagnostics {
+			if err := NewDiagnosticReport(cpu, runErr, history).Write(stderr); err != nil {
+				return 0, err
+			}
+		}
+		if opts.coreDir != "" {
+			path := filepath.Join(opts.coreDir, filepath.Base(opts.image)+".core")
+			if err := cpu.DumpCore(path, runErr); err != nil {
+				return 0, err
+			}
+			fmt.Fprintf(stderr, "core dumped to %s\n", path)
+		}
+		runErr = &guestError{runErr}
+	}
+	for _, f := range opts.saveMem {
+		if err := cpu.DumpMemory(f.path, f.addr, f.len); err != nil {
+			return 0, err
+		}
+	}
+	if opts.signature != "" {
+		if err := writeSignatureFile(cpu, opts.signature, signature); err != nil {
+			return 0, err
+		}
+	}
+	if opts.json {
+		report, err := NewRunReport(cpu, reason, runErr, opts.dumpMem)
+		if err != nil {
+			return 0, err
+		}
+		if pipeline != nil {
+			stats := pipeline.Stats()
+			report.Pipeline = &stats
+		}
+		if caches != nil {
+			r := caches.Report()
+			report.Caches = &r
+		}
+		if branches != nil {
+			stats := branches.Stats()
+			report.Branches = &stats
+		}
+		if err := report.WriteJSON(stdout); err != nil {
+			return 0, err
+		}
+		return cpu.ExitCode, runErr
+	}
+
+	count := fmt.Sprintf("%d instructions", cpu.Retired)
+	if cpu.cycleModel != nil {
+		count += fmt.Sprintf(" (%d cycles)", cpu.Cycles)
+	}
+	if pipeline != nil {
+		fmt.Fprintf(human, "pipeline: %s\n", pipeline.Stats())
+	}
+	if caches != nil {
+		r := caches.Report()
+		if r.ICache != nil {
+			fmt.Fprintf(human, "icache: %s\n", r.ICache)
+		}
+		if r.DCache != nil {
+			fmt.Fprintf(human, "dcache: %s\n", r.DCache)
+		}
+	}
+	if branches != nil {
+		printBranchStats(human, branches.Stats())
+	}
+	if reason == StopExit {
+		fmt.Fprintf(human, "exited with code %d after %s\n", cpu.ExitCode, count)
+		return cpu.ExitCode, nil
+	}
+	fmt.Fprintf(human, "stopped: %s after %s at pc=0x%08X\n", reason, count, cpu.PC)
+	if runErr == nil || !opts.diagnostics { // the report has the registers already
+		printRegisters(human, cpu)
+	}
+	return cpu.ExitCode, runErr
+}
+
+// writeSignatureFile writes the signature region s to the file at path
+func writeSignatureFile(cpu *CPU, path string, s Signature) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := cpu.WriteSignature(f, s); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// addTracer installs t next to the CPU's tracer, if it has one
+func addTracer(cpu *CPU, t Tracer) {
+	if cpu.Tracer != nil {
+		cpu.Tracer = MultiTracer(cpu.Tracer, t)
+	} else {
+		cpu.Tracer = t
+	}
+}
+
+// printBranchStats prints the branch predictor's totals and its most executed sites
+func printBranchStats(w io.Writer, stats BranchStats) {
+	fmt.Fprintf(w, "branches: %s\n", stats)
+	const shown = 10
+	for _, site := range stats.Sites[:min(len(stats.Sites), shown)] {
+		fmt.Fprintf(w, "  0x%08X  %d executed, %d taken, %.2f%% predicted\n",
+			site.PC, site.Executed, site.Taken, 100*site.Accuracy())
+	}
+	if len(stats.Sites) > shown {
+		fmt.Fprintf(w, "  (%d more sites, --json lists them all)\n", len(stats.Sites)-shown)
+	}
+}
+
+// checkImage prints the issues in the loaded image, returning 1 if any is an error
+func checkImage(cpu *CPU, w io.Writer) int {
+	issues := Validate(cpu)
+	status := 0
+	for _, issue := range issues {
+		fmt.Fprintln(w, issue)
+		if issue.Severity == SeverityError {
+			status = 1
+		}
+	}
+	fmt.Fprintf(w, "%d issues found\n", len(issues))
+	return status
+}
+
+// newLogger returns the CLI's logger: warnings and errors always, every step with verbose
+func newLogger(w io.Writer, verbose bool) *slog.Logger {
+	level := slog.LevelWarn
+	if verbose {
+		level = slog.LevelDebug
+	}
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}))
+}
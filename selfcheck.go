@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// ============================================================================
+// Lockstep self-check
+// ============================================================================
+// SelfCheck runs the machine the way Run does (basic blocks on its backend, the
+// decode cache, the fast memory path) next to a reference copy of it that goes
+// through Step one instruction at a time with none of those, and compares the
+// two after every block: the PC, the registers, the CSRs and counters, the bytes
+// either of them wrote (MemoryWritten notes them), and at the end all of RAM.
+// the first difference stops the run with a *Divergence naming the instruction
+// it blames:
+//   - a differing register: the last instruction of the block that wrote it
+//   - differing memory: the last store of the block to those bytes
+//   - anything else: the block's last instruction
+//
+// what the two machines can't both do is done once, by the machine under test:
+//   - ecall and ebreak hooks (a syscall must not happen twice). the reference is
+//     brought up to the hook and compared with the machine under test (the
+//     registers, and the bytes written so far in the block); once the hook has
+//     run, the reference takes the registers, the bytes the hook wrote and the
+//     halt from the machine under test
+//   - output: the reference's UART and console writes are discarded
+//
+// time must read the same on both, so SelfCheck switches the machine to
+// deterministic time for good: mtime counts instructions (at the machine's rate)
+// from where it was, and the RTC follows it like with WithDeterministic.
+//
+// the reference ticks devices and takes interrupts between instructions, the
+// machine under test between blocks (see blocks.go), so a program taking
+// interrupts may diverge by that much. WithDeterministic (or WithoutBlockCache)
+// keeps blocks out of it, which still checks the decode cache and fast memory
+
+// Divergence is the error SelfCheck stops with when the machines disagree
+type Divergence struct {
+	PC      uint32   // the instruction blamed for the difference
+	Instr   uint32   // its encoding
+	Block   uint32   // the first instruction the machine under test ran in one go with it
+	Retired uint64   // instructions the reference had retired when the difference was found
+	Diffs   []string // what differs, as "<what>: checked <value>, reference <value>"
+}
+
+func (d *Divergence) Error() string {
+	text, ok := Disassemble(d.Instr, d.PC)
+	if !ok {
+		text = fmt.Sprintf(".word 0x%08X", d.Instr)
+	}
+	return fmt.Sprintf("selfcheck: diverged from the reference at pc=0x%08X (%s, in the block at 0x%08X, after %d instructions): %s",
+		d.PC, text, d.Block, d.Retired, strings.Join(d.Diffs, "; "))
+}
+
+// selfCheckStep is an instruction the reference ran
+type selfCheckStep struct {
+	pc    uint32
+	d     decoded
+	store memRange // the bytes it stored to, if it's a store to RAM (len 0 otherwise)
+}
+
+// selfCheck is the state of a lockstep run
+type selfCheck struct {
+	cpu, ref *CPU
+	block    uint32          // the first instruction of the current block
+	steps    []selfCheckStep // what the reference ran of the current block
+	written  []memRange      // the RAM either machine wrote in the current block
+
+	// the machine under test at its last ecall or ebreak hook
+	hookWrites []memRange // the RAM the hook wrote
+	hookPC     int        // the PC right after it
+	hookHalted bool
+	hookReason StopReason
+}
+
+// SelfCheck runs the machine like Run, checking it against a reference copy in
+// lockstep (see above). inject, if set, is called with the machine after every
+// block it runs, pc the block's first instruction, before the machines are
+// compared: it's how a bug is planted on purpose, to see that it's caught
+func (cpu *CPU) SelfCheck(maxInstructions uint64, inject func(cpu *CPU, pc uint32)) (StopReason, error) {
+	cpu.control.enter()
+	defer cpu.control.leave()
+	if !cpu.deterministic || cpu.timeSource != TimeInstructions {
+		now := cpu.Time()
+		cpu.deterministic, cpu.timeSource = true, TimeInstructions
+		cpu.setTime(now)
+	}
+	s := &selfCheck{cpu: cpu, ref: cpu.newReference()}
+	ecall, ebreak := cpu.EcallHook, cpu.EbreakHook
+	cpu.writeLog, s.ref.writeLog = &s.written, &s.written
+	defer func() { cpu.EcallHook, cpu.EbreakHook, cpu.writeLog = ecall, ebreak, nil }()
+	s.wrapHooks()
+
+	debug := cpu.Logger.Enabled(context.Background(), slog.LevelDebug)
+	for n := uint64(0); maxInstructions == 0 || n < maxInstructions; {
+		cpu.control.checkpoint()
+		if cpu.watchdog != nil && cpu.watchdog.Load() {
+			return StopTimeout, nil
+		}
+
+		var err error
+		var b *block
+		if cpu.blocksUsable(debug) {
+			cpu.takePendingInterrupt()
+			b = cpu.blockAt()
+		}
+		pc, steps := uint32(cpu.PC), uint64(1)
+		s.block, s.steps, s.written = pc, s.steps[:0], s.written[:0]
+		if b != nil && (maxInstructions == 0 || maxInstructions-n >= uint64(len(b.instrs))) {
+			steps, err = cpu.runBlock(b)
+		} else {
+			err = cpu.Step()
+		}
+		n += steps
+		var diverged *Divergence
+		if errors.As(err, &diverged) { // found at a hook
+			return StopError, diverged
+		}
+		if inject != nil {
+			inject(cpu, pc)
+		}
+
+		refErr := s.stepReference(steps - uint64(len(s.steps)))
+		if d := s.compare(pc, err, refErr, false); d != nil {
+			return StopError, d
+		}
+		if err == nil && cpu.loops != nil {
+			err = cpu.loops.check(cpu, int(pc), steps)
+		}
+		if err != nil {
+			return StopError, err
+		}
+		if cpu.halted {
+			cpu.halted, s.ref.halted = false, false
+			if d := s.compare(pc, nil, nil, true); d != nil {
+				return StopError, d
+			}
+			return cpu.haltReason, nil
+		}
+	}
+	if d := s.compare(uint32(cpu.PC), nil, nil, true); d != nil {
+		return StopError, d
+	}
+	return StopLimit, nil
+}
+
+// newReference copies the machine for SelfCheck to compare it with
+func (cpu *CPU) newReference() *CPU {
+	ref := cpu.Clone()
+	ref.bcache = nil
+	ref.dcache = nil
+	ref.slowMemory = true
+	ref.Tracer = nil
+	ref.Observer = nil
+	ref.Logger = slog.New(slog.DiscardHandler)
+	ref.breakpoints = nil
+	ref.tracepoints = nil
+	ref.loops = nil
+	ref.console.out = io.Discard
+	for _, m := range ref.devices {
+		if u, ok := m.dev.(*UART); ok {
+			u.out = io.Discard
+		}
+	}
+	return ref
+}
+
+// wrapHooks makes the machine under test check the reference before its hooks
+// and note what they did, and the reference take that instead of running them again
+func (s *selfCheck) wrapHooks() {
+	wrap := func(hook func(*CPU) error) func(*CPU) error {
+		if hook == nil {
+			return nil
+		}
+		return func(cpu *CPU) error {
+			var refErr error
+			if s.ref.Retired < cpu.Retired {
+				refErr = s.stepReference(cpu.Retired - s.ref.Retired)
+			}
+			if d := s.compareAtHook(uint32(cpu.PC-4), refErr); d != nil {
+				return d
+			}
+			start := len(s.written)
+			err := hook(cpu)
+			s.hookWrites = append(s.hookWrites[:0], s.written[start:]...)
+			s.hookPC, s.hookHalted, s.hookReason = cpu.PC, cpu.halted, cpu.haltReason
+			return err
+		}
+	}
+	replay := func(ref *CPU) error {
+		ref.Regs = s.cpu.Regs
+		ref.PC = s.hookPC
+		for _, w := range s.hookWrites {
+			if off, ok := ref.ramOffset(w.addr, w.len); ok {
+				copy(ref.Memory[off:off+w.len], s.cpu.Memory[off:])
+				ref.MemoryWritten(w.addr, w.len)
+			}
+		}
+		ref.Exited, ref.ExitCode = s.cpu.Exited, s.cpu.ExitCode
+		ref.halted, ref.haltReason = s.hookHalted, s.hookReason
+		return nil
+	}
+	if s.cpu.EcallHook != nil {
+		s.ref.EcallHook = replay
+	}
+	if s.cpu.EbreakHook != nil {
+		s.ref.EbreakHook = replay
+	}
+	s.cpu.EcallHook, s.cpu.EbreakHook = wrap(s.cpu.EcallHook), wrap(s.cpu.EbreakHook)
+}
+
+// stepReference runs up to n more instructions on the reference, noting them in s.steps
+func (s *selfCheck) stepReference(n uint64) error {
+	ref := s.ref
+	for range n {
+		step := selfCheckStep{pc: uint32(ref.PC)}
+		if off, ok := ref.ramOffset(step.pc, 4); ok {
+			step.d = decode(binary.LittleEndian.Uint32(ref.Memory[off:]))
+		} else if instr, ok := ref.fetchROM(step.pc); ok {
+			step.d = decode(instr)
+		}
+		if step.d.opcode == STORE {
+			addr, size := ref.Regs[step.d.rs1]+step.d.imm, uint32(1)<<(step.d.funct3&3)
+			if _, ok := ref.ramOffset(addr, size); ok {
+				step.store = memRange{addr: addr, len: size}
+			}
+		}
+		s.steps = append(s.steps, step)
+		if err := ref.Step(); err != nil || ref.halted {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareAtHook returns how the reference, once it has been brought up to the
+// ecall or ebreak at pc and stopped with refErr, differs from the machine under
+// test about to run its hook for it, or nil if it doesn't: the hook is given the
+// registers and memory, of which only the bytes written in the block can differ
+func (s *selfCheck) compareAtHook(pc uint32, refErr error) *Divergence {
+	cpu, ref := s.cpu, s.ref
+	d := &Divergence{Block: s.block, Retired: ref.Retired}
+	if refErr != nil {
+		d.diff("error", nil, refErr)
+	} else if uint32(ref.PC) != pc {
+		d.diff("pc at the hook", hex32(pc), hex32(uint32(ref.PC)))
+	}
+	if reg := d.diffRegs(cpu.Regs, ref.Regs); reg >= 0 {
+		return s.blame(d, reg)
+	}
+	if addr, ok := d.diffMemory(cpu.Memory, ref.Memory, ref.ramBase, s.written); ok {
+		return s.blameStore(d, addr)
+	}
+	if len(d.Diffs) == 0 {
+		return nil
+	}
+	return s.blame(d, -1)
+}
+
+// compare returns how the machines differ after the block at pc, which ended
+// with err and refErr, or nil if they don't. all compares the whole of RAM
+// instead of the bytes written in the block
+func (s *selfCheck) compare(pc uint32, err, refErr error, all bool) *Divergence {
+	cpu, ref := s.cpu, s.ref
+	d := &Divergence{Block: pc, Retired: ref.Retired}
+	if (err == nil) != (refErr == nil) || (err != nil && err.Error() != refErr.Error()) {
+		d.diff("error", err, refErr)
+	}
+	if cpu.PC != ref.PC {
+		d.diff("pc", hex32(uint32(cpu.PC)), hex32(uint32(ref.PC)))
+	}
+	reg := d.diffRegs(cpu.Regs, ref.Regs)
+	if cpu.Retired != ref.Retired {
+		d.diff("retired", cpu.Retired, ref.Retired)
+	}
+	if cpu.Cycles != ref.Cycles {
+		d.diff("cycles", cpu.Cycles, ref.Cycles)
+	}
+	if cpu.hpm != ref.hpm {
+		d.diff("mhpmcounters", cpu.hpm, ref.hpm)
+	}
+	if cpu.halted != ref.halted || cpu.halted && cpu.haltReason != ref.haltReason {
+		d.diff("halted", cpu.haltReason, ref.haltReason)
+	}
+	if cpu.csrs != ref.csrs {
+		for addr := range cpu.csrs {
+			if cpu.csrs[addr] != ref.csrs[addr] {
+				name, ok := CSRNames[uint32(addr)]
+				if !ok {
+					name = fmt.Sprintf("csr 0x%03X", addr)
+				}
+				d.diff(name, hex32(cpu.csrs[addr]), hex32(ref.csrs[addr]))
+			}
+		}
+	}
+	if reg >= 0 {
+		return s.blame(d, reg)
+	}
+
+	ranges := s.written
+	if all {
+		ranges = []memRange{{addr: ref.ramBase, len: uint32(len(ref.Memory))}}
+	}
+	if addr, ok := d.diffMemory(cpu.Memory, ref.Memory, ref.ramBase, ranges); ok {
+		return s.blameStore(d, addr)
+	}
+	if len(d.Diffs) == 0 {
+		return nil
+	}
+	return s.blame(d, -1)
+}
+
+func hex32(v uint32) string { return fmt.Sprintf("0x%08X", v) }
+
+// diff adds a difference to d
+func (d *Divergence) diff(what string, checked, reference any) {
+	d.Diffs = append(d.Diffs, fmt.Sprintf("%s: checked %v, reference %v", what, checked, reference))
+}
+
+// diffRegs adds the registers that differ to d and returns the first one, or -1
+func (d *Divergence) diffRegs(checked, reference [32]uint32) int {
+	first := -1
+	for i := range checked {
+		if checked[i] != reference[i] {
+			d.diff(abiNames[i], hex32(checked[i]), hex32(reference[i]))
+			if first < 0 {
+				first = i
+			}
+		}
+	}
+	return first
+}
+
+// diffMemory adds the first byte that differs in ranges (of RAM) to d and
+// returns its address. both memories start at base
+func (d *Divergence) diffMemory(checked, reference []byte, base uint32, ranges []memRange) (uint32, bool) {
+	for _, r := range ranges {
+		off := r.addr - base
+		if uint64(off)+uint64(r.len) > uint64(len(checked)) || bytes.Equal(checked[off:off+r.len], reference[off:off+r.len]) {
+			continue
+		}
+		for addr := r.addr; addr-r.addr < r.len; addr++ {
+			if c, ref := checked[addr-base], reference[addr-base]; c != ref {
+				d.diff(fmt.Sprintf("memory 0x%08X", addr), fmt.Sprintf("0x%02X", c), fmt.Sprintf("0x%02X", ref))
+				return addr, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// blame fills in the instruction d is about: the last one of the block that
+// wrote register reg, or the last one if reg is -1 or none did
+func (s *selfCheck) blame(d *Divergence, reg int) *Divergence {
+	if len(s.steps) == 0 {
+		d.PC = d.Block
+		return d
+	}
+	i := len(s.steps) - 1
+	for j := i; j >= 0 && reg > 0; j-- {
+		if op := s.steps[j].d.opcode; s.steps[j].d.rd == uint32(reg) && op != STORE && op != BRANCH {
+			i = j
+			break
+		}
+	}
+	d.PC, d.Instr = s.steps[i].pc, s.steps[i].d.instr
+	return d
+}
+
+// blameStore fills in the instruction d is about: the last store of the block to addr
+func (s *selfCheck) blameStore(d *Divergence, addr uint32) *Divergence {
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		if r := s.steps[i].store; r.len > 0 && addr-r.addr < r.len {
+			d.PC, d.Instr = s.steps[i].pc, s.steps[i].d.instr
+			return d
+		}
+	}
+	return s.blame(d, -1)
+}
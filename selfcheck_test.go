@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// selfCheckProgram reads up to 16 bytes of stdin into 0x800, sums them in a
+// loop (storing the running sum at 0x900), reads the time, the RTC and the
+// second byte again, writes the input back and exits with the sum
+func selfCheckProgram(b *Builder) {
+	b.Li(S0, 0x800)
+	b.Li(A0, 0)
+	b.Mv(A1, S0)
+	b.Li(A2, 16)
+	b.Li(A7, newlibSysRead)
+	b.Ecall()
+	b.Mv(S1, A0) // bytes read
+	b.Li(S2, 0)
+	b.Li(T0, 0)
+	b.Label("sum")
+	b.Bge(T0, S1, "done")
+	b.Add(T1, S0, T0)
+	b.Lbu(T1, T1, 0)
+	b.Add(S2, S2, T1)
+	b.Sw(S2, S0, 0x100)
+	b.Addi(T0, T0, 1)
+	b.J("sum")
+	b.Label("done")
+	b.Csrrs(S3, CSR_TIME, ZERO)
+	b.Li(T2, 0x10001000)
+	b.Lw(S4, T2, 0)
+	b.Lbu(S5, S0, 1)
+	b.Li(A0, 1)
+	b.Mv(A1, S0)
+	b.Mv(A2, S1)
+	b.Li(A7, newlibSysWrite)
+	b.Ecall()
+	b.Andi(A0, S2, 0xFF)
+	b.Li(A7, newlibSysExit)
+	b.Ecall()
+}
+
+// newSelfCheckMachine loads selfCheckProgram on the default machine (wall-clock
+// time), with input on stdin and stdout going to out
+func newSelfCheckMachine(t *testing.T, input string, out *strings.Builder) *CPU {
+	t.Helper()
+	cpu, err := DefaultMachine().NewCPU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.LoadProgram(assemble(t, selfCheckProgram))
+	cpu.EcallHook = NewNewlibSyscalls(strings.NewReader(input), out, out, 0x1000, cpu.Regs[SP]).Handle
+	return cpu
+}
+
+func TestSelfCheck(t *testing.T) {
+	var out strings.Builder
+	cpu := newSelfCheckMachine(t, "abc", &out)
+	reason, err := cpu.SelfCheck(10_000, nil)
+	if err != nil || reason != StopExit {
+		t.Fatalf("stopped with %v, %v", reason, err)
+	}
+	// the syscalls ran once, and their results reached the reference
+	if out.String() != "abc" || cpu.ExitCode != ('a'+'b'+'c')&0xFF {
+		t.Errorf("output %q, exit %d", out.String(), cpu.ExitCode)
+	}
+	// time counts instructions now, so both machines read the same
+	if cpu.timeSource != TimeInstructions || !cpu.deterministic {
+		t.Error("SelfCheck left the machine on wall-clock time")
+	}
+	before := cpu.Time()
+	cpu.Retired += 10
+	if cpu.Time() != before+10 {
+		t.Errorf("mtime moved from %d to %d over 10 instructions", before, cpu.Time())
+	}
+}
+
+func TestSelfCheckInjected(t *testing.T) {
+	const sumLoop = 0x28 // the loop's first block: bge, which ends it
+	const sumBody = 0x2C // the rest of the loop: add, lbu, add, sw, addi, j
+
+	for _, tc := range []struct {
+		name   string
+		inject func(cpu *CPU, pc uint32)
+		pc     uint32 // the instruction blamed
+		diff   string
+	}{
+		{"register", func(cpu *CPU, pc uint32) {
+			if pc == sumBody {
+				cpu.Regs[S2] ^= 0x100
+			}
+		}, sumBody + 8, "s2: checked 0x00000161, reference 0x00000061"},
+		{"stored byte", func(cpu *CPU, pc uint32) {
+			if pc == sumBody {
+				cpu.Store(0x902, 1, 0xEE)
+			}
+		}, sumBody + 12, "memory 0x00000902: checked 0xEE, reference 0x00"},
+		{"unlogged write caught at a syscall", func(cpu *CPU, pc uint32) {
+			if pc == sumLoop && cpu.Regs[T0] == 3 {
+				// not through MemoryWritten, so no block compares it: the lbu before
+				// the write syscall reads it, and the syscall doesn't happen
+				cpu.Memory[0x801] = 'X'
+			}
+		}, 0x50, "s5: checked 0x00000058, reference 0x00000062"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out strings.Builder
+			cpu := newSelfCheckMachine(t, "abc", &out)
+			reason, err := cpu.SelfCheck(10_000, tc.inject)
+			var d *Divergence
+			if !errors.As(err, &d) || reason != StopError {
+				t.Fatalf("stopped with %v, %v; want a divergence", reason, err)
+			}
+			if d.PC != tc.pc || !strings.Contains(strings.Join(d.Diffs, "; "), tc.diff) {
+				t.Errorf("blamed 0x%X for %q; want 0x%X for %q", d.PC, d.Diffs, tc.pc, tc.diff)
+			}
+			if instr, _ := cpu.Load(d.PC, 4); d.Instr != instr {
+				t.Errorf("Instr 0x%08X, the instruction at 0x%X is 0x%08X", d.Instr, d.PC, instr)
+			}
+			if !strings.HasPrefix(err.Error(), "selfcheck: diverged from the reference at pc=") {
+				t.Errorf("error %q", err)
+			}
+			if out.Len() != 0 {
+				t.Errorf("the program got as far as writing %q", out.String())
+			}
+		})
+	}
+}
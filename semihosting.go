@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// the three instructions that mark a semihosting call: the ebreak is only a
+// semihosting request when it sits between these two otherwise pointless no-ops
+const (
+	semihostingEntry = 0x01F01013 // slli x0, x0, 0x1f
+	semihostingExit  = 0x40705013 // srai x0, x0, 7
+)
+
+// semihosting operation numbers, passed in a0
+const (
+	semihostingSysOpen         = 0x01
+	semihostingSysClose        = 0x02
+	semihostingSysWriteC       = 0x03
+	semihostingSysWrite0       = 0x04
+	semihostingSysWrite        = 0x05
+	semihostingSysRead         = 0x06
+	semihostingSysClock        = 0x10
+	semihostingSysExit         = 0x18
+	semihostingSysExitExtended = 0x20
+)
+
+const (
+	semihostingApplicationExit = 0x20026 // ADP_Stopped_ApplicationExit, the "normal exit" reason code
+	semihostingMaxString       = 1 << 20 // longest string SYS_WRITE0 will read
+)
+
+// the handles SYS_OPEN returns for the special file ":tt" (the console),
+// depending on whether it's opened for reading, writing or appending
+const (
+	semihostingStdin  = 1
+	semihostingStdout = 2
+	semihostingStderr = 3
+)
+
+// Semihosting implements the RISC-V semihosting convention: the sequence
+//
+//	slli x0, x0, 0x1f
+//	ebreak
+//	srai x0, x0, 7
+//
+// asks the host for the service numbered a0, with a1 pointing at a block of
+// 32-bit parameters (or holding the parameter itself for some calls), and the
+// result in a0. an ebreak without the surrounding instructions keeps its normal
+// behavior and stops the CPU.
+// install it with cpu.EbreakHook = semihosting.Handle
+type Semihosting struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	Now   func() time.Time // source of SYS_CLOCK, time.Now by default
+	start time.Time        // SYS_CLOCK counts from the first semihosting call
+}
+
+func NewSemihosting(stdin io.Reader, stdout, stderr io.Writer) *Semihosting {
+	return &Semihosting{Stdin: stdin, Stdout: stdout, Stderr: stderr, Now: time.Now}
+}
+
+// isSemihostingCall reports whether the ebreak at pc sits between the entry and exit markers
+func isSemihostingCall(cpu *CPU, pc uint32) bool {
+	if pc < 4 {
+		return false
+	}
+	before, err1 := cpu.Load(pc-4, 4)
+	after, err2 := cpu.Load(pc+4, 4)
+	return err1 == nil && err2 == nil && before == semihostingEntry && after == semihostingExit
+}
+
+// Handle services one ebreak
+func (s *Semihosting) Handle(cpu *CPU) error {
+	pc := uint32(cpu.PC) - 4 // address of the ebreak
+	if !isSemihostingCall(cpu, pc) {
+		cpu.Halt(StopBreakpoint)
+		return nil
+	}
+	if s.start.IsZero() {
+		s.start = s.Now()
+	}
+
+	op, arg := cpu.Regs[A0], cpu.Regs[A1]
+	var ret uint32
+	switch op {
+	case semihostingSysOpen:
+		ret = s.open(cpu, arg)
+
+	case semihostingSysClose:
+		ret = 0
+
+	case semihostingSysWriteC:
+		c, err := cpu.Load(arg, 1)
+		if err != nil {
+			return err
+		}
+		if _, err := s.Stdout.Write([]byte{byte(c)}); err != nil {
+			return err
+		}
+
+	case semihostingSysWrite0:
+		str, err := cpu.ReadString(arg, semihostingMaxString)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(s.Stdout, str); err != nil {
+			return err
+		}
+
+	case semihostingSysWrite:
+		params, err := s.params(cpu, arg, 3)
+		if err != nil {
+			return err
+		}
+		ret = s.write(cpu, params[0], params[1], params[2])
+
+	case semihostingSysRead:
+		params, err := s.params(cpu, arg, 3)
+		if err != nil {
+			return err
+		}
+		ret = s.read(cpu, params[0], params[1], params[2])
+
+	case semihostingSysClock:
+		ret = uint32(s.Now().Sub(s.start) / (10 * time.Millisecond)) // centiseconds since the start
+
+	case semihostingSysExit:
+		// on rv32 the reason code is passed directly in a1, and only a normal application exit is a success
+		code := 1
+		if arg == semihostingApplicationExit {
+			code = 0
+		}
+		cpu.Exit(code)
+		return nil
+
+	case semihostingSysExitExtended:
+		// the block holds the reason code and the exit code that goes with it
+		params, err := s.params(cpu, arg, 2)
+		if err != nil {
+			return err
+		}
+		code := 1
+		if params[0] == semihostingApplicationExit {
+			code = int(int32(params[1]))
+		}
+		cpu.Exit(code)
+		return nil
+
+	default:
+		return errors.New("unimplemented semihosting operation")
+	}
+
+	cpu.Regs[A0] = ret
+	return nil
+}
+
+// params reads the n words of a parameter block
+func (s *Semihosting) params(cpu *CPU, block uint32, n int) ([]uint32, error) {
+	params := make([]uint32, n)
+	for i := range params {
+		v, err := cpu.Load(block+uint32(i)*4, 4)
+		if err != nil {
+			return nil, err
+		}
+		params[i] = v
+	}
+	return params, nil
+}
+
+// open(name, mode, length) only knows the console ":tt"; it returns -1 for anything else
+func (s *Semihosting) open(cpu *CPU, block uint32) uint32 {
+	params, err := s.params(cpu, block, 3)
+	if err != nil {
+		return ^uint32(0)
+	}
+	name, err := cpu.ReadString(params[0], params[2]+1)
+	if err != nil || name != ":tt" {
+		return ^uint32(0)
+	}
+	// modes 0-3 are the "r" variants, 4-7 "w" and 8-11 "a"
+	switch {
+	case params[1] < 4:
+		return semihostingStdin
+	case params[1] < 8:
+		return semihostingStdout
+	}
+	return semihostingStderr
+}
+
+// write(handle, buf, len) returns the number of bytes NOT written
+func (s *Semihosting) write(cpu *CPU, handle, buf, length uint32) uint32 {
+	var w io.Writer
+	switch handle {
+	case semihostingStdout:
+		w = s.Stdout
+	case semihostingStderr:
+		w = s.Stderr
+	}
+	data, err := cpu.ReadMemory(buf, length)
+	if w == nil || err != nil {
+		return length
+	}
+	n, _ := w.Write(data)
+	return length - uint32(n)
+}
+
+// read(handle, buf, len) returns the number of bytes NOT read
+func (s *Semihosting) read(cpu *CPU, handle, buf, length uint32) uint32 {
+	if handle != semihostingStdin || s.Stdin == nil || cpu.checkRange(buf, length) != nil {
+		return length
+	}
+	data := make([]byte, length)
+	n, _ := s.Stdin.Read(data)
+	cpu.WriteMemory(buf, data[:n])
+	return length - uint32(n)
+}
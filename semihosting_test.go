@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+const semihostingData = 0x200 // where the semihosting programs keep their string and parameter block
+
+// semihostingCall emits the marked ebreak asking for op with argument arg
+func semihostingCall(b *Builder, op, arg int32) {
+	b.Li(A0, op)
+	b.Li(A1, arg)
+	b.Word(semihostingEntry)
+	b.Ebreak()
+	b.Word(semihostingExit)
+}
+
+// newSemihostingMachine loads program, with data at semihostingData, and installs semihosting
+func newSemihostingMachine(t *testing.T, program, data []byte, stdout *bytes.Buffer) *CPU {
+	t.Helper()
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(program)
+	copy(cpu.Memory[semihostingData:], data)
+	cpu.EbreakHook = NewSemihosting(bytes.NewReader(nil), stdout, stdout).Handle
+	return &cpu
+}
+
+func TestSemihostingWrite0(t *testing.T) {
+	program := assemble(t, func(b *Builder) {
+		semihostingCall(b, semihostingSysWrite0, semihostingData)
+		semihostingCall(b, semihostingSysWrite0, semihostingData+8)
+		b.Ebreak() // not marked, so it stops the CPU
+	})
+	var stdout bytes.Buffer
+	cpu := newSemihostingMachine(t, program, []byte("hello, \x00world\n\x00ignored"), &stdout)
+	runToEbreak(t, cpu)
+	if got, want := stdout.String(), "hello, world\n"; got != want {
+		t.Errorf("the console got %q, want %q", got, want)
+	}
+	if cpu.PC != len(program) {
+		t.Errorf("stopped at pc=0x%X, want the plain ebreak at 0x%X", cpu.PC-4, len(program)-4)
+	}
+}
+
+func TestSemihostingExit(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		op   int32
+		arg  int32
+		data []byte // the parameter block, for SYS_EXIT_EXTENDED
+		want int
+	}{
+		{"application exit", semihostingSysExit, semihostingApplicationExit, nil, 0},
+		{"other reason", semihostingSysExit, 0x20023, nil, 1}, // ADP_Stopped_RunTimeErrorUnknown
+		{"extended", semihostingSysExitExtended, semihostingData, []byte{0x26, 0x00, 0x02, 0x00, 42, 0, 0, 0}, 42},
+		{"extended other reason", semihostingSysExitExtended, semihostingData, []byte{0x23, 0x00, 0x02, 0x00, 42, 0, 0, 0}, 1},
+	} {
+		program := assemble(t, func(b *Builder) {
+			semihostingCall(b, tt.op, tt.arg)
+			b.Li(S0, 1) // not reached
+			b.Ebreak()
+		})
+		var stdout bytes.Buffer
+		cpu := newSemihostingMachine(t, program, tt.data, &stdout)
+		reason, err := cpu.Run(100)
+		if err != nil || reason != StopExit || !cpu.Exited || cpu.ExitCode != tt.want || cpu.Regs[S0] != 0 {
+			t.Errorf("%s: Run() = %v, %v with exit code %d (exited %v); want exit code %d", tt.name, reason, err, cpu.ExitCode, cpu.Exited, tt.want)
+		}
+	}
+}
+
+// run --semihosting prints the WRITE0 text and exits with the EXIT status
+func TestRunSemihosting(t *testing.T) {
+	program := assemble(t, func(b *Builder) {
+		semihostingCall(b, semihostingSysWrite0, semihostingData)
+		semihostingCall(b, semihostingSysExit, 0x20023)
+		b.Space(semihostingData - b.Len())
+		b.Word(0x0A216968) // "hi!\n"
+	})
+	path := writeTemp(t, "semihosting.bin", program)
+	code, stdout, stderr := runCommand("run", "--semihosting", path)
+	if code != 1 || stdout != "hi!\nexited with code 1 after 10 instructions\n" {
+		t.Errorf("exit %d, stdout %q, stderr %q; want hi! and exit code 1", code, stdout, stderr)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ============================================================================
+// Architectural test signatures
+// ============================================================================
+// the riscv-arch-test suite (run by RISCOF) checks an implementation by the
+// memory its tests leave between the begin_signature and end_signature
+// symbols: the test stores its results there, stops through HTIF (see htif.go)
+// and the framework compares the region, written one 32-bit word per line in
+// lowercase hex and address order, with the reference model's. `run
+// --signature=path` writes that file, so a RISCOF plugin for this emulator only
+// has to call
+//
+//	riscv-emu run --ram-base 0x80000000 --signature=<test>.signature <test>.elf
+
+// Signature is the region of memory an architectural test leaves its results in
+type Signature struct {
+	Begin uint32 // address of the first word
+	End   uint32 // address just past the last word
+}
+
+// signatureOf finds the signature region in the symbols of an ELF file
+func signatureOf(symbols map[string]uint32) (Signature, error) {
+	begin, okBegin := symbols["begin_signature"]
+	end, okEnd := symbols["end_signature"]
+	if !okBegin || !okEnd {
+		return Signature{}, errors.New("no begin_signature and end_signature symbols")
+	}
+	if end < begin || begin%4 != 0 || end%4 != 0 {
+		return Signature{}, fmt.Errorf("signature 0x%08X-0x%08X is not a range of words", begin, end)
+	}
+	return Signature{Begin: begin, End: end}, nil
+}
+
+// WriteSignature writes the words of the signature region s, one per line in lowercase hex
+func (cpu *CPU) WriteSignature(w io.Writer, s Signature) error {
+	data, err := cpu.ReadMemory(s.Begin, s.End-s.Begin)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for i := 0; i < len(data); i += 4 {
+		fmt.Fprintf(bw, "%08x\n", binary.LittleEndian.Uint32(data[i:]))
+	}
+	return bw.Flush()
+}
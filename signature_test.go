@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// archTestELF is a stand-in for an arch-test binary linked at 0x80000000: it
+// stores words to its signature region and stops through tohost
+func archTestELF(t *testing.T, words ...uint32) []byte {
+	const base = 0x80000000
+	begin := uint32(base + 0x100)
+	end := begin + 4*uint32(len(words))
+	tohost := uint32(base + 0x200)
+	image := assemble(t, func(b *Builder) {
+		b.Li(T0, int32(begin))
+		for i, w := range words {
+			b.Li(T1, int32(w))
+			b.Sw(T1, T0, int32(4*i))
+		}
+		b.Li(T0, int32(tohost))
+		b.Li(T1, 1)
+		b.Sw(T1, T0, 0)
+		b.Label("hang")
+		b.J("hang")
+	})
+	return buildELF(image, base, map[string]uint32{
+		"begin_signature": begin,
+		"end_signature":   end,
+		"tohost":          tohost,
+	})
+}
+
+func TestRunSignature(t *testing.T) {
+	elf := writeTemp(t, "test.elf", archTestELF(t, 0xDEADBEEF, 1, 0xABCDEF00, 0))
+	path := filepath.Join(t.TempDir(), "test.signature")
+	code, _, stderr := runCommand("run", "--ram-base=0x80000000", "--signature="+path, elf)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one word per line, lowercase hex, zero-padded, in address order
+	if want := "deadbeef\n00000001\nabcdef00\n00000000\n"; string(got) != want {
+		t.Errorf("signature file = %q, want %q", got, want)
+	}
+}
+
+func TestRunSignatureErrors(t *testing.T) {
+	noSymbols := writeTemp(t, "plain.elf", buildELF(assemble(t, exitProgram(0)), 0x80000000, nil))
+	if code, _, stderr := runCommand("run", "--ram-base=0x80000000", "--signature=x", noSymbols); code == 0 || !strings.Contains(stderr, "begin_signature") {
+		t.Errorf("no signature symbols: exit %d, stderr %q", code, stderr)
+	}
+	raw := writeTemp(t, "plain.bin", assemble(t, exitProgram(0)))
+	if code, _, stderr := runCommand("run", "--signature=x", raw); code == 0 || !strings.Contains(stderr, "needs an ELF") {
+		t.Errorf("raw image: exit %d, stderr %q", code, stderr)
+	}
+}
+
+func TestSignatureOf(t *testing.T) {
+	s, err := signatureOf(map[string]uint32{"begin_signature": 0x100, "end_signature": 0x110})
+	if err != nil || s != (Signature{Begin: 0x100, End: 0x110}) {
+		t.Errorf("signatureOf = %+v, %v", s, err)
+	}
+	for _, symbols := range []map[string]uint32{
+		{"begin_signature": 0x100},
+		{"begin_signature": 0x110, "end_signature": 0x100},
+		{"begin_signature": 0x102, "end_signature": 0x110},
+	} {
+		if _, err := signatureOf(symbols); err == nil {
+			t.Errorf("signatureOf(%v) succeeded", symbols)
+		}
+	}
+
+	cpu := NewCPUWithMemory(0x200)
+	copy(cpu.Memory[0x100:], []byte{0x78, 0x56, 0x34, 0x12, 0xFF, 0, 0, 0})
+	var buf bytes.Buffer
+	if err := cpu.WriteSignature(&buf, Signature{Begin: 0x100, End: 0x108}); err != nil || buf.String() != "12345678\n000000ff\n" {
+		t.Errorf("WriteSignature = %q, %v", buf.String(), err)
+	}
+	if err := cpu.WriteSignature(&buf, Signature{Begin: 0x1F0, End: 0x210}); err == nil {
+		t.Error("WriteSignature of a region past the end of memory succeeded")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import "fmt"
+
+// ============================================================================
+// Stack guard
+// ============================================================================
+// a stack that runs past its region corrupts whatever lies below it, and the
+// damage tends to show up much later. with a guard configured, the store that
+// first leaves the stack stops the run with a StackOverflowError instead.
+// only stores addressed off sp or fp (s0) are checked against the stack's range,
+// which covers pushes and locals without paying for a check on every store;
+// the guard band below the limit is checked for every store
+
+// StackGuard is the stack's legal range [Limit, Top) and, below it, Band bytes
+// that no store may touch
+type StackGuard struct {
+	Top   uint32
+	Limit uint32
+	Band  uint32
+}
+
+// StackOverflowError reports a store outside the stack
+type StackOverflowError struct {
+	PC   uint32 // the store instruction
+	SP   uint32 // sp when it executed
+	Addr uint32 // the address it wrote to
+	// Underflow is set when the store was above the stack's top instead of below its limit
+	Underflow bool
+}
+
+func (e *StackOverflowError) Error() string {
+	if e.Underflow {
+		return fmt.Sprintf("stack underflow: store to 0x%08X above the stack top at pc=0x%08X (sp=0x%08X)", e.Addr, e.PC, e.SP)
+	}
+	return fmt.Sprintf("stack overflow: store to 0x%08X below the stack limit at pc=0x%08X (sp=0x%08X)", e.Addr, e.PC, e.SP)
+}
+
+// WithStackGuard checks stores against the stack range of g
+func WithStackGuard(g StackGuard) Option {
+	return func(cpu *CPU) {
+		cpu.stackGuard = &g
+	}
+}
+
+// check returns a StackOverflowError if a store of size bytes at addr, based on rs1, leaves the stack
+func (g *StackGuard) check(cpu *CPU, rs1, addr, size uint32) error {
+	end := uint64(addr) + uint64(size)
+	inBand := end > uint64(g.Limit)-uint64(min(g.Band, g.Limit)) && addr < g.Limit
+	stackRelative := rs1 == SP || rs1 == S0
+	if !inBand && !(stackRelative && (addr < g.Limit || end > uint64(g.Top))) {
+		return nil
+	}
+	return &StackOverflowError{
+		PC:        uint32(cpu.PC - 4), // PC has already moved past the store
+		SP:        cpu.Regs[SP],
+		Addr:      addr,
+		Underflow: addr >= g.Limit,
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// stackMachine has 64 KiB of memory with the stack's top at the end of it, its
+// limit 4 KiB below and a 256-byte guard band under that
+var stackMachine = MachineConfig{MemSize: 0x10000, StackLimit: 0xF000, StackGuard: 0x100}
+
+// runStackProgram runs program on stackMachine and returns the error it stopped with
+func runStackProgram(t *testing.T, build func(b *Builder)) (*CPU, *StackOverflowError) {
+	t.Helper()
+	cpu, err := stackMachine.NewCPU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.LoadProgram(assemble(t, build))
+	if cpu.Regs[SP] != 0xFFF0 {
+		t.Fatalf("sp starts at 0x%X, want 16 bytes below the top of memory", cpu.Regs[SP])
+	}
+	// data just below the guard band, which the overflowing stores mustn't reach
+	if err := cpu.Store(0xEEFC, 4, 0xDA7A); err != nil {
+		t.Fatal(err)
+	}
+	_, err = cpu.Run(100_000)
+	var overflow *StackOverflowError
+	if !errors.As(err, &overflow) {
+		t.Fatalf("stopped with %v, want a StackOverflowError", err)
+	}
+	if data, _ := cpu.Load(0xEEFC, 4); data != 0xDA7A {
+		t.Errorf("the data below the stack was overwritten with 0x%X", data)
+	}
+	return cpu, overflow
+}
+
+// a function that calls itself forever pushes frames until the guard stops it
+func TestStackGuardRecursion(t *testing.T) {
+	cpu, overflow := runStackProgram(t, func(b *Builder) {
+		b.Call("recurse")
+		b.Ebreak()
+		b.Label("recurse") // 0x8
+		b.Addi(SP, SP, -16)
+		b.Sw(RA, SP, 12) // 0xC
+		b.Sw(S0, SP, 8)
+		b.Addi(S0, SP, 16)
+		b.Addi(A0, A0, 1)
+		b.Call("recurse")
+	})
+	// 255 frames fit between sp's start and the limit, and the 256th's first store is below it
+	want := StackOverflowError{PC: 0xC, SP: 0xEFF0, Addr: 0xEFFC}
+	if *overflow != want || cpu.Regs[A0] != 255 {
+		t.Fatalf("%+v after %d calls, want %+v after 255", *overflow, cpu.Regs[A0], want)
+	}
+	if got := overflow.Error(); got != "stack overflow: store to 0x0000EFFC below the stack limit at pc=0x0000000C (sp=0x0000EFF0)" {
+		t.Errorf("Error() = %q", got)
+	}
+}
+
+func TestStackGuardUnderflow(t *testing.T) {
+	_, overflow := runStackProgram(t, func(b *Builder) {
+		b.Addi(SP, SP, -8)
+		b.Sw(RA, SP, 4)
+		b.Addi(SP, SP, 24)
+		b.Sw(RA, SP, 0) // 0xC, at the top
+	})
+	if want := (StackOverflowError{PC: 0xC, SP: 0x10000, Addr: 0x10000, Underflow: true}); *overflow != want {
+		t.Fatalf("%+v, want %+v", *overflow, want)
+	}
+}
+
+// any store into the guard band is caught, whatever register it's based on;
+// below the band, only sp- and fp-relative ones are
+func TestStackGuardBand(t *testing.T) {
+	_, overflow := runStackProgram(t, func(b *Builder) {
+		b.Li(T0, 0xE000)
+		b.Sw(T0, T0, 0) // below the band: an ordinary store
+		b.Li(T0, 0xEF80)
+		b.Sw(T0, T0, 0) // 0x10, in the band
+	})
+	if want := (StackOverflowError{PC: 0x10, SP: 0xFFF0, Addr: 0xEF80}); *overflow != want {
+		t.Fatalf("%+v, want %+v", *overflow, want)
+	}
+}
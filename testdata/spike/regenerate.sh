@@ -0,0 +1,13 @@
+#!/bin/sh
+# replaces the commit logs in this directory, which were written by hand in
+# spike's format, with the ones spike writes for the programs TestSpikeFormatLogs
+# runs. to change a program, edit spikePrograms in tracediff_test.go, run
+#
+#	go test -run TestSpikeFormatLogs -update
+#
+# from the repository root (which rewrites the .elf files), then this script
+set -eu
+cd "$(dirname "$0")"
+for elf in *.elf; do
+	spike --isa=rv32i -l --log-commits "$elf" 2> "${elf%.elf}.log"
+done
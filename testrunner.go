@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ============================================================================
+// Guest test runner
+// ============================================================================
+// `riscv-emu test <dir>` runs every guest program in a directory, each on a CPU
+// of its own, and reports which passed. a program passes when it exits with
+// code 0, through either of the exit conventions the emulator understands:
+//   - the newlib exit ecall (a7 = 93, the code in a0); the other newlib
+//     calls are served too, so a test may print with write
+//   - the HTIF tohost word, for ELF files that have a tohost symbol (see htif.go)
+//
+// anything else (a nonzero exit code, an error, an ebreak, running out of the
+// instruction budget) is a failure. the machine has no test finisher device, so
+// programs written for one need the ecall or tohost instead.
+//
+// .elf and .bin files are run, the way `run` would load them. .s files are
+// listed as skipped: there is no text assembler to build them with (programs
+// for this repository are written with the Builder).
+//
+// what a test prints is kept in memory and, only when the test fails, written
+// next to it as <file>.out, and the same for the trace with -trace (<file>.trace),
+// so a passing run leaves the directory as it was
+
+// guestTestExtensions are the files `test` picks up in the directory
+var guestTestExtensions = []string{".bin", ".elf", ".s"}
+
+// GuestTestResult is the outcome of one program run by RunGuestTests
+type GuestTestResult struct {
+	Name    string // the file name, without the directory
+	Passed  bool
+	Skipped bool   // the file couldn't be run at all, see Detail
+	Detail  string // why it failed or was skipped
+	Retired uint64 // instructions it executed
+	Output  []byte // what it printed on the UART or through write
+	Trace   []byte // its trace, with GuestTestConfig.TraceFormat
+}
+
+// GuestTestConfig is how RunGuestTests runs the programs
+type GuestTestConfig struct {
+	Machine         MachineConfig
+	MaxInstructions uint64 // the budget of each test, 0 for no limit
+	TraceFormat     string // "" for no trace, otherwise one of TraceFormats
+	Jobs            int    // tests run at the same time, at least 1
+}
+
+// findGuestTests lists the test programs in dir, sorted by name
+func findGuestTests(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		if !e.IsDir() && slices.Contains(guestTestExtensions, filepath.Ext(e.Name())) {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// RunGuestTests runs the programs at paths and returns their results in the same order
+func RunGuestTests(paths []string, cfg GuestTestConfig) []GuestTestResult {
+	results := make([]GuestTestResult, len(paths))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range max(cfg.Jobs, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = runGuestTest(paths[i], cfg)
+			}
+		}()
+	}
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// runGuestTest runs the program at path on a CPU of its own
+func runGuestTest(path string, cfg GuestTestConfig) GuestTestResult {
+	r := GuestTestResult{Name: filepath.Base(path)}
+	if filepath.Ext(path) == ".s" {
+		r.Skipped = true
+		r.Detail = "assembly source (no assembler to build it with)"
+		return r
+	}
+	fail := func(err error) GuestTestResult {
+		r.Detail = err.Error()
+		return r
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fail(err)
+	}
+	var out, trace bytes.Buffer
+	cpu, err := cfg.Machine.NewCPU(WithConsole(nil, &out))
+	if err != nil {
+		return fail(err)
+	}
+	imageEnd := cfg.Machine.loadAddress() + uint32(len(data))
+	if isELF(data) {
+		image, err := cpu.LoadELF(bytes.NewReader(data))
+		if err != nil {
+			return fail(err)
+		}
+		imageEnd = image.End
+		if tohost, ok := image.Symbols["tohost"]; ok {
+			WithHTIF(tohost)(cpu)
+		}
+	} else if err := cpu.LoadProgramAt(data, cfg.Machine.loadAddress()); err != nil {
+		return fail(err)
+	}
+	cpu.EcallHook = NewNewlibSyscalls(nil, &out, &out, (imageEnd+0xF)&^0xF, cpu.Regs[SP]).Handle
+	if cfg.Machine.BootROM {
+		if err := cpu.BootFromROM(); err != nil {
+			return fail(err)
+		}
+	}
+	if cfg.TraceFormat != "" {
+		if cpu.Tracer, err = NewTracer(cfg.TraceFormat, &trace); err != nil {
+			return fail(err)
+		}
+	}
+
+	reason, err := cpu.Run(cfg.MaxInstructions)
+	r.Retired = cpu.Retired
+	r.Output = out.Bytes()
+	r.Trace = trace.Bytes()
+	switch {
+	case err != nil:
+		r.Detail = err.Error()
+	case reason == StopExit && cpu.ExitCode == 0:
+		r.Passed = true
+	case reason == StopExit:
+		r.Detail = fmt.Sprintf("exited with code %d", cpu.ExitCode)
+	default:
+		r.Detail = fmt.Sprintf("stopped: %s at pc=0x%08X", reason, cpu.PC)
+	}
+	return r
+}
+
+// saveFailure writes what the failed test at path printed, and its trace, next to it
+func saveFailure(path string, r GuestTestResult) error {
+	if err := os.WriteFile(path+".out", r.Output, 0o644); err != nil {
+		return err
+	}
+	if r.Trace != nil {
+		return os.WriteFile(path+".trace", r.Trace, 0o644)
+	}
+	return nil
+}
+
+func cmdTest(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: riscv-emu test [flags] <dir>")
+		fmt.Fprintln(stderr)
+		fmt.Fprintln(stderr, "runs every .elf and .bin program in dir and fails unless all of them exit with code 0;")
+		fmt.Fprintln(stderr, "a failing test's output is written next to it as <file>.out")
+		fmt.Fprintln(stderr)
+		fs.PrintDefaults()
+	}
+	maxInstructions := fs.Uint64("max-instructions", 10_000_000, "give up on a test after this many instructions (0 means no limit)")
+	machine := fs.String("machine", "", "JSON machine description to run the tests on")
+	trace := fs.String("trace", "", fmt.Sprintf("trace each test in this format (one of %v) and write a failing test's trace to <file>.trace", TraceFormats))
+	jobs := fs.Int("j", 1, "run this many tests at the same time (0 means one per CPU core)")
+	rest, err := parseInterspersed(fs, args)
+	if err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if len(rest) != 1 {
+		fmt.Fprintln(stderr, "riscv-emu test: exactly one directory is required")
+		return 2
+	}
+
+	cfg := GuestTestConfig{Machine: DefaultMachine(), MaxInstructions: *maxInstructions, TraceFormat: *trace, Jobs: *jobs}
+	if *machine != "" {
+		if cfg.Machine, err = LoadMachineConfig(*machine); err != nil {
+			fmt.Fprintf(stderr, "riscv-emu test: %v\n", err)
+			return 2
+		}
+	}
+	if cfg.TraceFormat != "" {
+		if _, err := NewTracer(cfg.TraceFormat, io.Discard); err != nil {
+			fmt.Fprintf(stderr, "riscv-emu test: %v\n", err)
+			return 2
+		}
+	}
+	if cfg.Jobs <= 0 {
+		cfg.Jobs = runtime.NumCPU()
+	}
+
+	paths, err := findGuestTests(rest[0])
+	if err != nil {
+		fmt.Fprintf(stderr, "riscv-emu test: %v\n", err)
+		return 2
+	}
+	if len(paths) == 0 {
+		fmt.Fprintf(stdout, "no tests in %s\n", rest[0])
+		return 0
+	}
+
+	results := RunGuestTests(paths, cfg)
+	width := 0
+	for _, r := range results {
+		width = max(width, len(r.Name))
+	}
+	var passed, failed, skipped int
+	for i, r := range results {
+		var status string
+		switch {
+		case r.Skipped:
+			status = "SKIP"
+			skipped++
+		case r.Passed:
+			status = "PASS"
+			passed++
+		default:
+			status = "FAIL"
+			failed++
+			if err := saveFailure(paths[i], r); err != nil {
+				fmt.Fprintf(stderr, "riscv-emu test: %v\n", err)
+			}
+		}
+		line := fmt.Sprintf("%s  %-*s  %12d instructions", status, width, r.Name, r.Retired)
+		if r.Skipped {
+			line = fmt.Sprintf("%s  %-*s  %12s", status, width, r.Name, "")
+		}
+		if r.Detail != "" {
+			line += "  " + r.Detail
+		}
+		fmt.Fprintln(stdout, strings.TrimRight(line, " "))
+	}
+	fmt.Fprintf(stdout, "%d passed, %d failed, %d skipped\n", passed, failed, skipped)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
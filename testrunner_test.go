@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// printAndExit prints msg through newlib's write and exits with code
+func printAndExit(msg string, code int32) func(b *Builder) {
+	return func(b *Builder) {
+		const buf = 0x800
+		b.Li(T0, buf)
+		for i, c := range []byte(msg) {
+			b.Li(T1, int32(c))
+			b.Sb(T1, T0, int32(i))
+		}
+		b.Li(A0, 1)
+		b.Li(A1, buf)
+		b.Li(A2, int32(len(msg)))
+		b.Li(A7, newlibSysWrite)
+		b.Ecall()
+		exitProgram(code)(b)
+	}
+}
+
+// guestTestDir is a directory of test programs: two passing (by ecall and by
+// tohost), two failing (by exit code and by running out of budget), a .s file
+// and a file that isn't a test
+func guestTestDir(t *testing.T) string {
+	dir := t.TempDir()
+	write := func(name string, data []byte) {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("pass.bin", assemble(t, printAndExit("fine\n", 0)))
+	write("fail.bin", assemble(t, printAndExit("oops\n", 3)))
+	write("spin.bin", assemble(t, loopProgram))
+	write("tohost.elf", buildELF(assemble(t, func(b *Builder) {
+		b.Li(T0, 0x400)
+		b.Li(T1, 1)
+		b.Sw(T1, T0, 0)
+		b.Label("hang")
+		b.J("hang")
+	}), 0, map[string]uint32{"tohost": 0x400}))
+	write("todo.s", []byte("li a0, 0\n"))
+	write("README", []byte("not a test"))
+	return dir
+}
+
+func TestRunGuestTests(t *testing.T) {
+	dir := guestTestDir(t)
+	paths, err := findGuestTests(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := RunGuestTests(paths, GuestTestConfig{Machine: DefaultMachine(), MaxInstructions: 1000, Jobs: 4})
+	want := []struct {
+		name            string
+		passed, skipped bool
+		output          string
+	}{
+		{"fail.bin", false, false, "oops\n"},
+		{"pass.bin", true, false, "fine\n"},
+		{"spin.bin", false, false, ""},
+		{"todo.s", false, true, ""},
+		{"tohost.elf", true, false, ""},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("%d results, want %d: %+v", len(results), len(want), results)
+	}
+	for i, w := range want {
+		r := results[i]
+		if r.Name != w.name || r.Passed != w.passed || r.Skipped != w.skipped || string(r.Output) != w.output {
+			t.Errorf("result %d = %+v, want %+v", i, r, w)
+		}
+	}
+	if results[2].Retired != 1000 || !strings.Contains(results[2].Detail, "instruction limit") {
+		t.Errorf("spin.bin: %d instructions, %q", results[2].Retired, results[2].Detail)
+	}
+}
+
+func TestCmdTest(t *testing.T) {
+	dir := guestTestDir(t)
+	code, stdout, stderr := runCommand("test", "-j", "0", "--max-instructions=1000", "--trace=human", dir)
+	if code != 1 {
+		t.Errorf("exit %d, want 1 with failing tests (stderr %q)", code, stderr)
+	}
+	for _, want := range []string{"FAIL  fail.bin", "PASS  pass.bin", "FAIL  spin.bin", "SKIP  todo.s", "PASS  tohost.elf", "2 passed, 2 failed, 1 skipped\n"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("output lacks %q:\n%s", want, stdout)
+		}
+	}
+
+	// only the failures leave their output and trace behind
+	if out, err := os.ReadFile(filepath.Join(dir, "fail.bin.out")); err != nil || string(out) != "oops\n" {
+		t.Errorf("fail.bin.out = %q, %v", out, err)
+	}
+	if trace, err := os.ReadFile(filepath.Join(dir, "spin.bin.trace")); err != nil || !strings.HasPrefix(string(trace), "[1] pc=0x00000000") {
+		t.Errorf("spin.bin.trace = %.40q, %v", trace, err)
+	}
+	for _, name := range []string{"pass.bin.out", "pass.bin.trace", "tohost.elf.out"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("the passing test left %s behind", name)
+		}
+	}
+
+	passing := t.TempDir()
+	os.WriteFile(filepath.Join(passing, "ok.bin"), assemble(t, exitProgram(0)), 0o644)
+	if code, stdout, _ := runCommand("test", passing); code != 0 || !strings.HasSuffix(stdout, "1 passed, 0 failed, 0 skipped\n") {
+		t.Errorf("all passing: exit %d:\n%s", code, stdout)
+	}
+	if code, stdout, _ := runCommand("test", t.TempDir()); code != 0 || !strings.HasPrefix(stdout, "no tests in ") {
+		t.Errorf("empty directory: exit %d, %q", code, stdout)
+	}
+	if code, _, _ := runCommand("test"); code != 2 {
+		t.Errorf("no directory: exit %d, want 2", code)
+	}
+}
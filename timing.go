@@ -0,0 +1,105 @@
+package main
+
+import "encoding/json"
+
+// ============================================================================
+// Cycle timing model
+// ============================================================================
+// without a model every instruction takes one cycle, so mcycle equals minstret.
+// WithCycleModel charges every retired instruction the latency of its class
+// instead, and mcycle (and, with instruction-driven time, mtime) counts those
+// cycles. it's an estimate for comparing code, not a model of any real core:
+// there's no pipeline, caching or overlap, a taken branch costs a fixed penalty
+// on top of the branch itself, and traps and interrupt entry are free.
+//
+// the latencies come from a CycleTable, which the machine file can override
+// field by field:
+//
+//	{"cycles": {"load": 3, "branch_taken": 2}}
+
+// CycleTable is the number of cycles each class of instruction takes
+type CycleTable struct {
+	ALU         uint64 `json:"alu"`          // register and immediate arithmetic, lui, auipc
+	Load        uint64 `json:"load"`         // lb, lh, lw, lbu, lhu
+	Store       uint64 `json:"store"`        // sb, sh, sw
+	Mul         uint64 `json:"mul"`          // M extension multiplies (used once it's implemented)
+	Div         uint64 `json:"div"`          // M extension divides and remainders (likewise)
+	Branch      uint64 `json:"branch"`       // a conditional branch
+	BranchTaken uint64 `json:"branch_taken"` // added to Branch when the branch is taken
+	Jump        uint64 `json:"jump"`         // jal, jalr
+	CSR         uint64 `json:"csr"`          // the csr instructions
+	System      uint64 `json:"system"`       // ecall, ebreak, mret, wfi
+	Fence       uint64 `json:"fence"`        // fence, fence.i
+}
+
+// DefaultCycleTable is roughly a simple in-order core
+func DefaultCycleTable() CycleTable {
+	return CycleTable{
+		ALU:         1,
+		Load:        2,
+		Store:       1,
+		Mul:         3,
+		Div:         32,
+		Branch:      1,
+		BranchTaken: 2,
+		Jump:        2,
+		CSR:         1,
+		System:      1,
+		Fence:       1,
+	}
+}
+
+// UnmarshalJSON starts from DefaultCycleTable, so fields left out keep their default latency
+func (t *CycleTable) UnmarshalJSON(data []byte) error {
+	type plain CycleTable // without the method, so Unmarshal doesn't come back here
+	p := plain(DefaultCycleTable())
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*t = CycleTable(p)
+	return nil
+}
+
+// WithCycleModel counts cycles with the latencies of t (see Cycles)
+func WithCycleModel(t CycleTable) Option {
+	return func(cpu *CPU) {
+		cpu.cycleModel = &t
+	}
+}
+
+// cost is how many cycles d takes; taken says whether it jumped (for branches)
+func (t *CycleTable) cost(d *decoded, taken bool) uint64 {
+	switch d.opcode {
+	case LOAD:
+		return t.Load
+	case STORE:
+		return t.Store
+	case BRANCH:
+		if taken {
+			return t.Branch + t.BranchTaken
+		}
+		return t.Branch
+	case JAL, JALR:
+		return t.Jump
+	case SYSTEM:
+		if d.funct3 != 0 {
+			return t.CSR
+		}
+		return t.System
+	case MISC_MEM:
+		return t.Fence
+	case OP:
+		if d.funct7 == 0x01 { // mul, mulh, mulhsu, mulhu, then div, divu, rem, remu
+			if d.funct3 < 4 {
+				return t.Mul
+			}
+			return t.Div
+		}
+	}
+	return t.ALU
+}
+
+// countCycles charges the instruction d at pc, which has just retired
+func (cpu *CPU) countCycles(d *decoded, pc uint32) {
+	cpu.Cycles += cpu.cycleModel.cost(d, uint32(cpu.PC) != pc+4)
+}
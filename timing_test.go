@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// timedProgram has a known mix: a three-times loop of a load, a store, an addi
+// and a branch taken twice and then not, a call to a function that fences and
+// returns, and a read of mcycle into t2
+func timedProgram(b *Builder) {
+	b.Li(A0, 3)
+	b.Label("loop")
+	b.Lw(T1, ZERO, 0x100)
+	b.Sw(T1, ZERO, 0x104)
+	b.Addi(A0, A0, -1)
+	b.Bnez(A0, "loop")
+	b.Call("f")
+	b.Csrrs(T2, CSR_MCYCLE, ZERO)
+	b.Ebreak()
+	b.Label("f")
+	b.Fence()
+	b.Ret()
+}
+
+func TestCycleModel(t *testing.T) {
+	var modified CycleTable
+	if err := json.Unmarshal([]byte(`{"load": 5, "branch_taken": 0, "jump": 3}`), &modified); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name  string
+		table CycleTable
+		// the cycles before the csrr, and the total with it and the ebreak
+		before, total uint64
+	}{
+		// li 1, the loop 3*(load 2 + store 1 + alu 1 + branch 1) and 2*2 for the taken
+		// branches, the call 2, fence 1, ret 2; then csrr 1 and ebreak 1
+		{"default", DefaultCycleTable(), 1 + 3*5 + 2*2 + 2 + 1 + 2, 25 + 1 + 1},
+		// loads take 5, taken branches nothing extra and jumps 3
+		{"modified", modified, 1 + 3*8 + 3 + 1 + 3, 32 + 1 + 1},
+	} {
+		cpu := NewCPUWithMemory(0x1000, WithCycleModel(tt.table))
+		cpu.LoadProgram(assemble(t, timedProgram))
+		runToEbreak(t, &cpu)
+		if cpu.Regs[T2] != uint32(tt.before) || cpu.Cycles != tt.total {
+			t.Errorf("%s: mcycle read %d and %d cycles in all, want %d and %d", tt.name, cpu.Regs[T2], cpu.Cycles, tt.before, tt.total)
+		}
+		if mcycle, _ := cpu.ReadCSR(CSR_MCYCLE); mcycle != uint32(tt.total) {
+			t.Errorf("%s: mcycle = %d, want %d", tt.name, mcycle, tt.total)
+		}
+	}
+
+	// without a model, mcycle counts instructions
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, timedProgram))
+	runToEbreak(t, &cpu)
+	if mcycle, _ := cpu.ReadCSR(CSR_MCYCLE); cpu.Cycles != 0 || uint64(mcycle) != cpu.Retired {
+		t.Errorf("without a model Cycles = %d and mcycle = %d, want 0 and the %d retired", cpu.Cycles, mcycle, cpu.Retired)
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// ============================================================================
+// Torture testing
+// ============================================================================
+// `riscv-emu torture` generates random RV32I programs, runs each on the
+// emulator in every execution mode (both backends, with and without the block,
+// decode and fast memory paths) and compares the registers and memory they end
+// with against tortureProgram.reference, a deliberately plain interpreter of the
+// generated instructions that shares no code with decode.go or the handlers.
+//
+// the programs are well-formed by construction, so any difference is a bug:
+//   - immediates stay in range and rd is never the scratch base register, which
+//     loads and stores use with an offset keeping them aligned and inside the
+//     scratch buffer
+//   - branches and jumps only go forward to another instruction of the program
+//     (or its end), so every program finishes. jalr comes right after an auipc
+//     setting up its base, and nothing jumps between the two
+//   - the program ends with an ecall, which exits
+//
+// program i is generated from seed+i and every line about it says its seed, so
+// `riscv-emu torture -seed <seed> -iterations 1` runs it again. when a program
+// fails, it's cut down to the shortest prefix that still fails (jumps past the
+// end go to the end instead) and that is what's printed. `go test` runs programs
+// 1 to 200 the same way, and `go test -run TestTorture -long` 10000 longer ones
+
+// where the programs keep their data, and how much of it
+const (
+	tortureScratch     = 0x8000
+	tortureScratchSize = 256
+	tortureBase        = S11 // holds tortureScratch, never written
+)
+
+// tortureModes are the ways the emulator runs every program
+var tortureModes = []struct {
+	name string
+	opts []Option
+}{
+	{"threaded", nil},
+	{"table", []Option{WithBackend(BackendTable)}},
+	{"no-block-cache", []Option{WithoutBlockCache()}},
+	{"no-decode-cache", []Option{WithoutBlockCache(), WithoutDecodeCache()}},
+	{"no-fast-memory", []Option{WithoutFastMemory()}},
+}
+
+// tortureOp is one generated instruction, in the form the reference evaluates
+type tortureOp struct {
+	name         string // the mnemonic
+	rd, rs1, rs2 uint32
+	imm          int32
+	target       int // for branches and jumps, the index of the instruction they go to
+}
+
+// tortureProgram is a generated program and the machine state it starts from
+type tortureProgram struct {
+	ops  []tortureOp
+	regs [32]uint32
+	mem  []byte // the scratch buffer
+}
+
+// tortureState is what a program leaves behind
+type tortureState struct {
+	regs    [32]uint32
+	mem     []byte
+	retired uint64 // the program's instructions executed, the final ecall left out
+}
+
+var (
+	tortureALU      = []string{"add", "sub", "sll", "slt", "sltu", "xor", "srl", "sra", "or", "and"}
+	tortureALUImm   = []string{"addi", "slti", "sltiu", "xori", "ori", "andi"}
+	tortureShifts   = []string{"slli", "srli", "srai"}
+	tortureLoads    = []string{"lb", "lh", "lw", "lbu", "lhu"}
+	tortureStores   = []string{"sb", "sh", "sw"}
+	tortureBranches = []string{"beq", "bne", "blt", "bge", "bltu", "bgeu"}
+)
+
+// tortureValues are register contents worth seeing more often than chance would have them
+var tortureValues = []uint32{0, 1, 2, 31, 32, 0x7FF, 0x800, 0x7FFFFFFF, 0x80000000, 0xFFFFFFFF, 0xFFFFF800}
+
+// generateTorture generates a program of up to length instructions from seed
+func generateTorture(seed uint64, length int) tortureProgram {
+	r := rand.New(rand.NewPCG(seed, 0))
+	p := tortureProgram{mem: make([]byte, tortureScratchSize)}
+	for i := range p.regs {
+		if r.IntN(3) == 0 {
+			p.regs[i] = tortureValues[r.IntN(len(tortureValues))]
+		} else {
+			p.regs[i] = r.Uint32()
+		}
+	}
+	p.regs[ZERO] = 0
+	p.regs[tortureBase] = tortureScratch
+	for i := range p.mem {
+		p.mem[i] = byte(r.Uint32())
+	}
+
+	reg := func() uint32 { return r.Uint32N(32) }
+	dest := func() uint32 { // any register but the scratch base, x0 included
+		for {
+			if rd := reg(); rd != tortureBase {
+				return rd
+			}
+		}
+	}
+	pick := func(names []string) string { return names[r.IntN(len(names))] }
+	imm12 := func() int32 { return r.Int32N(4096) - 2048 }
+	n := 1 + r.IntN(length)
+	forward := func() int { return len(p.ops) + 1 + r.IntN(16) } // clamped to the end below
+
+	for len(p.ops) < n {
+		var op tortureOp
+		switch k := r.IntN(20); {
+		case k < 5:
+			op = tortureOp{name: pick(tortureALU), rd: dest(), rs1: reg(), rs2: reg()}
+		case k < 9:
+			op = tortureOp{name: pick(tortureALUImm), rd: dest(), rs1: reg(), imm: imm12()}
+		case k < 11:
+			op = tortureOp{name: pick(tortureShifts), rd: dest(), rs1: reg(), imm: r.Int32N(32)}
+		case k < 12:
+			op = tortureOp{name: pick([]string{"lui", "auipc"}), rd: dest(), imm: r.Int32N(1 << 20)}
+		case k < 14:
+			name := pick(tortureLoads)
+			op = tortureOp{name: name, rd: dest(), rs1: tortureBase, imm: tortureOffset(r, name)}
+		case k < 16:
+			name := pick(tortureStores)
+			op = tortureOp{name: name, rs1: tortureBase, rs2: reg(), imm: tortureOffset(r, name)}
+		case k < 18:
+			op = tortureOp{name: pick(tortureBranches), rs1: reg(), rs2: reg(), target: forward()}
+		case k < 19:
+			op = tortureOp{name: "jal", rd: dest(), target: forward()}
+		default:
+			base := dest()
+			for base == ZERO {
+				base = dest()
+			}
+			p.ops = append(p.ops, tortureOp{name: "auipc", rd: base})
+			op = tortureOp{name: "jalr", rd: dest(), rs1: base, target: forward()}
+		}
+		p.ops = append(p.ops, op)
+	}
+	p = p.truncate(len(p.ops))
+	for i, op := range p.ops {
+		// jumping straight to a jalr would skip the auipc setting up its base
+		if op.target < len(p.ops) && p.ops[op.target].name == "jalr" {
+			p.ops[i].target++
+		}
+	}
+	return p
+}
+
+// tortureOffset picks an aligned offset from the scratch base for the load or store name
+func tortureOffset(r *rand.Rand, name string) int32 {
+	size := int32(4)
+	switch name {
+	case "lb", "lbu", "sb":
+		size = 1
+	case "lh", "lhu", "sh":
+		size = 2
+	}
+	return r.Int32N(tortureScratchSize/size) * size
+}
+
+// truncate returns the program's first n instructions, with jumps past them going to the end
+func (p tortureProgram) truncate(n int) tortureProgram {
+	q := p
+	q.ops = slices.Clone(p.ops[:n])
+	for i := range q.ops {
+		q.ops[i].target = min(q.ops[i].target, n)
+	}
+	return q
+}
+
+// assemble encodes the program, followed by the ecall that ends it, for address 0
+func (p tortureProgram) assemble() ([]byte, error) {
+	var b Builder
+	label := func(i int) string { return fmt.Sprintf("L%d", i) }
+	for i, op := range p.ops {
+		b.Label(label(i))
+		rd, rs1, rs2, imm, target := op.rd, op.rs1, op.rs2, op.imm, label(op.target)
+		switch op.name {
+		case "add":
+			b.Add(rd, rs1, rs2)
+		case "sub":
+			b.Sub(rd, rs1, rs2)
+		case "sll":
+			b.Sll(rd, rs1, rs2)
+		case "slt":
+			b.Slt(rd, rs1, rs2)
+		case "sltu":
+			b.Sltu(rd, rs1, rs2)
+		case "xor":
+			b.Xor(rd, rs1, rs2)
+		case "srl":
+			b.Srl(rd, rs1, rs2)
+		case "sra":
+			b.Sra(rd, rs1, rs2)
+		case "or":
+			b.Or(rd, rs1, rs2)
+		case "and":
+			b.And(rd, rs1, rs2)
+		case "addi":
+			b.Addi(rd, rs1, imm)
+		case "slti":
+			b.Slti(rd, rs1, imm)
+		case "sltiu":
+			b.Sltiu(rd, rs1, imm)
+		case "xori":
+			b.Xori(rd, rs1, imm)
+		case "ori":
+			b.Ori(rd, rs1, imm)
+		case "andi":
+			b.Andi(rd, rs1, imm)
+		case "slli":
+			b.Slli(rd, rs1, uint32(imm))
+		case "srli":
+			b.Srli(rd, rs1, uint32(imm))
+		case "srai":
+			b.Srai(rd, rs1, uint32(imm))
+		case "lui":
+			b.Lui(rd, uint32(imm))
+		case "auipc":
+			b.Auipc(rd, uint32(imm))
+		case "lb":
+			b.Lb(rd, rs1, imm)
+		case "lh":
+			b.Lh(rd, rs1, imm)
+		case "lw":
+			b.Lw(rd, rs1, imm)
+		case "lbu":
+			b.Lbu(rd, rs1, imm)
+		case "lhu":
+			b.Lhu(rd, rs1, imm)
+		case "sb":
+			b.Sb(rs2, rs1, imm)
+		case "sh":
+			b.Sh(rs2, rs1, imm)
+		case "sw":
+			b.Sw(rs2, rs1, imm)
+		case "beq":
+			b.Beq(rs1, rs2, target)
+		case "bne":
+			b.Bne(rs1, rs2, target)
+		case "blt":
+			b.Blt(rs1, rs2, target)
+		case "bge":
+			b.Bge(rs1, rs2, target)
+		case "bltu":
+			b.Bltu(rs1, rs2, target)
+		case "bgeu":
+			b.Bgeu(rs1, rs2, target)
+		case "jal":
+			b.Jal(rd, target)
+		case "jalr":
+			// relative to the auipc right before, which put its own address in rs1
+			b.Jalr(rd, rs1, int32(op.target-(i-1))*4)
+		default:
+			return nil, fmt.Errorf("unknown torture instruction %q", op.name)
+		}
+	}
+	b.Label(label(len(p.ops)))
+	b.Ecall()
+	return b.Assemble()
+}
+
+// reference runs the program the slow and obvious way
+func (p tortureProgram) reference() (tortureState, error) {
+	s := tortureState{regs: p.regs, mem: slices.Clone(p.mem)}
+	x := &s.regs
+	addr := func(op tortureOp, size uint32) (uint32, error) {
+		a := x[op.rs1] + uint32(op.imm) - tortureScratch
+		if a > tortureScratchSize-size || a%size != 0 {
+			return 0, fmt.Errorf("%s at 0x%08X is outside the scratch buffer", op.name, x[op.rs1]+uint32(op.imm))
+		}
+		return a, nil
+	}
+	load := func(op tortureOp, size uint32) (uint32, error) {
+		a, err := addr(op, size)
+		if err != nil {
+			return 0, err
+		}
+		var v uint32
+		for i := range size {
+			v |= uint32(s.mem[a+i]) << (8 * i)
+		}
+		return v, nil
+	}
+	store := func(op tortureOp, size uint32) error {
+		a, err := addr(op, size)
+		if err != nil {
+			return err
+		}
+		for i := range size {
+			s.mem[a+i] = byte(x[op.rs2] >> (8 * i))
+		}
+		return nil
+	}
+
+	pc := 0
+	for pc < len(p.ops) {
+		op := p.ops[pc]
+		a, b, imm := x[op.rs1], x[op.rs2], uint32(op.imm)
+		next := pc + 1
+		var v uint32
+		var err error
+		branch := func(taken bool) {
+			if taken {
+				next = op.target
+			}
+		}
+		switch op.name {
+		case "add":
+			v = a + b
+		case "sub":
+			v = a - b
+		case "sll":
+			v = a << (b % 32)
+		case "slt":
+			v = boolWord(int32(a) < int32(b))
+		case "sltu":
+			v = boolWord(a < b)
+		case "xor":
+			v = a ^ b
+		case "srl":
+			v = a >> (b % 32)
+		case "sra":
+			v = uint32(int32(a) >> (b % 32))
+		case "or":
+			v = a | b
+		case "and":
+			v = a & b
+		case "addi":
+			v = a + imm
+		case "slti":
+			v = boolWord(int32(a) < op.imm)
+		case "sltiu":
+			v = boolWord(a < imm)
+		case "xori":
+			v = a ^ imm
+		case "ori":
+			v = a | imm
+		case "andi":
+			v = a & imm
+		case "slli":
+			v = a << imm
+		case "srli":
+			v = a >> imm
+		case "srai":
+			v = uint32(int32(a) >> imm)
+		case "lui":
+			v = imm << 12
+		case "auipc":
+			v = uint32(pc*4) + imm<<12
+		case "lb":
+			v, err = load(op, 1)
+			v = uint32(int32(int8(v)))
+		case "lh":
+			v, err = load(op, 2)
+			v = uint32(int32(int16(v)))
+		case "lw":
+			v, err = load(op, 4)
+		case "lbu":
+			v, err = load(op, 1)
+		case "lhu":
+			v, err = load(op, 2)
+		case "sb":
+			err = store(op, 1)
+		case "sh":
+			err = store(op, 2)
+		case "sw":
+			err = store(op, 4)
+		case "beq":
+			branch(a == b)
+		case "bne":
+			branch(a != b)
+		case "blt":
+			branch(int32(a) < int32(b))
+		case "bge":
+			branch(int32(a) >= int32(b))
+		case "bltu":
+			branch(a < b)
+		case "bgeu":
+			branch(a >= b)
+		case "jal":
+			v, next = uint32(pc*4+4), op.target
+		case "jalr":
+			target := (a + uint32(op.target-(pc-1))*4) &^ 1
+			v, next = uint32(pc*4+4), int(target/4)
+			if target%4 != 0 || next <= pc || next > len(p.ops) {
+				err = fmt.Errorf("jalr at %d goes to 0x%08X", pc, target)
+			}
+		default:
+			err = fmt.Errorf("unknown torture instruction %q", op.name)
+		}
+		if err != nil {
+			return s, err
+		}
+		switch op.name {
+		case "sb", "sh", "sw", "beq", "bne", "blt", "bge", "bltu", "bgeu":
+		default:
+			x[op.rd] = v
+		}
+		x[ZERO] = 0
+		s.retired++
+		pc = next
+	}
+	return s, nil
+}
+
+func boolWord(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// emulate runs the program on a CPU built with opts
+func (p tortureProgram) emulate(opts []Option) (tortureState, error) {
+	program, err := p.assemble()
+	if err != nil {
+		return tortureState{}, err
+	}
+	cpu := NewCPU(opts...)
+	cpu.LoadProgram(program)
+	if err := cpu.WriteMemory(tortureScratch, p.mem); err != nil {
+		return tortureState{}, err
+	}
+	cpu.Regs = p.regs
+	cpu.EcallHook = func(cpu *CPU) error {
+		cpu.Exit(0)
+		return nil
+	}
+	// every instruction runs at most once, so this is only reached if control flow is broken
+	reason, err := cpu.Run(uint64(len(p.ops)) + 1)
+	if err != nil {
+		return tortureState{}, err
+	}
+	if reason != StopExit {
+		return tortureState{}, fmt.Errorf("stopped: %s at pc=0x%08X", reason, cpu.PC)
+	}
+	s := tortureState{regs: cpu.Regs, retired: cpu.Retired - 1}
+	if s.mem, err = cpu.ReadMemory(tortureScratch, tortureScratchSize); err != nil {
+		return tortureState{}, err
+	}
+	return s, nil
+}
+
+// check runs the program in the emulator with opts and returns how it differs from the reference
+func (p tortureProgram) check(opts []Option) ([]string, error) {
+	want, err := p.reference()
+	if err != nil {
+		return nil, fmt.Errorf("reference: %w", err) // a bug in the generator
+	}
+	got, err := p.emulate(opts)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	var diffs []string
+	for i := range got.regs {
+		if got.regs[i] != want.regs[i] {
+			diffs = append(diffs, fmt.Sprintf("%s: emulator 0x%08X, reference 0x%08X", abiNames[i], got.regs[i], want.regs[i]))
+		}
+	}
+	for i := 0; i < tortureScratchSize; i += 4 {
+		g, w := got.mem[i:i+4], want.mem[i:i+4]
+		if !slices.Equal(g, w) {
+			diffs = append(diffs, fmt.Sprintf("memory 0x%08X: emulator % X, reference % X", tortureScratch+i, g, w))
+		}
+	}
+	if got.retired != want.retired {
+		diffs = append(diffs, fmt.Sprintf("instructions: emulator %d, reference %d", got.retired, want.retired))
+	}
+	return diffs, nil
+}
+
+// minimize returns the shortest prefix of the program that still fails with opts
+func (p tortureProgram) minimize(opts []Option) tortureProgram {
+	for n := 1; n < len(p.ops); n++ {
+		q := p.truncate(n)
+		if diffs, err := q.check(opts); err == nil && len(diffs) > 0 {
+			return q
+		}
+	}
+	return p
+}
+
+// reportFailure writes the shortest prefix of the program that fails with opts, as a
+// listing, and how it differs from the reference
+func (p tortureProgram) reportFailure(w io.Writer, opts []Option) {
+	q := p.minimize(opts)
+	diffs, _ := q.check(opts)
+	fmt.Fprintf(w, "the first %d of its %d instructions already fail:\n", len(q.ops), len(p.ops))
+	program, _ := q.assemble()
+	writeListing(w, program, 0, nil)
+	for _, d := range diffs {
+		fmt.Fprintf(w, "  %s\n", d)
+	}
+}
+
+func cmdTorture(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("torture", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: riscv-emu torture [flags]")
+		fmt.Fprintln(stderr)
+		fmt.Fprintln(stderr, "runs random programs in every execution mode and checks them against a reference interpreter")
+		fmt.Fprintln(stderr)
+		fs.PrintDefaults()
+	}
+	seed := fs.Uint64("seed", 0, "generate program i from `seed`+i (0 picks a seed from the clock)")
+	iterations := fs.Int("iterations", 200, "number of programs to run")
+	length := fs.Int("length", 100, "maximum number of instructions in a program")
+	long := fs.Bool("long", false, "run 10000 programs of up to 500 instructions (unless -iterations or -length say otherwise)")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fmt.Fprintln(stderr, "riscv-emu torture: takes no arguments")
+		return 2
+	}
+	if *long {
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if !set["iterations"] {
+			*iterations = 10000
+		}
+		if !set["length"] {
+			*length = 500
+		}
+	}
+	if *length < 1 || *length > 1000 {
+		fmt.Fprintln(stderr, "riscv-emu torture: -length must be between 1 and 1000")
+		return 2
+	}
+	if *seed == 0 {
+		*seed = uint64(time.Now().UnixNano())
+	}
+	fmt.Fprintf(stdout, "seed %d\n", *seed)
+
+	var checked uint64
+	for i := range *iterations {
+		s := *seed + uint64(i)
+		p := generateTorture(s, *length)
+		for _, mode := range tortureModes {
+			diffs, err := p.check(mode.opts)
+			if err != nil {
+				fmt.Fprintf(stderr, "riscv-emu torture: seed %d: %v\n", s, err)
+				return 1
+			}
+			if len(diffs) == 0 {
+				continue
+			}
+			fmt.Fprintf(stdout, "FAIL  seed %d (%s): ", s, mode.name)
+			p.reportFailure(stdout, mode.opts)
+			fmt.Fprintf(stdout, "run it again with: riscv-emu torture -seed %d -iterations 1 -length %d\n", s, *length)
+			return 1
+		}
+		checked += uint64(len(p.ops))
+	}
+	fmt.Fprintf(stdout, "ok: %d programs, %d instructions, %d modes\n", *iterations, checked, len(tortureModes))
+	return 0
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+var long = flag.Bool("long", false, "run the long torture batch")
+
+// TestTorture runs a fixed batch of torture programs in every mode, or with
+// -long a much bigger one; a failure is reported with the minimized program
+func TestTorture(t *testing.T) {
+	iterations, length := 200, 100
+	if *long {
+		iterations, length = 10000, 500
+	}
+	for i := range iterations {
+		seed := uint64(1 + i)
+		p := generateTorture(seed, length)
+		for _, mode := range tortureModes {
+			diffs, err := p.check(mode.opts)
+			if err != nil {
+				t.Fatalf("seed %d: %v", seed, err)
+			}
+			if len(diffs) > 0 {
+				var report strings.Builder
+				p.reportFailure(&report, mode.opts)
+				t.Fatalf("seed %d (%s): %s", seed, mode.name, report.String())
+			}
+		}
+	}
+}
+
+// flipXor is a broken emulator: after every xor it flips the low bit of the result
+type flipXor struct{}
+
+func (flipXor) Trace(cpu *CPU, pc int, instr uint32) {
+	if rd := instr >> 7 & 0x1F; instr&0x7F == OP && instr>>12&0x7 == 0x4 && rd != ZERO {
+		cpu.Regs[rd] ^= 1
+	}
+}
+
+// a program that goes wrong is cut down to end at the first instruction that does,
+// and that is what's reported
+func TestTortureMinimizes(t *testing.T) {
+	broken := []Option{func(cpu *CPU) { cpu.Tracer = flipXor{} }}
+	p := generateTorture(1, 100)
+	var report strings.Builder
+	p.reportFailure(&report, broken)
+	want := `the first 3 of its 82 instructions already fail:
+  00000000  addi a4, s8, -1053
+  00000004  sh s6, 170(s11)
+  00000008  xor ra, s5, s5
+  0000000C  ecall
+  ra: emulator 0x00000001, reference 0x00000000
+`
+	if report.String() != want {
+		t.Errorf("report:\n%s\nwant\n%s", report.String(), want)
+	}
+}
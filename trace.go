@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Tracer is called after every instruction executed by Step
+// with the address and raw encoding of that instruction
+type Tracer interface {
+	Trace(cpu *CPU, pc int, instr uint32)
+}
+
+// MemAccess is the load or store an instruction made
+type MemAccess struct {
+	Kind  AccessKind // AccessLoad or AccessStore
+	Addr  uint32     // the effective address
+	Size  uint32     // in bytes, 0 when the instruction didn't access memory
+	Value uint32     // the value read (before sign extension) or written, the low Size bytes
+}
+
+// LastAccess returns the memory access of the instruction a Tracer is being called for,
+// if it made one. it's only recorded while a Tracer is set
+func (cpu *CPU) LastAccess() (MemAccess, bool) {
+	return cpu.access, cpu.access.Size != 0
+}
+
+// recordAccess keeps the access for LastAccess
+func (cpu *CPU) recordAccess(kind AccessKind, addr, size, value uint32) {
+	if cpu.Tracer != nil {
+		cpu.access = MemAccess{Kind: kind, Addr: addr, Size: size, Value: value & uint32(uint64(1)<<(8*size)-1)}
+	}
+}
+
+// memAnnotation describes a, e.g. "mem[0x0000FFF0] <- 0x1234502A" for a store
+// and "mem[0x0000FFF0] -> 0x2A" for a byte load
+func memAnnotation(a MemAccess) string {
+	arrow := "->"
+	if a.Kind == AccessStore {
+		arrow = "<-"
+	}
+	return fmt.Sprintf("mem[0x%08X] %s 0x%0*X", a.Addr, arrow, 2*a.Size, a.Value)
+}
+
+// TraceFormats lists the formats accepted by --trace=<format>
+var TraceFormats = []string{"human", "jsonl", "spike"}
+
+// NewTracer returns a tracer writing the given format to w
+func NewTracer(format string, w io.Writer) (Tracer, error) {
+	switch format {
+	case "human":
+		return &humanTracer{w: w}, nil
+	case "jsonl":
+		return &jsonlTracer{enc: json.NewEncoder(w)}, nil
+	case "spike":
+		return &spikeTracer{w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown trace format %q (want one of %v)", format, TraceFormats)
+}
+
+// humanTracer writes one line per instruction, with the memory a load or store accessed, e.g.
+//
+//	[1] pc=0x00000000 instr=0x12345537
+//	[2] pc=0x00000004 instr=0x00C12023  # mem[0x0000FFF0] <- 0x12345000
+type humanTracer struct {
+	w io.Writer
+}
+
+func (t *humanTracer) Trace(cpu *CPU, pc int, instr uint32) {
+	if a, ok := cpu.LastAccess(); ok {
+		fmt.Fprintf(t.w, "[%d] pc=0x%08X instr=0x%08X  # %s\n", cpu.Retired, pc, instr, memAnnotation(a))
+		return
+	}
+	fmt.Fprintf(t.w, "[%d] pc=0x%08X instr=0x%08X\n", cpu.Retired, pc, instr)
+}
+
+// jsonlTracer writes one JSON object per instruction, with the memory a load or store accessed, e.g.
+//
+//	{"step":1,"pc":0,"instr":305419575}
+//	{"step":2,"pc":4,"instr":12656675,"mem":{"access":"store","addr":65520,"size":4,"value":305418240}}
+type jsonlTracer struct {
+	enc *json.Encoder
+}
+
+type traceRecord struct {
+	Step  uint64          `json:"step"`
+	PC    int             `json:"pc"`
+	Instr uint32          `json:"instr"`
+	Mem   *traceMemRecord `json:"mem,omitempty"`
+}
+
+type traceMemRecord struct {
+	Access string `json:"access"` // "load" or "store"
+	Addr   uint32 `json:"addr"`
+	Size   uint32 `json:"size"`
+	Value  uint32 `json:"value"`
+}
+
+func (t *jsonlTracer) Trace(cpu *CPU, pc int, instr uint32) {
+	rec := traceRecord{Step: cpu.Retired, PC: pc, Instr: instr}
+	if a, ok := cpu.LastAccess(); ok {
+		rec.Mem = &traceMemRecord{Access: a.Kind.String(), Addr: a.Addr, Size: a.Size, Value: a.Value}
+	}
+	t.enc.Encode(rec)
+}
+
+// spikeTracer writes the commit log of spike -l --log-commits, so the two can be
+// compared with `riscv-emu trace-diff`: the privilege level (always 3, machine
+// mode), the pc and the encoding, then the register the instruction wrote and
+// the memory it accessed, e.g.
+//
+//	core   0: 3 0x80000000 (0x00000297) x5  0x80000000
+//	core   0: 3 0x80000004 (0x0002a303) x6  0x00000013 mem 0x80000000
+//	core   0: 3 0x80000008 (0x0062a223) mem 0x80000004 0x00000013
+//
+// CSRs written aren't logged (trace-diff ignores them), and neither is an
+// instruction that trapped, which never completed
+type spikeTracer struct {
+	w io.Writer
+}
+
+func (t *spikeTracer) Trace(cpu *CPU, pc int, instr uint32) {
+	d := decode(instr)
+	line := fmt.Sprintf("core   0: 3 0x%08x (0x%08x)", uint32(pc), instr)
+	if rd, ok := destReg(&d); ok {
+		line += fmt.Sprintf(" x%-2d 0x%08x", rd, cpu.Regs[rd])
+	}
+	if a, ok := cpu.LastAccess(); ok {
+		if a.Kind == AccessLoad {
+			line += fmt.Sprintf(" mem 0x%08x", a.Addr)
+		} else {
+			line += fmt.Sprintf(" mem 0x%08x 0x%0*x", a.Addr, 2*a.Size, a.Value)
+		}
+	}
+	fmt.Fprintln(t.w, line)
+}
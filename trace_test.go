@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// traceProgram is the demo program with loads added after its store
+func traceProgram(b *Builder) {
+	b.Lui(A0, 0x12345)
+	b.Addi(A1, ZERO, 42)
+	b.Add(A2, A0, A1)
+	b.Sub(A3, A2, A1)
+	b.Sw(A2, SP, 0)
+	b.Lw(A4, SP, 0)
+	b.Lb(A5, SP, 3)
+	b.Sh(A1, SP, 6)
+	b.Lhu(A6, SP, 6)
+	b.Beq(A4, A2, "end")
+	b.Label("end")
+}
+
+// traceSP is where traceProgram's stores go
+const traceSP = 0x100
+
+// TestTraceGolden traces traceProgram in every format and compares the traces
+// with testdata/trace.<format>.golden (-update rewrites them)
+func TestTraceGolden(t *testing.T) {
+	program := assemble(t, traceProgram)
+	for _, format := range TraceFormats {
+		t.Run(format, func(t *testing.T) {
+			var out bytes.Buffer
+			tracer, err := NewTracer(format, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cpu := NewCPU()
+			cpu.Tracer = tracer
+			cpu.LoadProgram(program)
+			cpu.Regs[SP] = traceSP
+			for cpu.PC < len(program) {
+				if err := cpu.Step(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			golden := filepath.Join("testdata", "trace."+format+".golden")
+			if *update {
+				if err := os.WriteFile(golden, out.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != string(want) {
+				t.Errorf("trace changed (run with -update if that's intended)\ngot:\n%s\nwant:\n%s", out.String(), want)
+			}
+		})
+	}
+}
+
+// the annotations the traces are there for, whatever the golden files say
+func TestTraceMemoryAnnotations(t *testing.T) {
+	var out bytes.Buffer
+	tracer, _ := NewTracer("human", &out)
+	cpu := NewCPU()
+	cpu.Tracer = tracer
+	program := assemble(t, traceProgram)
+	cpu.LoadProgram(program)
+	cpu.Regs[SP] = traceSP
+	const sp = traceSP
+	for cpu.PC < len(program) {
+		if err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := strings.Split(out.String(), "\n")
+	for i, want := range map[int]string{
+		4: fmt.Sprintf("mem[0x%08X] <- 0x1234502A", sp), // sw
+		5: fmt.Sprintf("mem[0x%08X] -> 0x1234502A", sp), // lw
+		6: fmt.Sprintf("mem[0x%08X] -> 0x12", sp+3),     // lb
+		7: fmt.Sprintf("mem[0x%08X] <- 0x002A", sp+6),   // sh
+		8: fmt.Sprintf("mem[0x%08X] -> 0x002A", sp+6),   // lhu
+	} {
+		if !strings.HasSuffix(lines[i], "  # "+want) {
+			t.Errorf("line %d = %q, want it to end with %q", i+1, lines[i], want)
+		}
+	}
+	for _, i := range []int{0, 3, 9} {
+		if strings.Contains(lines[i], "#") {
+			t.Errorf("line %d = %q has a memory annotation", i+1, lines[i])
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// Trace diffing
+// ============================================================================
+// `riscv-emu trace-diff ours.log reference.log` compares the commit log of
+// --trace=spike with one written by spike, instruction by instruction, and
+// stops at the first one where they disagree on the pc, the encoding, the
+// register written or the memory accessed. a reference log comes from
+//
+//	spike --isa=rv32i -l --log-commits program.elf 2> reference.log
+//	riscv-emu run --ram-base 0x80000000 --trace=spike --trace-out ours.log program.elf
+//
+// for a program linked at 0x80000000 and ending through tohost (see htif.go).
+// what differs only cosmetically is normalized away:
+//   - lines that aren't commit records (spike's disassembly lines, exceptions,
+//     anything else the tools print) are skipped
+//   - the reference's instructions before the first pc of ours, spike's boot ROM
+//     among them, are skipped
+//   - numbers are compared by value, so case and zero-padding (e.g. a 64-bit
+//     spike) don't matter, and CSR writes are left out, as --trace=spike doesn't
+//     log them
+//   - the reference may go on after ours ends: spike only notices tohost some
+//     time after it's written
+//
+// QEMU has no commit log of its own; a log turned into this format (one record
+// per retired instruction) compares just the same.
+//
+// testdata/spike has logs for a few small programs, written by hand in the
+// format above rather than produced by spike, which the tests compare against;
+// regenerate.sh replaces them with spike's own
+
+// commitRecord is one instruction of a commit log
+type commitRecord struct {
+	line   int    // line number in the file
+	text   string // the line as it was written
+	pc     uint64
+	instr  uint64
+	writes []string // the registers written and memory accessed, normalized
+}
+
+// parseCommitLog reads the records of a commit log, skipping the lines that aren't any
+func parseCommitLog(r io.Reader) ([]commitRecord, error) {
+	var records []commitRecord
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		if rec, ok := parseCommitRecord(scanner.Text()); ok {
+			rec.line = n
+			records = append(records, rec)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// parseCommitRecord parses "core N: <priv> 0x<pc> (0x<instr>) [writes...]"
+func parseCommitRecord(text string) (commitRecord, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(text), "core")
+	if !ok {
+		return commitRecord{}, false
+	}
+	_, rest, ok = strings.Cut(rest, ":")
+	if !ok {
+		return commitRecord{}, false
+	}
+	fields := strings.Fields(rest)
+	// a disassembly line has the pc right after the colon, a commit record the privilege level first
+	if len(fields) < 3 || len(fields[0]) != 1 || !strings.HasPrefix(fields[2], "(") {
+		return commitRecord{}, false
+	}
+	pc, ok1 := parseHex(fields[1])
+	instr, ok2 := parseHex(strings.Trim(fields[2], "()"))
+	if !ok1 || !ok2 {
+		return commitRecord{}, false
+	}
+	rec := commitRecord{text: text, pc: pc, instr: instr}
+	tokens := fields[3:]
+	for i := 0; i < len(tokens); i++ {
+		name := tokens[i]
+		var value string
+		if i+1 < len(tokens) {
+			if v, ok := parseHex(tokens[i+1]); ok {
+				value = strconv.FormatUint(v, 16)
+				i++
+			}
+		}
+		switch {
+		case name == "mem" && value != "":
+			// the address, and the value stored if there's another number
+			write := "mem[" + value + "]"
+			if i+1 < len(tokens) {
+				if v, ok := parseHex(tokens[i+1]); ok {
+					write += "=" + strconv.FormatUint(v, 16)
+					i++
+				}
+			}
+			rec.writes = append(rec.writes, write)
+		case isCSRToken(name):
+		default:
+			rec.writes = append(rec.writes, name+"="+value)
+		}
+	}
+	return rec, true
+}
+
+// parseHex parses a 0x-prefixed hex number
+func parseHex(s string) (uint64, bool) {
+	digits, ok := strings.CutPrefix(strings.ToLower(s), "0x")
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(digits, 16, 64)
+	return v, err == nil
+}
+
+// isCSRToken reports whether s names a CSR the way spike logs one, e.g. c768_mstatus
+func isCSRToken(s string) bool {
+	num, _, ok := strings.Cut(s, "_")
+	if !ok || len(num) < 2 || num[0] != 'c' {
+		return false
+	}
+	_, err := strconv.ParseUint(num[1:], 10, 16)
+	return err == nil
+}
+
+// sameCommit reports whether two records describe the same instruction doing the same thing
+func sameCommit(a, b commitRecord) bool {
+	if a.pc != b.pc || a.instr != b.instr || len(a.writes) != len(b.writes) {
+		return false
+	}
+	for i := range a.writes {
+		if a.writes[i] != b.writes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// commitDiff is the outcome of comparing two commit logs
+type commitDiff struct {
+	agreed   int // records that matched
+	skipped  int // reference records before the first pc of ours
+	diverged bool
+	extra    int // reference records after ours ended
+}
+
+// diffCommitLogs compares ours with ref, after skipping ref's records before ours starts
+func diffCommitLogs(ours, ref []commitRecord) commitDiff {
+	var d commitDiff
+	if len(ours) > 0 {
+		for d.skipped < len(ref) && ref[d.skipped].pc != ours[0].pc {
+			d.skipped++
+		}
+	}
+	ref = ref[d.skipped:]
+	for d.agreed < len(ours) {
+		if d.agreed == len(ref) || !sameCommit(ours[d.agreed], ref[d.agreed]) {
+			d.diverged = true
+			return d
+		}
+		d.agreed++
+	}
+	d.extra = len(ref) - d.agreed
+	return d
+}
+
+func readCommitLog(path string) ([]commitRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records, err := parseCommitLog(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return records, nil
+}
+
+func cmdTraceDiff(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("trace-diff", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: riscv-emu trace-diff [flags] <ours.log> <reference.log>")
+		fmt.Fprintln(stderr)
+		fmt.Fprintln(stderr, "compares a --trace=spike log with spike's commit log and shows the first instruction they disagree on")
+		fmt.Fprintln(stderr)
+		fs.PrintDefaults()
+	}
+	context := fs.Int("context", 3, "show this many agreeing records before the first difference")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprintln(stderr, "riscv-emu trace-diff: two log files are required")
+		fs.Usage()
+		return 2
+	}
+	oursPath, refPath := fs.Arg(0), fs.Arg(1)
+	ours, err := readCommitLog(oursPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "riscv-emu trace-diff: %v\n", err)
+		return 1
+	}
+	ref, err := readCommitLog(refPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "riscv-emu trace-diff: %v\n", err)
+		return 1
+	}
+	if len(ours) == 0 {
+		fmt.Fprintf(stderr, "riscv-emu trace-diff: no commit records in %s\n", oursPath)
+		return 1
+	}
+
+	d := diffCommitLogs(ours, ref)
+	if d.skipped > 0 {
+		fmt.Fprintf(stdout, "skipped %d reference instructions before pc 0x%08x\n", d.skipped, ours[0].pc)
+	}
+	if !d.diverged {
+		fmt.Fprintf(stdout, "the logs agree on all %d instructions", d.agreed)
+		if d.extra > 0 {
+			fmt.Fprintf(stdout, " (the reference goes on for %d more)", d.extra)
+		}
+		fmt.Fprintln(stdout)
+		return 0
+	}
+
+	fmt.Fprintf(stdout, "the logs agree on %d instructions, then differ at instruction %d:\n", d.agreed, d.agreed+1)
+	for _, rec := range ours[max(0, d.agreed-*context):d.agreed] {
+		fmt.Fprintf(stdout, "             %s\n", strings.TrimSpace(rec.text))
+	}
+	o := ours[d.agreed]
+	fmt.Fprintf(stdout, "  ours       %s  (%s:%d)\n", strings.TrimSpace(o.text), oursPath, o.line)
+	if i := d.skipped + d.agreed; i < len(ref) {
+		fmt.Fprintf(stdout, "  reference  %s  (%s:%d)\n", strings.TrimSpace(ref[i].text), refPath, ref[i].line)
+	} else {
+		fmt.Fprintln(stdout, "  reference  (ended)")
+	}
+	return 1
+}
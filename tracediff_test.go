@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// spike-format logs
+// ============================================================================
+// testdata/spike holds a few small programs, linked at 0x80000000 and ending
+// through tohost, next to a commit log for each. the logs were written by hand
+// in spike's format, boot ROM included, from what each instruction should do:
+// spike didn't produce them, so the test checks --trace=spike and trace-diff
+// against worked-out expectations, not against spike itself. `go test -run
+// TestSpikeFormatLogs -update` rewrites the programs from spikePrograms, and
+// testdata/spike/regenerate.sh replaces the logs with spike's own, for anyone
+// who has it
+
+const (
+	spikeBase   = 0x80000000
+	spikeToHost = spikeBase + 0x1000
+)
+
+// spikePrograms are the programs in testdata/spike, by name
+var spikePrograms = map[string]func(b *Builder){
+	"arith": func(b *Builder) {
+		b.Li(A0, 5)
+		b.Li(A1, -3)
+		b.Add(A2, A0, A1)
+		b.Sub(A3, A0, A1)
+		b.Slt(A4, A1, A0)
+		b.Sltu(A5, A1, A0)
+		b.Srai(A6, A1, 1)
+		b.Srli(A7, A1, 28)
+		b.Li(S2, 0x12345678)
+		b.Xori(S3, S2, -1)
+		b.Auipc(S4, 1)
+		spikeExit(b)
+	},
+	"memory": func(b *Builder) {
+		b.Auipc(S0, 0) // s0 = the base, the data goes 0x800 past it
+		b.Addi(S0, S0, 0x7F0)
+		b.Li(T0, -0x1234568) // 0xFEDCBA98
+		b.Sw(T0, S0, 0)
+		b.Sh(T0, S0, 4)
+		b.Sb(T0, S0, 6)
+		b.Lw(A0, S0, 0)
+		b.Lh(A1, S0, 0)
+		b.Lhu(A2, S0, 2)
+		b.Lb(A3, S0, 6)
+		b.Lbu(A4, S0, 6)
+		spikeExit(b)
+	},
+	"branches": func(b *Builder) {
+		// a0 = 1 + 2 + 3 + 4, through a call
+		b.Li(A0, 0)
+		b.Li(A1, 4)
+		b.Call("sum")
+		b.J("done")
+		b.Label("sum")
+		b.Add(A0, A0, A1)
+		b.Addi(A1, A1, -1)
+		b.Bnez(A1, "sum")
+		b.Ret()
+		b.Label("done")
+		spikeExit(b)
+	},
+}
+
+// spikeExit stores a pass to tohost and waits for spike to notice
+func spikeExit(b *Builder) {
+	b.Li(T0, int32(-0x80000000+(spikeToHost-spikeBase)))
+	b.Li(T1, 1)
+	b.Sw(T1, T0, 0)
+	b.Label("hang")
+	b.J("hang")
+}
+
+func TestSpikeFormatLogs(t *testing.T) {
+	for name, build := range spikePrograms {
+		t.Run(name, func(t *testing.T) {
+			elfPath := filepath.Join("testdata", "spike", name+".elf")
+			if *update {
+				elf := buildELF(assemble(t, build), spikeBase, map[string]uint32{"tohost": spikeToHost})
+				if err := os.WriteFile(elfPath, elf, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			oursPath := filepath.Join(t.TempDir(), name+".log")
+			if code, _, stderr := runCommand("run", "--ram-base=0x80000000", "--trace=spike", "--trace-out="+oursPath, elfPath); code != 0 {
+				t.Fatalf("run exited with %d: %s", code, stderr)
+			}
+			ours, err := readCommitLog(oursPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref, err := readCommitLog(filepath.Join("testdata", "spike", name+".log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ours) == 0 {
+				t.Fatal("no commit records")
+			}
+			d := diffCommitLogs(ours, ref)
+			if d.diverged {
+				reference := "(ended)"
+				if i := d.skipped + d.agreed; i < len(ref) {
+					reference = strings.TrimSpace(ref[i].text)
+				}
+				t.Fatalf("the logs differ at instruction %d:\n  ours       %s\n  reference  %s", d.agreed+1, strings.TrimSpace(ours[d.agreed].text), reference)
+			}
+		})
+	}
+}
+
+func TestDiffCommitLogs(t *testing.T) {
+	parse := func(log string) []commitRecord {
+		records, err := parseCommitLog(strings.NewReader(log))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return records
+	}
+	ours := parse(`core   0: 3 0x80000000 (0x00500513) x10 0x00000005
+core   0: 3 0x80000004 (0x30529073)
+core   0: 3 0x80000008 (0x00a02023) mem 0x00000000 0x00000005
+`)
+	// a 64-bit spike with a boot ROM, disassembly lines and a CSR write
+	ref := parse(`core   0: 0x0000000000001000 (0x00000297) auipc   t0, 0x0
+core   0: 3 0x0000000000001000 (0x00000297) x5  0x0000000000001000
+core   0: 0x0000000080000000 (0x00500513) li      a0, 5
+core   0: 3 0x0000000080000000 (0x00500513) x10 0x0000000000000005
+core   0: 3 0x0000000080000004 (0x30529073) c773_mtvec 0x0000000080000000
+core   0: 3 0x0000000080000008 (0x00A02023) mem 0x0000000000000000 0x00000005
+core   0: 3 0x000000008000000c (0x0000006f)
+`)
+	if len(ours) != 3 || len(ref) != 5 {
+		t.Fatalf("parsed %d and %d records, want 3 and 5", len(ours), len(ref))
+	}
+	if d := diffCommitLogs(ours, ref); d.diverged || d.agreed != 3 || d.skipped != 1 || d.extra != 1 {
+		t.Errorf("diff = %+v, want 3 agreed, 1 skipped, 1 extra", d)
+	}
+
+	wrong := parse(`core   0: 3 0x80000000 (0x00500513) x10 0x00000005
+core   0: 3 0x80000004 (0x30529073)
+core   0: 3 0x80000008 (0x00a02023) mem 0x00000000 0x00000006
+`)
+	if d := diffCommitLogs(wrong, ref); !d.diverged || d.agreed != 2 {
+		t.Errorf("diff with a wrong store = %+v, want a divergence after 2", d)
+	}
+	if d := diffCommitLogs(ours, ref[:3]); !d.diverged || d.agreed != 2 {
+		t.Errorf("diff with a short reference = %+v, want a divergence after 2", d)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// ============================================================================
+// Tracepoints
+// ============================================================================
+// a tracepoint is a breakpoint that doesn't stop: whenever execution reaches its
+// address (and its condition, if it has one, is nonzero) it writes a line made
+// from its message template and carries on. the template is text with
+// expressions (see expr.go) in braces, shown in signed decimal, or in hex with :x:
+//
+//	cpu.SetTracepoint(loop, "a0 > 2", "iter a0={a0} sum={a2} top={mem32[sp]:x}", os.Stderr)
+//
+// the line is written before the instruction at the address executes, like a
+// breakpoint would stop there. a value that can't be evaluated (memory outside
+// RAM) shows as <error>, and a condition that can't be evaluated counts as true,
+// so a mistake shows up in the output rather than hiding the line.
+//
+// tracepoints are kept next to the breakpoints and, like them, are checked by
+// Step: a PC without one costs a map lookup only while some are set, and Run
+// falls back to Step (not running basic blocks) while there are any
+
+// Tracepoint is a message written whenever execution reaches Addr, see SetTracepoint
+type Tracepoint struct {
+	Addr    int
+	Cond    *Expr // nil for always
+	Message string
+	Out     io.Writer
+
+	parts []tracePart // Message split into text and expressions
+}
+
+// tracePart is a piece of a tracepoint message: text, or an expression to format
+type tracePart struct {
+	text string
+	expr *Expr
+	hex  bool
+}
+
+// SetTracepoint adds a tracepoint at addr writing message to out (cond may be empty
+// for always). there may be several at one address; they write in the order they were set
+// (like everything else, only call it while Run is paused or not running)
+func (cpu *CPU) SetTracepoint(addr int, cond, message string, out io.Writer) (*Tracepoint, error) {
+	t := &Tracepoint{Addr: addr, Message: message, Out: out}
+	if cond != "" {
+		var err error
+		if t.Cond, err = ParseExpr(cond); err != nil {
+			return nil, err
+		}
+	}
+	for rest := message; rest != ""; {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			t.parts = append(t.parts, tracePart{text: rest})
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("tracepoint message %q: missing }", message)
+		}
+		src, hex := rest[open+1:open+end], false
+		if s, ok := strings.CutSuffix(src, ":x"); ok {
+			src, hex = s, true
+		}
+		expr, err := ParseExpr(src)
+		if err != nil {
+			return nil, err
+		}
+		t.parts = append(t.parts, tracePart{text: rest[:open]}, tracePart{expr: expr, hex: hex})
+		rest = rest[open+end+1:]
+	}
+
+	if cpu.tracepoints == nil {
+		cpu.tracepoints = make(map[int][]*Tracepoint)
+	}
+	cpu.tracepoints[addr] = append(cpu.tracepoints[addr], t)
+	return t, nil
+}
+
+// ClearTracepoints removes every tracepoint at addr
+func (cpu *CPU) ClearTracepoints(addr int) {
+	delete(cpu.tracepoints, addr)
+}
+
+// Tracepoints lists the tracepoints, by increasing address
+func (cpu *CPU) Tracepoints() []*Tracepoint {
+	var list []*Tracepoint
+	for _, addr := range slices.Sorted(maps.Keys(cpu.tracepoints)) {
+		list = append(list, cpu.tracepoints[addr]...)
+	}
+	return list
+}
+
+func (t *Tracepoint) String() string {
+	if t.Cond != nil {
+		return fmt.Sprintf("0x%08X if %s: %s", t.Addr, t.Cond, t.Message)
+	}
+	return fmt.Sprintf("0x%08X: %s", t.Addr, t.Message)
+}
+
+// fire writes the tracepoint's line if its condition holds
+func (t *Tracepoint) fire(cpu *CPU) {
+	if t.Cond != nil {
+		if v, err := t.Cond.Eval(cpu); err == nil && v == 0 {
+			return
+		}
+	}
+	var b strings.Builder
+	for _, part := range t.parts {
+		b.WriteString(part.text)
+		if part.expr == nil {
+			continue
+		}
+		v, err := part.expr.Eval(cpu)
+		switch {
+		case err != nil:
+			b.WriteString("<error>")
+		case part.hex:
+			fmt.Fprintf(&b, "0x%08X", v)
+		default:
+			fmt.Fprintf(&b, "%d", int32(v))
+		}
+	}
+	b.WriteByte('\n')
+	io.WriteString(t.Out, b.String())
+}
+
+// fireTracepoints runs the tracepoints at pc, if there are any
+func (cpu *CPU) fireTracepoints(pc int) {
+	for _, t := range cpu.tracepoints[pc] {
+		t.fire(cpu)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// tracepointLoop sums 1..5 into a2, storing the running sum at the top of the
+// stack; tracepointLoopTop is the address of the loop's first instruction
+func tracepointLoop(b *Builder) {
+	b.Li(SP, 0x400)
+	b.Li(A0, 0)
+	b.Li(A2, 0)
+	b.Li(A1, 5)
+	b.Label("loop")
+	b.Addi(A0, A0, 1)
+	b.Add(A2, A2, A0)
+	b.Sw(A2, SP, 0)
+	b.Blt(A0, A1, "loop")
+	b.Ebreak()
+}
+
+const tracepointLoopTop = 0x10
+
+func TestTracepoints(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, tracepointLoop))
+	var all, late, bad strings.Builder
+	if _, err := cpu.SetTracepoint(tracepointLoopTop, "", "iter a0={a0} sum={a2} top={mem32[sp]:x}", &all); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cpu.SetTracepoint(tracepointLoopTop, "a0 > 2", "late {a0}", &late); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cpu.SetTracepoint(tracepointLoopTop+8, "", "{mem32[0x100000]}", &bad); err != nil {
+		t.Fatal(err)
+	}
+	runToEbreak(t, &cpu)
+
+	want := "iter a0=0 sum=0 top=0x00000000\n" +
+		"iter a0=1 sum=1 top=0x00000001\n" +
+		"iter a0=2 sum=3 top=0x00000003\n" +
+		"iter a0=3 sum=6 top=0x00000006\n" +
+		"iter a0=4 sum=10 top=0x0000000A\n"
+	if all.String() != want {
+		t.Errorf("tracepoint wrote:\n%s\nwant:\n%s", all.String(), want)
+	}
+	if late.String() != "late 3\nlate 4\n" {
+		t.Errorf("conditional tracepoint wrote %q", late.String())
+	}
+	if bad.String() != strings.Repeat("<error>\n", 5) {
+		t.Errorf("tracepoint outside memory wrote %q", bad.String())
+	}
+	if cpu.Regs[A2] != 15 {
+		t.Errorf("a2 = %d, tracepoints changed the result", cpu.Regs[A2])
+	}
+
+	list := cpu.Tracepoints()
+	if len(list) != 3 || list[1].String() != "0x00000010 if a0 > 2: late {a0}" {
+		t.Errorf("Tracepoints() = %v", list)
+	}
+	cpu.ClearTracepoints(tracepointLoopTop)
+	if len(cpu.Tracepoints()) != 1 {
+		t.Errorf("%d tracepoints left after clearing 0x10", len(cpu.Tracepoints()))
+	}
+
+	for _, message := range []string{"{a0", "{a0 +}"} {
+		if _, err := cpu.SetTracepoint(0, "", message, &all); err == nil {
+			t.Errorf("message %q accepted", message)
+		}
+	}
+	if _, err := cpu.SetTracepoint(0, "a0 >", "x", &all); err == nil {
+		t.Error("bad condition accepted")
+	}
+}
+
+func TestDebuggerTrace(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, tracepointLoop))
+	var out strings.Builder
+	in := "trace 0x10 if a0>=3 a0={a0} sum={a2}\nbreakpoints\ncontinue\ndelete 0x10\nbreakpoints\ntrace 0x10\nquit\n"
+	if err := NewDebugger(&cpu, strings.NewReader(in), &out, 0).Loop(); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	for _, want := range []string{
+		"trace 0x00000010 if a0>=3: a0={a0} sum={a2}\n",
+		"a0=3 sum=6\na0=4 sum=10\n",
+		"error: usage: trace <addr> [if <cond>] <message>",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "a0=2 ") || strings.Count(got, "trace 0x00000010") != 1 {
+		t.Errorf("the condition or delete didn't hold:\n%s", got)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// ============================================================================
+// Traps: exceptions and interrupts
+// ============================================================================
+// an instruction that can't complete (illegal encoding, bad memory access, ecall
+// with nobody to answer it, ...) raises an exception. how it's handled depends on
+// whether the program installed a trap handler:
+//   - mtvec == 0: there is no handler, so Step returns the *Exception as an error
+//     and Run stops with StopError (the behavior simple programs rely on)
+//   - mtvec != 0: the CPU traps like real hardware does: mepc, mcause and mtval
+//     are set and execution continues at the handler
+// interrupts (timer, external) are only ever taken when a handler is installed
+
+// exception cause codes (the value of mcause, see the privileged spec table 3.6)
+const (
+	CauseMisalignedFetch    = 0
+	CauseFetchAccessFault   = 1
+	CauseIllegalInstruction = 2
+	CauseBreakpoint         = 3
+	CauseLoadAccessFault    = 5
+	CauseStoreAccessFault   = 7
+	CauseEcallFromM         = 11
+)
+
+// interrupt cause codes (mcause with the top bit set) and their bit in mip/mie
+const (
+	InterruptSoftware = 3
+	InterruptTimer    = 7
+	InterruptExternal = 11
+
+	mcauseInterrupt = 1 << 31
+)
+
+// Exception is the error an instruction returns when it raises an exception
+type Exception struct {
+	Cause uint32 // one of the Cause* codes
+	Tval  uint32 // the faulting address or instruction, written to mtval
+	Msg   string // human-readable description, used when the exception stops Run
+}
+
+func (e *Exception) Error() string { return e.Msg }
+
+// illegalInstruction builds the exception for an encoding we can't execute
+func illegalInstruction(instr uint32, msg string) *Exception {
+	return &Exception{Cause: CauseIllegalInstruction, Tval: instr, Msg: fmt.Sprintf("%s (instruction 0x%08X)", msg, instr)}
+}
+
+// accessFault wraps a failed memory access into the matching exception
+func accessFault(cause, addr uint32, err error) *Exception {
+	return &Exception{Cause: cause, Tval: addr, Msg: err.Error()}
+}
+
+// trapsEnabled reports whether the program installed a trap handler
+func (cpu *CPU) trapsEnabled() bool {
+	return cpu.csrs[CSR_MTVEC] != 0
+}
+
+// trap enters the machine-mode trap handler for cause, interrupting the instruction at pc
+func (cpu *CPU) trap(cause, tval uint32, pc uint32) {
+	// stack the interrupt-enable bit: MPIE = MIE, MIE = 0 (MPP always says we came from machine mode)
+	status := cpu.MStatus()
+	cpu.SetMStatus(MStatus{MIE: false, MPIE: status.MIE})
+
+	cpu.csrs[CSR_MEPC] = pc
+	cpu.SetMCause(cause&mcauseInterrupt != 0, cause)
+	cpu.csrs[CSR_MTVAL] = tval
+
+	// vectored mode sends interrupts to base + 4*code, everything else goes to base
+	base, mode := cpu.MTVec()
+	interrupt, code := cpu.MCause()
+	target := base
+	if mode == TVecVectored && interrupt {
+		target += 4 * code
+	}
+	cpu.PC = int(target)
+}
+
+// takeException traps for exc if a handler is installed; otherwise it hands exc back as the error
+func (cpu *CPU) takeException(exc *Exception, pc uint32) error {
+	if !cpu.trapsEnabled() {
+		return exc
+	}
+	if cpu.Logger.Enabled(context.Background(), slog.LevelDebug) {
+		cpu.Logger.Debug("exception", "cause", exc.Cause, "pc", fmt.Sprintf("0x%08X", pc), "tval", fmt.Sprintf("0x%08X", exc.Tval))
+	}
+	if cpu.hpmActive {
+		cpu.countEvent(HPMEventException, 1)
+	}
+	cpu.trap(exc.Cause, exc.Tval, pc)
+	return nil
+}
+
+// takePendingInterrupt traps for the highest priority interrupt that is pending and enabled
+// (external, then software, then timer) and reports whether it did
+func (cpu *CPU) takePendingInterrupt() bool {
+	if !cpu.trapsEnabled() || !cpu.MStatusMIE() {
+		return false
+	}
+	pending := cpu.csrs[CSR_MIP] & cpu.csrs[CSR_MIE]
+	if pending == 0 {
+		return false
+	}
+	for _, code := range []uint32{InterruptExternal, InterruptSoftware, InterruptTimer} {
+		if cpu.InterruptPending(code) && cpu.InterruptEnabled(code) {
+			if cpu.Logger.Enabled(context.Background(), slog.LevelDebug) {
+				cpu.Logger.Debug("interrupt", "code", code, "pc", fmt.Sprintf("0x%08X", cpu.PC))
+			}
+			cpu.trap(mcauseInterrupt|code, 0, uint32(cpu.PC))
+			return true
+		}
+	}
+	return false
+}
+
+// SetInterruptPending sets or clears an interrupt's bit in mip (devices call this to raise their lines)
+func (cpu *CPU) SetInterruptPending(code uint32, pending bool) {
+	cpu.setCSRBit(CSR_MIP, code, pending)
+}
+
+// MRET (return from a machine-mode trap - restores the interrupt-enable bit and jumps back to mepc)
+func (cpu *CPU) executeMret() error {
+	cpu.SetMStatus(MStatus{MIE: cpu.MStatusMPIE(), MPIE: true})
+	cpu.PC = int(cpu.csrs[CSR_MEPC])
+	return nil
+}
+
+// WFI (wait for interrupt - a hint, so doing nothing is a valid implementation:
+// the guest's idle loop keeps running until the interrupt it waits for is taken)
+func (cpu *CPU) executeWfi() error {
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import "fmt"
+
+// ============================================================================
+// Debug triggers
+// ============================================================================
+// the trigger module of the debug spec, the way debuggers set hardware
+// breakpoints and watchpoints: tselect picks one of triggerCount triggers and
+// tdata1 and tdata2 are its registers (tselect ignores a number past the last,
+// which is how software counts them). every trigger is an address match
+// (mcontrol, type 2) whose tdata1 has
+//
+//	bit 20     hit: set by the emulator when the trigger fires
+//	bits 15:12 action: 0 raises a breakpoint exception, 1 halts to the debugger
+//	bit 6      m: match in machine mode (the only mode, so a trigger needs it)
+//	bit 2      execute: match the address of an instruction about to run
+//	bit 1      store: match the address of a store
+//	bit 0      load: match the address of a load
+//
+// and tdata2 the address. a load or store matches when tdata2 is any of the
+// bytes it accesses. a match fires before the instruction does anything: with
+// action 0 and a trap handler installed it's a breakpoint exception (mepc is the
+// instruction, mtval the matched address); otherwise Run stops with
+// StopBreakpoint at the instruction, which then runs without matching once it's
+// resumed. the other fields read as zero (match is always "equal").
+//
+// gdb's hardware breakpoints and watchpoints (its Z1 to Z4 packets) program
+// them through the stub (gdbstub.go). nothing is checked while no trigger is
+// enabled; while one is, Run executes an instruction at a time instead of basic
+// blocks
+
+// triggerCount is how many triggers there are
+const triggerCount = 4
+
+// tdata1 fields of an mcontrol trigger
+const (
+	mcontrolType      = 2 << 28
+	mcontrolHit       = 1 << 20
+	mcontrolActionBit = 12
+	mcontrolM         = 1 << 6
+	mcontrolExecute   = 1 << 2
+	mcontrolStore     = 1 << 1
+	mcontrolLoad      = 1 << 0
+
+	mcontrolAccesses = mcontrolExecute | mcontrolStore | mcontrolLoad
+	mcontrolWritable = mcontrolHit | 1<<mcontrolActionBit | mcontrolM | mcontrolAccesses
+)
+
+// Trigger is an address trigger, taken apart
+type Trigger struct {
+	Execute, Load, Store bool   // which accesses match
+	Addr                 uint32 // the address they match
+	Halt                 bool   // halt to the debugger even when a trap handler is installed
+	Hit                  bool   // the trigger has fired since Hit was last cleared
+}
+
+// debugTrigger is the state of one trigger
+type debugTrigger struct {
+	tdata1, tdata2 uint32
+}
+
+// triggerHalt is what an instruction returns when a trigger stops Run
+type triggerHalt struct {
+	addr uint32
+}
+
+func (h *triggerHalt) Error() string { return fmt.Sprintf("trigger hit at 0x%08X", h.addr) }
+
+// Trigger returns trigger i
+func (cpu *CPU) Trigger(i int) (Trigger, error) {
+	if i < 0 || i >= triggerCount {
+		return Trigger{}, fmt.Errorf("trigger %d does not exist (there are %d)", i, triggerCount)
+	}
+	t := cpu.triggers[i]
+	return Trigger{
+		Execute: t.tdata1&mcontrolExecute != 0,
+		Load:    t.tdata1&mcontrolLoad != 0,
+		Store:   t.tdata1&mcontrolStore != 0,
+		Addr:    t.tdata2,
+		Halt:    t.tdata1>>mcontrolActionBit&1 != 0,
+		Hit:     t.tdata1&mcontrolHit != 0,
+	}, nil
+}
+
+// SetTrigger programs trigger i, like a guest writing its tdata1 and tdata2
+// (a Trigger matching nothing disables it)
+func (cpu *CPU) SetTrigger(i int, t Trigger) error {
+	if i < 0 || i >= triggerCount {
+		return fmt.Errorf("trigger %d does not exist (there are %d)", i, triggerCount)
+	}
+	var tdata1 uint32 = mcontrolM
+	for _, f := range []struct {
+		on  bool
+		bit uint32
+	}{{t.Execute, mcontrolExecute}, {t.Load, mcontrolLoad}, {t.Store, mcontrolStore}, {t.Halt, 1 << mcontrolActionBit}, {t.Hit, mcontrolHit}} {
+		if f.on {
+			tdata1 |= f.bit
+		}
+	}
+	cpu.triggers[i] = debugTrigger{tdata1: tdata1, tdata2: t.Addr}
+	cpu.updateTriggers()
+	return nil
+}
+
+// readTriggerCSR reads tselect, tdata1, tdata2 or tinfo
+func (cpu *CPU) readTriggerCSR(addr uint32) uint32 {
+	t := cpu.triggers[cpu.csrs[CSR_TSELECT]]
+	switch addr {
+	case CSR_TDATA1:
+		return mcontrolType | t.tdata1
+	case CSR_TDATA2:
+		return t.tdata2
+	case CSR_TINFO:
+		return 1 << (mcontrolType >> 28) // the types there are
+	}
+	return cpu.csrs[CSR_TSELECT]
+}
+
+// writeTriggerCSR writes tselect, tdata1 or tdata2 (tinfo is read-only)
+func (cpu *CPU) writeTriggerCSR(addr, value uint32) {
+	t := &cpu.triggers[cpu.csrs[CSR_TSELECT]]
+	switch addr {
+	case CSR_TSELECT:
+		if value < triggerCount {
+			cpu.csrs[CSR_TSELECT] = value
+		}
+	case CSR_TDATA1:
+		if value>>mcontrolActionBit&0xF > 1 { // only the two actions there are
+			value &^= 0xF << mcontrolActionBit
+		}
+		t.tdata1 = value & mcontrolWritable
+	case CSR_TDATA2:
+		t.tdata2 = value
+	}
+	cpu.updateTriggers()
+}
+
+// updateTriggers notes whether any trigger can fire
+func (cpu *CPU) updateTriggers() {
+	cpu.triggersActive = false
+	for _, t := range cpu.triggers {
+		if t.tdata1&mcontrolM != 0 && t.tdata1&mcontrolAccesses != 0 {
+			cpu.triggersActive = true
+		}
+	}
+}
+
+// checkTriggers fires the first trigger matching an access of kind (one of the
+// mcontrol access bits) to [addr, addr+size) by the instruction at pc, if any.
+// the error is the breakpoint exception or a *triggerHalt
+func (cpu *CPU) checkTriggers(kind, addr, size, pc uint32) error {
+	if cpu.triggerSkip {
+		return nil
+	}
+	for i := range cpu.triggers {
+		t := &cpu.triggers[i]
+		if t.tdata1&mcontrolM == 0 || t.tdata1&kind == 0 || t.tdata2-addr >= size {
+			continue
+		}
+		t.tdata1 |= mcontrolHit
+		if t.tdata1>>mcontrolActionBit&1 == 0 && cpu.trapsEnabled() {
+			return &Exception{Cause: CauseBreakpoint, Tval: t.tdata2, Msg: fmt.Sprintf("trigger %d hit at 0x%08X", i, t.tdata2)}
+		}
+		return &triggerHalt{addr: pc}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import "testing"
+
+// triggerTarget is the address of the function triggerProgram calls twice
+const triggerTarget = 0x100
+
+// triggerProgram counts the triggers (into a3), programs trigger 0 to execute
+// match addr, loads from triggerTarget and calls it twice. the trap handler
+// records mcause, mtval, mepc and tdata1 in s1, s2, s3 and a4 and counts the
+// traps in s4 (s6 is the count before the calls), then disables the trigger and
+// retries the instruction. the function counts its calls in s5. at the end it
+// loads from 0x204 and stores to 0x200, for watchpoints, and stops at an ebreak
+func triggerProgram(addr int32) func(b *Builder) {
+	return func(b *Builder) {
+		b.J("main")
+		b.Csrrs(S1, CSR_MCAUSE, ZERO)
+		b.Csrrs(S2, CSR_MTVAL, ZERO)
+		b.Csrrs(S3, CSR_MEPC, ZERO)
+		b.Addi(S4, S4, 1)
+		b.Csrrw(A4, CSR_TDATA1, ZERO)
+		b.Mret()
+
+		b.Label("main")
+		b.Li(T0, 4)
+		b.Csrrw(ZERO, CSR_MTVEC, T0)
+		// write tselect until it doesn't take the number
+		b.Label("count")
+		b.Csrrw(ZERO, CSR_TSELECT, A3)
+		b.Csrrs(T1, CSR_TSELECT, ZERO)
+		b.Bne(T1, A3, "counted")
+		b.Addi(A3, A3, 1)
+		b.Li(T2, 16)
+		b.Blt(A3, T2, "count")
+		b.Label("counted")
+		b.Csrrw(ZERO, CSR_TSELECT, ZERO)
+		b.Li(T0, addr)
+		b.Csrrw(ZERO, CSR_TDATA2, T0)
+		b.Li(T0, mcontrolM|mcontrolExecute)
+		b.Csrrw(ZERO, CSR_TDATA1, T0)
+
+		b.Lw(T1, ZERO, triggerTarget) // reading the address doesn't execute it
+		b.Mv(S6, S4)
+		b.Call("target")
+		b.Call("target")
+		b.Lw(T1, ZERO, 0x204)
+		b.Sw(S5, ZERO, 0x200)
+		b.Csrrw(ZERO, CSR_MTVEC, ZERO)
+		b.Ebreak()
+
+		b.Space(triggerTarget - b.Len())
+		b.Label("target")
+		b.Addi(S5, S5, 1)
+		b.Ret()
+	}
+}
+
+func TestTriggerFromGuest(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		addr  int32
+		traps uint32
+	}{
+		{"matching", triggerTarget, 1},
+		{"not matching", triggerTarget + 8, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cpu := NewCPUWithMemory(0x1000)
+			cpu.LoadProgram(assemble(t, triggerProgram(tc.addr)))
+			runToEbreak(t, &cpu)
+			if cpu.Regs[A3] != triggerCount {
+				t.Errorf("the guest counted %d triggers, want %d", cpu.Regs[A3], triggerCount)
+			}
+			if cpu.Regs[S4] != tc.traps || cpu.Regs[S6] != 0 {
+				t.Errorf("%d traps (%d before the calls), want %d and 0", cpu.Regs[S4], cpu.Regs[S6], tc.traps)
+			}
+			if cpu.Regs[S5] != 2 {
+				t.Errorf("the function ran %d times, want 2", cpu.Regs[S5])
+			}
+			if tc.traps == 0 {
+				return
+			}
+			if cpu.Regs[S1] != CauseBreakpoint || cpu.Regs[S2] != triggerTarget || cpu.Regs[S3] != triggerTarget {
+				t.Errorf("mcause %d, mtval 0x%X, mepc 0x%X; want a breakpoint at 0x%X", cpu.Regs[S1], cpu.Regs[S2], cpu.Regs[S3], triggerTarget)
+			}
+			if cpu.Regs[A4] != mcontrolType|mcontrolHit|mcontrolM|mcontrolExecute {
+				t.Errorf("the handler found tdata1 = 0x%08X, want the hit bit set", cpu.Regs[A4])
+			}
+			if trig, _ := cpu.Trigger(0); trig.Execute {
+				t.Errorf("trigger 0 = %+v after the handler disabled it", trig)
+			}
+		})
+	}
+}
+
+func TestTriggerHaltsRun(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, triggerProgram(triggerTarget+8)))
+	if err := cpu.SetTrigger(1, Trigger{Execute: true, Addr: triggerTarget, Halt: true}); err != nil {
+		t.Fatal(err)
+	}
+	for call := 1; call <= 2; call++ {
+		if reason, err := cpu.Run(1000); reason != StopBreakpoint || err != nil || cpu.PC != triggerTarget {
+			t.Fatalf("call %d: stopped with %v, %v at 0x%X; want the trigger at 0x%X", call, reason, err, cpu.PC, triggerTarget)
+		}
+		if cpu.Regs[S5] != uint32(call-1) {
+			t.Errorf("call %d: the function ran %d times before the trigger", call, cpu.Regs[S5])
+		}
+		trig, _ := cpu.Trigger(1)
+		if !trig.Hit {
+			t.Errorf("call %d: the hit bit isn't set", call)
+		}
+		trig.Hit = false
+		cpu.SetTrigger(1, trig)
+	}
+	runToEbreak(t, &cpu)
+	if cpu.Regs[S5] != 2 || cpu.Regs[S4] != 0 {
+		t.Errorf("the function ran %d times, %d traps", cpu.Regs[S5], cpu.Regs[S4])
+	}
+
+	if err := cpu.SetTrigger(triggerCount, Trigger{}); err == nil {
+		t.Error("SetTrigger accepted a trigger past the last")
+	}
+	if _, err := cpu.Trigger(-1); err == nil {
+		t.Error("Trigger accepted -1")
+	}
+}
+
+func TestTriggerCSRs(t *testing.T) {
+	cpu := NewCPUWithMemory(0x1000)
+	csrw(t, &cpu, CSR_TSELECT, 2)
+	csrw(t, &cpu, CSR_TDATA2, 0x1234)
+	csrw(t, &cpu, CSR_TDATA1, 0xFFFFFFFF)
+	if got := csrr(t, &cpu, CSR_TDATA1); got != mcontrolType|mcontrolHit|mcontrolM|mcontrolAccesses {
+		t.Errorf("tdata1 = 0x%08X with every bit written (the action isn't 0 or 1)", got)
+	}
+	want := Trigger{Execute: true, Load: true, Store: true, Addr: 0x1234, Hit: true}
+	if trig, _ := cpu.Trigger(2); trig != want {
+		t.Errorf("Trigger(2) = %+v, want %+v", trig, want)
+	}
+	csrw(t, &cpu, CSR_TSELECT, triggerCount)
+	if got := csrr(t, &cpu, CSR_TSELECT); got != 2 {
+		t.Errorf("tselect = %d after selecting a trigger past the last", got)
+	}
+	if got := csrr(t, &cpu, CSR_TINFO); got != 1<<2 {
+		t.Errorf("tinfo = 0x%X, want only mcontrol", got)
+	}
+}
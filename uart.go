@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io"
+	"sort"
+)
+
+// ============================================================================
+// UART (a 16550-compatible serial port)
+// ============================================================================
+// only what a polled or interrupt-driven console driver touches is modelled:
+// a byte written to THR is sent to the output immediately, and received bytes
+// queue up in an unbounded FIFO read through RBR. the RX interrupt (IER bit 0)
+// and the THR-empty interrupt (IER bit 1) drive the machine external interrupt.
+//
+// received bytes come from one of two places:
+//   - a live reader (e.g. stdin), drained by a goroutine: bytes arrive whenever the
+//     host delivers them, so the instruction they show up at varies between runs
+//   - a schedule of UARTInput events, delivered when the retired instruction count
+//     reaches each event's At (the only source used by WithDeterministic)
+
+// register offsets (one byte apart)
+const (
+	uartRBR = 0 // receive buffer (read), transmit holding register THR (write)
+	uartIER = 1 // interrupt enable
+	uartIIR = 2 // interrupt identification (read), FIFO control FCR (write)
+	uartLCR = 3 // line control; bit 7 (DLAB) swaps offsets 0 and 1 for the divisor latch
+	uartMCR = 4 // modem control
+	uartLSR = 5 // line status
+	uartMSR = 6 // modem status
+	uartSCR = 7 // scratch
+
+	UARTSize = 0x100
+)
+
+const (
+	uartIERRx   = 0x01 // interrupt when data is available
+	uartIERTx   = 0x02 // interrupt when THR is empty (always, since output is immediate)
+	uartLCRDLAB = 0x80
+	uartLSRDR   = 0x01 // data ready
+	uartLSRTHRE = 0x20 // THR empty
+	uartLSRTEMT = 0x40 // transmitter empty
+	uartIIRNone = 0x01 // no interrupt pending
+	uartIIRTx   = 0x02
+	uartIIRRx   = 0x04
+)
+
+// UARTInput is a chunk of received data delivered once At instructions have retired
+type UARTInput struct {
+	At   uint64
+	Data []byte
+}
+
+// UART is the serial console device
+type UART struct {
+	out                io.Writer
+	rx                 []byte      // received but not yet read
+	live               chan []byte // chunks read from a live input, nil without one
+	schedule           []UARTInput // sorted by At, delivered front to back
+	ier, lcr, mcr, scr uint8
+	divisor            uint16
+}
+
+// NewUART creates a UART whose transmitted bytes go to out
+func NewUART(out io.Writer) *UART {
+	if out == nil {
+		out = io.Discard
+	}
+	return &UART{out: out}
+}
+
+// SetLiveInput starts delivering bytes read from r as they arrive
+func (u *UART) SetLiveInput(r io.Reader) {
+	u.live = make(chan []byte, 16)
+	go func() {
+		defer close(u.live)
+		for {
+			buf := make([]byte, 256)
+			n, err := r.Read(buf)
+			if n > 0 {
+				u.live <- buf[:n]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Schedule adds input events; each one is delivered when the instruction count reaches its At
+func (u *UART) Schedule(events ...UARTInput) {
+	u.schedule = append(u.schedule, events...)
+	sort.SliceStable(u.schedule, func(i, j int) bool { return u.schedule[i].At < u.schedule[j].At })
+}
+
+func (u *UART) Read(offset, size uint32) (uint32, error) {
+	switch offset {
+	case uartRBR:
+		if u.lcr&uartLCRDLAB != 0 {
+			return uint32(u.divisor & 0xFF), nil
+		}
+		if len(u.rx) == 0 {
+			return 0, nil
+		}
+		b := u.rx[0]
+		u.rx = u.rx[1:]
+		return uint32(b), nil
+	case uartIER:
+		if u.lcr&uartLCRDLAB != 0 {
+			return uint32(u.divisor >> 8), nil
+		}
+		return uint32(u.ier), nil
+	case uartIIR:
+		switch {
+		case u.ier&uartIERRx != 0 && len(u.rx) > 0:
+			return uartIIRRx, nil
+		case u.ier&uartIERTx != 0:
+			return uartIIRTx, nil
+		}
+		return uartIIRNone, nil
+	case uartLCR:
+		return uint32(u.lcr), nil
+	case uartMCR:
+		return uint32(u.mcr), nil
+	case uartLSR:
+		lsr := uint32(uartLSRTHRE | uartLSRTEMT)
+		if len(u.rx) > 0 {
+			lsr |= uartLSRDR
+		}
+		return lsr, nil
+	case uartSCR:
+		return uint32(u.scr), nil
+	}
+	return 0, nil // MSR and unused offsets
+}
+
+func (u *UART) Write(offset, size, value uint32) error {
+	b := uint8(value)
+	switch offset {
+	case uartRBR:
+		if u.lcr&uartLCRDLAB != 0 {
+			u.divisor = u.divisor&0xFF00 | uint16(b)
+			return nil
+		}
+		_, err := u.out.Write([]byte{b})
+		return err
+	case uartIER:
+		if u.lcr&uartLCRDLAB != 0 {
+			u.divisor = u.divisor&0x00FF | uint16(b)<<8
+			return nil
+		}
+		u.ier = b & (uartIERRx | uartIERTx)
+	case uartLCR:
+		u.lcr = b
+	case uartMCR:
+		u.mcr = b
+	case uartSCR:
+		u.scr = b
+	}
+	return nil // FCR and the read-only registers ignore writes
+}
+
+// Tick delivers due input and updates the external interrupt line
+func (u *UART) Tick(cpu *CPU) {
+	for len(u.schedule) > 0 && u.schedule[0].At <= cpu.Retired {
+		u.rx = append(u.rx, u.schedule[0].Data...)
+		u.schedule = u.schedule[1:]
+	}
+	if u.live != nil {
+		select {
+		case chunk, ok := <-u.live:
+			if ok {
+				u.rx = append(u.rx, chunk...)
+			} else {
+				u.live = nil
+			}
+		default:
+		}
+	}
+
+	pending := u.ier&uartIERRx != 0 && len(u.rx) > 0 || u.ier&uartIERTx != 0
+	cpu.SetInterruptPending(InterruptExternal, pending)
+}
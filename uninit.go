@@ -0,0 +1,74 @@
+package main
+
+import "fmt"
+
+// ============================================================================
+// Uninitialized read detection
+// ============================================================================
+// memory starts out as zeros, so a program reading a variable it never set
+// usually just carries on with a wrong value. with WithUninitCheck the CPU keeps
+// a bitset of the RAM bytes that have been written, by a loader (including the
+// zero-filled BSS of an ELF file), a syscall handler or a guest store, and
+// reports loads and instruction fetches of bytes that never were.
+// it costs a bit test on every load, store and fetch, so it's off by default
+
+// UninitializedReadError reports a load or fetch of memory nothing has written
+type UninitializedReadError struct {
+	PC    uint32 // the load instruction, or the address fetched from
+	Addr  uint32 // the first uninitialized byte
+	Fetch bool   // whether it was an instruction fetch
+}
+
+func (e *UninitializedReadError) Error() string {
+	what := "load from"
+	if e.Fetch {
+		what = "instruction fetch from"
+	}
+	return fmt.Sprintf("%s uninitialized memory at 0x%08X (pc=0x%08X)", what, e.Addr, e.PC)
+}
+
+// uninitTracker is the written-bytes bitset
+type uninitTracker struct {
+	written []uint64 // bit i is set once byte i has been written
+	fatal   bool     // return an error instead of logging a warning
+}
+
+// WithUninitCheck turns on uninitialized read detection. if fatal is set the
+// offending instruction fails with an UninitializedReadError; otherwise a warning
+// is logged and the bytes count as initialized from then on, so each location is
+// reported once
+func WithUninitCheck(fatal bool) Option {
+	return func(cpu *CPU) {
+		cpu.uninit = &uninitTracker{
+			written: make([]uint64, (len(cpu.Memory)+63)/64),
+			fatal:   fatal,
+		}
+	}
+}
+
+// checkInitialized reports a read of size bytes at addr (which must be inside RAM)
+// that touches a byte never written, made by the instruction at pc
+func (cpu *CPU) checkInitialized(pc, addr, size uint32, fetch bool) error {
+	t := cpu.uninit
+	for a := addr; a < addr+size; a++ {
+		if off := a - cpu.ramBase; t.written[off/64]&(1<<(off%64)) != 0 {
+			continue
+		}
+		err := &UninitializedReadError{PC: pc, Addr: a, Fetch: fetch}
+		if t.fatal {
+			return err
+		}
+		cpu.Logger.Warn(err.Error())
+		t.markInitialized(addr-cpu.ramBase, size, len(cpu.Memory))
+		return nil
+	}
+	return nil
+}
+
+// markInitialized sets the bits of [off, off+n) of RAM (clipped to its size)
+func (t *uninitTracker) markInitialized(off, n uint32, memSize int) {
+	end := min(uint64(off)+uint64(n), uint64(memSize))
+	for a := uint64(off); a < end; a++ {
+		t.written[a/64] |= 1 << (a % 64)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+// uninitCPU is a CPU with uninitialized read detection, logging its warnings to log
+func uninitCPU(fatal bool, log *bytes.Buffer) *CPU {
+	cpu := NewCPUWithMemory(0x1000, WithUninitCheck(fatal))
+	cpu.Logger = slog.New(slog.NewTextHandler(log, nil))
+	return &cpu
+}
+
+// a program that only reads what it wrote first runs to the end without a report
+func TestUninitClean(t *testing.T) {
+	for _, fatal := range []bool{true, false} {
+		var log bytes.Buffer
+		cpu := uninitCPU(fatal, &log)
+		cpu.LoadProgram(assemble(t, func(b *Builder) {
+			b.Li(T0, 0x800)
+			b.Li(T1, 5)
+			b.Sw(T1, T0, 0)
+			b.Lw(A0, T0, 0)
+			b.Sb(T1, T0, 0x11)
+			b.Lbu(A1, T0, 0x11)
+			b.Ebreak()
+		}))
+		runToEbreak(t, cpu)
+		if cpu.Regs[A0] != 5 || cpu.Regs[A1] != 5 || log.Len() != 0 {
+			t.Errorf("fatal %v: a0=%d a1=%d, log %q; want 5, 5 and no warnings", fatal, cpu.Regs[A0], cpu.Regs[A1], log.String())
+		}
+	}
+}
+
+// a load of a word that was never written is reported at the load, naming the first unwritten byte
+func TestUninitLoad(t *testing.T) {
+	program := assemble(t, func(b *Builder) {
+		b.Li(T0, 0x800)
+		b.Sh(T0, T0, 0)
+		b.Lw(A0, T0, 0) // 0xC: bytes 0x802 and 0x803 were never written
+		b.Lw(A0, T0, 0) // reported once, so this one passes with a warning
+		b.Ebreak()
+	})
+
+	var log bytes.Buffer
+	cpu := uninitCPU(true, &log)
+	cpu.LoadProgram(program)
+	_, err := cpu.Run(100)
+	var uninit *UninitializedReadError
+	if !errors.As(err, &uninit) || *uninit != (UninitializedReadError{PC: 0xC, Addr: 0x802}) {
+		t.Fatalf("stopped with %v, want the load at 0xC reported", err)
+	}
+	if want := "load from uninitialized memory at 0x00000802 (pc=0x0000000C)"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err, want)
+	}
+
+	cpu = uninitCPU(false, &log)
+	cpu.LoadProgram(program)
+	runToEbreak(t, cpu)
+	want := `level=WARN msg="load from uninitialized memory at 0x00000802 (pc=0x0000000C)"`
+	if n := bytes.Count(log.Bytes(), []byte("level=WARN")); n != 1 || !bytes.Contains(log.Bytes(), []byte(want)) {
+		t.Errorf("the log has %d warnings, want one with %s:\n%s", n, want, log.String())
+	}
+}
+
+// what the loader wrote, including an ELF file's zero-filled BSS, is initialized;
+// the byte after the BSS isn't
+func TestUninitLoaderInitialized(t *testing.T) {
+	const bss = 0x40 // bytes of BSS after the image
+	var code []byte
+	build := func(b *Builder) {
+		b.Lw(A0, ZERO, int32(len(code)))         // the data word in the file
+		b.Lw(A1, ZERO, int32(len(code)+4+bss-4)) // the last word of the BSS
+		b.Lbu(A2, ZERO, int32(len(code)+4+bss))  // 0x8: just past it
+		b.Ebreak()
+	}
+	code = assemble(t, build)
+	code = assemble(t, build)
+	image := binary.LittleEndian.AppendUint32(code, 0x1234)
+	data := buildELF(image, 0, map[string]uint32{"_start": 0}, "_start")
+	// give the segment BSS by raising its Memsz, the sixth word of the program header
+	binary.LittleEndian.PutUint32(data[52+20:], uint32(len(image)+bss))
+
+	var log bytes.Buffer
+	cpu := uninitCPU(true, &log)
+	if _, err := cpu.LoadELF(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := cpu.Run(100)
+	var uninit *UninitializedReadError
+	if !errors.As(err, &uninit) || *uninit != (UninitializedReadError{PC: 0x8, Addr: uint32(len(image) + bss)}) {
+		t.Fatalf("stopped with %v, want only the load past the BSS at 0x8 reported", err)
+	}
+	if cpu.Regs[A0] != 0x1234 || cpu.Regs[A1] != 0 {
+		t.Errorf("a0=0x%X a1=0x%X, want the data word and a zero from the BSS", cpu.Regs[A0], cpu.Regs[A1])
+	}
+
+	// and a raw image is initialized as far as it goes, instructions included
+	log.Reset()
+	cpu = uninitCPU(true, &log)
+	cpu.LoadProgram(assemble(t, func(b *Builder) {
+		b.Lw(A0, ZERO, 0x8)
+		b.Ebreak()
+		b.Word(0x5678)
+	}))
+	runToEbreak(t, cpu)
+	if cpu.Regs[A0] != 0x5678 || log.Len() != 0 {
+		t.Errorf("a0=0x%X, log %q; want the word after the ebreak and no warnings", cpu.Regs[A0], log.String())
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ============================================================================
+// Static program validation
+// ============================================================================
+// Validate lints a loaded program without running it: it walks the text the
+// loaders recorded and reports what is bound to fail once executed. it can't
+// tell code from data, so words that aren't instructions are only warnings;
+// errors are for instructions that decode fine but can't possibly work:
+//   - branch and jump targets that are misaligned or outside memory
+//   - loads, stores and jalr through an address built by lui/auipc + addi
+//     that is outside memory and every device
+//
+// addresses built in registers are followed within straight-line code only,
+// everything is forgotten after a branch or jump. a word made of four printable
+// characters is most likely a string, so its errors are downgraded to warnings
+
+// Severity says how sure Validate is that an issue is a real problem
+type Severity int
+
+const (
+	SeverityWarning Severity = iota // suspicious, e.g. data in the text section
+	SeverityError                   // fails if it's ever executed
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Issue is one thing Validate found
+type Issue struct {
+	Severity Severity
+	Addr     uint32 // where the instruction is
+	Instr    uint32
+	Disasm   string
+	Msg      string
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("0x%08X: %s: %s    [%08X  %s]", i.Addr, i.Severity, i.Msg, i.Instr, i.Disasm)
+}
+
+// Validate checks the program loaded into cpu (by LoadProgram, LoadProgramAt or LoadELF)
+func Validate(cpu *CPU) []Issue {
+	var issues []Issue
+	for _, r := range cpu.text {
+		issues = append(issues, cpu.validateRange(r)...)
+	}
+	return issues
+}
+
+// validateRange checks the instructions in one text range
+func (cpu *CPU) validateRange(r memRange) []Issue {
+	var issues []Issue
+
+	// known[i] is set when register i is known to hold value[i] at this point
+	var known [32]bool
+	var value [32]uint32
+	forget := func() {
+		known = [32]bool{}
+		known[ZERO] = true
+	}
+	forget()
+
+	end := uint64(r.addr) + uint64(r.len)
+	for pc := uint64(r.addr+3) &^ 3; pc+4 <= end; pc += 4 {
+		addr := uint32(pc)
+		off, ok := cpu.ramOffset(addr, 4)
+		if !ok {
+			break
+		}
+		instr := binary.LittleEndian.Uint32(cpu.Memory[off:])
+		text, ok := Disassemble(instr, addr)
+		report := func(sev Severity, format string, args ...any) {
+			if sev == SeverityError && printable(cpu.Memory[off:off+4]) {
+				sev = SeverityWarning
+				format += " (or it's text)"
+			}
+			issues = append(issues, Issue{Severity: sev, Addr: addr, Instr: instr, Disasm: text, Msg: fmt.Sprintf(format, args...)})
+		}
+
+		if instr == 0 {
+			report(SeverityWarning, "all-zero word (illegal on hardware, a no-op here): data in the text section?")
+			forget()
+			continue
+		}
+		if _, custom := cpu.custom[instr&0x7F]; !ok && !custom {
+			if ext := extensionOf(instr); ext != "" {
+				report(SeverityWarning, "needs the %s extension, which isn't implemented", ext)
+			} else {
+				report(SeverityWarning, "not a valid instruction: data in the text section?")
+			}
+			forget()
+			continue
+		}
+
+		d := decode(instr)
+		switch d.opcode {
+		case JAL, BRANCH:
+			cpu.checkTarget(addr+d.imm, report)
+			forget()
+			continue
+		case JALR:
+			if known[d.rs1] {
+				cpu.checkTarget((value[d.rs1]+d.imm)&^1, report)
+			}
+			forget()
+			continue
+		case LOAD, STORE:
+			if known[d.rs1] {
+				target := value[d.rs1] + d.imm
+				size := uint32(1) << (d.funct3 & 0x3)
+				if !cpu.mapped(target, size) {
+					report(SeverityError, "address 0x%08X is outside memory and every device", target)
+				}
+			}
+		}
+
+		// keep track of the registers the instruction sets
+		switch {
+		case d.rd == ZERO || d.opcode == STORE || d.opcode == MISC_MEM:
+		case d.opcode == LUI:
+			known[d.rd], value[d.rd] = true, d.imm<<12
+		case d.opcode == AUIPC:
+			known[d.rd], value[d.rd] = true, addr+d.imm<<12
+		case d.opcode == OP_IMM && d.funct3 == 0x0 && known[d.rs1]:
+			known[d.rd], value[d.rd] = true, value[d.rs1]+d.imm
+		default:
+			known[d.rd] = false
+		}
+	}
+	return issues
+}
+
+// checkTarget reports a jump to target that can't work
+func (cpu *CPU) checkTarget(target uint32, report func(Severity, string, ...any)) {
+	switch {
+	case target%4 != 0:
+		report(SeverityError, "target 0x%08X is misaligned", target)
+	case cpu.checkRange(target, 4) != nil:
+		report(SeverityError, "target 0x%08X is outside memory", target)
+	case !cpu.inText(target):
+		report(SeverityWarning, "target 0x%08X is outside the loaded program", target)
+	}
+}
+
+// mapped reports whether [addr, addr+size) is RAM or belongs to a device
+func (cpu *CPU) mapped(addr, size uint32) bool {
+	if cpu.checkRange(addr, size) == nil {
+		return true
+	}
+	_, ok := cpu.findDevice(addr, size)
+	return ok
+}
+
+// inText reports whether addr is in memory a loader put code in
+func (cpu *CPU) inText(addr uint32) bool {
+	for _, r := range cpu.text {
+		if addr >= r.addr && uint64(addr) < uint64(r.addr)+uint64(r.len) {
+			return true
+		}
+	}
+	return false
+}
+
+// printable reports whether b is all printable ASCII
+func printable(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7E {
+			return false
+		}
+	}
+	return true
+}
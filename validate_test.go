@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// validateProgram loads program into 4 KiB of memory and validates it
+func validateProgram(t *testing.T, build func(b *Builder)) []Issue {
+	t.Helper()
+	cpu := NewCPUWithMemory(0x1000)
+	cpu.LoadProgram(assemble(t, build))
+	return Validate(&cpu)
+}
+
+func TestValidateClean(t *testing.T) {
+	issues := validateProgram(t, func(b *Builder) {
+		b.Li(T0, 0x800) // lui + addi
+		b.Li(A0, 10)
+		b.Label("loop")
+		b.Sw(A0, T0, 0)
+		b.Call("decrement")
+		b.Bne(A0, ZERO, "loop")
+		b.Ebreak()
+		b.Label("decrement")
+		b.Addi(A0, A0, -1)
+		b.Ret()
+	})
+	if len(issues) != 0 {
+		t.Fatalf("a clean program has issues %v", issues)
+	}
+}
+
+func TestValidateIllegalWord(t *testing.T) {
+	issues := validateProgram(t, func(b *Builder) {
+		b.Nop()
+		b.Word(0xFFFFFFFF)
+		b.Word(0x02B50533) // mul a0, a0, a1
+		b.Word(0)
+		b.Ebreak()
+	})
+	want := []struct {
+		addr uint32
+		msg  string
+	}{
+		{0x4, "not a valid instruction: data in the text section?"},
+		{0x8, "needs the M extension, which isn't implemented"},
+		{0xC, "all-zero word (illegal on hardware, a no-op here): data in the text section?"},
+	}
+	if len(issues) != len(want) {
+		t.Fatalf("issues %v, want %d", issues, len(want))
+	}
+	for i, w := range want {
+		if got := issues[i]; got.Severity != SeverityWarning || got.Addr != w.addr || got.Msg != w.msg {
+			t.Errorf("issue %d is %v, want a warning at 0x%X: %s", i, got, w.addr, w.msg)
+		}
+	}
+}
+
+func TestValidateJumpPastEnd(t *testing.T) {
+	issues := validateProgram(t, func(b *Builder) {
+		b.Word(encodeJ(JAL, ZERO, 0x2000)) // j past the end of memory
+		b.Word(encodeJ(JAL, ZERO, 0x100))  // j into memory, but past the program
+		b.Li(T0, 0x1FFC)
+		b.Lw(A0, T0, 8) // a load past the end of memory
+		b.Ebreak()
+	})
+	want := []Issue{
+		{Severity: SeverityError, Addr: 0x0, Msg: "target 0x00002000 is outside memory"},
+		{Severity: SeverityWarning, Addr: 0x4, Msg: "target 0x00000104 is outside the loaded program"},
+		{Severity: SeverityError, Addr: 0x10, Msg: "address 0x00002004 is outside memory and every device"},
+	}
+	if len(issues) != len(want) {
+		t.Fatalf("issues %v, want %v", issues, want)
+	}
+	for i, w := range want {
+		if got := issues[i]; got.Severity != w.Severity || got.Addr != w.Addr || got.Msg != w.Msg {
+			t.Errorf("issue %d is %v, want %v", i, got, w)
+		}
+	}
+}
+
+// run --check lists the issues and exits without running the program, with status 1 for errors
+func TestRunCheck(t *testing.T) {
+	for _, tt := range []struct {
+		build func(b *Builder)
+		code  int
+		want  string
+	}{
+		{func(b *Builder) { b.Li(A0, 1); b.Ebreak() }, 0, "0 issues found\n"},
+		{func(b *Builder) { b.Word(0xFFFFFFFF); b.Ebreak() }, 0,
+			"0x00000000: warning: not a valid instruction: data in the text section?    [FFFFFFFF  .word 0xFFFFFFFF]\n1 issues found\n"},
+		{func(b *Builder) { b.Word(encodeJ(JAL, ZERO, 0xFFFFC)) }, 1,
+			"0x00000000: error: target 0x000FFFFC is outside memory    [7FDFF06F  jal zero, 0x000FFFFC]\n1 issues found\n"},
+	} {
+		path := writeTemp(t, "prog.bin", assemble(t, tt.build))
+		code, stdout, stderr := runCommand("run", "--mem-size=0x1000", "--check", path)
+		if code != tt.code || stdout != tt.want || strings.Contains(stdout, "exited") {
+			t.Errorf("exit %d, stdout:\n%s\nstderr: %s\nwant exit %d and\n%s", code, stdout, stderr, tt.code, tt.want)
+		}
+	}
+}